@@ -39,6 +39,9 @@ func main() {
 			Usage:   "Output NF log to `FILE`",
 		},
 	}
+	app.Commands = []*cli.Command{
+		usageCommand(),
+	}
 
 	// rand.Seed(time.Now().UnixNano()) // rand.Seed has been deprecated
 	randSeed := rand.New(rand.NewSource(time.Now().UnixNano()))
@@ -0,0 +1,98 @@
+package main
+
+import (
+	"bufio"
+	"os"
+	"strconv"
+	"time"
+
+	"github.com/pkg/errors"
+	"github.com/urfave/cli/v2"
+
+	"github.com/free5gc/go-upf/internal/journal"
+	"github.com/free5gc/go-upf/pkg/factory"
+)
+
+// usageCommand queries the usage records of the usage journal
+func usageCommand() *cli.Command {
+	return &cli.Command{
+		Name:  "usage",
+		Usage: "Query the usage records of the usage journal",
+		Flags: []cli.Flag{
+			&cli.StringFlag{
+				Name:    "config",
+				Aliases: []string{"c"},
+				Usage:   "Read the journal file from the configuration `FILE`",
+			},
+			&cli.StringFlag{
+				Name:    "file",
+				Aliases: []string{"f"},
+				Usage:   "Journal `FILE`, with its rotated files",
+			},
+			&cli.StringFlag{
+				Name:  "seid",
+				Usage: "Only the records of the UP or CP `SEID`, e.g. 0x1",
+			},
+			&cli.TimestampFlag{
+				Name:   "from",
+				Usage:  "Only the records since `TIME`, in RFC 3339",
+				Layout: time.RFC3339,
+			},
+			&cli.TimestampFlag{
+				Name:   "to",
+				Usage:  "Only the records until `TIME`, in RFC 3339",
+				Layout: time.RFC3339,
+			},
+			&cli.StringFlag{
+				Name:  "format",
+				Value: journal.FORMAT_CSV,
+				Usage: "Output `FORMAT`: csv or json",
+			},
+		},
+		Action: usageAction,
+	}
+}
+
+func usageAction(cliCtx *cli.Context) error {
+	path := cliCtx.String("file")
+	if path == "" && cliCtx.String("config") != "" {
+		cfg, err := factory.ReadConfig(cliCtx.String("config"))
+		if err != nil {
+			return err
+		}
+		if cfg.UsageJournal != nil {
+			path = cfg.UsageJournal.File
+		}
+	}
+	if path == "" {
+		return errors.New("usage: no journal file")
+	}
+
+	var f journal.Filter
+	if v := cliCtx.String("seid"); v != "" {
+		seid, err := strconv.ParseUint(v, 0, 64)
+		if err != nil {
+			return errors.Wrapf(err, "usage: seid %q", v)
+		}
+		f.SEID = seid
+	}
+	if t := cliCtx.Timestamp("from"); t != nil {
+		f.From = *t
+	}
+	if t := cliCtx.Timestamp("to"); t != nil {
+		f.To = *t
+	}
+
+	w := bufio.NewWriter(os.Stdout)
+	enc, err := journal.NewEncoder(w, cliCtx.String("format"))
+	if err != nil {
+		return err
+	}
+	if err = enc.Header(); err != nil {
+		return err
+	}
+	if err = journal.Query(path, f, enc.Encode); err != nil {
+		return err
+	}
+	return w.Flush()
+}
@@ -0,0 +1,225 @@
+// Package event publishes the lifecycle events of the PFCP associations and
+// sessions to the sinks configured, e.g. for an OSS to consume them without
+// parsing the logs
+package event
+
+import (
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/sirupsen/logrus"
+
+	"github.com/free5gc/go-upf/internal/logger"
+	"github.com/free5gc/go-upf/internal/report"
+	"github.com/free5gc/go-upf/pkg/factory"
+)
+
+// QUEUE_LEN is the events queued to the sinks; the events published while
+// the queue is full are dropped
+const QUEUE_LEN = 1024
+
+type Type string
+
+const (
+	SESSION_ESTABLISHED Type = "SessionEstablished"
+	SESSION_MODIFIED    Type = "SessionModified"
+	SESSION_DELETED     Type = "SessionDeleted"
+	REPORT_SENT         Type = "ReportSent"
+	REPORT_ACKNOWLEDGED Type = "ReportAcknowledged"
+	ASSOCIATION_UP      Type = "AssociationUp"
+	ASSOCIATION_DOWN    Type = "AssociationDown"
+)
+
+// Event is a lifecycle event of an association or a session
+type Event struct {
+	Time   time.Time `json:"time"`
+	Type   Type      `json:"type"`
+	NodeID string    `json:"nodeID,omitempty"`
+	SEID   uint64    `json:"seid,omitempty"`   // UP SEID
+	CPSEID uint64    `json:"cpSeid,omitempty"` // CP SEID
+	// Sequence Number of the Session Report Request
+	Sequence uint32 `json:"sequence,omitempty"`
+	// Report Types of the Session Report Request, e.g. "USAR"
+	Reports []string `json:"reports,omitempty"`
+	Cause   uint8    `json:"cause,omitempty"`
+	Reason  string   `json:"reason,omitempty"`
+	// Sessions released with the association
+	Sessions int       `json:"sessions,omitempty"`
+	Diff     *RuleDiff `json:"diff,omitempty"`
+	Usage    []Usage   `json:"usage,omitempty"`
+}
+
+// RuleDiff is the rules changed by a session request, by rule type e.g. "PDR"
+type RuleDiff struct {
+	Created map[string][]uint32 `json:"created,omitempty"`
+	Updated map[string][]uint32 `json:"updated,omitempty"`
+	Removed map[string][]uint32 `json:"removed,omitempty"`
+}
+
+// Usage is a usage report of a URR
+type Usage struct {
+	URRID           uint32    `json:"urrID"`
+	URSEQN          uint32    `json:"urSeqn"`
+	Triggers        []string  `json:"triggers,omitempty"`
+	StartTime       time.Time `json:"startTime"`
+	EndTime         time.Time `json:"endTime"`
+	TotalVolume     uint64    `json:"totalVolume"`
+	UplinkVolume    uint64    `json:"uplinkVolume"`
+	DownlinkVolume  uint64    `json:"downlinkVolume"`
+	TotalPackets    uint64    `json:"totalPackets"`
+	UplinkPackets   uint64    `json:"uplinkPackets"`
+	DownlinkPackets uint64    `json:"downlinkPackets"`
+	Duration        uint64    `json:"duration"` // seconds
+}
+
+func NewUsage(r report.USAReport) Usage {
+	return Usage{
+		URRID:           r.URRID,
+		URSEQN:          r.URSEQN,
+		Triggers:        r.USARTrigger.Names(),
+		StartTime:       r.StartTime,
+		EndTime:         r.EndTime,
+		TotalVolume:     r.VolumMeasure.TotalVolume,
+		UplinkVolume:    r.VolumMeasure.UplinkVolume,
+		DownlinkVolume:  r.VolumMeasure.DownlinkVolume,
+		TotalPackets:    r.VolumMeasure.TotalPktNum,
+		UplinkPackets:   r.VolumMeasure.UplinkPktNum,
+		DownlinkPackets: r.VolumMeasure.DownlinkPktNum,
+		Duration:        uint64(time.Duration(r.DuratMeasure.DurationValue) / time.Second),
+	}
+}
+
+// Sink writes the events, from a single goroutine
+type Sink interface {
+	Write(e *Event) error
+	Close() error
+}
+
+// Stream publishes the events to the sinks, without blocking the publisher
+type Stream struct {
+	sinks   []Sink
+	ch      chan *Event
+	mu      sync.RWMutex
+	closed  bool
+	dropped atomic.Uint64
+	log     *logrus.Entry
+}
+
+// Open opens the sinks configured and starts publishing; a nil Stream is
+// returned if cfg is nil
+func Open(wg *sync.WaitGroup, cfg *factory.Events) (*Stream, error) {
+	if cfg == nil {
+		return nil, nil
+	}
+	s := &Stream{
+		ch:  make(chan *Event, QUEUE_LEN),
+		log: logger.EvtLog,
+	}
+	if cfg.File != "" {
+		sink, err := OpenFile(cfg.File)
+		if err != nil {
+			s.closeSinks()
+			return nil, err
+		}
+		s.sinks = append(s.sinks, sink)
+	}
+	if cfg.Syslog != nil {
+		sink, err := OpenSyslog(cfg.Syslog)
+		if err != nil {
+			s.closeSinks()
+			return nil, err
+		}
+		s.sinks = append(s.sinks, sink)
+	}
+	if cfg.Socket != "" {
+		sink, err := ListenSocket(wg, cfg.Socket)
+		if err != nil {
+			s.closeSinks()
+			return nil, err
+		}
+		s.sinks = append(s.sinks, sink)
+	}
+
+	wg.Add(1)
+	go s.run(wg)
+	return s, nil
+}
+
+// NewStream returns a Stream publishing to the sinks
+func NewStream(wg *sync.WaitGroup, sinks ...Sink) *Stream {
+	s := &Stream{
+		sinks: sinks,
+		ch:    make(chan *Event, QUEUE_LEN),
+		log:   logger.EvtLog,
+	}
+	wg.Add(1)
+	go s.run(wg)
+	return s
+}
+
+func (s *Stream) run(wg *sync.WaitGroup) {
+	defer wg.Done()
+	for e := range s.ch {
+		for _, sink := range s.sinks {
+			if err := sink.Write(e); err != nil {
+				s.log.Warnf("write %s event err: %+v", e.Type, err)
+			}
+		}
+	}
+	s.closeSinks()
+	if n := s.dropped.Load(); n > 0 {
+		s.log.Warnf("%d events dropped", n)
+	}
+}
+
+func (s *Stream) closeSinks() {
+	for _, sink := range s.sinks {
+		if err := sink.Close(); err != nil {
+			s.log.Warnf("close sink err: %+v", err)
+		}
+	}
+}
+
+// Publish queues an event to the sinks, timestamped now if not set. A nil
+// Stream discards it.
+func (s *Stream) Publish(e *Event) {
+	if s == nil {
+		return
+	}
+	if e.Time.IsZero() {
+		e.Time = time.Now()
+	}
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	if s.closed {
+		return
+	}
+	select {
+	case s.ch <- e:
+	default:
+		s.dropped.Add(1)
+	}
+}
+
+// Dropped returns the number of events dropped for the queue full
+func (s *Stream) Dropped() uint64 {
+	if s == nil {
+		return 0
+	}
+	return s.dropped.Load()
+}
+
+// Close stops publishing once the events queued are written, and closes
+// the sinks
+func (s *Stream) Close() {
+	if s == nil {
+		return
+	}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if !s.closed {
+		s.closed = true
+		close(s.ch)
+	}
+}
@@ -0,0 +1,134 @@
+package event
+
+import (
+	"bufio"
+	"encoding/json"
+	"net"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+
+	"github.com/free5gc/go-upf/internal/report"
+	"github.com/free5gc/go-upf/pkg/factory"
+)
+
+type blockSink struct {
+	release chan struct{}
+	events  []*Event
+}
+
+func (s *blockSink) Write(e *Event) error {
+	<-s.release
+	s.events = append(s.events, e)
+	return nil
+}
+
+func (s *blockSink) Close() error { return nil }
+
+func TestStream(t *testing.T) {
+	t.Run("nil", func(t *testing.T) {
+		var wg sync.WaitGroup
+		s, err := Open(&wg, nil)
+		require.NoError(t, err)
+		assert.Nil(t, s)
+		s.Publish(&Event{Type: SESSION_ESTABLISHED})
+		s.Close()
+	})
+
+	t.Run("drop when full", func(t *testing.T) {
+		var wg sync.WaitGroup
+		sink := &blockSink{release: make(chan struct{})}
+		s := NewStream(&wg, sink)
+		for range QUEUE_LEN + 10 {
+			s.Publish(&Event{Type: REPORT_SENT})
+		}
+		// one taken by the sink
+		assert.LessOrEqual(t, s.Dropped(), uint64(10))
+		assert.Positive(t, s.Dropped())
+		close(sink.release)
+		s.Close()
+		wg.Wait()
+		assert.Equal(t, uint64(QUEUE_LEN+10), uint64(len(sink.events))+s.Dropped())
+		assert.False(t, sink.events[0].Time.IsZero())
+
+		// discarded once closed
+		s.Publish(&Event{Type: REPORT_SENT})
+	})
+}
+
+func TestFileSink(t *testing.T) {
+	var wg sync.WaitGroup
+	path := filepath.Join(t.TempDir(), "events.json")
+	s, err := Open(&wg, &factory.Events{File: path})
+	require.NoError(t, err)
+
+	s.Publish(&Event{
+		Type:   SESSION_MODIFIED,
+		NodeID: "10.100.200.3",
+		SEID:   1,
+		CPSEID: 2,
+		Diff: &RuleDiff{
+			Created: map[string][]uint32{"PDR": {3}},
+			Removed: map[string][]uint32{"FAR": {1, 2}},
+		},
+	})
+	s.Publish(&Event{
+		Type: SESSION_DELETED,
+		SEID: 1,
+		Usage: []Usage{NewUsage(report.USAReport{
+			URRID:       1,
+			USARTrigger: report.UsageReportTrigger{Flags: report.USAR_TRIG_TERMR},
+		})},
+	})
+	s.Close()
+	wg.Wait()
+
+	b, err := os.ReadFile(path)
+	require.NoError(t, err)
+	lines := strings.Split(strings.TrimSpace(string(b)), "\n")
+	require.Len(t, lines, 2)
+
+	var e Event
+	require.NoError(t, json.Unmarshal([]byte(lines[0]), &e))
+	assert.Equal(t, SESSION_MODIFIED, e.Type)
+	assert.Equal(t, uint64(2), e.CPSEID)
+	assert.Equal(t, []uint32{1, 2}, e.Diff.Removed["FAR"])
+	require.NoError(t, json.Unmarshal([]byte(lines[1]), &e))
+	assert.Equal(t, []string{"TERMR"}, e.Usage[0].Triggers)
+}
+
+func TestSocketSink(t *testing.T) {
+	var wg sync.WaitGroup
+	path := filepath.Join(t.TempDir(), "events.sock")
+	sink, err := ListenSocket(&wg, path)
+	require.NoError(t, err)
+
+	conn, err := net.Dial("unix", path)
+	require.NoError(t, err)
+	defer conn.Close()
+	require.Eventually(t, func() bool {
+		return sink.(*socketSink).Subscribers() == 1
+	}, time.Second, 10*time.Millisecond)
+
+	s := NewStream(&wg, sink)
+	s.Publish(&Event{Type: ASSOCIATION_UP, NodeID: "smf"})
+
+	require.NoError(t, conn.SetReadDeadline(time.Now().Add(time.Second)))
+	line, err := bufio.NewReader(conn).ReadBytes('\n')
+	require.NoError(t, err)
+	var e Event
+	require.NoError(t, json.Unmarshal(line, &e))
+	assert.Equal(t, ASSOCIATION_UP, e.Type)
+	assert.Equal(t, "smf", e.NodeID)
+
+	s.Close()
+	wg.Wait()
+	_, err = os.Stat(path)
+	assert.True(t, os.IsNotExist(err))
+}
@@ -0,0 +1,159 @@
+package event
+
+import (
+	"encoding/json"
+	"log/syslog"
+	"net"
+	"os"
+	"sync"
+	"time"
+
+	"github.com/pkg/errors"
+
+	"github.com/free5gc/go-upf/internal/logger"
+	"github.com/free5gc/go-upf/pkg/factory"
+)
+
+const (
+	SYSLOG_TAG = "upf"
+	// WRITE_TIMEOUT is the time a subscriber of the socket is given to read
+	// an event before it is disconnected
+	WRITE_TIMEOUT = time.Second
+)
+
+// fileSink appends the events to a file as JSON lines
+type fileSink struct {
+	f   *os.File
+	enc *json.Encoder
+}
+
+func OpenFile(path string) (Sink, error) {
+	f, err := os.OpenFile(path, os.O_WRONLY|os.O_CREATE|os.O_APPEND, 0o644)
+	if err != nil {
+		return nil, errors.Wrap(err, "event file")
+	}
+	return &fileSink{f: f, enc: json.NewEncoder(f)}, nil
+}
+
+func (s *fileSink) Write(e *Event) error {
+	return s.enc.Encode(e)
+}
+
+func (s *fileSink) Close() error {
+	return s.f.Close()
+}
+
+// syslogSink sends the events to a syslog server, a JSON object a message
+type syslogSink struct {
+	w *syslog.Writer
+}
+
+func OpenSyslog(cfg *factory.EventSyslog) (Sink, error) {
+	tag := cfg.Tag
+	if tag == "" {
+		tag = SYSLOG_TAG
+	}
+	w, err := syslog.Dial(cfg.Network, cfg.Addr, syslog.LOG_INFO|syslog.LOG_DAEMON, tag)
+	if err != nil {
+		return nil, errors.Wrap(err, "event syslog")
+	}
+	return &syslogSink{w: w}, nil
+}
+
+func (s *syslogSink) Write(e *Event) error {
+	b, err := json.Marshal(e)
+	if err != nil {
+		return err
+	}
+	return s.w.Info(string(b))
+}
+
+func (s *syslogSink) Close() error {
+	return s.w.Close()
+}
+
+// socketSink writes the events as JSON lines to the subscribers connected
+// to a unix socket; a subscriber not reading them in time is disconnected
+type socketSink struct {
+	ln *net.UnixListener
+
+	mu    sync.Mutex
+	conns map[net.Conn]struct{}
+}
+
+func ListenSocket(wg *sync.WaitGroup, path string) (Sink, error) {
+	// a socket left by a previous run
+	if err := os.Remove(path); err != nil && !os.IsNotExist(err) {
+		return nil, errors.Wrap(err, "event socket")
+	}
+	ln, err := net.ListenUnix("unix", &net.UnixAddr{Name: path, Net: "unix"})
+	if err != nil {
+		return nil, errors.Wrap(err, "event socket")
+	}
+	ln.SetUnlinkOnClose(true)
+	s := &socketSink{
+		ln:    ln,
+		conns: make(map[net.Conn]struct{}),
+	}
+	wg.Add(1)
+	go s.accept(wg)
+	return s, nil
+}
+
+func (s *socketSink) accept(wg *sync.WaitGroup) {
+	defer wg.Done()
+	for {
+		conn, err := s.ln.Accept()
+		if err != nil {
+			if !errors.Is(err, net.ErrClosed) {
+				logger.EvtLog.Warnf("event socket: %v", err)
+			}
+			return
+		}
+		s.mu.Lock()
+		s.conns[conn] = struct{}{}
+		s.mu.Unlock()
+	}
+}
+
+// Subscribers returns the number of subscribers connected
+func (s *socketSink) Subscribers() int {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return len(s.conns)
+}
+
+func (s *socketSink) Write(e *Event) error {
+	b, err := json.Marshal(e)
+	if err != nil {
+		return err
+	}
+	b = append(b, '\n')
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	deadline := time.Now().Add(WRITE_TIMEOUT)
+	for conn := range s.conns {
+		err = conn.SetWriteDeadline(deadline)
+		if err == nil {
+			_, err = conn.Write(b)
+		}
+		if err != nil {
+			logger.EvtLog.Infof("event subscriber disconnected: %v", err)
+			conn.Close()
+			delete(s.conns, conn)
+		}
+	}
+	return nil
+}
+
+func (s *socketSink) Close() error {
+	err := s.ln.Close()
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	for conn := range s.conns {
+		conn.Close()
+		delete(s.conns, conn)
+	}
+	return err
+}
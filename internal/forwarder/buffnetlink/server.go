@@ -167,3 +167,7 @@ func (s *Server) ServeMsg(msg *nl.Msg) bool {
 func (s *Server) Pop(seid uint64, pdrid uint16) ([]byte, bool) {
 	return s.handler.PopBufPkt(seid, pdrid)
 }
+
+func (s *Server) Drop(seid uint64, pdrid uint16) bool {
+	return s.handler.DropBufPkt(seid, pdrid)
+}
@@ -71,6 +71,11 @@ func (h *testHandler) PopBufPkt(seid uint64, pdrid uint16) ([]byte, bool) {
 	}
 }
 
+func (h *testHandler) DropBufPkt(seid uint64, pdrid uint16) bool {
+	_, ok := h.PopBufPkt(seid, pdrid)
+	return ok
+}
+
 func TestServer(t *testing.T) {
 	if testing.Short() {
 		t.Skip("skipping testing in short mode")
@@ -0,0 +1,193 @@
+package forwarder
+
+import (
+	"sync"
+	"syscall"
+
+	"github.com/khirono/go-nl"
+	"github.com/pkg/errors"
+
+	"github.com/free5gc/go-gtp5gnl"
+)
+
+// client serializes the requests of a gtp5g netlink client: go-nl Client.Do
+// takes the sequence number and stacks the reply handler of the connection
+// without a lock, so concurrent requests would take each other's replies.
+// Each PFCP session worker has a client of its own; the packet paths of its
+// sessions share it.
+type client struct {
+	mu   sync.Mutex
+	c    *gtp5gnl.Client
+	conn *nl.Conn // of a worker client
+}
+
+func newClient(conn *nl.Conn, mux *nl.Mux) (*client, error) {
+	c, err := gtp5gnl.NewClient(conn, mux)
+	if err != nil {
+		return nil, err
+	}
+	return &client{c: c}, nil
+}
+
+// openClients opens a netlink connection and a client per PFCP session
+// worker, so that the requests of the sessions of different workers run in
+// parallel
+func (g *Gtp5g) openClients(n int) error {
+	for range n {
+		conn, err := nl.Open(syscall.NETLINK_GENERIC)
+		if err != nil {
+			return errors.Wrap(err, "open worker netlink")
+		}
+		c, err := newClient(conn, g.mux)
+		if err != nil {
+			conn.Close()
+			return errors.Wrap(err, "new worker client")
+		}
+		c.conn = conn
+		g.clients = append(g.clients, c)
+	}
+	return nil
+}
+
+func (g *Gtp5g) closeClients() {
+	for _, c := range g.clients {
+		c.conn.Close()
+	}
+	g.clients = nil
+}
+
+// sessClient returns the client of the worker of the session: the PFCP
+// session workers are sharded by local SEID the same way. Without worker
+// clients, the requests share the client of the forwarder.
+func (g *Gtp5g) sessClient(lSeid uint64) *client {
+	if len(g.clients) == 0 {
+		return g.client
+	}
+	return g.clients[lSeid%uint64(len(g.clients))]
+}
+
+func (c *client) Version() (string, error) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return gtp5gnl.GetVersion(c.c)
+}
+
+func (c *client) CreatePDR(link *gtp5gnl.Link, oid gtp5gnl.OID, attrs []nl.Attr) error {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return gtp5gnl.CreatePDROID(c.c, link, oid, attrs)
+}
+
+func (c *client) UpdatePDR(link *gtp5gnl.Link, oid gtp5gnl.OID, attrs []nl.Attr) error {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return gtp5gnl.UpdatePDROID(c.c, link, oid, attrs)
+}
+
+func (c *client) RemovePDR(link *gtp5gnl.Link, oid gtp5gnl.OID) error {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return gtp5gnl.RemovePDROID(c.c, link, oid)
+}
+
+func (c *client) GetPDR(link *gtp5gnl.Link, oid gtp5gnl.OID) (*gtp5gnl.PDR, error) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return gtp5gnl.GetPDROID(c.c, link, oid)
+}
+
+func (c *client) CreateFAR(link *gtp5gnl.Link, oid gtp5gnl.OID, attrs []nl.Attr) error {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return gtp5gnl.CreateFAROID(c.c, link, oid, attrs)
+}
+
+func (c *client) UpdateFAR(link *gtp5gnl.Link, oid gtp5gnl.OID, attrs []nl.Attr) error {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return gtp5gnl.UpdateFAROID(c.c, link, oid, attrs)
+}
+
+func (c *client) RemoveFAR(link *gtp5gnl.Link, oid gtp5gnl.OID) error {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return gtp5gnl.RemoveFAROID(c.c, link, oid)
+}
+
+func (c *client) GetFAR(link *gtp5gnl.Link, oid gtp5gnl.OID) (*gtp5gnl.FAR, error) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return gtp5gnl.GetFAROID(c.c, link, oid)
+}
+
+func (c *client) CreateQER(link *gtp5gnl.Link, oid gtp5gnl.OID, attrs []nl.Attr) error {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return gtp5gnl.CreateQEROID(c.c, link, oid, attrs)
+}
+
+func (c *client) UpdateQER(link *gtp5gnl.Link, oid gtp5gnl.OID, attrs []nl.Attr) error {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return gtp5gnl.UpdateQEROID(c.c, link, oid, attrs)
+}
+
+func (c *client) RemoveQER(link *gtp5gnl.Link, oid gtp5gnl.OID) error {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return gtp5gnl.RemoveQEROID(c.c, link, oid)
+}
+
+func (c *client) GetQER(link *gtp5gnl.Link, oid gtp5gnl.OID) (*gtp5gnl.QER, error) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return gtp5gnl.GetQEROID(c.c, link, oid)
+}
+
+func (c *client) CreateURR(link *gtp5gnl.Link, oid gtp5gnl.OID, attrs []nl.Attr) error {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return gtp5gnl.CreateURROID(c.c, link, oid, attrs)
+}
+
+func (c *client) UpdateURR(link *gtp5gnl.Link, oid gtp5gnl.OID, attrs []nl.Attr) ([]gtp5gnl.USAReport, error) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return gtp5gnl.UpdateURROID(c.c, link, oid, attrs)
+}
+
+func (c *client) RemoveURR(link *gtp5gnl.Link, oid gtp5gnl.OID) ([]gtp5gnl.USAReport, error) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return gtp5gnl.RemoveURROID(c.c, link, oid)
+}
+
+func (c *client) GetReport(link *gtp5gnl.Link, oid gtp5gnl.OID) ([]gtp5gnl.USAReport, error) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return gtp5gnl.GetReportOID(c.c, link, oid)
+}
+
+func (c *client) GetMultiReports(link *gtp5gnl.Link, oids []gtp5gnl.OID) ([]gtp5gnl.USAReport, error) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return gtp5gnl.GetMultiReportsOID(c.c, link, oids)
+}
+
+func (c *client) CreateBAR(link *gtp5gnl.Link, oid gtp5gnl.OID, attrs []nl.Attr) error {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return gtp5gnl.CreateBAROID(c.c, link, oid, attrs)
+}
+
+func (c *client) UpdateBAR(link *gtp5gnl.Link, oid gtp5gnl.OID, attrs []nl.Attr) error {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return gtp5gnl.UpdateBAROID(c.c, link, oid, attrs)
+}
+
+func (c *client) RemoveBAR(link *gtp5gnl.Link, oid gtp5gnl.OID) error {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return gtp5gnl.RemoveBAROID(c.c, link, oid)
+}
@@ -0,0 +1,18 @@
+package forwarder
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestSessClient(t *testing.T) {
+	g := &Gtp5g{client: &client{}}
+	assert.Same(t, g.client, g.sessClient(5))
+
+	g.clients = []*client{{}, {}, {}}
+	// sharded like the PFCP session workers
+	assert.Same(t, g.clients[1], g.sessClient(1))
+	assert.Same(t, g.clients[1], g.sessClient(4))
+	assert.Same(t, g.clients[0], g.sessClient(6))
+}
@@ -2,8 +2,8 @@ package forwarder
 
 import (
 	"fmt"
-	"net"
 	"sync"
+	"time"
 
 	"github.com/pkg/errors"
 	"github.com/wmnsk/go-pfcp/ie"
@@ -13,6 +13,89 @@ import (
 	"github.com/free5gc/go-upf/pkg/factory"
 )
 
+// ErrUnsupported is wrapped by the errors of the Build*Plan methods when a
+// rule requests a feature the forwarder cannot provide
+var ErrUnsupported = errors.New("not supported by the forwarder")
+
+// IEError is returned by the Build*Plan methods for an IE of a rule which
+// cannot be built, reported to the CP function as the Offending IE
+type IEError struct {
+	Type uint16
+	Err  error
+}
+
+func (e *IEError) Error() string {
+	return fmt.Sprintf("IE(%d): %v", e.Type, e.Err)
+}
+
+func (e *IEError) Unwrap() error {
+	return e.Err
+}
+
+// ieError wraps err with the type of the IE it is of, unless either is unknown
+func ieError(typ uint16, err error) error {
+	if err == nil || typ == 0 {
+		return err
+	}
+	var e *IEError
+	if errors.As(err, &e) {
+		return err
+	}
+	return &IEError{Type: typ, Err: err}
+}
+
+// OffendingIE returns the type of the IE an error is of, 0 if unknown
+func OffendingIE(err error) uint16 {
+	var e *IEError
+	if errors.As(err, &e) {
+		return e.Type
+	}
+	return 0
+}
+
+// RuleError is the error of a rule, reported to the CP function as the
+// Failed Rule ID
+type RuleError struct {
+	Type uint8 // Rule ID Type, e.g. ie.RuleIDTypePDR
+	ID   uint32
+	Err  error
+}
+
+func (e *RuleError) Error() string {
+	return fmt.Sprintf("%s[%#x]: %v", RuleTypeName(e.Type), e.ID, e.Err)
+}
+
+func (e *RuleError) Unwrap() error {
+	return e.Err
+}
+
+// RuleTypeName returns the name of a Rule ID Type
+func RuleTypeName(typ uint8) string {
+	switch typ {
+	case ie.RuleIDTypePDR:
+		return "PDR"
+	case ie.RuleIDTypeFAR:
+		return "FAR"
+	case ie.RuleIDTypeQER:
+		return "QER"
+	case ie.RuleIDTypeURR:
+		return "URR"
+	case ie.RuleIDTypeBAR:
+		return "BAR"
+	case RULE_ID_TYPE_SRR:
+		return "SRR"
+	default:
+		return fmt.Sprintf("Rule(%d)", typ)
+	}
+}
+
+// RULE_ID_TYPE_SRR is the Rule ID Type of the SRRs, unknown to go-pfcp
+const RULE_ID_TYPE_SRR uint8 = 6
+
+// Driver is called concurrently by the PFCP session workers. The calls of
+// a session are sequential, from its worker, while those of different
+// sessions may run at once; the drivers guard their shared state, e.g. the
+// Gtp5g serializes its netlink requests
 type Driver interface {
 	Close()
 
@@ -21,6 +104,22 @@ type Driver interface {
 
 	HandleReport(report.Handler)
 
+	// LastActivity returns the last time user plane traffic was seen on the
+	// session, from its reports and the counters of its PDRs, or the zero
+	// time if none is known
+	LastActivity(lSeid uint64, pdrids []uint16) time.Time
+	// DroppedDL returns the DL packets the forwarder dropped on the PDRs of
+	// a session since the previous call, without reporting them
+	DroppedDL(lSeid uint64, pdrids []uint16) map[uint16]uint64
+
+	// SendQoSMonitoring sends a QoS monitoring packet in the downlink of a
+	// QoS flow of a session; the delays measured are reported as
+	// report.QoSMonitoringReport
+	SendQoSMonitoring(lSeid uint64, qfi uint8) error
+	// StopQoSMonitoring stops receiving the QoS monitoring packets of a
+	// session whose QoS flows are no longer monitored
+	StopQoSMonitoring(lSeid uint64)
+
 	// Plan-based methods for two-phase commit
 	// Build*Plan methods parse and validate IEs without executing
 	BuildCreatePDRPlan(lSeid uint64, req *ie.IE) (*PDRPlan, error)
@@ -63,30 +162,38 @@ func NewDriver(wg *sync.WaitGroup, cfg *factory.Config) (Driver, error) {
 
 	logger.MainLog.Infof("starting Gtpu Forwarder [%s]", cfgGtpu.Forwarder)
 	if cfgGtpu.Forwarder == "gtp5g" {
-		var gtpuAddr string
-		var mtu uint32
-		for _, ifInfo := range cfgGtpu.IfList {
-			mtu = ifInfo.MTU
-			gtpuAddr = fmt.Sprintf("%s:%d", ifInfo.Addr, factory.UpfGtpDefaultPort)
-			logger.MainLog.Infof("GTP Address: %q", gtpuAddr)
-			break
-		}
-		if gtpuAddr == "" {
+		if len(cfgGtpu.IfList) == 0 {
 			return nil, errors.Errorf("not found GTP address")
 		}
+		ifInfo := cfgGtpu.IfList[0]
+		mtu := ifInfo.MTU
+		gtpuAddr := ifInfo.GtpuAddr()
+		logger.MainLog.Infof("GTP Address: %q", gtpuAddr)
 		driver, err := OpenGtp5g(wg, gtpuAddr, mtu)
 		if err != nil {
 			return nil, errors.Wrap(err, "open Gtp5g")
 		}
-
-		link := driver.Link()
-		for _, dnn := range cfg.DnnList {
-			_, dst, err := net.ParseCIDR(dnn.Cidr)
+		err = driver.openClients(cfg.Pfcp.NumWorkers())
+		if err != nil {
+			driver.Close()
+			return nil, err
+		}
+		driver.setDscp(cfgGtpu.DscpByQFI())
+		driver.gtpu = cfgGtpu
+
+		// The other interfaces, e.g. N9 on an address of its own, are
+		// received by links of their own
+		for _, ifInfo := range cfgGtpu.IfList[1:] {
+			logger.MainLog.Infof("GTP Address: %q (%s)", ifInfo.Addr, ifInfo.Type)
+			_, err = driver.openNILink(ifInfo.Addr, ifInfo.MTU)
 			if err != nil {
-				logger.MainLog.Errorln(err)
-				continue
+				driver.Close()
+				return nil, err
 			}
-			err = link.RouteAdd(dst)
+		}
+
+		for i := range cfg.DnnList {
+			err = driver.AddDnn(&cfg.DnnList[i], mtu)
 			if err != nil {
 				driver.Close()
 				return nil, err
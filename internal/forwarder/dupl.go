@@ -0,0 +1,427 @@
+package forwarder
+
+import (
+	"encoding/binary"
+	"net"
+	"time"
+
+	"github.com/pkg/errors"
+	"github.com/wmnsk/go-pfcp/ie"
+
+	"github.com/free5gc/go-gtp5gnl"
+	"github.com/free5gc/go-upf/internal/gtpv1"
+	"github.com/free5gc/go-upf/internal/report"
+	"github.com/free5gc/util/pfcp"
+)
+
+const (
+	DUPL_QUEUE_LEN = 1024
+
+	// X3_PDU_TYPE_CORRELATED is the type of the header prepended to a copy
+	// whose Duplicating Parameters carry a correlation ID. The header is a
+	// framing of this UPF, not the X3 PDU of ETSI TS 103 221-2, for the
+	// mediation function to tell the intercepts apart:
+	//
+	//	| type(1) = 1 | correlation ID length(2) | correlation ID | packet |
+	//
+	// The length is in bytes, in network byte order, and the correlation ID
+	// is the Forwarding Policy Identifier of the Duplicating Parameters. The
+	// copies without a correlation ID are the bare packets.
+	X3_PDU_TYPE_CORRELATED uint8 = 1
+)
+
+// Duplication is a delivery target of the packets duplicated by a FAR,
+// from the Duplicating Parameters
+type Duplication struct {
+	DstIf   uint8
+	Addr    *net.UDPAddr
+	TEID    uint32
+	HasTEID bool
+	// CorrelationID is carried in the Forwarding Policy of the Duplicating
+	// Parameters, and identifies the intercept at the delivery target
+	CorrelationID []byte
+}
+
+func (g *Gtp5g) newDuplication(ies []*ie.IE) (Duplication, error) {
+	var d Duplication
+	for _, x := range ies {
+		switch x.Type {
+		case ie.DestinationInterface:
+			v, err := x.DestinationInterface()
+			if err != nil {
+				return d, err
+			}
+			d.DstIf = v
+		case ie.OuterHeaderCreation:
+			v, err := pfcp.ParseOuterHeaderCreation(x.Payload)
+			if err != nil {
+				return d, err
+			}
+			if !v.HasIPv4() {
+				return d, errors.New("Duplicating Parameters: IPv4 address required")
+			}
+			d.Addr = &net.UDPAddr{IP: v.IPv4Address}
+			if v.HasTEID() {
+				d.TEID = v.TEID
+				d.HasTEID = true
+				d.Addr.Port = int(g.peerPort(v.IPv4Address))
+			} else {
+				d.Addr.Port = int(v.PortNumber)
+			}
+		case ie.ForwardingPolicy:
+			v, err := x.ForwardingPolicyIdentifier()
+			if err != nil {
+				return d, err
+			}
+			d.CorrelationID = []byte(v)
+		}
+	}
+	if d.Addr == nil {
+		return d, errors.New("Duplicating Parameters: Outer Header Creation not found")
+	}
+	return d, nil
+}
+
+// encode returns the datagram sent to the target for a duplicated packet
+func (d *Duplication) encode(pkt []byte) ([]byte, error) {
+	payload := pkt
+	if len(d.CorrelationID) > 0 {
+		payload = make([]byte, 3+len(d.CorrelationID)+len(pkt))
+		payload[0] = X3_PDU_TYPE_CORRELATED
+		binary.BigEndian.PutUint16(payload[1:], uint16(len(d.CorrelationID)))
+		n := copy(payload[3:], d.CorrelationID)
+		copy(payload[3+n:], pkt)
+	}
+	if !d.HasTEID {
+		return payload, nil
+	}
+	msg := gtpv1.Message{
+		Flags:   0x32,
+		Type:    gtpv1.MsgTypeTPDU,
+		TEID:    d.TEID,
+		Payload: payload,
+	}
+	b := make([]byte, msg.Len())
+	_, err := msg.Encode(b)
+	if err != nil {
+		return nil, err
+	}
+	return b, nil
+}
+
+// duplFAR is a FAR duplicating its packets. The kernel module cannot
+// duplicate packets, so such a FAR buffers in the kernel to deliver its
+// packets to the UPF, which duplicates them and applies the action of the FAR.
+type duplFAR struct {
+	action  uint16 // Apply Action requested by the CP function
+	targets []Duplication
+}
+
+// duplKey is the key of a FAR OID{SEID, FARID}
+type duplKey [2]uint64
+
+func newDuplKey(oid gtp5gnl.OID) duplKey {
+	var k duplKey
+	copy(k[:], oid)
+	return k
+}
+
+type duplPkt struct {
+	lSeid uint64
+	pdrid uint16
+	pkt   []byte
+}
+
+// kernelAction returns the Apply Action of a FAR in the kernel module. The
+// kernel module cannot duplicate, so every FAR with DUPL is programmed to
+// BUFF, whatever its FORW or DROP: all its packets, not only the copies, are
+// handed to the UPF through the buffering netlink socket and forwarded by
+// handleDupl, at the cost of the kernel fast path for the FAR.
+func kernelAction(act report.ApplyAction) uint16 {
+	if !act.DUPL() {
+		return act.Flags
+	}
+	flags := act.Flags &^ (report.APPLY_ACT_DROP | report.APPLY_ACT_FORW)
+	return flags | report.APPLY_ACT_BUFF
+}
+
+// setDuplFAR records the duplication of a created or updated FAR
+func (g *Gtp5g) setDuplFAR(p *FARPlan) {
+	g.duplMu.Lock()
+	defer g.duplMu.Unlock()
+	k := newDuplKey(p.OID)
+	f, ok := g.dupls[k]
+	if p.ApplyAction != nil {
+		if !p.ApplyAction.DUPL() {
+			delete(g.dupls, k)
+			return
+		}
+		if !ok {
+			f = &duplFAR{}
+			g.dupls[k] = f
+		}
+		f.action = p.ApplyAction.Flags
+	}
+	if f != nil && p.Duplications != nil {
+		f.targets = p.Duplications
+	}
+}
+
+func (g *Gtp5g) delDuplFAR(oid gtp5gnl.OID) {
+	g.duplMu.Lock()
+	defer g.duplMu.Unlock()
+	delete(g.dupls, newDuplKey(oid))
+}
+
+func (g *Gtp5g) duplFAR(oid gtp5gnl.OID) (duplFAR, bool) {
+	g.duplMu.Lock()
+	defer g.duplMu.Unlock()
+	f, ok := g.dupls[newDuplKey(oid)]
+	if !ok {
+		return duplFAR{}, false
+	}
+	return *f, true
+}
+
+// pdrState is the kernel state of a PDR whose packets are forwarded by the
+// UPF, cached from its first packet until a plan of its session is executed
+type pdrState struct {
+	pdr  *gtp5gnl.PDR
+	far  *gtp5gnl.FAR // nil if the PDR has no FAR
+	qers []*gtp5gnl.QER
+}
+
+func (g *Gtp5g) cachedPDR(lSeid uint64, pdrid uint16) (*pdrState, bool) {
+	g.duplMu.Lock()
+	defer g.duplMu.Unlock()
+	ps, ok := g.pdrs[duplKey{lSeid, uint64(pdrid)}]
+	return ps, ok
+}
+
+// loadPDR returns the state of a PDR, read from the kernel if not cached
+func (g *Gtp5g) loadPDR(link *Gtp5gLink, lSeid uint64, pdrid uint16) (*pdrState, error) {
+	if ps, ok := g.cachedPDR(lSeid, pdrid); ok {
+		return ps, nil
+	}
+	pdr, err := g.sessClient(lSeid).GetPDR(link.link, gtp5gnl.OID{lSeid, uint64(pdrid)})
+	if err != nil {
+		return nil, errors.Wrap(err, "GetPDR")
+	}
+	ps := &pdrState{pdr: pdr}
+	if pdr.FARID != nil {
+		ps.far, err = g.sessClient(lSeid).GetFAR(link.link, gtp5gnl.OID{lSeid, uint64(*pdr.FARID)})
+		if err != nil {
+			return nil, errors.Wrap(err, "GetFAR")
+		}
+		ps.qers = g.pdrQERs(lSeid, pdr)
+	}
+	g.duplMu.Lock()
+	defer g.duplMu.Unlock()
+	g.pdrs[duplKey{lSeid, uint64(pdrid)}] = ps
+	return ps, nil
+}
+
+// flushPDRs forgets the cached state of the PDRs of a session, whose rules
+// are changed by a plan
+func (g *Gtp5g) flushPDRs(lSeid uint64) {
+	g.duplMu.Lock()
+	defer g.duplMu.Unlock()
+	for k := range g.pdrs {
+		if k[0] == lSeid {
+			delete(g.pdrs, k)
+		}
+	}
+}
+
+// interceptDupl takes the packets of duplicating FARs out of the session
+// report, to be handled by serveDupl; it runs in the netlink receive path,
+// so no netlink request is sent here. If serveDupl falls behind, the copies
+// are dropped while the original packets are forwarded here, from the cached
+// state of their PDR.
+func (g *Gtp5g) interceptDupl(sr report.SessReport) report.SessReport {
+	var rpts []report.Report
+	for _, rpt := range sr.Reports {
+		r, ok := rpt.(report.DLDReport)
+		if !ok || r.Action&report.APPLY_ACT_DUPL == 0 || len(r.BufPkt) == 0 {
+			rpts = append(rpts, rpt)
+			continue
+		}
+		pkt := make([]byte, len(r.BufPkt))
+		copy(pkt, r.BufPkt)
+		p := duplPkt{lSeid: sr.SEID, pdrid: r.PDRID, pkt: pkt}
+		select {
+		case g.duplCh <- p:
+		default:
+			g.overflowDupl(p)
+		}
+	}
+	sr.Reports = rpts
+	return sr
+}
+
+// overflowDupl forwards the original of a packet the duplication queue has
+// no room for, without its copy
+func (g *Gtp5g) overflowDupl(p duplPkt) {
+	ps, ok := g.cachedPDR(p.lSeid, p.pdrid)
+	if !ok {
+		// the state of the PDR is not known before its first packet
+		g.duplDropped.Add(1)
+		g.log.Warnf("duplication queue full, drop packet of PDR[%#x]", p.pdrid)
+		return
+	}
+	g.applyDupl(g.sessLink(p.lSeid), p, ps, false)
+}
+
+// DuplDropped returns the number of copies of duplicated packets dropped
+// for the duplication queue being full, with the packets dropped whole
+func (g *Gtp5g) DuplDropped() uint64 {
+	return g.duplDropped.Load()
+}
+
+func (g *Gtp5g) serveDupl(done <-chan struct{}) {
+	for {
+		select {
+		case <-done:
+			return
+		case p := <-g.duplCh:
+			g.handleDupl(p)
+		}
+	}
+}
+
+// handleDupl duplicates a packet of a duplicating FAR, then applies the
+// Apply Action of the FAR to the original packet. The packets of the FARs
+// forwarded by the UPF for Header Enrichment or Redirect Information are
+// handled here as well.
+func (g *Gtp5g) handleDupl(p duplPkt) {
+	link := g.sessLink(p.lSeid)
+	ps, err := g.loadPDR(link, p.lSeid, p.pdrid)
+	if err != nil {
+		g.log.Warnf("handleDupl err: %+v", err)
+		return
+	}
+	g.applyDupl(link, p, ps, true)
+}
+
+// applyDupl duplicates a packet of a PDR, unless it is forwarded without
+// its copy by overflowDupl, then applies the Apply Action of the FAR to it.
+// Without its copy, no netlink request is sent.
+func (g *Gtp5g) applyDupl(link *Gtp5gLink, p duplPkt, ps *pdrState, dupl bool) {
+	far := ps.far
+	if far == nil {
+		return
+	}
+	// the HTTP traffic punted for Header Enrichment is of the rules shadowed
+	pdrid, farid := heShadowed(p.pdrid, far.ID)
+	oid := gtp5gnl.OID{p.lSeid, uint64(farid)}
+	st, tracked := g.farState(oid)
+	f, ok := g.duplFAR(oid)
+	if ok {
+		if dupl {
+			g.duplicate(f.targets, p.pkt)
+		} else {
+			n := g.duplDropped.Add(1)
+			g.log.Debugf("duplication queue full, copy of PDR[%#x] dropped (%d dropped)", pdrid, n)
+		}
+	} else if tracked {
+		f.action = st.action
+	} else {
+		return
+	}
+
+	act := report.ApplyAction{Flags: f.action}
+	switch {
+	case act.FORW():
+		if tracked && st.redirect != nil {
+			if !dupl {
+				// the access FAR of the response is read from the kernel
+				g.log.Warnf("duplication queue full, drop packet of PDR[%#x]", pdrid)
+				return
+			}
+			err := g.redirect(link, p.lSeid, ps, st.redirect, p.pkt)
+			if err != nil {
+				g.log.Warnf("handleDupl redirect err: %+v", err)
+			}
+			return
+		}
+		pkt := p.pkt
+		if tracked {
+			now := time.Now()
+			if st.access {
+				pkt = g.enrich.downlink(p.lSeid, pkt, now)
+			} else {
+				pkt = g.enrich.uplink(p.lSeid, pkt, st.headers, now)
+			}
+		}
+		err := g.forwardPacket(link, p.lSeid, far, ps.qers, pkt)
+		if errors.Is(err, errRateLimited) {
+			g.notifyDrops(p.lSeid, []report.Report{g.dropReport(p.lSeid, pdrid, far, len(pkt))})
+			return
+		}
+		if err != nil {
+			g.log.Warnf("handleDupl WritePacket err: %+v", err)
+		}
+	case act.BUFF():
+		if g.handler == nil {
+			return
+		}
+		g.handler.NotifySessReport(report.SessReport{
+			SEID: p.lSeid,
+			Reports: []report.Report{report.DLDReport{
+				PDRID:  pdrid,
+				Action: f.action &^ report.APPLY_ACT_DUPL,
+				BufPkt: p.pkt,
+			}},
+		})
+	}
+}
+
+// duplicate sends a copy of the packet to each target
+func (g *Gtp5g) duplicate(targets []Duplication, pkt []byte) {
+	conn, err := g.copySocket()
+	if err != nil {
+		g.log.Warnf("duplicate err: %+v", err)
+		return
+	}
+	for i := range targets {
+		b, err := targets[i].encode(pkt)
+		if err != nil {
+			g.log.Warnf("duplicate encode err: %+v", err)
+			continue
+		}
+		_, err = conn.WriteTo(b, targets[i].Addr)
+		if err != nil {
+			g.log.Warnf("duplicate to %v err: %+v", targets[i].Addr, err)
+		}
+	}
+}
+
+// copySocket returns the socket the copies are sent from, opened on first
+// use on the GTP-U address of the UPF. The copies have a socket of their own,
+// apart from the G-PDUs and their Transport Level Marking.
+func (g *Gtp5g) copySocket() (*net.UDPConn, error) {
+	g.copyMu.Lock()
+	defer g.copyMu.Unlock()
+	if g.copyConn != nil {
+		return g.copyConn, nil
+	}
+	laddr := &net.UDPAddr{}
+	if g.link != nil && g.link.addr != nil {
+		laddr.IP = g.link.addr.IP
+	}
+	conn, err := net.ListenUDP("udp4", laddr)
+	if err != nil {
+		return nil, errors.Wrap(err, "open copy socket")
+	}
+	g.copyConn = conn
+	return conn, nil
+}
+
+func (g *Gtp5g) closeCopySocket() {
+	g.copyMu.Lock()
+	defer g.copyMu.Unlock()
+	if g.copyConn != nil {
+		g.copyConn.Close()
+		g.copyConn = nil
+	}
+}
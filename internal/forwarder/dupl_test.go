@@ -0,0 +1,201 @@
+package forwarder
+
+import (
+	"net"
+	"testing"
+	"time"
+
+	"github.com/khirono/go-nl"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"github.com/wmnsk/go-pfcp/ie"
+
+	"github.com/free5gc/go-gtp5gnl"
+	"github.com/free5gc/go-upf/internal/logger"
+	"github.com/free5gc/go-upf/internal/report"
+)
+
+func newDuplTestGtp5g(t *testing.T) (*Gtp5g, *net.UDPConn) {
+	conn, err := net.ListenUDP("udp4", &net.UDPAddr{IP: net.IPv4(127, 0, 0, 1)})
+	require.NoError(t, err)
+	target, err := net.ListenUDP("udp4", &net.UDPAddr{IP: net.IPv4(127, 0, 0, 1)})
+	require.NoError(t, err)
+	t.Cleanup(func() {
+		conn.Close()
+		target.Close()
+	})
+	g := &Gtp5g{
+		link:   &Gtp5gLink{conn: conn, raw: newRawSocket(0)},
+		log:    logger.FwderLog,
+		dupls:  make(map[duplKey]*duplFAR),
+		pdrs:   make(map[duplKey]*pdrState),
+		duplCh: make(chan duplPkt, DUPL_QUEUE_LEN),
+	}
+	return g, target
+}
+
+func TestBuildFARPlanDupl(t *testing.T) {
+	g, _ := newDuplTestGtp5g(t)
+
+	far := ie.NewCreateFAR(
+		ie.NewFARID(1),
+		ie.NewApplyAction(0x12), // FORW|DUPL
+		ie.NewDuplicatingParameters(
+			ie.NewDestinationInterface(ie.DstInterfaceLIFunction),
+			ie.NewOuterHeaderCreation(0x0100, 0x11, "10.0.0.9", "", 0, 0, 0),
+			ie.NewForwardingPolicy("li-7"),
+		),
+	)
+	p, err := g.BuildCreateFARPlan(1, far)
+	require.NoError(t, err)
+
+	var action uint16
+	for _, a := range p.Attrs {
+		if a.Type == gtp5gnl.FAR_APPLY_ACTION {
+			action = uint16(a.Value.(nl.AttrU16))
+		}
+	}
+	assert.Equal(t, uint16(report.APPLY_ACT_BUFF|report.APPLY_ACT_DUPL), action)
+	require.NotNil(t, p.ApplyAction)
+	assert.True(t, p.ApplyAction.FORW())
+	require.Len(t, p.Duplications, 1)
+	d := p.Duplications[0]
+	assert.Equal(t, uint8(ie.DstInterfaceLIFunction), d.DstIf)
+	assert.True(t, d.HasTEID)
+	assert.Equal(t, uint32(0x11), d.TEID)
+	assert.Equal(t, "10.0.0.9:2152", d.Addr.String())
+	assert.Equal(t, []byte("li-7"), d.CorrelationID)
+
+	// Outer Header Creation is mandatory in the Duplicating Parameters
+	far = ie.NewCreateFAR(
+		ie.NewFARID(2),
+		ie.NewApplyAction(0x12),
+		ie.NewDuplicatingParameters(
+			ie.NewDestinationInterface(ie.DstInterfaceLIFunction),
+		),
+	)
+	_, err = g.BuildCreateFARPlan(1, far)
+	assert.Error(t, err)
+}
+
+func TestDuplication(t *testing.T) {
+	g, target := newDuplTestGtp5g(t)
+	laddr := target.LocalAddr().(*net.UDPAddr)
+	pkt := []byte{0x45, 0x00, 0x00, 0x14}
+
+	t.Cleanup(g.closeCopySocket)
+	recv := func() []byte {
+		err := target.SetReadDeadline(time.Now().Add(100 * time.Millisecond))
+		require.NoError(t, err)
+		b := make([]byte, 1500)
+		n, from, err := target.ReadFromUDP(b)
+		require.NoError(t, err)
+		// not from the socket of the G-PDUs
+		assert.NotEqual(t, g.link.conn.LocalAddr().(*net.UDPAddr).Port, from.Port)
+		return b[:n]
+	}
+
+	t.Run("X3 PDU with correlation ID", func(t *testing.T) {
+		d := Duplication{Addr: laddr, CorrelationID: []byte("li")}
+		g.duplicate([]Duplication{d}, pkt)
+		want := append([]byte{X3_PDU_TYPE_CORRELATED, 0x00, 0x02, 'l', 'i'}, pkt...)
+		assert.Equal(t, want, recv())
+	})
+
+	t.Run("G-PDU to the target TEID", func(t *testing.T) {
+		d := Duplication{Addr: laddr, TEID: 0x1234, HasTEID: true}
+		g.duplicate([]Duplication{d}, pkt)
+		b := recv()
+		require.Len(t, b, 12+len(pkt))
+		assert.Equal(t, []byte{0x32, 0xff, 0x00, 0x08, 0x00, 0x00, 0x12, 0x34}, b[:8])
+		assert.Equal(t, pkt, b[12:])
+	})
+
+	t.Run("FAR duplication state", func(t *testing.T) {
+		oid := gtp5gnl.OID{1, 3}
+		act := report.ApplyAction{Flags: report.APPLY_ACT_FORW | report.APPLY_ACT_DUPL}
+		d := Duplication{Addr: laddr}
+		g.setDuplFAR(&FARPlan{OID: oid, ApplyAction: &act, Duplications: []Duplication{d}})
+		f, ok := g.duplFAR(oid)
+		require.True(t, ok)
+		assert.Equal(t, act.Flags, f.action)
+		assert.Len(t, f.targets, 1)
+
+		// an update without Duplicating Parameters keeps the targets
+		act.Flags = report.APPLY_ACT_BUFF | report.APPLY_ACT_DUPL
+		g.setDuplFAR(&FARPlan{OID: oid, ApplyAction: &act})
+		f, ok = g.duplFAR(oid)
+		require.True(t, ok)
+		assert.Equal(t, act.Flags, f.action)
+		assert.Len(t, f.targets, 1)
+
+		act.Flags = report.APPLY_ACT_FORW
+		g.setDuplFAR(&FARPlan{OID: oid, ApplyAction: &act})
+		_, ok = g.duplFAR(oid)
+		assert.False(t, ok)
+	})
+
+	t.Run("intercept packets of duplicating FARs", func(t *testing.T) {
+		sr := g.interceptDupl(report.SessReport{
+			SEID: 1,
+			Reports: []report.Report{
+				report.DLDReport{PDRID: 1, Action: report.APPLY_ACT_BUFF, BufPkt: pkt},
+				report.DLDReport{
+					PDRID:  2,
+					Action: report.APPLY_ACT_BUFF | report.APPLY_ACT_DUPL,
+					BufPkt: pkt,
+				},
+			},
+		})
+		require.Len(t, sr.Reports, 1)
+		assert.Equal(t, uint16(1), sr.Reports[0].(report.DLDReport).PDRID)
+		p := <-g.duplCh
+		assert.Equal(t, uint16(2), p.pdrid)
+		assert.Equal(t, pkt, p.pkt)
+	})
+
+	t.Run("queue full", func(t *testing.T) {
+		peer, err := net.ListenUDP("udp4", &net.UDPAddr{IP: net.IPv4(127, 0, 0, 1)})
+		require.NoError(t, err)
+		defer peer.Close()
+		paddr := peer.LocalAddr().(*net.UDPAddr)
+
+		g.duplCh = make(chan duplPkt)
+		g.dupls[duplKey{1, 5}] = &duplFAR{
+			action:  report.APPLY_ACT_FORW | report.APPLY_ACT_DUPL,
+			targets: []Duplication{{Addr: laddr}},
+		}
+		g.pdrs[duplKey{1, 2}] = &pdrState{
+			pdr: &gtp5gnl.PDR{ID: 2},
+			far: &gtp5gnl.FAR{ID: 5, Param: &gtp5gnl.ForwardParam{
+				Creation: &gtp5gnl.HeaderCreation{TEID: 9, PeerAddr: paddr.IP, Port: uint16(paddr.Port)},
+			}},
+		}
+		dl := func(pdrid uint16) report.SessReport {
+			return report.SessReport{SEID: 1, Reports: []report.Report{report.DLDReport{
+				PDRID:  pdrid,
+				Action: report.APPLY_ACT_BUFF | report.APPLY_ACT_DUPL,
+				BufPkt: pkt,
+			}}}
+		}
+
+		// the original is forwarded, the copy is dropped
+		g.interceptDupl(dl(2))
+		require.NoError(t, peer.SetReadDeadline(time.Now().Add(100*time.Millisecond)))
+		b := make([]byte, 1500)
+		n, _, err := peer.ReadFrom(b)
+		require.NoError(t, err)
+		assert.Equal(t, pkt, b[n-len(pkt):n])
+		require.NoError(t, target.SetReadDeadline(time.Now().Add(50*time.Millisecond)))
+		_, _, err = target.ReadFrom(b)
+		assert.Error(t, err)
+		assert.Equal(t, uint64(1), g.DuplDropped())
+
+		// the state of the PDR is not known yet
+		g.interceptDupl(dl(3))
+		assert.Equal(t, uint64(2), g.DuplDropped())
+
+		g.flushPDRs(1)
+		assert.Empty(t, g.pdrs)
+	})
+}
@@ -1,6 +1,8 @@
 package forwarder
 
 import (
+	"time"
+
 	"github.com/wmnsk/go-pfcp/ie"
 
 	"github.com/free5gc/go-upf/internal/report"
@@ -18,6 +20,21 @@ func (Empty) QueryURR(uint64, uint32) ([]report.USAReport, error) {
 func (Empty) HandleReport(report.Handler) {
 }
 
+func (Empty) LastActivity(uint64, []uint16) time.Time {
+	return time.Time{}
+}
+
+func (Empty) DroppedDL(uint64, []uint16) map[uint16]uint64 {
+	return nil
+}
+
+func (Empty) SendQoSMonitoring(uint64, uint8) error {
+	return nil
+}
+
+func (Empty) StopQoSMonitoring(uint64) {
+}
+
 // Plan-based methods for two-phase commit
 
 func (Empty) BuildCreatePDRPlan(lSeid uint64, req *ie.IE) (*PDRPlan, error) {
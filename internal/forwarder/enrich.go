@@ -0,0 +1,884 @@
+package forwarder
+
+import (
+	"bytes"
+	"encoding/binary"
+	"fmt"
+	"sync"
+	"time"
+
+	"github.com/khirono/go-nl"
+	"github.com/pkg/errors"
+	"github.com/sirupsen/logrus"
+	"github.com/wmnsk/go-pfcp/ie"
+
+	"github.com/free5gc/go-gtp5gnl"
+	"github.com/free5gc/go-upf/internal/report"
+)
+
+const (
+	HE_HTTP_PORT = 80
+	// Largest enriched packet; a request which would not fit is forwarded
+	// unchanged rather than fragmented
+	HE_MAX_PKT_LEN = 1500
+	// Limits of the TCP connections with sequence adjustment
+	HE_MAX_FLOWS      = 65536
+	HE_MAX_INSERTIONS = 64
+	HE_FLOW_TIMEOUT   = 10 * time.Minute
+
+	IP_PROTO_TCP = 6
+
+	TCP_FLAG_FIN = 0x01
+	TCP_FLAG_SYN = 0x02
+	TCP_FLAG_RST = 0x04
+	TCP_FLAG_PSH = 0x08
+	TCP_FLAG_ACK = 0x10
+
+	TCP_OPT_END  = 0
+	TCP_OPT_NOP  = 1
+	TCP_OPT_SACK = 5
+
+	// The kernel rules punting the HTTP traffic of an enriched session take
+	// the IDs of the rules they shadow, in a range of their own
+	HE_PDR_ID = 0x8000
+	HE_FAR_ID = 0x80000000
+	// Flow Description of the HTTP traffic of a UE, as in a downlink PDI
+	HE_HTTP_FLOW = "permit out 6 from any 80 to %s"
+)
+
+var httpMethods = [][]byte{
+	[]byte("GET "), []byte("POST "), []byte("HEAD "), []byte("PUT "),
+	[]byte("DELETE "), []byte("OPTIONS "), []byte("PATCH "),
+	[]byte("CONNECT "), []byte("TRACE "),
+}
+
+// HeaderEnrichment is a header inserted into the HTTP requests forwarded by
+// a FAR, from the Header Enrichment of the Forwarding Parameters
+type HeaderEnrichment struct {
+	Name  string
+	Value string
+}
+
+func newHeaderEnrichment(x *ie.IE) (HeaderEnrichment, error) {
+	var h HeaderEnrichment
+	v, err := x.HeaderEnrichment()
+	if err != nil {
+		return h, err
+	}
+	if v.HeaderType != ie.HeaderTypeHTTP {
+		return h, errors.Wrapf(ErrUnsupported, "Header Enrichment: header type %d", v.HeaderType)
+	}
+	if !validHeaderName(v.HeaderFieldName) {
+		return h, errors.Errorf("Header Enrichment: invalid header name %q", v.HeaderFieldName)
+	}
+	if bytes.ContainsAny([]byte(v.HeaderFieldValue), "\r\n") {
+		return h, errors.Errorf("Header Enrichment: invalid value of header %q", v.HeaderFieldName)
+	}
+	h.Name = v.HeaderFieldName
+	h.Value = v.HeaderFieldValue
+	return h, nil
+}
+
+// validHeaderName reports whether s is an HTTP field name token
+func validHeaderName(s string) bool {
+	if s == "" {
+		return false
+	}
+	for i := 0; i < len(s); i++ {
+		c := s[i]
+		switch {
+		case c >= 'a' && c <= 'z', c >= 'A' && c <= 'Z', c >= '0' && c <= '9':
+		case bytes.IndexByte([]byte("!#$%&'*+-.^_`|~"), c) >= 0:
+		default:
+			return false
+		}
+	}
+	return true
+}
+
+// headerEnrichments returns the Header Enrichment of Forwarding Parameters
+// forwarding to dstIf
+func headerEnrichments(ies []*ie.IE, dstIf *uint8) ([]HeaderEnrichment, error) {
+	var hs []HeaderEnrichment
+	for _, x := range ies {
+		if x.Type != ie.HeaderEnrichment {
+			continue
+		}
+		h, err := newHeaderEnrichment(x)
+		if err != nil {
+			return nil, err
+		}
+		hs = append(hs, h)
+	}
+	if len(hs) > 0 && dstIf != nil && *dstIf != ie.DstInterfaceCore {
+		return nil, errors.Wrapf(ErrUnsupported,
+			"Header Enrichment: destination interface %d", *dstIf)
+	}
+	return hs, nil
+}
+
+// userspaceAction returns the Apply Action of a FAR in the kernel module
+// when its packets are forwarded by the UPF, like the duplicating FARs
+func userspaceAction(flags uint16) uint16 {
+	flags &^= report.APPLY_ACT_DROP | report.APPLY_ACT_FORW
+	return flags | report.APPLY_ACT_BUFF | report.APPLY_ACT_DUPL
+}
+
+// setUserspaceAction programs a FAR forwarded by the UPF, for its Redirect
+// Information, with userspace forwarding from its creation
+func setUserspaceAction(attrs []nl.Attr, act *report.ApplyAction, r *Redirect) {
+	if act == nil || !act.FORW() || r == nil {
+		return
+	}
+	for i := range attrs {
+		if attrs[i].Type == gtp5gnl.FAR_APPLY_ACTION {
+			attrs[i].Value = nl.AttrU16(userspaceAction(act.Flags))
+		}
+	}
+}
+
+// farState is the forwarding of a FAR of a session. The FARs with Redirect
+// Information are forwarded by the UPF; the FARs with Header Enrichment stay
+// in the kernel module, and only their HTTP traffic is punted to the UPF by
+// the rules of syncHERules.
+type farState struct {
+	action   uint16 // Apply Action requested by the CP function
+	kernel   uint16 // Apply Action programmed in the kernel module
+	access   bool
+	headers  []HeaderEnrichment
+	redirect *Redirect
+}
+
+// userspace reports whether the packets of the FAR are forwarded by the UPF
+func (f *farState) userspace() bool {
+	act := report.ApplyAction{Flags: f.action}
+	return act.FORW() && f.redirect != nil
+}
+
+func farAttrAction(attrs []nl.Attr) (uint16, bool) {
+	for _, a := range attrs {
+		if a.Type == gtp5gnl.FAR_APPLY_ACTION {
+			v, ok := a.Value.(nl.AttrU16)
+			return uint16(v), ok
+		}
+	}
+	return 0, false
+}
+
+// syncFARs records the FARs of an executed plan, and switches the FARs of
+// the session between kernel and userspace forwarding as their Redirect
+// Information changes
+func (g *Gtp5g) syncFARs(plan *ModificationPlan, link *Gtp5gLink) {
+	type update struct {
+		oid    gtp5gnl.OID
+		action uint16
+	}
+	var updates []update
+
+	g.duplMu.Lock()
+	if plan.Release {
+		for k := range g.fars {
+			if k[0] == plan.SEID {
+				delete(g.fars, k)
+			}
+		}
+		g.duplMu.Unlock()
+		g.enrich.delSess(plan.SEID)
+		return
+	}
+	for _, p := range plan.RemoveFARs {
+		delete(g.fars, newDuplKey(p.OID))
+	}
+	for _, ps := range [][]*FARPlan{plan.CreateFARs, plan.UpdateFARs} {
+		for _, p := range ps {
+			k := newDuplKey(p.OID)
+			f, ok := g.fars[k]
+			if !ok {
+				f = &farState{}
+				g.fars[k] = f
+			}
+			if p.ApplyAction != nil {
+				f.action = p.ApplyAction.Flags
+				f.kernel, _ = farAttrAction(p.Attrs)
+			}
+			if p.DstIf != nil {
+				f.access = *p.DstIf == ie.DstInterfaceAccess
+			}
+			if p.HeaderEnrichment != nil {
+				f.headers = p.HeaderEnrichment
+			}
+			if p.Redirect != nil {
+				f.redirect = p.Redirect
+			}
+		}
+	}
+	var enriched bool
+	for k, f := range g.fars {
+		if k[0] == plan.SEID && len(f.headers) > 0 {
+			enriched = true
+			break
+		}
+	}
+	for k, f := range g.fars {
+		if k[0] != plan.SEID {
+			continue
+		}
+		want := kernelAction(report.ApplyAction{Flags: f.action})
+		if f.userspace() {
+			want = userspaceAction(f.action)
+		}
+		if want != f.kernel {
+			f.kernel = want
+			updates = append(updates, update{oid: gtp5gnl.OID{k[0], k[1]}, action: want})
+		}
+	}
+	g.duplMu.Unlock()
+
+	if !enriched {
+		g.enrich.delSess(plan.SEID)
+	}
+	for _, u := range updates {
+		attrs := []nl.Attr{{Type: gtp5gnl.FAR_APPLY_ACTION, Value: nl.AttrU16(u.action)}}
+		if err := g.sessClient(plan.SEID).UpdateFAR(link.link, u.oid, attrs); err != nil {
+			g.log.Errorf("syncFARs: UpdateFAR[%#x] failed: %v", u.oid[1], err)
+		}
+	}
+}
+
+func (g *Gtp5g) farState(oid gtp5gnl.OID) (farState, bool) {
+	g.duplMu.Lock()
+	defer g.duplMu.Unlock()
+	f, ok := g.fars[newDuplKey(oid)]
+	if !ok {
+		return farState{}, false
+	}
+	return *f, true
+}
+
+// heRules is the kernel rules punting the HTTP traffic of an enriched
+// session to the UPF: a PDR matching the HTTP traffic of each PDR of the
+// FARs concerned, with a higher precedence, forwarding to a copy of the FAR
+// with userspace forwarding
+type heRules struct {
+	pdrs []uint16
+	fars []uint32
+}
+
+// heFAR is a FAR whose HTTP traffic is punted to the UPF
+type heFAR struct {
+	farid uint32
+	dl    bool
+}
+
+// heShadowed returns the IDs of the rules shadowed by a PDR punting HTTP
+// traffic, given its FAR, or else the IDs given
+func heShadowed(pdrid uint16, farid uint32) (uint16, uint32) {
+	if farid&HE_FAR_ID == 0 {
+		return pdrid, farid
+	}
+	return pdrid &^ HE_PDR_ID, farid &^ HE_FAR_ID
+}
+
+// heFARs returns the FARs of a session whose HTTP traffic is punted: the
+// uplink of the FARs with Header Enrichment, and the downlink of the FARs to
+// the access, whose acknowledgments are shifted back
+func (g *Gtp5g) heFARs(lSeid uint64) []heFAR {
+	g.duplMu.Lock()
+	defer g.duplMu.Unlock()
+	var enriched bool
+	for k, f := range g.fars {
+		if k[0] == lSeid && len(f.headers) > 0 {
+			enriched = true
+			break
+		}
+	}
+	if !enriched {
+		return nil
+	}
+	var fars []heFAR
+	for k, f := range g.fars {
+		act := report.ApplyAction{Flags: f.action}
+		if k[0] != lSeid || !act.FORW() || f.userspace() {
+			continue
+		}
+		if _, ok := g.dupls[k]; ok {
+			// forwarded by the UPF as a whole
+			continue
+		}
+		switch {
+		case len(f.headers) > 0:
+			fars = append(fars, heFAR{farid: uint32(k[1])})
+		case f.access:
+			fars = append(fars, heFAR{farid: uint32(k[1]), dl: true})
+		}
+	}
+	return fars
+}
+
+// syncHERules replaces the kernel rules punting the HTTP traffic of a
+// session after a plan, so that they follow the rules they shadow
+func (g *Gtp5g) syncHERules(plan *ModificationPlan, link *Gtp5gLink) {
+	lSeid := plan.SEID
+	var fars []heFAR
+	if !plan.Release {
+		fars = g.heFARs(lSeid)
+	}
+
+	g.duplMu.Lock()
+	old := g.heRules[lSeid]
+	delete(g.heRules, lSeid)
+	g.duplMu.Unlock()
+	if old != nil {
+		for _, pdrid := range old.pdrs {
+			err := g.sessClient(lSeid).RemovePDR(link.link, gtp5gnl.OID{lSeid, uint64(pdrid)})
+			if err != nil {
+				g.log.Warnf("syncHERules: RemovePDR[%#x] err: %v", pdrid, err)
+			}
+		}
+		for _, farid := range old.fars {
+			err := g.sessClient(lSeid).RemoveFAR(link.link, gtp5gnl.OID{lSeid, uint64(farid)})
+			if err != nil {
+				g.log.Warnf("syncHERules: RemoveFAR[%#x] err: %v", farid, err)
+			}
+		}
+	}
+	if len(fars) == 0 {
+		return
+	}
+
+	rules := &heRules{}
+	for _, f := range fars {
+		err := g.createHERules(link, lSeid, f, rules)
+		if err != nil {
+			g.log.Errorf("syncHERules: FAR[%#x]: %v", f.farid, err)
+		}
+	}
+	g.duplMu.Lock()
+	g.heRules[lSeid] = rules
+	g.duplMu.Unlock()
+}
+
+// createHERules creates the rules punting the HTTP traffic of the PDRs of a
+// FAR. The PDRs matching more than a UE address and a tunnel, or with IDs in
+// the range of the punting rules, are not enriched.
+func (g *Gtp5g) createHERules(link *Gtp5gLink, lSeid uint64, f heFAR, rules *heRules) error {
+	far, err := g.sessClient(lSeid).GetFAR(link.link, gtp5gnl.OID{lSeid, uint64(f.farid)})
+	if err != nil {
+		return errors.Wrap(err, "GetFAR")
+	}
+	var pdrs []nl.AttrList
+	for _, pdrid := range far.PDRIDs {
+		if pdrid&HE_PDR_ID != 0 {
+			g.log.Debugf("PDR[%#x]: ID in the range of the Header Enrichment rules", pdrid)
+			continue
+		}
+		pdr, err := g.sessClient(lSeid).GetPDR(link.link, gtp5gnl.OID{lSeid, uint64(pdrid)})
+		if err != nil {
+			return errors.Wrap(err, "GetPDR")
+		}
+		attrs, err := g.hePDRAttrs(pdr, f.farid|HE_FAR_ID)
+		if err != nil {
+			g.log.Debugf("PDR[%#x]: %v", pdrid, err)
+			continue
+		}
+		pdrs = append(pdrs, attrs)
+	}
+	if len(pdrs) == 0 {
+		return nil
+	}
+
+	oid := gtp5gnl.OID{lSeid, uint64(f.farid | HE_FAR_ID)}
+	err = g.sessClient(lSeid).CreateFAR(link.link, oid, heFARAttrs(far))
+	if err != nil {
+		return errors.Wrap(err, "CreateFAR")
+	}
+	rules.fars = append(rules.fars, f.farid|HE_FAR_ID)
+	for _, attrs := range pdrs {
+		pdrid := uint16(attrs[0].Value.(nl.AttrU16))
+		err = g.sessClient(lSeid).CreatePDR(link.link, gtp5gnl.OID{lSeid, uint64(pdrid)}, attrs)
+		if err != nil {
+			return errors.Wrapf(err, "CreatePDR[%#x]", pdrid)
+		}
+		rules.pdrs = append(rules.pdrs, pdrid)
+	}
+	return nil
+}
+
+// hePDRAttrs returns the PDR punting the HTTP traffic of a PDR to a FAR; its
+// ID comes first
+func (g *Gtp5g) hePDRAttrs(pdr *gtp5gnl.PDR, farid uint32) (nl.AttrList, error) {
+	pdi := pdr.PDI
+	if pdi == nil || pdi.SrcIntf == nil {
+		return nil, errors.New("no Source Interface")
+	}
+	if pdi.SDF != nil || len(pdi.EPFs) > 0 {
+		return nil, errors.New("packet filters of its own")
+	}
+	ue := "assigned"
+	if pdi.UEAddr != nil {
+		ue = pdi.UEAddr.String()
+	}
+	fd, err := g.newFlowDesc(fmt.Sprintf(HE_HTTP_FLOW, ue), *pdi.SrcIntf == ie.SrcInterfaceAccess)
+	if err != nil {
+		return nil, err
+	}
+
+	pdiAttrs := nl.AttrList{
+		{Type: gtp5gnl.PDI_SRC_INTF, Value: nl.AttrU8(*pdi.SrcIntf)},
+		{Type: gtp5gnl.PDI_SDF_FILTER, Value: nl.AttrList{
+			{Type: gtp5gnl.SDF_FILTER_FLOW_DESCRIPTION, Value: fd},
+		}},
+	}
+	if pdi.FTEID != nil {
+		pdiAttrs = append(pdiAttrs, nl.Attr{
+			Type: gtp5gnl.PDI_F_TEID,
+			Value: nl.AttrList{
+				{Type: gtp5gnl.F_TEID_I_TEID, Value: nl.AttrU32(pdi.FTEID.TEID)},
+				{Type: gtp5gnl.F_TEID_GTPU_ADDR_IPV4, Value: nl.AttrBytes(pdi.FTEID.GTPuAddr.To4())},
+			},
+		})
+	}
+	if ip := pdi.UEAddr.To4(); ip != nil {
+		pdiAttrs = append(pdiAttrs, nl.Attr{Type: gtp5gnl.PDI_UE_ADDR_IPV4, Value: nl.AttrBytes(ip)})
+	}
+
+	// matched before the PDR
+	var precedence uint32
+	if pdr.Precedence != nil && *pdr.Precedence > 0 {
+		precedence = *pdr.Precedence - 1
+	}
+	attrs := nl.AttrList{
+		{Type: gtp5gnl.PDR_ID, Value: nl.AttrU16(pdr.ID | HE_PDR_ID)},
+		{Type: gtp5gnl.PDR_PRECEDENCE, Value: nl.AttrU32(precedence)},
+		{Type: gtp5gnl.PDR_PDI, Value: pdiAttrs},
+		{Type: gtp5gnl.PDR_FAR_ID, Value: nl.AttrU32(farid)},
+	}
+	if pdr.OuterHdrRemoval != nil {
+		attrs = append(attrs, nl.Attr{Type: gtp5gnl.PDR_OUTER_HEADER_REMOVAL, Value: nl.AttrU8(*pdr.OuterHdrRemoval)})
+	}
+	for _, id := range pdr.QERID {
+		attrs = append(attrs, nl.Attr{Type: gtp5gnl.PDR_QER_ID, Value: nl.AttrU32(id)})
+	}
+	for _, id := range pdr.URRID {
+		attrs = append(attrs, nl.Attr{Type: gtp5gnl.PDR_URR_ID, Value: nl.AttrU32(id)})
+	}
+	return attrs, nil
+}
+
+// heFARAttrs returns the copy of a FAR with userspace forwarding
+func heFARAttrs(far *gtp5gnl.FAR) nl.AttrList {
+	attrs := nl.AttrList{
+		{Type: gtp5gnl.FAR_ID, Value: nl.AttrU32(far.ID | HE_FAR_ID)},
+		{Type: gtp5gnl.FAR_APPLY_ACTION, Value: nl.AttrU16(userspaceAction(far.Action))},
+	}
+	if far.Param != nil {
+		attrs = append(attrs, nl.Attr{
+			Type:  gtp5gnl.FAR_FORWARDING_PARAMETER,
+			Value: forwardingParamAttrs(far.Param),
+		})
+	}
+	return attrs
+}
+
+// forwardingParamAttrs returns the Forwarding Parameters of a kernel FAR, to
+// be given again as a whole
+func forwardingParamAttrs(p *gtp5gnl.ForwardParam) nl.AttrList {
+	var param nl.AttrList
+	if hc := p.Creation; hc != nil {
+		creation := nl.AttrList{
+			{Type: gtp5gnl.OUTER_HEADER_CREATION_DESCRIPTION, Value: nl.AttrU16(hc.Desc)},
+			{Type: gtp5gnl.OUTER_HEADER_CREATION_PORT, Value: nl.AttrU16(hc.Port)},
+		}
+		if hc.TEID != 0 {
+			creation = append(creation, nl.Attr{
+				Type:  gtp5gnl.OUTER_HEADER_CREATION_O_TEID,
+				Value: nl.AttrU32(hc.TEID),
+			})
+		}
+		if ip := hc.PeerAddr.To4(); ip != nil {
+			creation = append(creation, nl.Attr{
+				Type:  gtp5gnl.OUTER_HEADER_CREATION_PEER_ADDR_IPV4,
+				Value: nl.AttrBytes(ip),
+			})
+		}
+		param = append(param, nl.Attr{
+			Type:  gtp5gnl.FORWARDING_PARAMETER_OUTER_HEADER_CREATION,
+			Value: creation,
+		})
+	}
+	if p.Policy != nil {
+		param = append(param, nl.Attr{
+			Type:  gtp5gnl.FORWARDING_PARAMETER_FORWARDING_POLICY,
+			Value: nl.AttrString(*p.Policy),
+		})
+	}
+	param = append(param, nl.Attr{
+		Type:  gtp5gnl.FORWARDING_PARAMETER_TOS_TC,
+		Value: nl.AttrU8(p.TosTc),
+	})
+	return param
+}
+
+// heFlowKey is a TCP connection of a session, from the UE side
+type heFlowKey struct {
+	lSeid    uint64
+	ue       [4]byte
+	peer     [4]byte
+	uePort   uint16
+	peerPort uint16
+}
+
+// heInsertion is a header block inserted before the uplink sequence number
+// seq of the UE
+type heInsertion struct {
+	seq uint32
+	len uint32
+}
+
+// heFlow is a TCP connection with inserted headers. The uplink sequence
+// numbers are shifted by the bytes inserted before them, and the downlink
+// acknowledgments are shifted back.
+type heFlow struct {
+	ins  []heInsertion // ordered by seq
+	last time.Time
+}
+
+func seqLT(a, b uint32) bool {
+	return int32(a-b) < 0
+}
+
+func seqLE(a, b uint32) bool {
+	return int32(a-b) <= 0
+}
+
+// shift maps an uplink sequence number of the UE to the one sent
+func (f *heFlow) shift(seq uint32) uint32 {
+	var d uint32
+	for _, x := range f.ins {
+		if !seqLT(x.seq, seq) {
+			break
+		}
+		d += x.len
+	}
+	return seq + d
+}
+
+// unshift maps a downlink acknowledgment of the peer to the UE one
+func (f *heFlow) unshift(ack uint32) uint32 {
+	var d uint32
+	for _, x := range f.ins {
+		start := x.seq + d
+		if seqLE(ack, start) {
+			break
+		}
+		if seqLT(ack, start+x.len) {
+			// within the inserted headers
+			return x.seq
+		}
+		d += x.len
+	}
+	return ack - d
+}
+
+// insert records headers of n bytes inserted before seq, and reports whether
+// the headers are inserted
+func (f *heFlow) insert(seq, n uint32) bool {
+	for _, x := range f.ins {
+		if x.seq == seq {
+			// a retransmitted request
+			return x.len == n
+		}
+	}
+	if len(f.ins) >= HE_MAX_INSERTIONS {
+		return false
+	}
+	if len(f.ins) > 0 && !seqLT(f.ins[len(f.ins)-1].seq, seq) {
+		return false
+	}
+	f.ins = append(f.ins, heInsertion{seq: seq, len: n})
+	return true
+}
+
+// enricher inserts the Header Enrichment of the FARs into the HTTP requests
+// of the UEs, and keeps the TCP sequence numbers of the connections
+// consistent afterwards
+type enricher struct {
+	log   *logrus.Entry
+	mu    sync.Mutex
+	flows map[heFlowKey]*heFlow
+}
+
+func newEnricher(log *logrus.Entry) *enricher {
+	return &enricher{
+		log:   log,
+		flows: make(map[heFlowKey]*heFlow),
+	}
+}
+
+func (e *enricher) delSess(lSeid uint64) {
+	e.mu.Lock()
+	defer e.mu.Unlock()
+	for k := range e.flows {
+		if k.lSeid == lSeid {
+			delete(e.flows, k)
+		}
+	}
+}
+
+// newFlow returns a new connection, or nil if too many are tracked
+func (e *enricher) newFlow(k heFlowKey, now time.Time) *heFlow {
+	if len(e.flows) >= HE_MAX_FLOWS {
+		for fk, f := range e.flows {
+			if now.Sub(f.last) >= HE_FLOW_TIMEOUT {
+				delete(e.flows, fk)
+			}
+		}
+		if len(e.flows) >= HE_MAX_FLOWS {
+			return nil
+		}
+	}
+	f := &heFlow{}
+	e.flows[k] = f
+	return f
+}
+
+// tcpPacket is a TCP segment in an IPv4 packet
+type tcpPacket struct {
+	b     []byte
+	ihl   int
+	doff  int
+	flags uint8
+}
+
+func parseTCPPacket(b []byte) (tcpPacket, bool) {
+	var p tcpPacket
+	if len(b) < 20 || b[0]>>4 != 4 || b[9] != IP_PROTO_TCP {
+		return p, false
+	}
+	// fragments
+	if binary.BigEndian.Uint16(b[6:])&0x3fff != 0 {
+		return p, false
+	}
+	ihl := int(b[0]&0x0f) * 4
+	tot := int(binary.BigEndian.Uint16(b[2:]))
+	if ihl < 20 || tot < ihl+20 || tot > len(b) {
+		return p, false
+	}
+	doff := int(b[ihl+12]>>4) * 4
+	if doff < 20 || ihl+doff > tot {
+		return p, false
+	}
+	p.b = b[:tot]
+	p.ihl = ihl
+	p.doff = doff
+	p.flags = b[ihl+13]
+	return p, true
+}
+
+func (p *tcpPacket) tcp() []byte {
+	return p.b[p.ihl:]
+}
+
+func (p *tcpPacket) payload() []byte {
+	return p.b[p.ihl+p.doff:]
+}
+
+func (p *tcpPacket) srcPort() uint16 {
+	return binary.BigEndian.Uint16(p.tcp()[0:])
+}
+
+func (p *tcpPacket) dstPort() uint16 {
+	return binary.BigEndian.Uint16(p.tcp()[2:])
+}
+
+func (p *tcpPacket) seq() uint32 {
+	return binary.BigEndian.Uint32(p.tcp()[4:])
+}
+
+func (p *tcpPacket) ack() uint32 {
+	return binary.BigEndian.Uint32(p.tcp()[8:])
+}
+
+// checksum recomputes the IPv4 and TCP checksums
+func (p *tcpPacket) checksum() {
+	ip := p.b[:p.ihl]
+	ip[10], ip[11] = 0, 0
+	binary.BigEndian.PutUint16(ip[10:], fold(sum(ip, 0)))
+
+	tcp := p.tcp()
+	tcp[16], tcp[17] = 0, 0
+	s := sum(ip[12:20], uint32(IP_PROTO_TCP)+uint32(len(tcp)))
+	binary.BigEndian.PutUint16(tcp[16:], fold(sum(tcp, s)))
+}
+
+func sum(b []byte, s uint32) uint32 {
+	for i := 0; i+1 < len(b); i += 2 {
+		s += uint32(binary.BigEndian.Uint16(b[i:]))
+	}
+	if len(b)%2 == 1 {
+		s += uint32(b[len(b)-1]) << 8
+	}
+	return s
+}
+
+func fold(s uint32) uint16 {
+	for s>>16 != 0 {
+		s = s&0xffff + s>>16
+	}
+	return ^uint16(s)
+}
+
+// httpMethod reports whether the payload starts an HTTP request
+func httpMethod(payload []byte) bool {
+	for _, m := range httpMethods {
+		if bytes.HasPrefix(payload, m) {
+			return true
+		}
+	}
+	return false
+}
+
+// requestLineEnd returns the length of the request line of an HTTP request,
+// or 0 if the payload does not start a request
+func requestLineEnd(payload []byte) int {
+	if !httpMethod(payload) {
+		return 0
+	}
+	i := bytes.Index(payload, []byte("\r\n"))
+	if i < 0 {
+		return 0
+	}
+	return i + 2
+}
+
+func encodeHeaders(headers []HeaderEnrichment) []byte {
+	var b []byte
+	for _, h := range headers {
+		b = append(b, h.Name...)
+		b = append(b, ": "...)
+		b = append(b, h.Value...)
+		b = append(b, "\r\n"...)
+	}
+	return b
+}
+
+// uplink inserts the headers into an HTTP request of the UE, and shifts the
+// sequence number of the segments of enriched connections. It returns the
+// packet to forward.
+func (e *enricher) uplink(lSeid uint64, pkt []byte, headers []HeaderEnrichment, now time.Time) []byte {
+	p, ok := parseTCPPacket(pkt)
+	if !ok {
+		return pkt
+	}
+	k := heFlowKey{
+		lSeid:    lSeid,
+		uePort:   p.srcPort(),
+		peerPort: p.dstPort(),
+	}
+	copy(k.ue[:], p.b[12:16])
+	copy(k.peer[:], p.b[16:20])
+
+	e.mu.Lock()
+	defer e.mu.Unlock()
+	f := e.flows[k]
+
+	var hdr []byte
+	var off int
+	if k.peerPort == HE_HTTP_PORT && len(headers) > 0 {
+		off = requestLineEnd(p.payload())
+		if off > 0 {
+			hdr = encodeHeaders(headers)
+		}
+		if len(p.b)+len(hdr) > HE_MAX_PKT_LEN {
+			e.log.Debugf("request of %d bytes too long to enrich", len(p.b))
+			hdr = nil
+		}
+	}
+	if hdr != nil && f == nil {
+		f = e.newFlow(k, now)
+	}
+	if f == nil {
+		return pkt
+	}
+	f.last = now
+	if hdr != nil && !f.insert(p.seq()+uint32(off), uint32(len(hdr))) {
+		hdr = nil
+	}
+
+	at := p.ihl + p.doff + off
+	b := make([]byte, 0, len(p.b)+len(hdr))
+	b = append(b, p.b[:at]...)
+	b = append(b, hdr...)
+	b = append(b, p.b[at:]...)
+	q := tcpPacket{b: b, ihl: p.ihl, doff: p.doff, flags: p.flags}
+	binary.BigEndian.PutUint16(b[2:], uint16(len(b)))
+	binary.BigEndian.PutUint32(q.tcp()[4:], f.shift(p.seq()))
+	q.checksum()
+
+	if p.flags&TCP_FLAG_RST != 0 {
+		delete(e.flows, k)
+	}
+	return b
+}
+
+// downlink shifts the acknowledgments of enriched connections back to the
+// sequence numbers of the UE. It returns the packet to forward.
+func (e *enricher) downlink(lSeid uint64, pkt []byte, now time.Time) []byte {
+	p, ok := parseTCPPacket(pkt)
+	if !ok {
+		return pkt
+	}
+	k := heFlowKey{
+		lSeid:    lSeid,
+		uePort:   p.dstPort(),
+		peerPort: p.srcPort(),
+	}
+	copy(k.ue[:], p.b[16:20])
+	copy(k.peer[:], p.b[12:16])
+
+	e.mu.Lock()
+	defer e.mu.Unlock()
+	f, ok := e.flows[k]
+	if !ok {
+		return pkt
+	}
+	f.last = now
+	if p.flags&TCP_FLAG_RST != 0 {
+		delete(e.flows, k)
+	}
+	if p.flags&TCP_FLAG_ACK == 0 {
+		return pkt
+	}
+
+	b := make([]byte, len(p.b))
+	copy(b, p.b)
+	q := tcpPacket{b: b, ihl: p.ihl, doff: p.doff, flags: p.flags}
+	tcp := q.tcp()
+	binary.BigEndian.PutUint32(tcp[8:], f.unshift(p.ack()))
+
+	// SACK blocks
+	opts := tcp[20:q.doff]
+	for i := 0; i < len(opts); {
+		switch opts[i] {
+		case TCP_OPT_END:
+			i = len(opts)
+			continue
+		case TCP_OPT_NOP:
+			i++
+			continue
+		}
+		if i+1 >= len(opts) || opts[i+1] < 2 || i+int(opts[i+1]) > len(opts) {
+			break
+		}
+		n := int(opts[i+1])
+		if opts[i] == TCP_OPT_SACK {
+			for j := i + 2; j+4 <= i+n; j += 4 {
+				edge := binary.BigEndian.Uint32(opts[j:])
+				binary.BigEndian.PutUint32(opts[j:], f.unshift(edge))
+			}
+		}
+		i += n
+	}
+	q.checksum()
+	return b
+}
@@ -0,0 +1,294 @@
+package forwarder
+
+import (
+	"encoding/binary"
+	"net"
+	"testing"
+	"time"
+
+	"github.com/khirono/go-nl"
+	"github.com/pkg/errors"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"github.com/wmnsk/go-pfcp/ie"
+
+	"github.com/free5gc/go-gtp5gnl"
+	"github.com/free5gc/go-upf/internal/logger"
+	"github.com/free5gc/go-upf/internal/report"
+)
+
+func TestBuildFARPlanHeaderEnrichment(t *testing.T) {
+	g := &Gtp5g{log: logger.FwderLog}
+
+	newFAR := func(dstIf uint8, he *ie.IE) *ie.IE {
+		return ie.NewCreateFAR(
+			ie.NewFARID(1),
+			ie.NewApplyAction(0x02),
+			ie.NewForwardingParameters(
+				ie.NewDestinationInterface(dstIf),
+				ie.NewNetworkInstance("internet"),
+				he,
+			),
+		)
+	}
+
+	p, err := g.BuildCreateFARPlan(1, newFAR(ie.DstInterfaceCore,
+		ie.NewHeaderEnrichment(ie.HeaderTypeHTTP, "X-MSISDN", "819012345678")))
+	require.NoError(t, err)
+	assert.Equal(t, []HeaderEnrichment{{Name: "X-MSISDN", Value: "819012345678"}}, p.HeaderEnrichment)
+	// forwarded by the kernel module, but for its HTTP traffic
+	act, ok := farAttrAction(p.Attrs)
+	require.True(t, ok)
+	assert.Equal(t, uint16(report.APPLY_ACT_FORW), act)
+
+	_, err = g.BuildCreateFARPlan(1, newFAR(ie.DstInterfaceCore,
+		ie.NewHeaderEnrichment(1, "X-MSISDN", "819012345678")))
+	assert.True(t, errors.Is(err, ErrUnsupported))
+
+	_, err = g.BuildCreateFARPlan(1, newFAR(ie.DstInterfaceAccess,
+		ie.NewHeaderEnrichment(ie.HeaderTypeHTTP, "X-MSISDN", "819012345678")))
+	assert.True(t, errors.Is(err, ErrUnsupported))
+
+	_, err = g.BuildCreateFARPlan(1, newFAR(ie.DstInterfaceCore,
+		ie.NewHeaderEnrichment(ie.HeaderTypeHTTP, "X-MSISDN", "1\r\nHost: evil")))
+	assert.Error(t, err)
+	assert.False(t, errors.Is(err, ErrUnsupported))
+
+	_, err = g.BuildCreateFARPlan(1, newFAR(ie.DstInterfaceCore,
+		ie.NewHeaderEnrichment(ie.HeaderTypeHTTP, "X MSISDN", "1")))
+	assert.Error(t, err)
+}
+
+// newTCPPacket returns an IPv4 TCP segment from the UE 10.60.0.1:40000 to
+// the server 10.0.0.80:80, or back if dl
+func newTCPPacket(dl bool, seq, ack uint32, flags uint8, opts, payload []byte) []byte {
+	ue := []byte{10, 60, 0, 1}
+	server := []byte{10, 0, 0, 80}
+	b := []byte{0x45, 0, 0, 0, 0, 0, 0x40, 0, 64, IP_PROTO_TCP, 0, 0}
+	tcp := make([]byte, 20)
+	if dl {
+		b = append(append(b, server...), ue...)
+		binary.BigEndian.PutUint16(tcp[0:], HE_HTTP_PORT)
+		binary.BigEndian.PutUint16(tcp[2:], 40000)
+	} else {
+		b = append(append(b, ue...), server...)
+		binary.BigEndian.PutUint16(tcp[0:], 40000)
+		binary.BigEndian.PutUint16(tcp[2:], HE_HTTP_PORT)
+	}
+	binary.BigEndian.PutUint32(tcp[4:], seq)
+	binary.BigEndian.PutUint32(tcp[8:], ack)
+	tcp[12] = uint8((20+len(opts))/4) << 4
+	tcp[13] = flags
+	binary.BigEndian.PutUint16(tcp[14:], 0xffff)
+	b = append(b, tcp...)
+	b = append(b, opts...)
+	b = append(b, payload...)
+	binary.BigEndian.PutUint16(b[2:], uint16(len(b)))
+	p, _ := parseTCPPacket(b)
+	p.checksum()
+	return b
+}
+
+func requireChecksums(t *testing.T, b []byte) tcpPacket {
+	p, ok := parseTCPPacket(b)
+	require.True(t, ok)
+	assert.Zero(t, fold(sum(p.b[:p.ihl], 0)))
+	tcp := p.tcp()
+	assert.Zero(t, fold(sum(tcp, sum(p.b[12:20], uint32(IP_PROTO_TCP)+uint32(len(tcp))))))
+	return p
+}
+
+func TestEnricher(t *testing.T) {
+	e := newEnricher(logger.FwderLog)
+	headers := []HeaderEnrichment{{Name: "X-MSISDN", Value: "819012345678"}}
+	hdr := "X-MSISDN: 819012345678\r\n"
+	req := "GET / HTTP/1.1\r\nHost: example.com\r\n\r\n"
+	now := time.Now()
+
+	// the handshake is not enriched
+	syn := newTCPPacket(false, 999, 0, 0x02, nil, nil)
+	assert.Equal(t, syn, e.uplink(1, syn, headers, now))
+	assert.Empty(t, e.flows)
+
+	t.Run("request is enriched", func(t *testing.T) {
+		b := e.uplink(1, newTCPPacket(false, 1000, 5000, 0x18, nil, []byte(req)), headers, now)
+		p := requireChecksums(t, b)
+		assert.Equal(t, "GET / HTTP/1.1\r\n"+hdr+"Host: example.com\r\n\r\n", string(p.payload()))
+		assert.Equal(t, uint32(1000), p.seq())
+
+		// a retransmission is enriched again
+		b = e.uplink(1, newTCPPacket(false, 1000, 5000, 0x18, nil, []byte(req)), headers, now)
+		p = requireChecksums(t, b)
+		assert.Equal(t, "GET / HTTP/1.1\r\n"+hdr+"Host: example.com\r\n\r\n", string(p.payload()))
+		require.Len(t, e.flows, 1)
+	})
+
+	n := uint32(len(req))
+	d := uint32(len(hdr))
+
+	t.Run("sequence numbers are shifted", func(t *testing.T) {
+		b := e.uplink(1, newTCPPacket(false, 1000+n, 5100, 0x10, nil, nil), headers, now)
+		p := requireChecksums(t, b)
+		assert.Equal(t, 1000+n+d, p.seq())
+		assert.Equal(t, uint32(5100), p.ack())
+	})
+
+	t.Run("acknowledgments are shifted back", func(t *testing.T) {
+		b := e.downlink(1, newTCPPacket(true, 5000, 1000+n+d, 0x10, nil, nil), now)
+		p := requireChecksums(t, b)
+		assert.Equal(t, 1000+n, p.ack())
+
+		// within the inserted headers
+		b = e.downlink(1, newTCPPacket(true, 5000, 1000+20, 0x10, nil, nil), now)
+		p = requireChecksums(t, b)
+		assert.Equal(t, uint32(1000+16), p.ack())
+
+		// SACK blocks
+		opts := []byte{TCP_OPT_NOP, TCP_OPT_NOP, TCP_OPT_SACK, 10, 0, 0, 0, 0, 0, 0, 0, 0}
+		binary.BigEndian.PutUint32(opts[4:], 1000+n+d+100)
+		binary.BigEndian.PutUint32(opts[8:], 1000+n+d+200)
+		b = e.downlink(1, newTCPPacket(true, 5000, 1000+n+d, 0x10, opts, nil), now)
+		p = requireChecksums(t, b)
+		sack := p.tcp()[20+4:]
+		assert.Equal(t, 1000+n+100, binary.BigEndian.Uint32(sack[0:]))
+		assert.Equal(t, 1000+n+200, binary.BigEndian.Uint32(sack[4:]))
+	})
+
+	t.Run("second request", func(t *testing.T) {
+		b := e.uplink(1, newTCPPacket(false, 1000+n, 5100, 0x18, nil, []byte(req)), headers, now)
+		p := requireChecksums(t, b)
+		assert.Equal(t, 1000+n+d, p.seq())
+		b = e.downlink(1, newTCPPacket(true, 5100, 1000+2*(n+d), 0x10, nil, nil), now)
+		p = requireChecksums(t, b)
+		assert.Equal(t, 1000+2*n, p.ack())
+	})
+
+	t.Run("other connections are unchanged", func(t *testing.T) {
+		dl := newTCPPacket(true, 5000, 1000, 0x10, nil, nil)
+		assert.Equal(t, dl, e.downlink(2, dl, now))
+		ul := newTCPPacket(false, 1000, 5000, 0x18, nil, []byte("not http"))
+		assert.Equal(t, ul, e.uplink(2, ul, headers, now))
+	})
+
+	t.Run("reset", func(t *testing.T) {
+		e.downlink(1, newTCPPacket(true, 5200, 0, TCP_FLAG_RST, nil, nil), now)
+		assert.Empty(t, e.flows)
+	})
+}
+
+func TestFARStateUserspace(t *testing.T) {
+	far := &farState{action: report.APPLY_ACT_FORW, access: true}
+	assert.False(t, far.userspace())
+
+	far = &farState{
+		action:  report.APPLY_ACT_FORW,
+		headers: []HeaderEnrichment{{Name: "X-IMSI", Value: "001010000000001"}},
+	}
+	assert.False(t, far.userspace())
+
+	far.redirect = &Redirect{}
+	assert.True(t, far.userspace())
+	far.action = report.APPLY_ACT_BUFF | report.APPLY_ACT_NOCP
+	assert.False(t, far.userspace())
+
+	attrs := []nl.Attr{{Type: gtp5gnl.FAR_APPLY_ACTION, Value: nl.AttrU16(report.APPLY_ACT_FORW)}}
+	act := report.ApplyAction{Flags: report.APPLY_ACT_FORW}
+	setUserspaceAction(attrs, &act, &Redirect{})
+	v, _ := farAttrAction(attrs)
+	assert.Equal(t, userspaceAction(act.Flags), v)
+}
+
+func TestHERules(t *testing.T) {
+	g := &Gtp5g{
+		log:   logger.FwderLog,
+		dupls: make(map[duplKey]*duplFAR),
+		fars:  make(map[duplKey]*farState),
+	}
+	headers := []HeaderEnrichment{{Name: "X-IMSI", Value: "001010000000001"}}
+
+	t.Run("FARs of the HTTP traffic", func(t *testing.T) {
+		g.fars[duplKey{1, 1}] = &farState{action: report.APPLY_ACT_FORW}
+		g.fars[duplKey{1, 2}] = &farState{action: report.APPLY_ACT_FORW, access: true}
+		g.fars[duplKey{2, 2}] = &farState{action: report.APPLY_ACT_FORW, access: true}
+		assert.Empty(t, g.heFARs(1))
+
+		g.fars[duplKey{1, 1}].headers = headers
+		assert.ElementsMatch(t, []heFAR{{farid: 1}, {farid: 2, dl: true}}, g.heFARs(1))
+		assert.Empty(t, g.heFARs(2))
+
+		// the buffered downlink is not punted
+		g.fars[duplKey{1, 2}].action = report.APPLY_ACT_BUFF
+		assert.Equal(t, []heFAR{{farid: 1}}, g.heFARs(1))
+	})
+
+	t.Run("uplink PDR", func(t *testing.T) {
+		access, prec, ohr := uint8(ie.SrcInterfaceAccess), uint32(255), uint8(0)
+		farid := uint32(1)
+		attrs, err := g.hePDRAttrs(&gtp5gnl.PDR{
+			ID:         1,
+			Precedence: &prec,
+			PDI: &gtp5gnl.PDI{
+				SrcIntf: &access,
+				UEAddr:  net.IPv4(10, 60, 0, 1),
+				FTEID:   &gtp5gnl.FTEID{TEID: 0x11, GTPuAddr: net.IPv4(10, 100, 0, 1)},
+			},
+			OuterHdrRemoval: &ohr,
+			FARID:           &farid,
+			QERID:           []uint32{1},
+			URRID:           []uint32{1, 2},
+		}, 1|HE_FAR_ID)
+		require.NoError(t, err)
+		assert.Equal(t, nl.AttrU16(1|HE_PDR_ID), attrs[0].Value)
+		assert.Equal(t, nl.AttrU32(254), findAttr(attrs, gtp5gnl.PDR_PRECEDENCE).Value)
+		assert.Equal(t, nl.AttrU32(1|HE_FAR_ID), findAttr(attrs, gtp5gnl.PDR_FAR_ID).Value)
+		assert.NotNil(t, findAttr(attrs, gtp5gnl.PDR_OUTER_HEADER_REMOVAL))
+
+		pdi := findAttr(attrs, gtp5gnl.PDR_PDI).Value.(nl.AttrList)
+		assert.NotNil(t, findAttr(pdi, gtp5gnl.PDI_F_TEID))
+		assert.NotNil(t, findAttr(pdi, gtp5gnl.PDI_UE_ADDR_IPV4))
+		sdf := findAttr(pdi, gtp5gnl.PDI_SDF_FILTER).Value.(nl.AttrList)
+		fd := findAttr(sdf, gtp5gnl.SDF_FILTER_FLOW_DESCRIPTION).Value.(nl.AttrList)
+		// from the UE to the HTTP port
+		assert.Equal(t, nl.AttrU8(IP_PROTO_TCP), findAttr(fd, gtp5gnl.FLOW_DESCRIPTION_PROTOCOL).Value)
+		assert.Equal(t, nl.AttrBytes(net.IPv4(10, 60, 0, 1).To4()),
+			findAttr(fd, gtp5gnl.FLOW_DESCRIPTION_SRC_IPV4).Value)
+		assert.NotEmpty(t, findAttr(fd, gtp5gnl.FLOW_DESCRIPTION_DEST_PORT).Value)
+		assert.Empty(t, findAttr(fd, gtp5gnl.FLOW_DESCRIPTION_SRC_PORT).Value)
+	})
+
+	t.Run("PDR with packet filters", func(t *testing.T) {
+		access := uint8(ie.SrcInterfaceAccess)
+		_, err := g.hePDRAttrs(&gtp5gnl.PDR{
+			ID:  1,
+			PDI: &gtp5gnl.PDI{SrcIntf: &access, SDF: &gtp5gnl.SDFFilter{}},
+		}, 1|HE_FAR_ID)
+		assert.Error(t, err)
+	})
+
+	t.Run("copy of the FAR", func(t *testing.T) {
+		attrs := heFARAttrs(&gtp5gnl.FAR{
+			ID:     2,
+			Action: report.APPLY_ACT_FORW,
+			Param: &gtp5gnl.ForwardParam{
+				Creation: &gtp5gnl.HeaderCreation{Desc: 0x0100, TEID: 0x22, PeerAddr: net.IPv4(10, 100, 0, 2), Port: 2152},
+				TosTc:    0xb8,
+			},
+		})
+		assert.Equal(t, nl.AttrU32(2|HE_FAR_ID), findAttr(attrs, gtp5gnl.FAR_ID).Value)
+		v, _ := farAttrAction(attrs)
+		assert.Equal(t, userspaceAction(report.APPLY_ACT_FORW), v)
+		param := findAttr(attrs, gtp5gnl.FAR_FORWARDING_PARAMETER).Value.(nl.AttrList)
+		assert.Equal(t, nl.AttrU8(0xb8), findAttr(param, gtp5gnl.FORWARDING_PARAMETER_TOS_TC).Value)
+		hc := findAttr(param, gtp5gnl.FORWARDING_PARAMETER_OUTER_HEADER_CREATION).Value.(nl.AttrList)
+		assert.Equal(t, nl.AttrU32(0x22), findAttr(hc, gtp5gnl.OUTER_HEADER_CREATION_O_TEID).Value)
+	})
+
+	t.Run("shadowed rules", func(t *testing.T) {
+		pdrid, farid := heShadowed(1|HE_PDR_ID, 2|HE_FAR_ID)
+		assert.Equal(t, uint16(1), pdrid)
+		assert.Equal(t, uint32(2), farid)
+		pdrid, farid = heShadowed(0x8001, 2)
+		assert.Equal(t, uint16(0x8001), pdrid)
+		assert.Equal(t, uint32(2), farid)
+	})
+}
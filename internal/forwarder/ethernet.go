@@ -0,0 +1,598 @@
+package forwarder
+
+import (
+	"encoding/binary"
+	"net"
+	"slices"
+	"sync"
+	"syscall"
+	"time"
+	"unsafe"
+
+	"github.com/khirono/go-nl"
+	"github.com/pkg/errors"
+	"github.com/sirupsen/logrus"
+	"github.com/wmnsk/go-pfcp/ie"
+
+	"github.com/free5gc/go-gtp5gnl"
+	"github.com/free5gc/go-upf/internal/gtpv1"
+	"github.com/free5gc/go-upf/internal/report"
+	"github.com/free5gc/go-upf/pkg/factory"
+	"github.com/free5gc/util/pfcp"
+)
+
+const (
+	// MAC_TAP_SNAPLEN covers the IPv4, UDP and GTP-U headers with extension
+	// headers, and the Ethernet header of the frame
+	MAC_TAP_SNAPLEN      = 128
+	MAC_TAP_READ_TIMEOUT = 500 * time.Millisecond
+	// MAC_REFRESH_INTERVAL is the interval a MAC address still in use is
+	// notified again, for the Ethernet Inactivity Timer of the URRs
+	MAC_REFRESH_INTERVAL = time.Second
+)
+
+// Outer Header Removal Description
+const (
+	OHR_DESC_GTPU_UDP_IPV4 uint8 = 0
+	OHR_DESC_GTPU_UDP_IP   uint8 = 6
+	OHR_DESC_STAG          uint8 = 7
+	OHR_DESC_STAG_CTAG     uint8 = 8
+)
+
+// Outer Header Creation Description
+const (
+	OHC_DESC_CTAG uint16 = 0x4000
+	OHC_DESC_STAG uint16 = 0x8000
+)
+
+// checkOuterHeaderCreation checks the Outer Header Creation of Forwarding
+// Parameters does not add VLAN tags, which the kernel module cannot add
+func checkOuterHeaderCreation(ies []*ie.IE) error {
+	for _, x := range ies {
+		if x.Type != ie.OuterHeaderCreation {
+			continue
+		}
+		v, err := pfcp.ParseOuterHeaderCreation(x.Payload)
+		if err != nil {
+			// tolerated by newForwardingParameter
+			continue
+		}
+		if v.OuterHeaderCreationDescription&(OHC_DESC_CTAG|OHC_DESC_STAG) != 0 {
+			return errors.New("C-TAG/S-TAG of Outer Header Creation not supported")
+		}
+	}
+	return nil
+}
+
+// kernelOuterHeaderRemoval returns the Outer Header Removal of a PDR in the
+// kernel module. The GTP-U/UDP/IP removal of the Ethernet PDU sessions is
+// the GTP-U/UDP/IPv4 removal since the F-TEIDs are IPv4; the kernel module
+// cannot remove VLAN tags.
+func kernelOuterHeaderRemoval(desc uint8) (uint8, error) {
+	switch desc {
+	case OHR_DESC_GTPU_UDP_IP:
+		return OHR_DESC_GTPU_UDP_IPV4, nil
+	case OHR_DESC_STAG, OHR_DESC_STAG_CTAG:
+		return 0, errors.Errorf("Outer Header Removal of VLAN tags(%d) not supported", desc)
+	}
+	return desc, nil
+}
+
+func (g *Gtp5g) newEthPktFilter(i *ie.IE, srcIf uint8) (nl.AttrList, error) {
+	var attrs nl.AttrList
+
+	ies, err := i.EthernetPacketFilter()
+	if err != nil {
+		return nil, err
+	}
+
+	for _, x := range ies {
+		switch x.Type {
+		case ie.EthernetFilterID:
+			v, err := x.EthernetFilterID()
+			if err != nil {
+				return nil, errors.Wrap(err, "Ethernet Filter ID")
+			}
+			attrs = append(attrs, nl.Attr{
+				Type:  gtp5gnl.EPF_FILTER_ETHERNET_FILTER_ID,
+				Value: nl.AttrU32(v),
+			})
+		case ie.EthernetFilterProperties:
+			v, err := x.EthernetFilterProperties()
+			if err != nil {
+				return nil, errors.Wrap(err, "Ethernet Filter Properties")
+			}
+			attrs = append(attrs, nl.Attr{
+				Type:  gtp5gnl.EPF_FILTER_ETHERNET_FILTER_PROPERTIES,
+				Value: nl.AttrU8(v),
+			})
+		case ie.MACAddress:
+			v, err := parseMACAddress(x.Payload)
+			if err != nil {
+				return nil, errors.Wrap(err, "MAC Address")
+			}
+			var macs nl.AttrList
+			if v.HasSOUR() {
+				macs = append(macs, nl.Attr{
+					Type:  gtp5gnl.MACADDRESS_SRC,
+					Value: nl.AttrBytes(v.SourceMACAddress),
+				})
+			}
+			if v.HasDEST() {
+				macs = append(macs, nl.Attr{
+					Type:  gtp5gnl.MACADDRESS_DST,
+					Value: nl.AttrBytes(v.DestinationMACAddress),
+				})
+			}
+			if v.HasUSOU() {
+				macs = append(macs, nl.Attr{
+					Type:  gtp5gnl.MACADDRESS_UPPER_SRC,
+					Value: nl.AttrBytes(v.UpperSourceMACAddress),
+				})
+			}
+			if v.HasUDES() {
+				macs = append(macs, nl.Attr{
+					Type:  gtp5gnl.MACADDRESS_UPPER_DST,
+					Value: nl.AttrBytes(v.UpperDestinationMACAddress),
+				})
+			}
+			attrs = append(attrs, nl.Attr{
+				Type:  gtp5gnl.EPF_FILTER_MACADDRESS,
+				Value: macs,
+			})
+		case ie.Ethertype:
+			v, err := x.Ethertype()
+			if err != nil {
+				return nil, errors.Wrap(err, "Ethertype")
+			}
+			attrs = append(attrs, nl.Attr{
+				Type:  gtp5gnl.EPF_FILTER_ETHERTYPE,
+				Value: nl.AttrU16(v),
+			})
+		case ie.CTAG:
+			// the kernel takes the C-TAG/S-TAG in their PFCP encoding
+			if _, err := x.CTAG(); err != nil {
+				return nil, errors.Wrap(err, "C-TAG")
+			}
+			attrs = append(attrs, nl.Attr{
+				Type:  gtp5gnl.EPF_FILTER_CTAG,
+				Value: nl.AttrBytes(x.Payload),
+			})
+		case ie.STAG:
+			if _, err := x.STAG(); err != nil {
+				return nil, errors.Wrap(err, "S-TAG")
+			}
+			attrs = append(attrs, nl.Attr{
+				Type:  gtp5gnl.EPF_FILTER_STAG,
+				Value: nl.AttrBytes(x.Payload),
+			})
+		case ie.SDFFilter:
+			if len(x.Payload) < 3 {
+				return nil, errors.Errorf("SDF Filter IE payload too short: %d bytes (minimum 3)", len(x.Payload))
+			}
+			v, err := g.newSdfFilter(x, srcIf)
+			if err != nil {
+				return nil, errors.Wrap(err, "newSdfFilter failed")
+			}
+			attrs = append(attrs, nl.Attr{
+				Type:  gtp5gnl.EPF_FILTER_SDF_FILTER,
+				Value: v,
+			})
+		}
+	}
+
+	return attrs, nil
+}
+
+// parseMACAddress parses a MAC Address IE; go-pfcp leaves its addresses
+// empty
+func parseMACAddress(b []byte) (*ie.MACAddressFields, error) {
+	if len(b) < 1 {
+		return nil, errors.New("empty MAC Address")
+	}
+	f := &ie.MACAddressFields{Flags: b[0]}
+	off := 1
+	for _, p := range []struct {
+		has  bool
+		addr *net.HardwareAddr
+	}{
+		{f.HasSOUR(), &f.SourceMACAddress},
+		{f.HasDEST(), &f.DestinationMACAddress},
+		{f.HasUSOU(), &f.UpperSourceMACAddress},
+		{f.HasUDES(), &f.UpperDestinationMACAddress},
+	} {
+		if !p.has {
+			continue
+		}
+		if len(b) < off+6 {
+			return nil, errors.Errorf("MAC Address too short: %d bytes", len(b))
+		}
+		*p.addr = net.HardwareAddr(b[off : off+6])
+		off += 6
+	}
+	return f, nil
+}
+
+// ethernetPdi reports whether the PDI identifies the frames of an Ethernet
+// PDU session
+func ethernetPdi(ies []*ie.IE) bool {
+	for _, x := range ies {
+		switch x.Type {
+		case ie.EthernetPDUSessionInformation:
+			if x.HasETHI() {
+				return true
+			}
+		case ie.EthernetPacketFilter:
+			return true
+		}
+	}
+	return false
+}
+
+// ulTEID returns the TEID of the F-TEID of a PDI receiving the uplink from
+// the access side
+func ulTEID(ies []*ie.IE) *uint32 {
+	var teid *uint32
+	var access bool
+	for _, x := range ies {
+		switch x.Type {
+		case ie.SourceInterface:
+			v, err := x.SourceInterface()
+			if err != nil {
+				return nil
+			}
+			access = v == ie.SrcInterfaceAccess
+		case ie.FTEID:
+			v, err := x.FTEID()
+			if err != nil || v.IPv4Address == nil {
+				return nil
+			}
+			teid = &v.TEID
+		}
+	}
+	if !access {
+		return nil
+	}
+	return teid
+}
+
+// macKey identifies the uplink tunnel of a PDR by its F-TEID
+type macKey struct {
+	addr [4]byte
+	teid uint32
+}
+
+func newMacKey(addr net.IP, teid uint32) (macKey, bool) {
+	k := macKey{teid: teid}
+	ip := addr.To4()
+	if ip == nil {
+		return k, false
+	}
+	copy(k.addr[:], ip)
+	return k, true
+}
+
+type macPDR struct {
+	lSeid uint64
+	pdrid uint16
+}
+
+// macTap learns the MAC addresses of the UEs of the Ethernet PDU sessions.
+// The kernel module forwards the frames without reporting their addresses,
+// so the uplink GTP-U packets received by the UPF are tapped, only while
+// Ethernet sessions exist, and the source MAC address of their frames is
+// notified for the PDR of their tunnel.
+type macTap struct {
+	wg     *sync.WaitGroup
+	log    *logrus.Entry
+	notify func(lSeid uint64, pdrid uint16, mac net.HardwareAddr)
+
+	mu    sync.Mutex
+	ports []uint16 // GTP-U ports of the links
+	pdrs  map[macKey]macPDR
+	eth   map[uint64]struct{} // key: lSeid of the Ethernet sessions
+	seen  map[macPDR]map[string]time.Time
+	done  chan struct{} // non-nil while the tap is open
+}
+
+func newMacTap(
+	wg *sync.WaitGroup,
+	log *logrus.Entry,
+	notify func(lSeid uint64, pdrid uint16, mac net.HardwareAddr),
+) *macTap {
+	return &macTap{
+		wg:     wg,
+		log:    log,
+		notify: notify,
+		ports:  []uint16{factory.UpfGtpDefaultPort},
+		pdrs:   make(map[macKey]macPDR),
+		eth:    make(map[uint64]struct{}),
+		seen:   make(map[macPDR]map[string]time.Time),
+	}
+}
+
+// apply follows the uplink tunnels of the PDRs of an executed plan
+func (t *macTap) apply(plan *ModificationPlan) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	if plan.Release {
+		t.delSess(plan.SEID)
+		t.update()
+		return
+	}
+	for _, p := range plan.RemovePDRs {
+		t.delPDR(macPDR{lSeid: plan.SEID, pdrid: p.PDRID})
+	}
+	for _, ps := range [][]*PDRPlan{plan.CreatePDRs, plan.UpdatePDRs} {
+		for _, p := range ps {
+			if p.Ethernet {
+				t.eth[plan.SEID] = struct{}{}
+			}
+			if p.ULTEID == nil {
+				continue
+			}
+			k, ok := newMacKey(p.FTEIDAddr, *p.ULTEID)
+			if !ok {
+				continue
+			}
+			pdr := macPDR{lSeid: plan.SEID, pdrid: p.PDRID}
+			t.delPDR(pdr)
+			t.pdrs[k] = pdr
+		}
+	}
+	t.update()
+}
+
+func (t *macTap) delPDR(pdr macPDR) {
+	for k, v := range t.pdrs {
+		if v == pdr {
+			delete(t.pdrs, k)
+		}
+	}
+	delete(t.seen, pdr)
+}
+
+func (t *macTap) delSess(lSeid uint64) {
+	for k, v := range t.pdrs {
+		if v.lSeid == lSeid {
+			delete(t.pdrs, k)
+			delete(t.seen, v)
+		}
+	}
+	delete(t.eth, lSeid)
+}
+
+// update opens the tap while Ethernet sessions exist, and closes it after
+func (t *macTap) update() {
+	if len(t.eth) == 0 {
+		t.stop()
+		return
+	}
+	if t.done != nil {
+		return
+	}
+	fd, err := openGTPUTapSocket(t.ports)
+	if err != nil {
+		t.log.Errorf("open MAC tap err: %+v", err)
+		return
+	}
+	t.log.Infoln("MAC tap opened")
+	done := make(chan struct{})
+	t.done = done
+	t.wg.Add(1)
+	go func(ports []uint16) {
+		defer t.wg.Done()
+		t.run(fd, done, ports)
+	}(t.ports)
+}
+
+// setPorts sets the GTP-U ports tapped from the next opening
+func (t *macTap) setPorts(ports []uint16) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	t.ports = ports
+}
+
+func (t *macTap) stop() {
+	if t.done == nil {
+		return
+	}
+	close(t.done)
+	t.done = nil
+	t.log.Infoln("MAC tap closed")
+}
+
+func (t *macTap) Close() {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	t.stop()
+}
+
+func (t *macTap) run(fd int, done chan struct{}, ports []uint16) {
+	defer func() {
+		err := syscall.Close(fd)
+		if err != nil {
+			t.log.Warnf("MAC tap close err: %+v", err)
+		}
+	}()
+
+	b := make([]byte, MAC_TAP_SNAPLEN)
+	for {
+		select {
+		case <-done:
+			return
+		default:
+		}
+		n, from, err := syscall.Recvfrom(fd, b, 0)
+		if err != nil {
+			if errors.Is(err, syscall.EAGAIN) || errors.Is(err, syscall.EINTR) {
+				continue
+			}
+			t.log.Errorf("MAC tap read err: %+v", err)
+			return
+		}
+		if ll, ok := from.(*syscall.SockaddrLinklayer); ok && ll.Pkttype == syscall.PACKET_OUTGOING {
+			continue
+		}
+		k, mac, ok := parseULFrame(b[:n], ports)
+		if !ok {
+			continue
+		}
+		t.learn(k, mac, time.Now())
+	}
+}
+
+// learn notifies the MAC address seen in the uplink of a tunnel, once per
+// MAC_REFRESH_INTERVAL
+func (t *macTap) learn(k macKey, mac net.HardwareAddr, now time.Time) {
+	t.mu.Lock()
+	pdr, ok := t.pdrs[k]
+	if !ok {
+		t.mu.Unlock()
+		return
+	}
+	if _, ok = t.eth[pdr.lSeid]; !ok {
+		t.mu.Unlock()
+		return
+	}
+	macs, ok := t.seen[pdr]
+	if !ok {
+		macs = make(map[string]time.Time)
+		t.seen[pdr] = macs
+	}
+	if last, ok := macs[string(mac)]; ok && now.Sub(last) < MAC_REFRESH_INTERVAL {
+		t.mu.Unlock()
+		return
+	}
+	macs[string(mac)] = now
+	t.mu.Unlock()
+
+	t.notify(pdr.lSeid, pdr.pdrid, mac)
+}
+
+// parseULFrame returns the tunnel and the source MAC address of the frame
+// carried by a GTP-U packet to one of the ports in an IPv4 packet
+func parseULFrame(b []byte, ports []uint16) (macKey, net.HardwareAddr, bool) {
+	var k macKey
+	if len(b) < 20 || b[0]>>4 != 4 || b[9] != syscall.IPPROTO_UDP {
+		return k, nil, false
+	}
+	copy(k.addr[:], b[16:20])
+	off := int(b[0]&0x0f) * 4
+	if len(b) < off+8 || !slices.Contains(ports, binary.BigEndian.Uint16(b[off+2:])) {
+		return k, nil, false
+	}
+	off += 8
+
+	// GTP-U header
+	if len(b) < off+8 || b[off+1] != gtpv1.MsgTypeTPDU {
+		return k, nil, false
+	}
+	flags := b[off]
+	k.teid = binary.BigEndian.Uint32(b[off+4:])
+	off += 8
+	if flags&0x07 != 0 {
+		if len(b) < off+4 {
+			return k, nil, false
+		}
+		next := b[off+3]
+		off += 4
+		if flags&0x04 != 0 {
+			for next != 0 {
+				if len(b) < off+1 || b[off] == 0 {
+					return k, nil, false
+				}
+				l := int(b[off]) * 4
+				if len(b) < off+l {
+					return k, nil, false
+				}
+				next = b[off+l-1]
+				off += l
+			}
+		}
+	}
+
+	// Ethernet header: destination, source
+	if len(b) < off+12 {
+		return k, nil, false
+	}
+	mac := net.HardwareAddr(b[off+6 : off+12])
+	if mac[0]&0x01 != 0 {
+		// not the address of a station
+		return k, nil, false
+	}
+	return k, append(net.HardwareAddr(nil), mac...), true
+}
+
+// openGTPUTapSocket opens a packet socket receiving the GTP-U packets
+func openGTPUTapSocket(ports []uint16) (int, error) {
+	fd, err := syscall.Socket(syscall.AF_PACKET, syscall.SOCK_DGRAM, int(htons(syscall.ETH_P_IP)))
+	if err != nil {
+		return -1, errors.Wrap(err, "socket")
+	}
+	err = syscall.AttachLsf(fd, gtpuTapFilter(ports))
+	if err != nil {
+		syscall.Close(fd)
+		return -1, errors.Wrap(err, "attach filter")
+	}
+	tv := syscall.NsecToTimeval(MAC_TAP_READ_TIMEOUT.Nanoseconds())
+	err = syscall.SetsockoptTimeval(fd, syscall.SOL_SOCKET, syscall.SO_RCVTIMEO, &tv)
+	if err != nil {
+		syscall.Close(fd)
+		return -1, errors.Wrap(err, "set read timeout")
+	}
+	return fd, nil
+}
+
+// gtpuTapFilter returns the filter of the UDP packets to one of the ports
+// which are not fragments, truncated to MAC_TAP_SNAPLEN
+func gtpuTapFilter(ports []uint16) []syscall.SockFilter {
+	n := uint8(len(ports))
+	filter := []syscall.SockFilter{
+		{Code: syscall.BPF_LD | syscall.BPF_B | syscall.BPF_ABS, K: 9},
+		{Code: syscall.BPF_JMP | syscall.BPF_JEQ | syscall.BPF_K, Jt: 0, Jf: 5 + n, K: syscall.IPPROTO_UDP},
+		{Code: syscall.BPF_LD | syscall.BPF_H | syscall.BPF_ABS, K: 6},
+		{Code: syscall.BPF_JMP | syscall.BPF_JSET | syscall.BPF_K, Jt: 3 + n, Jf: 0, K: 0x1fff},
+		{Code: syscall.BPF_LDX | syscall.BPF_B | syscall.BPF_MSH, K: 0},
+		{Code: syscall.BPF_LD | syscall.BPF_H | syscall.BPF_IND, K: 2},
+	}
+	for i, port := range ports {
+		// to the accepting return, or else to the next port
+		jf := uint8(0)
+		if i == len(ports)-1 {
+			jf = 1
+		}
+		filter = append(filter, syscall.SockFilter{
+			Code: syscall.BPF_JMP | syscall.BPF_JEQ | syscall.BPF_K,
+			Jt:   n - 1 - uint8(i),
+			Jf:   jf,
+			K:    uint32(port),
+		})
+	}
+	return append(filter,
+		syscall.SockFilter{Code: syscall.BPF_RET | syscall.BPF_K, K: MAC_TAP_SNAPLEN},
+		syscall.SockFilter{Code: syscall.BPF_RET | syscall.BPF_K, K: 0},
+	)
+}
+
+func htons(v uint16) uint16 {
+	b := (*[2]byte)(unsafe.Pointer(&v))
+	return binary.BigEndian.Uint16(b[:])
+}
+
+// notifyMAC notifies the handler of a MAC address learnt on a PDR
+func (g *Gtp5g) notifyMAC(lSeid uint64, pdrid uint16, mac net.HardwareAddr) {
+	if g.handler == nil {
+		return
+	}
+	g.handler.NotifySessReport(report.SessReport{
+		SEID: lSeid,
+		Reports: []report.Report{
+			report.MACReport{
+				PDRID: pdrid,
+				MACs:  []net.HardwareAddr{mac},
+			},
+		},
+	})
+}
@@ -0,0 +1,254 @@
+package forwarder
+
+import (
+	"encoding/binary"
+	"net"
+	"syscall"
+	"testing"
+	"time"
+
+	"github.com/khirono/go-nl"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"github.com/wmnsk/go-pfcp/ie"
+
+	"github.com/free5gc/go-gtp5gnl"
+	"github.com/free5gc/go-upf/internal/logger"
+	"github.com/free5gc/go-upf/pkg/factory"
+)
+
+var gtpuPorts = []uint16{factory.UpfGtpDefaultPort}
+
+func TestEthernetPDR(t *testing.T) {
+	g := &Gtp5g{log: logger.FwderLog}
+	ue := net.HardwareAddr{0x02, 0x00, 0x00, 0x00, 0x00, 0x01}
+
+	t.Run("uplink with Ethernet Packet Filter", func(t *testing.T) {
+		p, err := g.BuildCreatePDRPlan(1, ie.NewCreatePDR(
+			ie.NewPDRID(1),
+			ie.NewPDI(
+				ie.NewSourceInterface(ie.SrcInterfaceAccess),
+				ie.NewFTEID(0x01, 0x11, net.IPv4(10, 100, 0, 1), nil, 0),
+				ie.NewEthernetPacketFilter(
+					ie.NewEthernetFilterID(7),
+					ie.NewMACAddress(ue, nil, nil, nil),
+					ie.NewEthertype(0x0800),
+					ie.NewCTAG(0x04, 0, 0, 100),
+				),
+			),
+			ie.NewOuterHeaderRemoval(OHR_DESC_GTPU_UDP_IP, 0),
+			ie.NewFARID(1),
+		))
+		require.NoError(t, err)
+		assert.True(t, p.Ethernet)
+		require.NotNil(t, p.ULTEID)
+		assert.Equal(t, uint32(0x11), *p.ULTEID)
+
+		epf := findAttr(pdiAttrs(t, p), gtp5gnl.PDI_ETHERNET_PACKET_FILTER)
+		require.NotNil(t, epf)
+		epfAttrs := epf.Value.(nl.AttrList)
+		assert.Equal(t, nl.AttrU32(7), findAttr(epfAttrs, gtp5gnl.EPF_FILTER_ETHERNET_FILTER_ID).Value)
+		assert.Equal(t, nl.AttrU16(0x0800), findAttr(epfAttrs, gtp5gnl.EPF_FILTER_ETHERTYPE).Value)
+		assert.NotNil(t, findAttr(epfAttrs, gtp5gnl.EPF_FILTER_CTAG))
+		macs := findAttr(epfAttrs, gtp5gnl.EPF_FILTER_MACADDRESS)
+		require.NotNil(t, macs)
+		src := findAttr(macs.Value.(nl.AttrList), gtp5gnl.MACADDRESS_SRC)
+		require.NotNil(t, src)
+		assert.Equal(t, nl.AttrBytes(ue), src.Value)
+		assert.Nil(t, findAttr(macs.Value.(nl.AttrList), gtp5gnl.MACADDRESS_DST))
+
+		// the GTP-U/UDP/IP removal is an IPv4 one in the kernel
+		ohr := findAttr(p.Attrs, gtp5gnl.PDR_OUTER_HEADER_REMOVAL)
+		require.NotNil(t, ohr)
+		assert.Equal(t, nl.AttrU8(OHR_DESC_GTPU_UDP_IPV4), ohr.Value)
+	})
+
+	t.Run("downlink with Ethernet PDU Session Information", func(t *testing.T) {
+		p, err := g.BuildCreatePDRPlan(1, ie.NewCreatePDR(
+			ie.NewPDRID(2),
+			ie.NewPDI(
+				ie.NewSourceInterface(ie.SrcInterfaceCore),
+				ie.NewEthernetPDUSessionInformation(0x01),
+			),
+			ie.NewFARID(2),
+		))
+		require.NoError(t, err)
+		assert.True(t, p.Ethernet)
+		assert.Nil(t, p.ULTEID)
+	})
+
+	t.Run("VLAN tags", func(t *testing.T) {
+		_, err := g.BuildCreatePDRPlan(1, ie.NewCreatePDR(
+			ie.NewPDRID(3),
+			ie.NewOuterHeaderRemoval(OHR_DESC_STAG, 0),
+		))
+		assert.Error(t, err)
+
+		payload := []byte{0x41, 0x00, 0, 0, 0, 0x22, 10, 100, 0, 2, 0x04, 0, 100}
+		_, err = g.BuildCreateFARPlan(1, ie.NewCreateFAR(
+			ie.NewFARID(3),
+			ie.NewApplyAction(0x02),
+			ie.NewForwardingParameters(
+				ie.NewDestinationInterface(ie.DstInterfaceAccess),
+				ie.New(ie.OuterHeaderCreation, payload),
+			),
+		))
+		assert.Error(t, err)
+
+		// a malformed Outer Header Creation is still ignored
+		_, err = g.BuildCreateFARPlan(1, ie.NewCreateFAR(
+			ie.NewFARID(4),
+			ie.NewApplyAction(0x02),
+			ie.NewForwardingParameters(
+				ie.NewDestinationInterface(ie.DstInterfaceAccess),
+				ie.New(ie.OuterHeaderCreation, []byte{0x41}),
+			),
+		))
+		assert.NoError(t, err)
+	})
+}
+
+// newULFrame returns an IPv4 GTP-U packet carrying a frame from src
+func newULFrame(dst net.IP, teid uint32, ext bool, src net.HardwareAddr) []byte {
+	var gtp []byte
+	if ext {
+		// PDU Session Container
+		gtp = []byte{0x34, 0xff, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0x85, 1, 0x10, 0x01, 0}
+	} else {
+		gtp = []byte{0x30, 0xff, 0, 0, 0, 0, 0, 0}
+	}
+	binary.BigEndian.PutUint32(gtp[4:], teid)
+	eth := make([]byte, 14)
+	copy(eth[0:6], net.HardwareAddr{0xff, 0xff, 0xff, 0xff, 0xff, 0xff})
+	copy(eth[6:12], src)
+	binary.BigEndian.PutUint16(eth[12:], 0x0806)
+
+	b := []byte{0x45, 0, 0, 0, 0, 0, 0x40, 0, 64, 17, 0, 0, 10, 100, 0, 2}
+	b = append(b, dst.To4()...)
+	b = append(b, 0x08, 0x68, 0x08, 0x68, 0, 0, 0, 0)
+	b = append(b, gtp...)
+	return append(b, eth...)
+}
+
+func TestParseULFrame(t *testing.T) {
+	ue := net.HardwareAddr{0x02, 0x00, 0x00, 0x00, 0x00, 0x01}
+	addr := net.IPv4(10, 100, 0, 1)
+	want, ok := newMacKey(addr, 0x11)
+	require.True(t, ok)
+
+	for _, ext := range []bool{false, true} {
+		k, mac, ok := parseULFrame(newULFrame(addr, 0x11, ext, ue), gtpuPorts)
+		require.True(t, ok)
+		assert.Equal(t, want, k)
+		assert.Equal(t, ue, mac)
+	}
+
+	// a multicast source is not a station
+	_, _, ok = parseULFrame(newULFrame(addr, 0x11, false, net.HardwareAddr{0x01, 0, 0x5e, 0, 0, 1}), gtpuPorts)
+	assert.False(t, ok)
+
+	// truncated before the frame
+	b := newULFrame(addr, 0x11, true, ue)
+	_, _, ok = parseULFrame(b[:len(b)-10], gtpuPorts)
+	assert.False(t, ok)
+
+	// to a port of no link
+	_, _, ok = parseULFrame(newULFrame(addr, 0x11, false, ue), []uint16{2153})
+	assert.False(t, ok)
+}
+
+// runTapFilter runs the instructions of a GTP-U tap filter on a packet
+func runTapFilter(t *testing.T, filter []syscall.SockFilter, b []byte) uint32 {
+	var a, x uint32
+	for pc := 0; pc < len(filter); pc++ {
+		f := filter[pc]
+		switch f.Code {
+		case syscall.BPF_LD | syscall.BPF_B | syscall.BPF_ABS:
+			a = uint32(b[f.K])
+		case syscall.BPF_LD | syscall.BPF_H | syscall.BPF_ABS:
+			a = uint32(binary.BigEndian.Uint16(b[f.K:]))
+		case syscall.BPF_LD | syscall.BPF_H | syscall.BPF_IND:
+			a = uint32(binary.BigEndian.Uint16(b[x+f.K:]))
+		case syscall.BPF_LDX | syscall.BPF_B | syscall.BPF_MSH:
+			x = uint32(b[f.K]&0x0f) * 4
+		case syscall.BPF_JMP | syscall.BPF_JEQ | syscall.BPF_K:
+			if a == f.K {
+				pc += int(f.Jt)
+			} else {
+				pc += int(f.Jf)
+			}
+		case syscall.BPF_JMP | syscall.BPF_JSET | syscall.BPF_K:
+			if a&f.K != 0 {
+				pc += int(f.Jt)
+			} else {
+				pc += int(f.Jf)
+			}
+		case syscall.BPF_RET | syscall.BPF_K:
+			return f.K
+		default:
+			t.Fatalf("unexpected instruction %#x", f.Code)
+		}
+	}
+	t.Fatal("no return")
+	return 0
+}
+
+func TestGTPUTapFilter(t *testing.T) {
+	toPort := func(port uint16) []byte {
+		b := newULFrame(net.IPv4(10, 100, 0, 1), 0x11, false, net.HardwareAddr{2, 0, 0, 0, 0, 1})
+		binary.BigEndian.PutUint16(b[22:], port)
+		return b
+	}
+	for _, ports := range [][]uint16{{2152}, {2152, 2153, 2154}} {
+		filter := gtpuTapFilter(ports)
+		for _, port := range ports {
+			assert.Equal(t, uint32(MAC_TAP_SNAPLEN), runTapFilter(t, filter, toPort(port)), "port %d", port)
+		}
+		assert.Zero(t, runTapFilter(t, filter, toPort(2155)))
+
+		fragment := toPort(ports[0])
+		fragment[7] = 0x10
+		assert.Zero(t, runTapFilter(t, filter, fragment))
+
+		tcp := toPort(ports[0])
+		tcp[9] = syscall.IPPROTO_TCP
+		assert.Zero(t, runTapFilter(t, filter, tcp))
+	}
+}
+
+func TestMacTapLearn(t *testing.T) {
+	type learnt struct {
+		lSeid uint64
+		pdrid uint16
+		mac   string
+	}
+	var got []learnt
+	tap := newMacTap(nil, logger.FwderLog, func(lSeid uint64, pdrid uint16, mac net.HardwareAddr) {
+		got = append(got, learnt{lSeid, pdrid, mac.String()})
+	})
+
+	k, ok := newMacKey(net.IPv4(10, 100, 0, 1), 0x11)
+	require.True(t, ok)
+	tap.pdrs[k] = macPDR{lSeid: 1, pdrid: 1}
+	ue := net.HardwareAddr{0x02, 0x00, 0x00, 0x00, 0x00, 0x01}
+	now := time.Now()
+
+	// not an Ethernet session
+	tap.learn(k, ue, now)
+	assert.Empty(t, got)
+
+	tap.eth[1] = struct{}{}
+	tap.learn(k, ue, now)
+	tap.learn(k, ue, now.Add(MAC_REFRESH_INTERVAL/2))
+	assert.Equal(t, []learnt{{1, 1, ue.String()}}, got)
+
+	// refreshed for the Ethernet Inactivity Timer
+	tap.learn(k, ue, now.Add(MAC_REFRESH_INTERVAL))
+	assert.Len(t, got, 2)
+
+	tap.delSess(1)
+	tap.learn(k, ue, now.Add(2*MAC_REFRESH_INTERVAL))
+	assert.Len(t, got, 2)
+	assert.Empty(t, tap.pdrs)
+	assert.Empty(t, tap.eth)
+}
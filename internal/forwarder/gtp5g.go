@@ -3,13 +3,16 @@ package forwarder
 import (
 	"fmt"
 	"net"
+	"slices"
 	"sync"
+	"sync/atomic"
 	"syscall"
 	"time"
 	"unsafe"
 
 	"github.com/hashicorp/go-version"
 	"github.com/khirono/go-nl"
+	"github.com/khirono/go-rtnlroute"
 	"github.com/pkg/errors"
 	"github.com/sirupsen/logrus"
 	"github.com/wmnsk/go-pfcp/ie"
@@ -35,16 +38,87 @@ type Gtp5g struct {
 	link     *Gtp5gLink
 	conn     *nl.Conn
 	psConn   *nl.Conn
-	client   *gtp5gnl.Client
-	psClient *gtp5gnl.Client
+	client   *client
+	psClient *client
+	clients  []*client // of the PFCP session workers, see sessClient
 	bsnl     *buffnetlink.Server
 	ps       *perio.Server
 	log      *logrus.Entry
+
+	actMu   sync.Mutex
+	lastAct map[uint64]time.Time // key: lSeid
+	actPkts map[uint64]uint64    // key: lSeid, value: packets of the last sample
+	dlDrops map[duplKey]uint64   // DL drops of the kernel PDRs at the last sample
+	stats   pdrStats
+
+	nis       map[string]*netInstance // key: Network Instance
+	niLinks   map[string]*Gtp5gLink   // key: GTP-U address
+	rules     []rule
+	routes    []*rtnlroute.Request
+	sessMu    sync.Mutex
+	sessLinks map[uint64]*Gtp5gLink   // key: lSeid
+	sessNIs   map[uint64]*netInstance // key: lSeid
+
+	handler report.Handler
+	tap     *macTap
+	qmp     *qmpTap
+	duplMu  sync.Mutex
+	dupls   map[duplKey]*duplFAR
+	pdrs    map[duplKey]*pdrState // key: PDR OID
+	fars    map[duplKey]*farState
+	heRules map[uint64]*heRules // key: lSeid
+	enrich  *enricher
+	limit   *rateLimiter
+	duplCh  chan duplPkt
+	// socket of the copies of the duplicated packets, see copySocket
+	copyMu   sync.Mutex
+	copyConn *net.UDPConn
+	// copies dropped for the duplication queue being full
+	duplDropped atomic.Uint64
+	duplDone    chan struct{}
+
+	markMu sync.Mutex
+	marks  map[uint64]*sessMarking // key: lSeid
+	dscp   map[uint8]uint8         // key: QFI
+
+	// GTP-U config of the interfaces and the peers, set before the sessions
+	gtpu *factory.Gtpu
+}
+
+// activityHandler records the user plane activity of the sessions from the
+// reports of the forwarder before passing them to the handler
+type activityHandler struct {
+	report.Handler
+	g *Gtp5g
+}
+
+func (h activityHandler) NotifySessReport(sr report.SessReport) {
+	h.g.markActivity(sr)
+	sr = h.g.interceptDupl(sr)
+	if len(sr.Reports) == 0 {
+		return
+	}
+	h.Handler.NotifySessReport(sr)
 }
 
 func OpenGtp5g(wg *sync.WaitGroup, addr string, mtu uint32) (*Gtp5g, error) {
 	g := &Gtp5g{
-		log: logger.FwderLog.WithField(logger_util.FieldCategory, "Gtp5g"),
+		log:       logger.FwderLog.WithField(logger_util.FieldCategory, "Gtp5g"),
+		lastAct:   make(map[uint64]time.Time),
+		actPkts:   make(map[uint64]uint64),
+		dlDrops:   make(map[duplKey]uint64),
+		stats:     pdrStats{path: PROC_PDR},
+		dupls:     make(map[duplKey]*duplFAR),
+		pdrs:      make(map[duplKey]*pdrState),
+		fars:      make(map[duplKey]*farState),
+		heRules:   make(map[uint64]*heRules),
+		marks:     make(map[uint64]*sessMarking),
+		nis:       make(map[string]*netInstance),
+		niLinks:   make(map[string]*Gtp5gLink),
+		sessLinks: make(map[uint64]*Gtp5gLink),
+		sessNIs:   make(map[uint64]*netInstance),
+		duplCh:    make(chan duplPkt, DUPL_QUEUE_LEN),
+		duplDone:  make(chan struct{}),
 	}
 
 	mux, err := nl.NewMux()
@@ -61,7 +135,7 @@ func OpenGtp5g(wg *sync.WaitGroup, addr string, mtu uint32) (*Gtp5g, error) {
 	}()
 	g.mux = mux
 
-	link, err := OpenGtp5gLink(mux, addr, mtu, g.log)
+	link, err := OpenGtp5gLink(mux, "upfgtp", addr, mtu, g.log)
 	if err != nil {
 		g.Close()
 		return nil, errors.Wrap(err, "open link")
@@ -75,7 +149,7 @@ func OpenGtp5g(wg *sync.WaitGroup, addr string, mtu uint32) (*Gtp5g, error) {
 	}
 	g.conn = conn
 
-	c, err := gtp5gnl.NewClient(conn, mux)
+	c, err := newClient(conn, mux)
 	if err != nil {
 		g.Close()
 		return nil, errors.Wrap(err, "new client")
@@ -89,7 +163,7 @@ func OpenGtp5g(wg *sync.WaitGroup, addr string, mtu uint32) (*Gtp5g, error) {
 	}
 	g.psConn = psConn
 
-	psc, err := gtp5gnl.NewClient(psConn, mux)
+	psc, err := newClient(psConn, mux)
 	if err != nil {
 		g.Close()
 		return nil, errors.Wrap(err, "new ps client")
@@ -102,7 +176,7 @@ func OpenGtp5g(wg *sync.WaitGroup, addr string, mtu uint32) (*Gtp5g, error) {
 		return nil, errors.Wrap(err, "version mismatch")
 	}
 
-	bsnl, err := buffnetlink.OpenServer(wg, c.Client, mux)
+	bsnl, err := buffnetlink.OpenServer(wg, c.c.Client, mux)
 	if err != nil {
 		g.Close()
 		return nil, errors.Wrap(err, "open buff(netlink) server")
@@ -116,6 +190,18 @@ func OpenGtp5g(wg *sync.WaitGroup, addr string, mtu uint32) (*Gtp5g, error) {
 	}
 	g.ps = ps
 
+	g.tap = newMacTap(wg, g.log, g.notifyMAC)
+	g.qmp = newQMPTap(wg, g.log, g.notifyQoSMonitoring)
+	g.setTapPorts()
+	g.enrich = newEnricher(g.log)
+	g.limit = newRateLimiter()
+
+	wg.Add(1)
+	go func() {
+		defer wg.Done()
+		g.serveDupl(g.duplDone)
+	}()
+
 	g.log.Infof("Forwarder started")
 	return g, nil
 }
@@ -124,10 +210,12 @@ func (g *Gtp5g) Close() {
 	if g.conn != nil {
 		g.conn.Close()
 	}
+	g.closeClients()
 	if g.psConn != nil {
 		g.psConn.Close()
 	}
 	if g.link != nil {
+		g.closeNetInstances()
 		g.link.Close()
 	}
 	if g.mux != nil {
@@ -139,11 +227,21 @@ func (g *Gtp5g) Close() {
 	if g.ps != nil {
 		g.ps.Close()
 	}
+	if g.tap != nil {
+		g.tap.Close()
+	}
+	if g.qmp != nil {
+		g.qmp.Close()
+	}
+	if g.duplDone != nil {
+		close(g.duplDone)
+	}
+	g.closeCopySocket()
 }
 
 func (g *Gtp5g) checkVersion() error {
 	// get gtp5g version
-	gtp5gVer, err := gtp5gnl.GetVersion(g.client)
+	gtp5gVer, err := g.client.Version()
 	if err != nil {
 		return err
 	}
@@ -337,7 +435,9 @@ func (g *Gtp5g) newPdi(i *ie.IE) (nl.AttrList, error) {
 	}
 
 	var srcIf uint8
-	var sdfIEs []*ie.IE
+	var sdfIEs, epfIEs []*ie.IE
+	var ueAddr *nl.Attr
+	var tunnel bool
 	for _, x := range ies {
 		switch x.Type {
 		case ie.SourceInterface:
@@ -355,6 +455,7 @@ func (g *Gtp5g) newPdi(i *ie.IE) (nl.AttrList, error) {
 			if err != nil {
 				break
 			}
+			tunnel = true
 			attrs = append(attrs, nl.Attr{
 				Type: gtp5gnl.PDI_F_TEID,
 				Value: nl.AttrList{
@@ -374,10 +475,10 @@ func (g *Gtp5g) newPdi(i *ie.IE) (nl.AttrList, error) {
 			if err != nil {
 				break
 			}
-			attrs = append(attrs, nl.Attr{
+			ueAddr = &nl.Attr{
 				Type:  gtp5gnl.PDI_UE_ADDR_IPV4,
 				Value: nl.AttrBytes(v.IPv4Address),
-			})
+			}
 		case ie.SDFFilter:
 			// Validate SDF Filter IE payload length early (TS 29.244 Section 8.2.5)
 			// Minimum: 1 byte (flags) + 1 byte (spare) + at least 1 byte for content
@@ -385,10 +486,20 @@ func (g *Gtp5g) newPdi(i *ie.IE) (nl.AttrList, error) {
 				return nil, errors.Errorf("SDF Filter IE payload too short: %d bytes (minimum 3)", len(x.Payload))
 			}
 			sdfIEs = append(sdfIEs, x)
+		case ie.EthernetPacketFilter:
+			epfIEs = append(epfIEs, x)
+		case ie.EthernetPDUSessionInformation:
 		case ie.ApplicationID:
 		}
 	}
 
+	// The kernel matches the UE IP address of a tunnel PDI with the source
+	// address of the decapsulated packets, i.e. as an uplink. The downlink
+	// received from a PSA over N9 is identified by its F-TEID alone.
+	if ueAddr != nil && !(tunnel && srcIf != ie.SrcInterfaceAccess) {
+		attrs = append(attrs, *ueAddr)
+	}
+
 	for _, x := range sdfIEs {
 		v, err := g.newSdfFilter(x, srcIf)
 		if err != nil {
@@ -400,6 +511,17 @@ func (g *Gtp5g) newPdi(i *ie.IE) (nl.AttrList, error) {
 		})
 	}
 
+	for _, x := range epfIEs {
+		v, err := g.newEthPktFilter(x, srcIf)
+		if err != nil {
+			return nil, errors.Wrap(err, "newEthPktFilter failed")
+		}
+		attrs = append(attrs, nl.Attr{
+			Type:  gtp5gnl.PDI_ETHERNET_PACKET_FILTER,
+			Value: v,
+		})
+	}
+
 	return attrs, nil
 }
 
@@ -427,10 +549,10 @@ func (g *Gtp5g) newForwardingParameter(ies []*ie.IE) (nl.AttrList, error) {
 					Type:  gtp5gnl.OUTER_HEADER_CREATION_O_TEID,
 					Value: nl.AttrU32(v.TEID),
 				})
-				// GTPv1-U port
+				// GTPv1-U port of the peer
 				hc = append(hc, nl.Attr{
 					Type:  gtp5gnl.OUTER_HEADER_CREATION_PORT,
-					Value: nl.AttrU16(factory.UpfGtpDefaultPort),
+					Value: nl.AttrU16(g.peerPort(v.IPv4Address)),
 				})
 			} else {
 				hc = append(hc, nl.Attr{
@@ -466,6 +588,15 @@ func (g *Gtp5g) newForwardingParameter(ies []*ie.IE) (nl.AttrList, error) {
 				Type:  gtp5gnl.FORWARDING_PARAMETER_PFCPSM_REQ_FLAGS,
 				Value: nl.AttrU8(v),
 			})
+		case ie.TransportLevelMarking:
+			v, err := transportLevelMarking(x)
+			if err != nil {
+				return nil, err
+			}
+			attrs = append(attrs, nl.Attr{
+				Type:  gtp5gnl.FORWARDING_PARAMETER_TOS_TC,
+				Value: nl.AttrU8(v),
+			})
 		}
 	}
 
@@ -540,6 +671,17 @@ func (g *Gtp5g) newVolumeQuota(i *ie.IE) (nl.AttrList, error) {
 	return attrs, nil
 }
 
+// newDroppedDLThreshold parses the Dropped DL Traffic Threshold IE; gtp5g
+// does not support it, the dropped DL traffic is measured by the UPF itself
+func newDroppedDLThreshold(i *ie.IE) (*report.DroppedDLThreshold, error) {
+	var t report.DroppedDLThreshold
+	err := t.Unmarshal(i.Payload)
+	if err != nil {
+		return nil, err
+	}
+	return &t, nil
+}
+
 func (g *Gtp5g) QueryURR(lSeid uint64, urrid uint32) ([]report.USAReport, error) {
 	return g.queryURR(lSeid, urrid, false)
 }
@@ -552,11 +694,11 @@ func (g *Gtp5g) queryURR(lSeid uint64, urrid uint32, ps bool) ([]report.USARepor
 	var usars []report.USAReport
 
 	oid := gtp5gnl.OID{lSeid, uint64(urrid)}
-	c := g.client
+	c := g.sessClient(lSeid)
 	if ps {
 		c = g.psClient
 	}
-	rs, err := gtp5gnl.GetReportOID(c, g.link.link, oid)
+	rs, err := c.GetReport(g.sessLink(lSeid).link, oid)
 	if err != nil {
 		return nil, errors.Wrapf(err, "queryURR[%#x:%#x]", lSeid, urrid)
 	}
@@ -595,7 +737,6 @@ func (g *Gtp5g) QueryMultiURR(lSeidUrridsMap map[uint64][]uint32) (map[uint64][]
 }
 
 func (g *Gtp5g) queryMultiURR(lSeidUrridsMap map[uint64][]uint32, ps bool) (map[uint64][]report.USAReport, error) {
-	var oids []gtp5gnl.OID
 	var reports []gtp5gnl.USAReport
 
 	c := g.client
@@ -603,38 +744,31 @@ func (g *Gtp5g) queryMultiURR(lSeidUrridsMap map[uint64][]uint32, ps bool) (map[
 		c = g.psClient
 	}
 
+	// The URRs are queried from the link of their session
+	linkOIDs := make(map[*Gtp5gLink][]gtp5gnl.OID)
+	for seid, urrIds := range lSeidUrridsMap {
+		link := g.sessLink(seid)
+		for _, urrId := range urrIds {
+			linkOIDs[link] = append(linkOIDs[link], gtp5gnl.OID{seid, uint64(urrId)})
+		}
+	}
+
 	// Note: the max size of netlink msg is 16k,
 	//       the number of reports from gtp5g is limited
 	//       depending on the size of report
-	queryNum := 0
 	queryNumOnce := gtp5gnl.MaxNetlinkUsageReportNum()
-	for seid, urrIds := range lSeidUrridsMap {
-		for _, urrId := range urrIds {
-			oids = append(oids, gtp5gnl.OID{seid, uint64(urrId)})
-			queryNum++
-
-			if queryNum >= queryNumOnce {
-				rs, err := gtp5gnl.GetMultiReportsOID(c, g.link.link, oids)
-				if err != nil {
-					return nil, errors.Wrapf(err, "queryMultiURR[%+v]", lSeidUrridsMap)
-				}
-
-				g.log.Tracef("Reports number in one netlink request: %+v", len(rs))
-				reports = append(reports, rs...)
-				oids = oids[:0]
-				queryNum = 0
+	for link, oids := range linkOIDs {
+		for len(oids) > 0 {
+			n := min(len(oids), queryNumOnce)
+			rs, err := c.GetMultiReports(link.link, oids[:n])
+			if err != nil {
+				return nil, errors.Wrapf(err, "queryMultiURR[%+v]", lSeidUrridsMap)
 			}
-		}
-	}
 
-	if len(oids) > 0 {
-		rs, err := gtp5gnl.GetMultiReportsOID(c, g.link.link, oids)
-		if err != nil {
-			return nil, errors.Wrapf(err, "queryMultiURR[%+v]", lSeidUrridsMap)
+			g.log.Tracef("Reports number in one netlink request: %+v", len(rs))
+			reports = append(reports, rs...)
+			oids = oids[n:]
 		}
-
-		g.log.Tracef("Reports number in one netlink request: %+v", len(rs))
-		reports = append(reports, rs...)
 	}
 
 	if reports == nil {
@@ -667,13 +801,123 @@ func (g *Gtp5g) queryMultiURR(lSeidUrridsMap map[uint64][]uint32, ps bool) (map[
 }
 
 func (g *Gtp5g) HandleReport(handler report.Handler) {
-	g.bsnl.Handle(handler)
-	g.ps.Handle(handler, g.psQueryURR)
+	g.handler = handler
+	h := activityHandler{Handler: handler, g: g}
+	g.bsnl.Handle(h)
+	g.ps.Handle(h, g.psQueryURR)
+}
+
+// markActivity updates the last activity of the session: a DL data arrival
+// or a usage report with measured packets indicates user plane traffic
+func (g *Gtp5g) markActivity(sr report.SessReport) {
+	var last time.Time
+	for _, rpt := range sr.Reports {
+		switch r := rpt.(type) {
+		case report.DLDReport:
+			last = time.Now()
+		case report.USAReport:
+			if r.VolumMeasure.TotalPktNum == 0 && r.VolumMeasure.TotalVolume == 0 {
+				continue
+			}
+			t := r.EndTime
+			if t.IsZero() {
+				t = time.Now()
+			}
+			if t.After(last) {
+				last = t
+			}
+		}
+	}
+	if last.IsZero() {
+		return
+	}
+
+	g.actMu.Lock()
+	defer g.actMu.Unlock()
+	if last.After(g.lastAct[sr.SEID]) {
+		g.lastAct[sr.SEID] = last
+	}
+}
+
+// LastActivity samples the packet counters of the kernel PDRs of the
+// session: the traffic forwarded by the kernel, which no report tells of, is
+// seen as the counters changing since the previous sample
+func (g *Gtp5g) LastActivity(lSeid uint64, pdrids []uint16) time.Time {
+	link := g.sessLink(lSeid).link.Name
+	g.duplMu.Lock()
+	if r, ok := g.heRules[lSeid]; ok {
+		pdrids = append(slices.Clip(pdrids), r.pdrs...)
+	}
+	g.duplMu.Unlock()
+	var pkts uint64
+	sampled := false
+	for _, pdrid := range pdrids {
+		st, err := g.stats.read(link, lSeid, pdrid)
+		if err != nil {
+			g.log.Debugf("LastActivity: %v", err)
+			continue
+		}
+		pkts += st.ULPkts + st.DLPkts
+		sampled = true
+	}
+
+	g.actMu.Lock()
+	defer g.actMu.Unlock()
+	if sampled {
+		if prev, ok := g.actPkts[lSeid]; ok && prev != pkts {
+			g.lastAct[lSeid] = time.Now()
+		}
+		g.actPkts[lSeid] = pkts
+	}
+	return g.lastAct[lSeid]
+}
+
+// DroppedDL samples the DL drop counters of the kernel PDRs of the session:
+// the packets the kernel module dropped, e.g. by a FAR dropping them, which
+// no report tells of, are the counters increasing since the previous sample
+func (g *Gtp5g) DroppedDL(lSeid uint64, pdrids []uint16) map[uint16]uint64 {
+	link := g.sessLink(lSeid).link.Name
+	counts := make(map[uint16]uint64, len(pdrids))
+	for _, pdrid := range pdrids {
+		st, err := g.stats.read(link, lSeid, pdrid)
+		if err != nil {
+			g.log.Debugf("DroppedDL: %v", err)
+			continue
+		}
+		counts[pdrid] = st.DLDrops
+	}
+
+	g.actMu.Lock()
+	defer g.actMu.Unlock()
+	drops := make(map[uint16]uint64)
+	for pdrid, n := range counts {
+		k := duplKey{lSeid, uint64(pdrid)}
+		// a PDR created again restarts its counters
+		if prev, ok := g.dlDrops[k]; ok && n > prev {
+			drops[pdrid] = n - prev
+		}
+		g.dlDrops[k] = n
+	}
+	return drops
+}
+
+// forgetActivity drops the activity of a released session
+func (g *Gtp5g) forgetActivity(lSeid uint64) {
+	g.actMu.Lock()
+	defer g.actMu.Unlock()
+	delete(g.lastAct, lSeid)
+	delete(g.actPkts, lSeid)
+	for k := range g.dlDrops {
+		if k[0] == lSeid {
+			delete(g.dlDrops, k)
+		}
+	}
 }
 
 func (g *Gtp5g) applyAction(lSeid uint64, farid int, action report.ApplyAction) {
+	link := g.sessLink(lSeid)
 	oid := gtp5gnl.OID{lSeid, uint64(farid)}
-	far, err := gtp5gnl.GetFAROID(g.client, g.link.link, oid)
+	far, err := g.sessClient(lSeid).GetFAR(link.link, oid)
 	if err != nil {
 		g.log.Errorf("applyAction err: %+v", err)
 		return
@@ -681,58 +925,85 @@ func (g *Gtp5g) applyAction(lSeid uint64, farid int, action report.ApplyAction)
 	if far.Action&report.APPLY_ACT_BUFF == 0 {
 		return
 	}
+	// A duplicating FAR buffers in the kernel; its buffered packets are
+	// released if the FAR doesn't buffer any more
+	f, _ := g.duplFAR(oid)
+	kact := report.ApplyAction{Flags: far.Action}
+	if kact.DUPL() && action.BUFF() {
+		return
+	}
 	switch {
 	case action.DROP():
 		// BUFF -> DROP
 		for _, pdrid := range far.PDRIDs {
-			for {
-				_, ok := g.bsnl.Pop(lSeid, pdrid)
-				if !ok {
-					break
-				}
+			for g.bsnl.Drop(lSeid, pdrid) {
 			}
 		}
 	case action.FORW():
 		// BUFF -> FORW
 		for _, pdrid := range far.PDRIDs {
 			oid := gtp5gnl.OID{lSeid, uint64(pdrid)}
-			pdr, err := gtp5gnl.GetPDROID(g.client, g.link.link, oid)
+			pdr, err := g.sessClient(lSeid).GetPDR(link.link, oid)
 			if err != nil {
 				g.log.Warnf("applyAction GetPDROID err: %+v", err)
 				continue
 			}
-			var qer *gtp5gnl.QER
-			for _, qerId := range pdr.QERID {
-				oid := gtp5gnl.OID{lSeid, uint64(qerId)}
-				q, err := gtp5gnl.GetQEROID(g.client, g.link.link, oid)
-				if err != nil {
-					g.log.Warnf("applyAction GetQEROID err: %+v", err)
-					continue
-				}
-				if q.QFI != 0 {
-					qer = q
-					break
-				}
-			}
+			qers := g.pdrQERs(lSeid, pdr)
+			var drops []report.Report
 			for {
 				pkt, ok := g.bsnl.Pop(lSeid, pdrid)
 				if !ok {
 					break
 				}
-				err := g.WritePacket(far, qer, pkt)
+				if kact.DUPL() {
+					g.duplicate(f.targets, pkt)
+				}
+				err := g.forwardPacket(link, lSeid, far, qers, pkt)
+				if errors.Is(err, errRateLimited) {
+					drops = append(drops, g.dropReport(lSeid, pdrid, far, len(pkt)))
+					continue
+				}
 				if err != nil {
 					g.log.Warnf("applyAction WritePacket err: %+v", err)
 					continue
 				}
 			}
+			g.notifyDrops(lSeid, drops)
 		}
 	}
 }
 
+// WritePacket forwards a packet by the UPF itself: the packet is
+// encapsulated as a G-PDU to the peer given by the Outer Header Creation of
+// the FAR, marked with the ToS of the FAR, or sent as an IP packet to the DN
+// if the FAR has none. The packet is sent from the link of the session of the
+// FAR, or to the DN through the routing table of the DNN of the session, and
+// dropped if it exceeds the MBR of the QER.
 func (g *Gtp5g) WritePacket(far *gtp5gnl.FAR, qer *gtp5gnl.QER, pkt []byte) error {
-	if far.Param == nil || far.Param.Creation == nil {
+	if far.SEID == nil {
+		return g.writePacket(g.link, nil, far, qer, pkt)
+	}
+	link := g.sessLink(*far.SEID)
+	if qer == nil {
+		return g.writePacket(link, g.sessNI(*far.SEID), far, qer, pkt)
+	}
+	return g.forwardPacket(link, *far.SEID, far, []*gtp5gnl.QER{qer}, pkt)
+}
+
+// writePacket forwards a packet through the link of its session, or to the
+// DN through the Network Instance of its session, if any
+func (g *Gtp5g) writePacket(
+	link *Gtp5gLink, ni *netInstance, far *gtp5gnl.FAR, qer *gtp5gnl.QER, pkt []byte,
+) error {
+	if far.Param == nil {
 		return errors.New("far param not found")
 	}
+	if far.Param.Creation == nil {
+		if ni != nil {
+			return ni.WriteIP(pkt)
+		}
+		return link.WriteIP(pkt)
+	}
 	hc := far.Param.Creation
 	addr := &net.UDPAddr{
 		IP:   hc.PeerAddr,
@@ -758,7 +1029,7 @@ func (g *Gtp5g) WritePacket(far *gtp5gnl.FAR, qer *gtp5gnl.QER, pkt []byte) erro
 	if err != nil {
 		return err
 	}
-	_, err = g.link.WriteTo(b, addr)
+	_, err = link.WriteToTOS(b, addr, far.Param.TosTc)
 	return err
 }
 
@@ -766,10 +1037,17 @@ func (g *Gtp5g) WritePacket(far *gtp5gnl.FAR, qer *gtp5gnl.QER, pkt []byte) erro
 // Plan-based methods for two-phase commit (validation + execution)
 // ============================================================================
 
-func (g *Gtp5g) BuildCreatePDRPlan(lSeid uint64, req *ie.IE) (*PDRPlan, error) {
+func (g *Gtp5g) BuildCreatePDRPlan(lSeid uint64, req *ie.IE) (_ *PDRPlan, err error) {
+	var cur uint16 // the type of the IE being built
+	defer func() { err = ieError(cur, err) }()
 	var pdrid uint64
 	var attrs []nl.Attr
-	var urrids []uint32
+	var urrids, qerids []uint32
+	var ni string
+	var teidAddr net.IP
+	var ulTeid *uint32
+	var eth bool
+	var farid *uint32
 
 	ies, err := req.CreatePDR()
 	if err != nil {
@@ -777,6 +1055,7 @@ func (g *Gtp5g) BuildCreatePDRPlan(lSeid uint64, req *ie.IE) (*PDRPlan, error) {
 	}
 
 	for _, i := range ies {
+		cur = i.Type
 		switch i.Type {
 		case ie.PDRID:
 			v, err := i.PDRID()
@@ -798,6 +1077,12 @@ func (g *Gtp5g) BuildCreatePDRPlan(lSeid uint64, req *ie.IE) (*PDRPlan, error) {
 			if err != nil {
 				return nil, errors.Wrap(err, "CreatePDR: failed to parse PDI")
 			}
+			if xs, err := i.PDI(); err == nil {
+				ni = networkInstance(xs)
+				teidAddr = fteidAddr(xs)
+				ulTeid = ulTEID(xs)
+				eth = ethernetPdi(xs)
+			}
 			if v != nil {
 				attrs = append(attrs, nl.Attr{
 					Type:  gtp5gnl.PDR_PDI,
@@ -809,6 +1094,10 @@ func (g *Gtp5g) BuildCreatePDRPlan(lSeid uint64, req *ie.IE) (*PDRPlan, error) {
 			if err != nil {
 				return nil, errors.Wrap(err, "CreatePDR: failed to parse OuterHeaderRemoval")
 			}
+			v, err = kernelOuterHeaderRemoval(v)
+			if err != nil {
+				return nil, errors.Wrap(err, "CreatePDR")
+			}
 			attrs = append(attrs, nl.Attr{
 				Type:  gtp5gnl.PDR_OUTER_HEADER_REMOVAL,
 				Value: nl.AttrU8(v),
@@ -819,6 +1108,7 @@ func (g *Gtp5g) BuildCreatePDRPlan(lSeid uint64, req *ie.IE) (*PDRPlan, error) {
 			if err != nil {
 				return nil, errors.Wrap(err, "CreatePDR: failed to parse FARID")
 			}
+			farid = &v
 			attrs = append(attrs, nl.Attr{
 				Type:  gtp5gnl.PDR_FAR_ID,
 				Value: nl.AttrU32(v),
@@ -834,6 +1124,7 @@ func (g *Gtp5g) BuildCreatePDRPlan(lSeid uint64, req *ie.IE) (*PDRPlan, error) {
 				Type:  gtp5gnl.PDR_QER_ID,
 				Value: nl.AttrU32(v),
 			})
+			qerids = append(qerids, v)
 		case ie.URRID:
 			v, err := i.URRID()
 			if err != nil {
@@ -848,6 +1139,7 @@ func (g *Gtp5g) BuildCreatePDRPlan(lSeid uint64, req *ie.IE) (*PDRPlan, error) {
 			urrids = append(urrids, v)
 		}
 	}
+	cur = 0
 
 	// TODO:
 	// Not in 3GPP spec, just used for routing
@@ -863,19 +1155,32 @@ func (g *Gtp5g) BuildCreatePDRPlan(lSeid uint64, req *ie.IE) (*PDRPlan, error) {
 	})
 
 	return &PDRPlan{
-		Op:         OpCreate,
-		OID:        gtp5gnl.OID{lSeid, pdrid},
-		Attrs:      attrs,
-		OriginalIE: req,
-		PDRID:      uint16(pdrid),
-		URRIDs:     urrids,
+		Op:              OpCreate,
+		OID:             gtp5gnl.OID{lSeid, pdrid},
+		Attrs:           attrs,
+		OriginalIE:      req,
+		PDRID:           uint16(pdrid),
+		FARID:           farid,
+		URRIDs:          urrids,
+		QERIDs:          qerids,
+		NetworkInstance: ni,
+		FTEIDAddr:       teidAddr,
+		ULTEID:          ulTeid,
+		Ethernet:        eth,
 	}, nil
 }
 
-func (g *Gtp5g) BuildUpdatePDRPlan(lSeid uint64, req *ie.IE) (*PDRPlan, error) {
+func (g *Gtp5g) BuildUpdatePDRPlan(lSeid uint64, req *ie.IE) (_ *PDRPlan, err error) {
+	var cur uint16 // the type of the IE being built
+	defer func() { err = ieError(cur, err) }()
 	var pdrid uint64
 	var attrs []nl.Attr
-	var urrids []uint32
+	var urrids, qerids []uint32
+	var ni string
+	var teidAddr net.IP
+	var ulTeid *uint32
+	var eth bool
+	var farid *uint32
 
 	ies, err := req.UpdatePDR()
 	if err != nil {
@@ -883,6 +1188,7 @@ func (g *Gtp5g) BuildUpdatePDRPlan(lSeid uint64, req *ie.IE) (*PDRPlan, error) {
 	}
 
 	for _, i := range ies {
+		cur = i.Type
 		switch i.Type {
 		case ie.PDRID:
 			v, err := i.PDRID()
@@ -906,6 +1212,12 @@ func (g *Gtp5g) BuildUpdatePDRPlan(lSeid uint64, req *ie.IE) (*PDRPlan, error) {
 			if err != nil {
 				return nil, errors.Wrap(err, "UpdatePDR: failed to parse PDI")
 			}
+			if xs, err := i.PDI(); err == nil {
+				ni = networkInstance(xs)
+				teidAddr = fteidAddr(xs)
+				ulTeid = ulTEID(xs)
+				eth = ethernetPdi(xs)
+			}
 			if v != nil {
 				attrs = append(attrs, nl.Attr{
 					Type:  gtp5gnl.PDR_PDI,
@@ -918,6 +1230,10 @@ func (g *Gtp5g) BuildUpdatePDRPlan(lSeid uint64, req *ie.IE) (*PDRPlan, error) {
 				logger.FwderLog.Warnf("UpdatePDR: Failed to parse OuterHeaderRemoval: %v", err)
 				break
 			}
+			v, err = kernelOuterHeaderRemoval(v)
+			if err != nil {
+				return nil, errors.Wrap(err, "UpdatePDR")
+			}
 			attrs = append(attrs, nl.Attr{
 				Type:  gtp5gnl.PDR_OUTER_HEADER_REMOVAL,
 				Value: nl.AttrU8(v),
@@ -929,6 +1245,7 @@ func (g *Gtp5g) BuildUpdatePDRPlan(lSeid uint64, req *ie.IE) (*PDRPlan, error) {
 				logger.FwderLog.Warnf("UpdatePDR: Failed to parse FARID: %v", err)
 				break
 			}
+			farid = &v
 			attrs = append(attrs, nl.Attr{
 				Type:  gtp5gnl.PDR_FAR_ID,
 				Value: nl.AttrU32(v),
@@ -943,6 +1260,7 @@ func (g *Gtp5g) BuildUpdatePDRPlan(lSeid uint64, req *ie.IE) (*PDRPlan, error) {
 				Type:  gtp5gnl.PDR_QER_ID,
 				Value: nl.AttrU32(v),
 			})
+			qerids = append(qerids, v)
 		case ie.URRID:
 			v, err := i.URRID()
 			if err != nil {
@@ -956,14 +1274,21 @@ func (g *Gtp5g) BuildUpdatePDRPlan(lSeid uint64, req *ie.IE) (*PDRPlan, error) {
 			urrids = append(urrids, v)
 		}
 	}
+	cur = 0
 
 	return &PDRPlan{
-		Op:         OpUpdate,
-		OID:        gtp5gnl.OID{lSeid, pdrid},
-		Attrs:      attrs,
-		OriginalIE: req,
-		PDRID:      uint16(pdrid),
-		URRIDs:     urrids,
+		Op:              OpUpdate,
+		OID:             gtp5gnl.OID{lSeid, pdrid},
+		Attrs:           attrs,
+		OriginalIE:      req,
+		PDRID:           uint16(pdrid),
+		FARID:           farid,
+		URRIDs:          urrids,
+		QERIDs:          qerids,
+		NetworkInstance: ni,
+		FTEIDAddr:       teidAddr,
+		ULTEID:          ulTeid,
+		Ethernet:        eth,
 	}, nil
 }
 
@@ -982,9 +1307,18 @@ func (g *Gtp5g) BuildRemovePDRPlan(lSeid uint64, req *ie.IE) (*PDRPlan, error) {
 	}, nil
 }
 
-func (g *Gtp5g) BuildCreateFARPlan(lSeid uint64, req *ie.IE) (*FARPlan, error) {
+func (g *Gtp5g) BuildCreateFARPlan(lSeid uint64, req *ie.IE) (_ *FARPlan, err error) {
+	var cur uint16 // the type of the IE being built
+	defer func() { err = ieError(cur, err) }()
 	var farid uint64
 	var attrs []nl.Attr
+	var applyAction *report.ApplyAction
+	var dupls []Duplication
+	var headers []HeaderEnrichment
+	var redirect *Redirect
+	var tos *uint8
+	var ni string
+	var dstIf *uint8
 
 	ies, err := req.CreateFAR()
 	if err != nil {
@@ -992,6 +1326,7 @@ func (g *Gtp5g) BuildCreateFARPlan(lSeid uint64, req *ie.IE) (*FARPlan, error) {
 	}
 
 	for _, i := range ies {
+		cur = i.Type
 		switch i.Type {
 		case ie.FARID:
 			v, err := i.FARID()
@@ -1011,16 +1346,50 @@ func (g *Gtp5g) BuildCreateFARPlan(lSeid uint64, req *ie.IE) (*FARPlan, error) {
 			}
 			attrs = append(attrs, nl.Attr{
 				Type:  gtp5gnl.FAR_APPLY_ACTION,
-				Value: nl.AttrU16(act.Flags),
+				Value: nl.AttrU16(kernelAction(act)),
 			})
+			applyAction = &act
+		case ie.DuplicatingParameters:
+			xs, err := i.DuplicatingParameters()
+			if err != nil {
+				return nil, err
+			}
+			d, err := g.newDuplication(xs)
+			if err != nil {
+				return nil, err
+			}
+			dupls = append(dupls, d)
 		case ie.ForwardingParameters:
 			xs, err := i.ForwardingParameters()
 			if err != nil {
 				return nil, err
 			}
+			ni = networkInstance(xs)
+			dstIf = destinationInterface(xs)
+			headers, err = headerEnrichments(xs, dstIf)
+			if err != nil {
+				return nil, err
+			}
+			redirect, err = redirectInformation(xs)
+			if err != nil {
+				return nil, err
+			}
+			if redirect != nil {
+				if err = redirect.resolve(); err != nil {
+					// the UE can still resolve the server itself
+					g.log.Warnf("FAR[%#x]: %v", farid, err)
+				}
+			}
+			tos, err = findTransportLevelMarking(xs)
+			if err != nil {
+				return nil, err
+			}
+			if err = checkOuterHeaderCreation(xs); err != nil {
+				return nil, err
+			}
 			v, err := g.newForwardingParameter(xs)
 			if err != nil {
-				break
+				return nil, err
 			}
 			if v != nil {
 				attrs = append(attrs, nl.Attr{
@@ -1039,20 +1408,39 @@ func (g *Gtp5g) BuildCreateFARPlan(lSeid uint64, req *ie.IE) (*FARPlan, error) {
 			})
 		}
 	}
+	cur = 0
+
+	setUserspaceAction(attrs, applyAction, redirect)
 
 	return &FARPlan{
-		Op:         OpCreate,
-		OID:        gtp5gnl.OID{lSeid, farid},
-		Attrs:      attrs,
-		OriginalIE: req,
-		FARID:      uint32(farid),
+		Op:               OpCreate,
+		OID:              gtp5gnl.OID{lSeid, farid},
+		Attrs:            attrs,
+		OriginalIE:       req,
+		FARID:            uint32(farid),
+		ApplyAction:      applyAction,
+		Duplications:     dupls,
+		HeaderEnrichment: headers,
+		Redirect:         redirect,
+		NetworkInstance:  ni,
+		DstIf:            dstIf,
+
+		TransportLevelMarking: tos,
 	}, nil
 }
 
-func (g *Gtp5g) BuildUpdateFARPlan(lSeid uint64, req *ie.IE) (*FARPlan, error) {
+func (g *Gtp5g) BuildUpdateFARPlan(lSeid uint64, req *ie.IE) (_ *FARPlan, err error) {
+	var cur uint16 // the type of the IE being built
+	defer func() { err = ieError(cur, err) }()
 	var farid uint64
 	var attrs []nl.Attr
 	var applyAction *report.ApplyAction
+	var dupls []Duplication
+	var headers []HeaderEnrichment
+	var redirect *Redirect
+	var tos *uint8
+	var ni string
+	var dstIf *uint8
 
 	ies, err := req.UpdateFAR()
 	if err != nil {
@@ -1060,6 +1448,7 @@ func (g *Gtp5g) BuildUpdateFARPlan(lSeid uint64, req *ie.IE) (*FARPlan, error) {
 	}
 
 	for _, i := range ies {
+		cur = i.Type
 		switch i.Type {
 		case ie.FARID:
 			v, err := i.FARID()
@@ -1079,17 +1468,50 @@ func (g *Gtp5g) BuildUpdateFARPlan(lSeid uint64, req *ie.IE) (*FARPlan, error) {
 			}
 			attrs = append(attrs, nl.Attr{
 				Type:  gtp5gnl.FAR_APPLY_ACTION,
-				Value: nl.AttrU16(act.Flags),
+				Value: nl.AttrU16(kernelAction(act)),
 			})
 			applyAction = &act
+		case ie.UpdateDuplicatingParameters:
+			xs, err := i.UpdateDuplicatingParameters()
+			if err != nil {
+				return nil, err
+			}
+			d, err := g.newDuplication(xs)
+			if err != nil {
+				return nil, err
+			}
+			dupls = append(dupls, d)
 		case ie.UpdateForwardingParameters:
 			xs, err := i.UpdateForwardingParameters()
 			if err != nil {
 				return nil, err
 			}
+			ni = networkInstance(xs)
+			dstIf = destinationInterface(xs)
+			headers, err = headerEnrichments(xs, dstIf)
+			if err != nil {
+				return nil, err
+			}
+			redirect, err = redirectInformation(xs)
+			if err != nil {
+				return nil, err
+			}
+			if redirect != nil {
+				if err = redirect.resolve(); err != nil {
+					// the UE can still resolve the server itself
+					g.log.Warnf("FAR[%#x]: %v", farid, err)
+				}
+			}
+			tos, err = findTransportLevelMarking(xs)
+			if err != nil {
+				return nil, err
+			}
+			if err = checkOuterHeaderCreation(xs); err != nil {
+				return nil, err
+			}
 			v, err := g.newForwardingParameter(xs)
 			if err != nil {
-				break
+				return nil, err
 			}
 			if v != nil {
 				attrs = append(attrs, nl.Attr{
@@ -1108,14 +1530,24 @@ func (g *Gtp5g) BuildUpdateFARPlan(lSeid uint64, req *ie.IE) (*FARPlan, error) {
 			})
 		}
 	}
+	cur = 0
+
+	setUserspaceAction(attrs, applyAction, redirect)
 
 	return &FARPlan{
-		Op:          OpUpdate,
-		OID:         gtp5gnl.OID{lSeid, farid},
-		Attrs:       attrs,
-		OriginalIE:  req,
-		FARID:       uint32(farid),
-		ApplyAction: applyAction,
+		Op:               OpUpdate,
+		OID:              gtp5gnl.OID{lSeid, farid},
+		Attrs:            attrs,
+		OriginalIE:       req,
+		FARID:            uint32(farid),
+		ApplyAction:      applyAction,
+		Duplications:     dupls,
+		HeaderEnrichment: headers,
+		Redirect:         redirect,
+		NetworkInstance:  ni,
+		DstIf:            dstIf,
+
+		TransportLevelMarking: tos,
 	}, nil
 }
 
@@ -1134,8 +1566,11 @@ func (g *Gtp5g) BuildRemoveFARPlan(lSeid uint64, req *ie.IE) (*FARPlan, error) {
 	}, nil
 }
 
-func (g *Gtp5g) BuildCreateQERPlan(lSeid uint64, req *ie.IE) (*QERPlan, error) {
+func (g *Gtp5g) BuildCreateQERPlan(lSeid uint64, req *ie.IE) (_ *QERPlan, err error) {
+	var cur uint16 // the type of the IE being built
+	defer func() { err = ieError(cur, err) }()
 	var qerid uint64
+	var qfi, ppi, tos *uint8
 	var attrs []nl.Attr
 
 	ies, err := req.CreateQER()
@@ -1144,6 +1579,7 @@ func (g *Gtp5g) BuildCreateQERPlan(lSeid uint64, req *ie.IE) (*QERPlan, error) {
 	}
 
 	for _, i := range ies {
+		cur = i.Type
 		switch i.Type {
 		case ie.QERID:
 			v, err := i.QERID()
@@ -1210,6 +1646,7 @@ func (g *Gtp5g) BuildCreateQERPlan(lSeid uint64, req *ie.IE) (*QERPlan, error) {
 			if err != nil {
 				break
 			}
+			qfi = &v
 			attrs = append(attrs, nl.Attr{
 				Type:  gtp5gnl.QER_QFI,
 				Value: nl.AttrU8(v),
@@ -1228,12 +1665,21 @@ func (g *Gtp5g) BuildCreateQERPlan(lSeid uint64, req *ie.IE) (*QERPlan, error) {
 			if err != nil {
 				break
 			}
+			ppi = &v
 			attrs = append(attrs, nl.Attr{
 				Type:  gtp5gnl.QER_PPI,
 				Value: nl.AttrU8(v),
 			})
+		case ie.TransportLevelMarking:
+			// marked by the FARs of the PDRs of the QER
+			v, err := transportLevelMarking(i)
+			if err != nil {
+				return nil, err
+			}
+			tos = &v
 		}
 	}
+	cur = 0
 
 	return &QERPlan{
 		Op:         OpCreate,
@@ -1241,11 +1687,18 @@ func (g *Gtp5g) BuildCreateQERPlan(lSeid uint64, req *ie.IE) (*QERPlan, error) {
 		Attrs:      attrs,
 		OriginalIE: req,
 		QERID:      uint32(qerid),
+		QFI:        qfi,
+		PPI:        ppi,
+
+		TransportLevelMarking: tos,
 	}, nil
 }
 
-func (g *Gtp5g) BuildUpdateQERPlan(lSeid uint64, req *ie.IE) (*QERPlan, error) {
+func (g *Gtp5g) BuildUpdateQERPlan(lSeid uint64, req *ie.IE) (_ *QERPlan, err error) {
+	var cur uint16 // the type of the IE being built
+	defer func() { err = ieError(cur, err) }()
 	var qerid uint64
+	var qfi, ppi, tos *uint8
 	var attrs []nl.Attr
 
 	ies, err := req.UpdateQER()
@@ -1254,6 +1707,7 @@ func (g *Gtp5g) BuildUpdateQERPlan(lSeid uint64, req *ie.IE) (*QERPlan, error) {
 	}
 
 	for _, i := range ies {
+		cur = i.Type
 		switch i.Type {
 		case ie.QERID:
 			v, err := i.QERID()
@@ -1320,6 +1774,7 @@ func (g *Gtp5g) BuildUpdateQERPlan(lSeid uint64, req *ie.IE) (*QERPlan, error) {
 			if err != nil {
 				break
 			}
+			qfi = &v
 			attrs = append(attrs, nl.Attr{
 				Type:  gtp5gnl.QER_QFI,
 				Value: nl.AttrU8(v),
@@ -1338,12 +1793,21 @@ func (g *Gtp5g) BuildUpdateQERPlan(lSeid uint64, req *ie.IE) (*QERPlan, error) {
 			if err != nil {
 				break
 			}
+			ppi = &v
 			attrs = append(attrs, nl.Attr{
 				Type:  gtp5gnl.QER_PPI,
 				Value: nl.AttrU8(v),
 			})
+		case ie.TransportLevelMarking:
+			// marked by the FARs of the PDRs of the QER
+			v, err := transportLevelMarking(i)
+			if err != nil {
+				return nil, err
+			}
+			tos = &v
 		}
 	}
+	cur = 0
 
 	return &QERPlan{
 		Op:         OpUpdate,
@@ -1351,6 +1815,10 @@ func (g *Gtp5g) BuildUpdateQERPlan(lSeid uint64, req *ie.IE) (*QERPlan, error) {
 		Attrs:      attrs,
 		OriginalIE: req,
 		QERID:      uint32(qerid),
+		QFI:        qfi,
+		PPI:        ppi,
+
+		TransportLevelMarking: tos,
 	}, nil
 }
 
@@ -1369,12 +1837,21 @@ func (g *Gtp5g) BuildRemoveQERPlan(lSeid uint64, req *ie.IE) (*QERPlan, error) {
 	}, nil
 }
 
-func (g *Gtp5g) BuildCreateURRPlan(lSeid uint64, req *ie.IE) (*URRPlan, error) {
+func (g *Gtp5g) BuildCreateURRPlan(lSeid uint64, req *ie.IE) (_ *URRPlan, err error) {
+	var cur uint16 // the type of the IE being built
+	defer func() { err = ieError(cur, err) }()
 	var urrid uint32
 	var measureMethod uint8
 	var rptTrig report.ReportingTrigger
 	var measurePeriod time.Duration
 	var measureInfoIE *ie.IE
+	var droppedDLThreshold *report.DroppedDLThreshold
+	var eventThreshold, eventQuota *uint32
+	var linkedURRIDs []uint32
+	var ethInactivityTimer *time.Duration
+	var quotaFARID *uint32
+	var timeQuota *time.Duration
+	var volumeQuota bool
 	var attrs []nl.Attr
 
 	ies, err := req.CreateURR()
@@ -1383,6 +1860,7 @@ func (g *Gtp5g) BuildCreateURRPlan(lSeid uint64, req *ie.IE) (*URRPlan, error) {
 	}
 
 	for _, i := range ies {
+		cur = i.Type
 		switch i.Type {
 		case ie.URRID:
 			urrid, err = i.URRID()
@@ -1453,10 +1931,55 @@ func (g *Gtp5g) BuildCreateURRPlan(lSeid uint64, req *ie.IE) (*URRPlan, error) {
 				Type:  gtp5gnl.URR_VOLUME_QUOTA,
 				Value: v,
 			})
+			volumeQuota = true
+		case ie.TimeQuota:
+			v, err := i.TimeQuota()
+			if err != nil {
+				return nil, err
+			}
+			timeQuota = &v
+		case ie.FARID:
+			// FAR ID for Quota Action
+			v, err := i.FARID()
+			if err != nil {
+				return nil, err
+			}
+			quotaFARID = &v
+		case ie.DroppedDLTrafficThreshold:
+			droppedDLThreshold, err = newDroppedDLThreshold(i)
+			if err != nil {
+				return nil, err
+			}
+		case ie.EventThreshold:
+			v, err := i.EventThreshold()
+			if err != nil {
+				return nil, err
+			}
+			eventThreshold = &v
+		case ie.EventQuota:
+			v, err := i.EventQuota()
+			if err != nil {
+				return nil, err
+			}
+			eventQuota = &v
+		case ie.LinkedURRID:
+			v, err := i.LinkedURRID()
+			if err != nil {
+				return nil, err
+			}
+			linkedURRIDs = append(linkedURRIDs, v)
+		case ie.EthernetInactivityTimer:
+			v, err := i.EthernetInactivityTimer()
+			if err != nil {
+				return nil, err
+			}
+			ethInactivityTimer = &v
 		}
 	}
+	cur = 0
 
 	if rptTrig.PERIO() && measurePeriod <= 0 {
+		cur = ie.MeasurementPeriod
 		return nil, errors.New("invalid measurement period for PERIO trigger")
 	}
 
@@ -1470,14 +1993,34 @@ func (g *Gtp5g) BuildCreateURRPlan(lSeid uint64, req *ie.IE) (*URRPlan, error) {
 		ReportingTrigger: rptTrig,
 		MeasurePeriod:    measurePeriod,
 		MeasureInfoIE:    measureInfoIE,
+
+		DroppedDLThreshold: droppedDLThreshold,
+		EventThreshold:     eventThreshold,
+		EventQuota:         eventQuota,
+		LinkedURRIDs:       linkedURRIDs,
+		EthInactivityTimer: ethInactivityTimer,
+		QuotaFARID:         quotaFARID,
+		TimeQuota:          timeQuota,
+		VolumeQuota:        volumeQuota,
 	}, nil
 }
 
 // BuildUpdateURRPlan parses and validates UpdateURR IE without executing
-func (g *Gtp5g) BuildUpdateURRPlan(lSeid uint64, req *ie.IE) (*URRPlan, error) {
+func (g *Gtp5g) BuildUpdateURRPlan(lSeid uint64, req *ie.IE) (_ *URRPlan, err error) {
+	var cur uint16 // the type of the IE being built
+	defer func() { err = ieError(cur, err) }()
 	var urrid uint64
 	var measureMethod uint8
+	var rptTrig report.ReportingTrigger
+	var hasRptTrig bool
 	var measureInfoIE *ie.IE
+	var droppedDLThreshold *report.DroppedDLThreshold
+	var eventThreshold, eventQuota *uint32
+	var linkedURRIDs []uint32
+	var ethInactivityTimer *time.Duration
+	var quotaFARID *uint32
+	var timeQuota *time.Duration
+	var volumeQuota bool
 	var attrs []nl.Attr
 
 	ies, err := req.UpdateURR()
@@ -1486,6 +2029,7 @@ func (g *Gtp5g) BuildUpdateURRPlan(lSeid uint64, req *ie.IE) (*URRPlan, error) {
 	}
 
 	for _, i := range ies {
+		cur = i.Type
 		switch i.Type {
 		case ie.URRID:
 			v, err := i.URRID()
@@ -1508,11 +2052,11 @@ func (g *Gtp5g) BuildUpdateURRPlan(lSeid uint64, req *ie.IE) (*URRPlan, error) {
 			if err != nil {
 				return nil, err
 			}
-			var rptTrig report.ReportingTrigger
 			err = rptTrig.Unmarshal(v)
 			if err != nil {
 				return nil, err
 			}
+			hasRptTrig = true
 			attrs = append(attrs, nl.Attr{
 				Type:  gtp5gnl.URR_REPORTING_TRIGGER,
 				Value: nl.AttrU32(rptTrig.Flags),
@@ -1554,10 +2098,54 @@ func (g *Gtp5g) BuildUpdateURRPlan(lSeid uint64, req *ie.IE) (*URRPlan, error) {
 				Type:  gtp5gnl.URR_VOLUME_QUOTA,
 				Value: v,
 			})
+			volumeQuota = true
+		case ie.TimeQuota:
+			v, err := i.TimeQuota()
+			if err != nil {
+				return nil, err
+			}
+			timeQuota = &v
+		case ie.FARID:
+			// FAR ID for Quota Action
+			v, err := i.FARID()
+			if err != nil {
+				return nil, err
+			}
+			quotaFARID = &v
+		case ie.DroppedDLTrafficThreshold:
+			droppedDLThreshold, err = newDroppedDLThreshold(i)
+			if err != nil {
+				return nil, err
+			}
+		case ie.EventThreshold:
+			v, err := i.EventThreshold()
+			if err != nil {
+				return nil, err
+			}
+			eventThreshold = &v
+		case ie.EventQuota:
+			v, err := i.EventQuota()
+			if err != nil {
+				return nil, err
+			}
+			eventQuota = &v
+		case ie.LinkedURRID:
+			v, err := i.LinkedURRID()
+			if err != nil {
+				return nil, err
+			}
+			linkedURRIDs = append(linkedURRIDs, v)
+		case ie.EthernetInactivityTimer:
+			v, err := i.EthernetInactivityTimer()
+			if err != nil {
+				return nil, err
+			}
+			ethInactivityTimer = &v
 		}
 
 		// TODO: should apply PERIO updateURR and receive final report from old URR
 	}
+	cur = 0
 
 	return &URRPlan{
 		Op:            OpUpdate,
@@ -1567,6 +2155,18 @@ func (g *Gtp5g) BuildUpdateURRPlan(lSeid uint64, req *ie.IE) (*URRPlan, error) {
 		URRID:         uint32(urrid),
 		MeasureMethod: measureMethod,
 		MeasureInfoIE: measureInfoIE,
+
+		ReportingTrigger:   rptTrig,
+		DroppedDLThreshold: droppedDLThreshold,
+		EventThreshold:     eventThreshold,
+		EventQuota:         eventQuota,
+		LinkedURRIDs:       linkedURRIDs,
+		EthInactivityTimer: ethInactivityTimer,
+		QuotaFARID:         quotaFARID,
+		TimeQuota:          timeQuota,
+		VolumeQuota:        volumeQuota,
+
+		HasReportingTrigger: hasRptTrig,
 	}, nil
 }
 
@@ -1600,8 +2200,12 @@ func (g *Gtp5g) BuildQueryURRPlan(lSeid uint64, req *ie.IE) (*URRPlan, error) {
 	}, nil
 }
 
-func (g *Gtp5g) BuildCreateBARPlan(lSeid uint64, req *ie.IE) (*BARPlan, error) {
+func (g *Gtp5g) BuildCreateBARPlan(lSeid uint64, req *ie.IE) (_ *BARPlan, err error) {
+	var cur uint16 // the type of the IE being built
+	defer func() { err = ieError(cur, err) }()
 	var barid uint64
+	var ddnDelay *time.Duration
+	var bufPktsCnt *uint16
 	var attrs []nl.Attr
 
 	ies, err := req.CreateBAR()
@@ -1610,6 +2214,7 @@ func (g *Gtp5g) BuildCreateBARPlan(lSeid uint64, req *ie.IE) (*BARPlan, error) {
 	}
 
 	for _, i := range ies {
+		cur = i.Type
 		switch i.Type {
 		case ie.BARID:
 			v, err := i.BARID()
@@ -1622,22 +2227,26 @@ func (g *Gtp5g) BuildCreateBARPlan(lSeid uint64, req *ie.IE) (*BARPlan, error) {
 			if err != nil {
 				return nil, err
 			}
-			// TODO: convert time.Duration -> ?
+			ddnDelay = &v
+			// encoded in multiples of 50 millisecond
 			attrs = append(attrs, nl.Attr{
 				Type:  gtp5gnl.BAR_DOWNLINK_DATA_NOTIFICATION_DELAY,
-				Value: nl.AttrU8(v),
+				Value: nl.AttrU8(v / (50 * time.Millisecond)),
 			})
 		case ie.SuggestedBufferingPacketsCount:
 			v, err := i.SuggestedBufferingPacketsCount()
 			if err != nil {
 				return nil, err
 			}
+			cnt := uint16(v)
+			bufPktsCnt = &cnt
 			attrs = append(attrs, nl.Attr{
 				Type:  gtp5gnl.BAR_BUFFERING_PACKETS_COUNT,
 				Value: nl.AttrU16(v),
 			})
 		}
 	}
+	cur = 0
 
 	return &BARPlan{
 		Op:         OpCreate,
@@ -1645,11 +2254,18 @@ func (g *Gtp5g) BuildCreateBARPlan(lSeid uint64, req *ie.IE) (*BARPlan, error) {
 		Attrs:      attrs,
 		OriginalIE: req,
 		BARID:      uint8(barid),
+
+		DLDataNotificationDelay:        ddnDelay,
+		SuggestedBufferingPacketsCount: bufPktsCnt,
 	}, nil
 }
 
-func (g *Gtp5g) BuildUpdateBARPlan(lSeid uint64, req *ie.IE) (*BARPlan, error) {
+func (g *Gtp5g) BuildUpdateBARPlan(lSeid uint64, req *ie.IE) (_ *BARPlan, err error) {
+	var cur uint16 // the type of the IE being built
+	defer func() { err = ieError(cur, err) }()
 	var barid uint64
+	var ddnDelay, bufDuration *time.Duration
+	var bufPktsCnt *uint16
 	var attrs []nl.Attr
 
 	ies, err := req.UpdateBAR()
@@ -1658,6 +2274,7 @@ func (g *Gtp5g) BuildUpdateBARPlan(lSeid uint64, req *ie.IE) (*BARPlan, error) {
 	}
 
 	for _, i := range ies {
+		cur = i.Type
 		switch i.Type {
 		case ie.BARID:
 			v, err := i.BARID()
@@ -1670,22 +2287,38 @@ func (g *Gtp5g) BuildUpdateBARPlan(lSeid uint64, req *ie.IE) (*BARPlan, error) {
 			if err != nil {
 				return nil, err
 			}
-			// TODO: convert time.Duration -> ?
+			ddnDelay = &v
+			// encoded in multiples of 50 millisecond
 			attrs = append(attrs, nl.Attr{
 				Type:  gtp5gnl.BAR_DOWNLINK_DATA_NOTIFICATION_DELAY,
-				Value: nl.AttrU8(v),
+				Value: nl.AttrU8(v / (50 * time.Millisecond)),
 			})
 		case ie.SuggestedBufferingPacketsCount:
 			v, err := i.SuggestedBufferingPacketsCount()
 			if err != nil {
 				return nil, err
 			}
+			cnt := uint16(v)
+			bufPktsCnt = &cnt
 			attrs = append(attrs, nl.Attr{
 				Type:  gtp5gnl.BAR_BUFFERING_PACKETS_COUNT,
 				Value: nl.AttrU16(v),
 			})
+		case ie.DLBufferingDuration:
+			v, err := i.DLBufferingDuration()
+			if err != nil {
+				return nil, err
+			}
+			bufDuration = &v
+		case ie.DLBufferingSuggestedPacketCount:
+			v, err := i.DLBufferingSuggestedPacketCount()
+			if err != nil {
+				return nil, err
+			}
+			bufPktsCnt = &v
 		}
 	}
+	cur = 0
 
 	return &BARPlan{
 		Op:         OpUpdate,
@@ -1693,6 +2326,10 @@ func (g *Gtp5g) BuildUpdateBARPlan(lSeid uint64, req *ie.IE) (*BARPlan, error) {
 		Attrs:      attrs,
 		OriginalIE: req,
 		BARID:      uint8(barid),
+
+		DLDataNotificationDelay:        ddnDelay,
+		SuggestedBufferingPacketsCount: bufPktsCnt,
+		DLBufferingDuration:            bufDuration,
 	}, nil
 }
 
@@ -1725,31 +2362,33 @@ type createdRules struct {
 // dependency order. Only rules whose creation succeeded are removed, so a rule
 // that already existed before the plan is never touched.
 func (g *Gtp5g) rollbackCreatedRules(plan *ModificationPlan, created *createdRules) {
+	link := g.sessLink(plan.SEID)
 	for _, p := range created.pdrs {
-		if err := gtp5gnl.RemovePDROID(g.client, g.link.link, p.OID); err != nil {
+		if err := g.sessClient(plan.SEID).RemovePDR(link.link, p.OID); err != nil {
 			g.log.Errorf("Rollback: RemovePDR[%#x] failed: %v", p.PDRID, err)
 		}
 	}
 	for _, p := range created.bars {
-		if err := gtp5gnl.RemoveBAROID(g.client, g.link.link, p.OID); err != nil {
+		if err := g.sessClient(plan.SEID).RemoveBAR(link.link, p.OID); err != nil {
 			g.log.Errorf("Rollback: RemoveBAR[%#x] failed: %v", p.BARID, err)
 		}
 	}
 	for _, p := range created.urrs {
-		if _, err := gtp5gnl.RemoveURROID(g.client, g.link.link, p.OID); err != nil {
+		if _, err := g.sessClient(plan.SEID).RemoveURR(link.link, p.OID); err != nil {
 			g.log.Errorf("Rollback: RemoveURR[%#x] failed: %v", p.URRID, err)
 		}
 		g.ps.DelPeriodReportTimer(plan.SEID, p.URRID)
 	}
 	for _, p := range created.qers {
-		if err := gtp5gnl.RemoveQEROID(g.client, g.link.link, p.OID); err != nil {
+		if err := g.sessClient(plan.SEID).RemoveQER(link.link, p.OID); err != nil {
 			g.log.Errorf("Rollback: RemoveQER[%#x] failed: %v", p.QERID, err)
 		}
 	}
 	for _, p := range created.fars {
-		if err := gtp5gnl.RemoveFAROID(g.client, g.link.link, p.OID); err != nil {
+		if err := g.sessClient(plan.SEID).RemoveFAR(link.link, p.OID); err != nil {
 			g.log.Errorf("Rollback: RemoveFAR[%#x] failed: %v", p.FARID, err)
 		}
+		g.delDuplFAR(p.OID)
 	}
 }
 
@@ -1766,21 +2405,33 @@ func (g *Gtp5g) rollbackCreatedRules(plan *ModificationPlan, created *createdRul
 // updated rule cannot be restored), and callers that build Remove-only plans
 // (e.g. session close in node.go) rely on this to clean up as much as possible.
 func (g *Gtp5g) ExecuteModificationPlan(plan *ModificationPlan) (*ExecutionResult, error) {
+	// the packets forwarded by the UPF see the rules changed
+	defer g.flushPDRs(plan.SEID)
 	result := NewExecutionResult()
 	created := &createdRules{}
+	err := g.bindSess(plan)
+	if err != nil {
+		return nil, errors.Wrap(err, "ModificationPlan")
+	}
+	link := g.sessLink(plan.SEID)
+	if plan.Release {
+		defer g.releaseSess(plan.SEID)
+		defer g.forgetActivity(plan.SEID)
+	}
 
 	for _, p := range plan.CreateFARs {
-		if err := gtp5gnl.CreateFAROID(g.client, g.link.link, p.OID, p.Attrs); err != nil {
+		if err := g.sessClient(plan.SEID).CreateFAR(link.link, p.OID, p.Attrs); err != nil {
 			g.rollbackCreatedRules(plan, created)
-			return nil, errors.Wrapf(err, "ModificationPlan: CreateFAR[%#x] failed", p.FARID)
+			return nil, errors.Wrap(&RuleError{Type: ie.RuleIDTypeFAR, ID: p.FARID, Err: err}, "ModificationPlan: CreateFAR failed")
 		}
 		created.fars = append(created.fars, p)
+		g.setDuplFAR(p)
 	}
 
 	for _, p := range plan.CreateQERs {
-		if err := gtp5gnl.CreateQEROID(g.client, g.link.link, p.OID, p.Attrs); err != nil {
+		if err := g.sessClient(plan.SEID).CreateQER(link.link, p.OID, p.Attrs); err != nil {
 			g.rollbackCreatedRules(plan, created)
-			return nil, errors.Wrapf(err, "ModificationPlan: CreateQER[%#x] failed", p.QERID)
+			return nil, errors.Wrap(&RuleError{Type: ie.RuleIDTypeQER, ID: p.QERID, Err: err}, "ModificationPlan: CreateQER failed")
 		}
 		created.qers = append(created.qers, p)
 	}
@@ -1789,26 +2440,26 @@ func (g *Gtp5g) ExecuteModificationPlan(plan *ModificationPlan) (*ExecutionResul
 		if p.ReportingTrigger.PERIO() && p.MeasurePeriod > 0 {
 			g.ps.AddPeriodReportTimer(plan.SEID, p.URRID, p.MeasurePeriod)
 		}
-		if err := gtp5gnl.CreateURROID(g.client, g.link.link, p.OID, p.Attrs); err != nil {
+		if err := g.sessClient(plan.SEID).CreateURR(link.link, p.OID, p.Attrs); err != nil {
 			g.ps.DelPeriodReportTimer(plan.SEID, p.URRID)
 			g.rollbackCreatedRules(plan, created)
-			return nil, errors.Wrapf(err, "ModificationPlan: CreateURR[%#x] failed", p.URRID)
+			return nil, errors.Wrap(&RuleError{Type: ie.RuleIDTypeURR, ID: p.URRID, Err: err}, "ModificationPlan: CreateURR failed")
 		}
 		created.urrs = append(created.urrs, p)
 	}
 
 	for _, p := range plan.CreateBARs {
-		if err := gtp5gnl.CreateBAROID(g.client, g.link.link, p.OID, p.Attrs); err != nil {
+		if err := g.sessClient(plan.SEID).CreateBAR(link.link, p.OID, p.Attrs); err != nil {
 			g.rollbackCreatedRules(plan, created)
-			return nil, errors.Wrapf(err, "ModificationPlan: CreateBAR[%#x] failed", p.BARID)
+			return nil, errors.Wrap(&RuleError{Type: ie.RuleIDTypeBAR, ID: uint32(p.BARID), Err: err}, "ModificationPlan: CreateBAR failed")
 		}
 		created.bars = append(created.bars, p)
 	}
 
 	for _, p := range plan.CreatePDRs {
-		if err := gtp5gnl.CreatePDROID(g.client, g.link.link, p.OID, p.Attrs); err != nil {
+		if err := g.sessClient(plan.SEID).CreatePDR(link.link, p.OID, p.Attrs); err != nil {
 			g.rollbackCreatedRules(plan, created)
-			return nil, errors.Wrapf(err, "ModificationPlan: CreatePDR[%#x] failed", p.PDRID)
+			return nil, errors.Wrap(&RuleError{Type: ie.RuleIDTypePDR, ID: uint32(p.PDRID), Err: err}, "ModificationPlan: CreatePDR failed")
 		}
 		created.pdrs = append(created.pdrs, p)
 	}
@@ -1817,20 +2468,20 @@ func (g *Gtp5g) ExecuteModificationPlan(plan *ModificationPlan) (*ExecutionResul
 	// already succeeded at this point, so a later failure here is logged and
 	// execution continues instead of rolling back the created rules.
 	for _, p := range plan.RemovePDRs {
-		if err := gtp5gnl.RemovePDROID(g.client, g.link.link, p.OID); err != nil {
+		if err := g.sessClient(plan.SEID).RemovePDR(link.link, p.OID); err != nil {
 			g.log.Errorf("ExecuteModificationPlan: RemovePDR[%#x] failed: %v", p.PDRID, err)
 		}
 	}
 
 	for _, p := range plan.RemoveBARs {
-		if err := gtp5gnl.RemoveBAROID(g.client, g.link.link, p.OID); err != nil {
+		if err := g.sessClient(plan.SEID).RemoveBAR(link.link, p.OID); err != nil {
 			g.log.Errorf("ExecuteModificationPlan: RemoveBAR[%#x] failed: %v", p.BARID, err)
 		}
 	}
 
 	for _, p := range plan.RemoveURRs {
 		g.ps.DelPeriodReportTimer(plan.SEID, p.URRID)
-		rs, err := gtp5gnl.RemoveURROID(g.client, g.link.link, p.OID)
+		rs, err := g.sessClient(plan.SEID).RemoveURR(link.link, p.OID)
 		if err != nil {
 			g.log.Errorf("ExecuteModificationPlan: RemoveURR[%#x] failed: %v", p.URRID, err)
 		}
@@ -1840,21 +2491,23 @@ func (g *Gtp5g) ExecuteModificationPlan(plan *ModificationPlan) (*ExecutionResul
 	}
 
 	for _, p := range plan.RemoveQERs {
-		if err := gtp5gnl.RemoveQEROID(g.client, g.link.link, p.OID); err != nil {
+		if err := g.sessClient(plan.SEID).RemoveQER(link.link, p.OID); err != nil {
 			g.log.Errorf("ExecuteModificationPlan: RemoveQER[%#x] failed: %v", p.QERID, err)
 		}
 	}
 
 	for _, p := range plan.RemoveFARs {
-		if err := gtp5gnl.RemoveFAROID(g.client, g.link.link, p.OID); err != nil {
+		if err := g.sessClient(plan.SEID).RemoveFAR(link.link, p.OID); err != nil {
 			g.log.Errorf("ExecuteModificationPlan: RemoveFAR[%#x] failed: %v", p.FARID, err)
 		}
+		g.delDuplFAR(p.OID)
 	}
 
 	for _, p := range plan.UpdateFARs {
-		if err := gtp5gnl.UpdateFAROID(g.client, g.link.link, p.OID, p.Attrs); err != nil {
+		if err := g.sessClient(plan.SEID).UpdateFAR(link.link, p.OID, p.Attrs); err != nil {
 			g.log.Errorf("ExecuteModificationPlan: UpdateFAR[%#x] failed: %v", p.FARID, err)
 		}
+		g.setDuplFAR(p)
 
 		if p.ApplyAction != nil {
 			g.applyAction(plan.SEID, int(p.FARID), *p.ApplyAction)
@@ -1862,13 +2515,13 @@ func (g *Gtp5g) ExecuteModificationPlan(plan *ModificationPlan) (*ExecutionResul
 	}
 
 	for _, p := range plan.UpdateQERs {
-		if err := gtp5gnl.UpdateQEROID(g.client, g.link.link, p.OID, p.Attrs); err != nil {
+		if err := g.sessClient(plan.SEID).UpdateQER(link.link, p.OID, p.Attrs); err != nil {
 			g.log.Errorf("ExecuteModificationPlan: UpdateQER[%#x] failed: %v", p.QERID, err)
 		}
 	}
 
 	for _, p := range plan.UpdateURRs {
-		rs, err := gtp5gnl.UpdateURROID(g.client, g.link.link, p.OID, p.Attrs)
+		rs, err := g.sessClient(plan.SEID).UpdateURR(link.link, p.OID, p.Attrs)
 		if err != nil {
 			g.log.Errorf("ExecuteModificationPlan: UpdateURR[%#x] failed: %v", p.URRID, err)
 		}
@@ -1878,20 +2531,20 @@ func (g *Gtp5g) ExecuteModificationPlan(plan *ModificationPlan) (*ExecutionResul
 	}
 
 	for _, p := range plan.UpdateBARs {
-		if err := gtp5gnl.UpdateBAROID(g.client, g.link.link, p.OID, p.Attrs); err != nil {
+		if err := g.sessClient(plan.SEID).UpdateBAR(link.link, p.OID, p.Attrs); err != nil {
 			g.log.Errorf("ExecuteModificationPlan: UpdateBAR[%#x] failed: %v", p.BARID, err)
 		}
 	}
 
 	for _, p := range plan.UpdatePDRs {
-		if err := gtp5gnl.UpdatePDROID(g.client, g.link.link, p.OID, p.Attrs); err != nil {
+		if err := g.sessClient(plan.SEID).UpdatePDR(link.link, p.OID, p.Attrs); err != nil {
 			g.log.Errorf("ExecuteModificationPlan: UpdatePDR[%#x] failed: %v", p.PDRID, err)
 		}
 	}
 
 	// Execute Query operations
 	for _, p := range plan.QueryURRs {
-		rs, err := gtp5gnl.GetReportOID(g.client, g.link.link, p.OID)
+		rs, err := g.sessClient(plan.SEID).GetReport(link.link, p.OID)
 		if err != nil {
 			g.log.Errorf("ExecuteModificationPlan: QueryURR[%#x] failed: %v", p.QueryURRID, err)
 			continue
@@ -1901,23 +2554,44 @@ func (g *Gtp5g) ExecuteModificationPlan(plan *ModificationPlan) (*ExecutionResul
 		}
 	}
 
+	g.syncFARs(plan, link)
+	g.syncMarkings(plan, link)
+	g.syncHERules(plan, link)
+	if g.tap != nil {
+		g.tap.apply(plan)
+	}
+	if g.qmp != nil {
+		g.qmp.apply(plan)
+	}
+	if g.limit != nil {
+		g.limit.apply(plan)
+	}
+
 	return result, nil
 }
 
 // ExecuteEstablishmentPlan executes Create operations for session establishment.
 // Uses fail-fast semantics: returns error on first failure.
 func (g *Gtp5g) ExecuteEstablishmentPlan(plan *ModificationPlan) (*ExecutionResult, error) {
+	// the packets forwarded by the UPF see the rules changed
+	defer g.flushPDRs(plan.SEID)
 	result := NewExecutionResult()
+	err := g.bindSess(plan)
+	if err != nil {
+		return nil, errors.Wrap(err, "EstablishmentPlan")
+	}
+	link := g.sessLink(plan.SEID)
 
 	for _, p := range plan.CreateFARs {
-		if err := gtp5gnl.CreateFAROID(g.client, g.link.link, p.OID, p.Attrs); err != nil {
-			return nil, errors.Wrapf(err, "EstablishmentPlan: CreateFAR[%#x] failed", p.FARID)
+		if err := g.sessClient(plan.SEID).CreateFAR(link.link, p.OID, p.Attrs); err != nil {
+			return nil, errors.Wrap(&RuleError{Type: ie.RuleIDTypeFAR, ID: p.FARID, Err: err}, "EstablishmentPlan: CreateFAR failed")
 		}
+		g.setDuplFAR(p)
 	}
 
 	for _, p := range plan.CreateQERs {
-		if err := gtp5gnl.CreateQEROID(g.client, g.link.link, p.OID, p.Attrs); err != nil {
-			return nil, errors.Wrapf(err, "EstablishmentPlan: CreateQER[%#x] failed", p.QERID)
+		if err := g.sessClient(plan.SEID).CreateQER(link.link, p.OID, p.Attrs); err != nil {
+			return nil, errors.Wrap(&RuleError{Type: ie.RuleIDTypeQER, ID: p.QERID, Err: err}, "EstablishmentPlan: CreateQER failed")
 		}
 	}
 
@@ -1925,22 +2599,34 @@ func (g *Gtp5g) ExecuteEstablishmentPlan(plan *ModificationPlan) (*ExecutionResu
 		if p.ReportingTrigger.PERIO() && p.MeasurePeriod > 0 {
 			g.ps.AddPeriodReportTimer(plan.SEID, p.URRID, p.MeasurePeriod)
 		}
-		if err := gtp5gnl.CreateURROID(g.client, g.link.link, p.OID, p.Attrs); err != nil {
-			return nil, errors.Wrapf(err, "EstablishmentPlan: CreateURR[%#x] failed", p.URRID)
+		if err := g.sessClient(plan.SEID).CreateURR(link.link, p.OID, p.Attrs); err != nil {
+			return nil, errors.Wrap(&RuleError{Type: ie.RuleIDTypeURR, ID: p.URRID, Err: err}, "EstablishmentPlan: CreateURR failed")
 		}
 	}
 
 	for _, p := range plan.CreateBARs {
-		if err := gtp5gnl.CreateBAROID(g.client, g.link.link, p.OID, p.Attrs); err != nil {
-			return nil, errors.Wrapf(err, "EstablishmentPlan: CreateBAR[%#x] failed", p.BARID)
+		if err := g.sessClient(plan.SEID).CreateBAR(link.link, p.OID, p.Attrs); err != nil {
+			return nil, errors.Wrap(&RuleError{Type: ie.RuleIDTypeBAR, ID: uint32(p.BARID), Err: err}, "EstablishmentPlan: CreateBAR failed")
 		}
 	}
 
 	for _, p := range plan.CreatePDRs {
-		if err := gtp5gnl.CreatePDROID(g.client, g.link.link, p.OID, p.Attrs); err != nil {
-			return nil, errors.Wrapf(err, "EstablishmentPlan: CreatePDR[%#x] failed", p.PDRID)
+		if err := g.sessClient(plan.SEID).CreatePDR(link.link, p.OID, p.Attrs); err != nil {
+			return nil, errors.Wrap(&RuleError{Type: ie.RuleIDTypePDR, ID: uint32(p.PDRID), Err: err}, "EstablishmentPlan: CreatePDR failed")
 		}
 	}
+	g.syncFARs(plan, link)
+	g.syncMarkings(plan, link)
+	g.syncHERules(plan, link)
+	if g.tap != nil {
+		g.tap.apply(plan)
+	}
+	if g.qmp != nil {
+		g.qmp.apply(plan)
+	}
+	if g.limit != nil {
+		g.limit.apply(plan)
+	}
 
 	return result, nil
 }
@@ -14,6 +14,7 @@ import (
 	"github.com/wmnsk/go-pfcp/ie"
 
 	"github.com/free5gc/go-gtp5gnl"
+	"github.com/free5gc/go-upf/internal/logger"
 	"github.com/free5gc/go-upf/internal/report"
 	"github.com/free5gc/go-upf/pkg/factory"
 )
@@ -40,6 +41,34 @@ func (h *testHandler) PopBufPkt(lSeid uint64, pdrid uint16) ([]byte, bool) {
 	return nil, true
 }
 
+func (h *testHandler) DropBufPkt(lSeid uint64, pdrid uint16) bool {
+	return false
+}
+
+func TestBuildPlanOffendingIE(t *testing.T) {
+	g := &Gtp5g{log: logger.FwderLog}
+
+	_, err := g.BuildCreateFARPlan(1, ie.NewCreateFAR(
+		ie.NewFARID(1),
+		ie.New(ie.ApplyAction, nil),
+	))
+	require.Error(t, err)
+	assert.Equal(t, ie.ApplyAction, OffendingIE(err))
+
+	_, err = g.BuildCreateURRPlan(1, ie.NewCreateURR(
+		ie.NewURRID(1),
+		ie.NewMeasurementMethod(0, 1, 0),
+		ie.NewReportingTriggers(0x01, 0x00),
+	))
+	require.Error(t, err)
+	assert.Equal(t, ie.MeasurementPeriod, OffendingIE(err))
+
+	// an error of the rule itself
+	_, err = g.BuildCreateQERPlan(1, ie.NewCreateFAR(ie.NewFARID(1)))
+	require.Error(t, err)
+	assert.Zero(t, OffendingIE(err))
+}
+
 func TestGtp5g_CreateRules(t *testing.T) {
 	if testing.Short() {
 		t.Skip("skipping testing in short mode")
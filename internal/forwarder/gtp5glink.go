@@ -1,9 +1,12 @@
 package forwarder
 
 import (
+	"encoding/binary"
 	"net"
 	"os"
+	"sync"
 	"syscall"
+	"unsafe"
 
 	"github.com/khirono/go-nl"
 	"github.com/khirono/go-rtnllink"
@@ -19,14 +22,17 @@ type Gtp5gLink struct {
 	rtconn *nl.Conn
 	client *nl.Client
 	link   *gtp5gnl.Link
+	addr   *net.UDPAddr
 	conn   *net.UDPConn
 	f      *os.File
 	log    *logrus.Entry
+	raw    *rawSocket
 }
 
-func OpenGtp5gLink(mux *nl.Mux, addr string, mtu uint32, log *logrus.Entry) (*Gtp5gLink, error) {
+func OpenGtp5gLink(mux *nl.Mux, name string, addr string, mtu uint32, log *logrus.Entry) (*Gtp5gLink, error) {
 	g := &Gtp5gLink{
 		log: log,
+		raw: newRawSocket(0),
 	}
 
 	g.mux = mux
@@ -43,6 +49,7 @@ func OpenGtp5gLink(mux *nl.Mux, addr string, mtu uint32, log *logrus.Entry) (*Gt
 		g.Close()
 		return nil, errors.Wrap(err, "resolve addr")
 	}
+	g.addr = laddr
 	conn, err := net.ListenUDP("udp4", laddr)
 	if err != nil {
 		g.Close()
@@ -89,17 +96,17 @@ func OpenGtp5gLink(mux *nl.Mux, addr string, mtu uint32, log *logrus.Entry) (*Gt
 		})
 	}
 
-	err = rtnllink.Create(g.client, "upfgtp", attrs...)
+	err = rtnllink.Create(g.client, name, attrs...)
 	if err != nil {
 		g.Close()
 		return nil, errors.Wrap(err, "create")
 	}
-	err = rtnllink.Up(g.client, "upfgtp")
+	err = rtnllink.Up(g.client, name)
 	if err != nil {
 		g.Close()
 		return nil, errors.Wrap(err, "up")
 	}
-	link, err := gtp5gnl.GetLink("upfgtp")
+	link, err := gtp5gnl.GetLink(name)
 	if err != nil {
 		g.Close()
 		return nil, errors.Wrap(err, "get link")
@@ -122,7 +129,7 @@ func (g *Gtp5gLink) Close() {
 		}
 	}
 	if g.link != nil {
-		err := rtnllink.Remove(g.client, "upfgtp")
+		err := rtnllink.Remove(g.client, g.link.Name)
 		if err != nil {
 			g.log.Warnf("rtnllink remove err: %+v", err)
 		}
@@ -130,6 +137,10 @@ func (g *Gtp5gLink) Close() {
 	if g.rtconn != nil {
 		g.rtconn.Close()
 	}
+	err := g.raw.close()
+	if err != nil {
+		g.log.Warnf("raw socket close err: %+v", err)
+	}
 }
 
 func (g *Gtp5gLink) RouteAdd(dst *net.IPNet) error {
@@ -153,5 +164,85 @@ func (g *Gtp5gLink) RouteAdd(dst *net.IPNet) error {
 }
 
 func (g *Gtp5gLink) WriteTo(b []byte, addr net.Addr) (int, error) {
-	return g.conn.WriteTo(b, addr)
+	return g.WriteToTOS(b, addr, 0)
+}
+
+// WriteToTOS sends a packet with the ToS of its outer IP header, the
+// Transport Level Marking of the G-PDUs forwarded by the UPF itself. The ToS
+// is given with the packet, so the packets sent concurrently from the
+// socket don't share it.
+func (g *Gtp5gLink) WriteToTOS(b []byte, addr net.Addr, tos uint8) (int, error) {
+	a, ok := addr.(*net.UDPAddr)
+	if !ok {
+		return 0, errors.Errorf("WriteToTOS: not a UDP address: %v", addr)
+	}
+	n, _, err := g.conn.WriteMsgUDP(b, tosCmsg(tos), a)
+	return n, err
+}
+
+// tosCmsg returns the ancillary data of the ToS of a packet sent from a UDP
+// socket
+func tosCmsg(tos uint8) []byte {
+	oob := make([]byte, syscall.CmsgSpace(4))
+	h := (*syscall.Cmsghdr)(unsafe.Pointer(&oob[0]))
+	h.Level = syscall.IPPROTO_IP
+	h.Type = syscall.IP_TOS
+	h.SetLen(syscall.CmsgLen(4))
+	binary.NativeEndian.PutUint32(oob[syscall.CmsgLen(0):], uint32(tos))
+	return oob
+}
+
+// WriteIP sends an IPv4 packet to its destination through the routing of
+// the host, for a packet forwarded to the DN by the UPF itself
+func (g *Gtp5gLink) WriteIP(b []byte) error {
+	return g.raw.write(b)
+}
+
+// rawSocket is a raw IPv4 socket, opened on first use. The packets sent
+// from it carry the firewall mark, if any, for the policy routing to look
+// them up in the routing table of a DNN.
+type rawSocket struct {
+	mu   sync.Mutex
+	fd   int
+	mark uint32
+}
+
+func newRawSocket(mark uint32) *rawSocket {
+	return &rawSocket{fd: -1, mark: mark}
+}
+
+func (r *rawSocket) write(b []byte) error {
+	if len(b) < 20 || b[0]>>4 != 4 {
+		return errors.New("not an IPv4 packet")
+	}
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	if r.fd < 0 {
+		fd, err := syscall.Socket(syscall.AF_INET, syscall.SOCK_RAW, syscall.IPPROTO_RAW)
+		if err != nil {
+			return errors.Wrap(err, "open raw socket")
+		}
+		if r.mark != 0 {
+			err = syscall.SetsockoptInt(fd, syscall.SOL_SOCKET, syscall.SO_MARK, int(r.mark))
+			if err != nil {
+				syscall.Close(fd)
+				return errors.Wrap(err, "mark raw socket")
+			}
+		}
+		r.fd = fd
+	}
+	var dst syscall.SockaddrInet4
+	copy(dst.Addr[:], b[16:20])
+	return syscall.Sendto(r.fd, b, 0, &dst)
+}
+
+func (r *rawSocket) close() error {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	if r.fd < 0 {
+		return nil
+	}
+	err := syscall.Close(r.fd)
+	r.fd = -1
+	return err
 }
@@ -0,0 +1,280 @@
+package forwarder
+
+import (
+	"sort"
+
+	"github.com/khirono/go-nl"
+	"github.com/pkg/errors"
+	"github.com/wmnsk/go-pfcp/ie"
+
+	"github.com/free5gc/go-gtp5gnl"
+)
+
+// transportLevelMarking returns the ToS of a Transport Level Marking IE.
+// The kernel module sets the ToS of the outer IP header as a whole, so the
+// ToS mask is not applied.
+func transportLevelMarking(i *ie.IE) (uint8, error) {
+	v, err := i.TransportLevelMarking()
+	if err != nil {
+		return 0, errors.Wrap(err, "failed to parse TransportLevelMarking")
+	}
+	return uint8(v >> 8), nil
+}
+
+// findTransportLevelMarking returns the ToS of the Transport Level Marking
+// of the Forwarding Parameters, or nil if it is not provided
+func findTransportLevelMarking(ies []*ie.IE) (*uint8, error) {
+	for _, x := range ies {
+		if x.Type != ie.TransportLevelMarking {
+			continue
+		}
+		v, err := transportLevelMarking(x)
+		if err != nil {
+			return nil, err
+		}
+		return &v, nil
+	}
+	return nil, nil
+}
+
+// dscpToS returns the ToS of a DSCP
+func dscpToS(dscp uint8) uint8 {
+	return dscp << 2
+}
+
+// farAttrParam returns the Forwarding Parameters of the attributes of a FAR
+func farAttrParam(attrs []nl.Attr) (nl.AttrList, bool) {
+	for _, a := range attrs {
+		if a.Type == gtp5gnl.FAR_FORWARDING_PARAMETER {
+			v, ok := a.Value.(nl.AttrList)
+			return v, ok
+		}
+	}
+	return nil, false
+}
+
+// withTosTc returns a copy of the attributes of Forwarding Parameters with
+// the ToS set
+func withTosTc(param nl.AttrList, tos uint8) nl.AttrList {
+	attrs := make(nl.AttrList, 0, len(param)+1)
+	for _, a := range param {
+		if a.Type != gtp5gnl.FORWARDING_PARAMETER_TOS_TC {
+			attrs = append(attrs, a)
+		}
+	}
+	return append(attrs, nl.Attr{Type: gtp5gnl.FORWARDING_PARAMETER_TOS_TC, Value: nl.AttrU8(tos)})
+}
+
+// farMarking is the marking of the outer IP header of the G-PDUs of a FAR
+type farMarking struct {
+	tos    *uint8      // Transport Level Marking of the FAR
+	encap  bool        // the FAR has an Outer Header Creation
+	kernel uint8       // ToS programmed in the kernel module
+	param  nl.AttrList // Forwarding Parameters programmed in the kernel module
+}
+
+type qerMarking struct {
+	tos *uint8 // Transport Level Marking of the QER
+	qfi *uint8
+}
+
+type pdrMarking struct {
+	farid  uint32
+	qerids []uint32
+}
+
+// sessMarking is the Transport Level Marking of the FARs of a session. A
+// FAR without a Transport Level Marking of its own is marked by the QERs of
+// its PDRs: by their Transport Level Marking, or by the DSCP configured for
+// the 5QI of their QFI.
+type sessMarking struct {
+	fars map[uint32]*farMarking
+	qers map[uint32]*qerMarking
+	pdrs map[uint16]*pdrMarking
+}
+
+func newSessMarking() *sessMarking {
+	return &sessMarking{
+		fars: make(map[uint32]*farMarking),
+		qers: make(map[uint32]*qerMarking),
+		pdrs: make(map[uint16]*pdrMarking),
+	}
+}
+
+// apply records the rules of an executed plan, and returns the ToS of the
+// FARs whose ToS programmed in the kernel module differs from their marking
+func (m *sessMarking) apply(plan *ModificationPlan, dscp map[uint8]uint8) map[uint32]uint8 {
+	for _, p := range plan.RemoveFARs {
+		delete(m.fars, p.FARID)
+	}
+	for _, p := range plan.RemoveQERs {
+		delete(m.qers, p.QERID)
+	}
+	for _, p := range plan.RemovePDRs {
+		delete(m.pdrs, p.PDRID)
+	}
+	for _, ps := range [][]*FARPlan{plan.CreateFARs, plan.UpdateFARs} {
+		for _, p := range ps {
+			f, ok := m.fars[p.FARID]
+			if !ok {
+				f = &farMarking{}
+				m.fars[p.FARID] = f
+			}
+			param, ok := farAttrParam(p.Attrs)
+			if !ok {
+				continue
+			}
+			// the kernel module replaces the Forwarding Parameters as a whole
+			if p.TransportLevelMarking != nil {
+				f.tos = p.TransportLevelMarking
+			}
+			f.encap = false
+			f.kernel = 0
+			f.param = param
+			for _, a := range param {
+				switch a.Type {
+				case gtp5gnl.FORWARDING_PARAMETER_OUTER_HEADER_CREATION:
+					f.encap = true
+				case gtp5gnl.FORWARDING_PARAMETER_TOS_TC:
+					v, _ := a.Value.(nl.AttrU8)
+					f.kernel = uint8(v)
+				}
+			}
+		}
+	}
+	for _, ps := range [][]*QERPlan{plan.CreateQERs, plan.UpdateQERs} {
+		for _, p := range ps {
+			q, ok := m.qers[p.QERID]
+			if !ok {
+				q = &qerMarking{}
+				m.qers[p.QERID] = q
+			}
+			if p.TransportLevelMarking != nil {
+				q.tos = p.TransportLevelMarking
+			}
+			if p.QFI != nil {
+				q.qfi = p.QFI
+			}
+		}
+	}
+	for _, ps := range [][]*PDRPlan{plan.CreatePDRs, plan.UpdatePDRs} {
+		for _, p := range ps {
+			r, ok := m.pdrs[p.PDRID]
+			if !ok {
+				r = &pdrMarking{}
+				m.pdrs[p.PDRID] = r
+			}
+			if p.FARID != nil {
+				r.farid = *p.FARID
+			}
+			if p.QERIDs != nil {
+				r.qerids = p.QERIDs
+			}
+		}
+	}
+
+	updates := make(map[uint32]uint8)
+	for farid, f := range m.fars {
+		if !f.encap {
+			continue
+		}
+		tos := m.marking(farid, f, dscp)
+		if tos != f.kernel {
+			updates[farid] = tos
+		}
+	}
+	return updates
+}
+
+// marking returns the ToS of the G-PDUs of a FAR
+func (m *sessMarking) marking(farid uint32, f *farMarking, dscp map[uint8]uint8) uint8 {
+	if f.tos != nil {
+		return *f.tos
+	}
+	var qers []*qerMarking
+	pdrids := make([]uint16, 0, len(m.pdrs))
+	for pdrid, r := range m.pdrs {
+		if r.farid == farid {
+			pdrids = append(pdrids, pdrid)
+		}
+	}
+	sort.Slice(pdrids, func(i, j int) bool { return pdrids[i] < pdrids[j] })
+	for _, pdrid := range pdrids {
+		for _, qerid := range m.pdrs[pdrid].qerids {
+			if q, ok := m.qers[qerid]; ok {
+				qers = append(qers, q)
+			}
+		}
+	}
+	for _, q := range qers {
+		if q.tos != nil {
+			return *q.tos
+		}
+	}
+	for _, q := range qers {
+		if q.qfi == nil {
+			continue
+		}
+		if v, ok := dscp[*q.qfi]; ok {
+			return dscpToS(v)
+		}
+	}
+	return 0
+}
+
+// setDscp sets the DSCP by QFI, from the 5QI of the QFIs, of the FARs without
+// a Transport Level Marking
+func (g *Gtp5g) setDscp(dscp map[uint8]uint8) {
+	g.markMu.Lock()
+	defer g.markMu.Unlock()
+	g.dscp = dscp
+}
+
+// syncMarkings records the rules of an executed plan, and programs the ToS
+// of the FARs whose marking is given by their QERs
+func (g *Gtp5g) syncMarkings(plan *ModificationPlan, link *Gtp5gLink) {
+	g.markMu.Lock()
+	if plan.Release {
+		delete(g.marks, plan.SEID)
+		g.markMu.Unlock()
+		return
+	}
+	m, ok := g.marks[plan.SEID]
+	if !ok {
+		m = newSessMarking()
+		g.marks[plan.SEID] = m
+	}
+	updates := m.apply(plan, g.dscp)
+	g.markMu.Unlock()
+
+	for farid, tos := range updates {
+		g.markMu.Lock()
+		f, ok := m.fars[farid]
+		var param nl.AttrList
+		if ok {
+			param = withTosTc(f.param, tos)
+		}
+		g.markMu.Unlock()
+		if !ok {
+			continue
+		}
+		oid := gtp5gnl.OID{plan.SEID, uint64(farid)}
+		err := g.updateFARMarking(link, oid, param)
+		if err != nil {
+			g.log.Errorf("syncMarkings: FAR[%#x]: %v", farid, err)
+			continue
+		}
+		g.markMu.Lock()
+		f.kernel = tos
+		f.param = param
+		g.markMu.Unlock()
+	}
+}
+
+// updateFARMarking programs the ToS of a FAR. The kernel module replaces the
+// Forwarding Parameters as a whole, so they are given again as programmed
+// with the Outer Header Creation of the SMF.
+func (g *Gtp5g) updateFARMarking(link *Gtp5gLink, oid gtp5gnl.OID, param nl.AttrList) error {
+	attrs := []nl.Attr{{Type: gtp5gnl.FAR_FORWARDING_PARAMETER, Value: param}}
+	return errors.Wrap(g.sessClient(oid[0]).UpdateFAR(link.link, oid, attrs), "UpdateFAR")
+}
@@ -0,0 +1,221 @@
+package forwarder
+
+import (
+	"net"
+	"syscall"
+	"testing"
+	"time"
+
+	"github.com/khirono/go-nl"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"github.com/wmnsk/go-pfcp/ie"
+
+	"github.com/free5gc/go-gtp5gnl"
+	"github.com/free5gc/go-upf/internal/logger"
+)
+
+func TestBuildPlanTransportLevelMarking(t *testing.T) {
+	g := &Gtp5g{log: logger.FwderLog}
+
+	p, err := g.BuildCreateFARPlan(1, ie.NewCreateFAR(
+		ie.NewFARID(1),
+		ie.NewApplyAction(0x02),
+		ie.NewForwardingParameters(
+			ie.NewDestinationInterface(ie.DstInterfaceAccess),
+			ie.NewOuterHeaderCreation(0x0100, 1, "10.200.200.1", "", 0, 0, 0),
+			ie.NewTransportLevelMarking(0xb8ff),
+		),
+	))
+	require.NoError(t, err)
+	require.NotNil(t, p.TransportLevelMarking)
+	assert.Equal(t, uint8(0xb8), *p.TransportLevelMarking)
+	param, ok := farAttrParam(p.Attrs)
+	require.True(t, ok)
+	assert.Contains(t, param, nlAttrTOS(0xb8))
+
+	q, err := g.BuildCreateQERPlan(1, ie.NewCreateQER(
+		ie.NewQERID(1),
+		ie.NewGateStatus(0, 0),
+		ie.NewQFI(1),
+		ie.NewTransportLevelMarking(0x68ff),
+	))
+	require.NoError(t, err)
+	require.NotNil(t, q.TransportLevelMarking)
+	assert.Equal(t, uint8(0x68), *q.TransportLevelMarking)
+
+	// an unparsable marking fails the FAR, not only the marking
+	bad := ie.New(ie.TransportLevelMarking, []byte{0xb8})
+	_, err = g.newForwardingParameter([]*ie.IE{bad})
+	assert.Error(t, err)
+	_, err = g.BuildUpdateFARPlan(1, ie.NewUpdateFAR(
+		ie.NewFARID(1),
+		ie.NewUpdateForwardingParameters(bad),
+	))
+	assert.Error(t, err)
+}
+
+func TestSessMarking(t *testing.T) {
+	u32 := func(v uint32) *uint32 { return &v }
+	u8 := func(v uint8) *uint8 { return &v }
+	dscp := map[uint8]uint8{1: 46, 9: 10}
+	m := newSessMarking()
+
+	dl := &FARPlan{FARID: 1, Attrs: newFARAttrs(true, nil)}
+	ul := &FARPlan{FARID: 2, Attrs: newFARAttrs(false, nil)}
+	plan := &ModificationPlan{
+		CreateFARs: []*FARPlan{dl, ul},
+		CreateQERs: []*QERPlan{{QERID: 1, QFI: u8(9)}},
+		CreatePDRs: []*PDRPlan{
+			{PDRID: 1, FARID: u32(2), QERIDs: []uint32{1}},
+			{PDRID: 2, FARID: u32(1), QERIDs: []uint32{1}},
+		},
+	}
+	t.Run("DSCP of the QFI", func(t *testing.T) {
+		assert.Equal(t, map[uint32]uint8{1: 10 << 2}, m.apply(plan, dscp))
+		m.fars[1].kernel = 10 << 2
+
+		// the Outer Header Creation is kept with the ToS
+		param, ok := farAttrParam(dl.Attrs)
+		require.True(t, ok)
+		assert.Equal(t, param, m.fars[1].param)
+		assert.Equal(t, nl.AttrList{param[0], nlAttrTOS(10 << 2)}, withTosTc(param, 10<<2))
+		assert.Equal(t, nl.AttrList{param[0], nlAttrTOS(0x68)},
+			withTosTc(nl.AttrList{param[0], nlAttrTOS(10 << 2)}, 0x68))
+	})
+
+	t.Run("marking of the QER", func(t *testing.T) {
+		plan := &ModificationPlan{
+			UpdateQERs: []*QERPlan{{QERID: 1, TransportLevelMarking: u8(0x68)}},
+		}
+		assert.Equal(t, map[uint32]uint8{1: 0x68}, m.apply(plan, dscp))
+		m.fars[1].kernel = 0x68
+	})
+
+	t.Run("marking of the FAR", func(t *testing.T) {
+		tos := u8(0xb8)
+		plan := &ModificationPlan{
+			UpdateFARs: []*FARPlan{{FARID: 1, Attrs: newFARAttrs(true, tos), TransportLevelMarking: tos}},
+		}
+		assert.Empty(t, m.apply(plan, dscp))
+
+		// Forwarding Parameters updated without the marking
+		plan = &ModificationPlan{
+			UpdateFARs: []*FARPlan{{FARID: 1, Attrs: newFARAttrs(true, nil)}},
+		}
+		assert.Equal(t, map[uint32]uint8{1: 0xb8}, m.apply(plan, dscp))
+	})
+
+	t.Run("no QER", func(t *testing.T) {
+		m := newSessMarking()
+		plan := &ModificationPlan{
+			CreateFARs: []*FARPlan{{FARID: 1, Attrs: newFARAttrs(true, nil)}},
+			CreatePDRs: []*PDRPlan{{PDRID: 1, FARID: u32(1)}},
+		}
+		assert.Empty(t, m.apply(plan, dscp))
+	})
+}
+
+func TestWriteToTOS(t *testing.T) {
+	conn, err := net.ListenUDP("udp4", &net.UDPAddr{IP: net.IPv4(127, 0, 0, 1)})
+	require.NoError(t, err)
+	defer conn.Close()
+	peer, err := net.ListenUDP("udp4", &net.UDPAddr{IP: net.IPv4(127, 0, 0, 1)})
+	require.NoError(t, err)
+	defer peer.Close()
+	rc, err := peer.SyscallConn()
+	require.NoError(t, err)
+	var serr error
+	err = rc.Control(func(fd uintptr) {
+		serr = syscall.SetsockoptInt(int(fd), syscall.IPPROTO_IP, syscall.IP_RECVTOS, 1)
+	})
+	require.NoError(t, err)
+	require.NoError(t, serr)
+	link := &Gtp5gLink{conn: conn}
+
+	_, err = link.WriteToTOS([]byte{0}, peer.LocalAddr(), 0xb8)
+	require.NoError(t, err)
+	assert.Equal(t, uint8(0xb8), recvTOS(t, peer))
+
+	// the ToS is not left on the socket
+	_, err = link.WriteTo([]byte{0}, peer.LocalAddr())
+	require.NoError(t, err)
+	assert.Equal(t, uint8(0), recvTOS(t, peer))
+}
+
+func TestWritePacket(t *testing.T) {
+	listen := func() *net.UDPConn {
+		conn, err := net.ListenUDP("udp4", &net.UDPAddr{IP: net.IPv4(127, 0, 0, 1)})
+		require.NoError(t, err)
+		t.Cleanup(func() { conn.Close() })
+		return conn
+	}
+	n3 := &Gtp5gLink{conn: listen()}
+	n9 := &Gtp5gLink{conn: listen()}
+	peer := listen()
+	g := &Gtp5g{
+		link:      n3,
+		sessLinks: map[uint64]*Gtp5gLink{5: n9},
+	}
+	lSeid := uint64(5)
+	far := &gtp5gnl.FAR{
+		ID: 1,
+		Param: &gtp5gnl.ForwardParam{
+			Creation: &gtp5gnl.HeaderCreation{
+				Desc:     0x0100,
+				TEID:     0x22,
+				PeerAddr: net.IPv4(127, 0, 0, 1),
+				Port:     uint16(peer.LocalAddr().(*net.UDPAddr).Port),
+			},
+		},
+		SEID: &lSeid,
+	}
+
+	// sent from the link of the session
+	require.NoError(t, g.WritePacket(far, nil, []byte{0x45}))
+	require.NoError(t, peer.SetReadDeadline(time.Now().Add(time.Second)))
+	b := make([]byte, 64)
+	_, from, err := peer.ReadFromUDP(b)
+	require.NoError(t, err)
+	assert.Equal(t, n9.conn.LocalAddr().(*net.UDPAddr).Port, from.Port)
+}
+
+// recvTOS receives a packet and returns the ToS of its IP header
+func recvTOS(t *testing.T, conn *net.UDPConn) uint8 {
+	require.NoError(t, conn.SetReadDeadline(time.Now().Add(time.Second)))
+	b := make([]byte, 16)
+	oob := make([]byte, syscall.CmsgSpace(4))
+	_, oobn, _, _, err := conn.ReadMsgUDP(b, oob)
+	require.NoError(t, err)
+	msgs, err := syscall.ParseSocketControlMessage(oob[:oobn])
+	require.NoError(t, err)
+	for _, m := range msgs {
+		if m.Header.Level == syscall.IPPROTO_IP && m.Header.Type == syscall.IP_TOS && len(m.Data) > 0 {
+			return m.Data[0]
+		}
+	}
+	require.FailNow(t, "no ToS received")
+	return 0
+}
+
+func nlAttrTOS(tos uint8) nl.Attr {
+	return nl.Attr{Type: gtp5gnl.FORWARDING_PARAMETER_TOS_TC, Value: nl.AttrU8(tos)}
+}
+
+// newFARAttrs returns the attributes of a FAR with Forwarding Parameters,
+// encapsulating to the access if encap
+func newFARAttrs(encap bool, tos *uint8) []nl.Attr {
+	var param nl.AttrList
+	if encap {
+		param = append(param, nl.Attr{
+			Type: gtp5gnl.FORWARDING_PARAMETER_OUTER_HEADER_CREATION,
+			Value: nl.AttrList{
+				{Type: gtp5gnl.OUTER_HEADER_CREATION_DESCRIPTION, Value: nl.AttrU16(0x0100)},
+			},
+		})
+	}
+	if tos != nil {
+		param = append(param, nlAttrTOS(*tos))
+	}
+	return []nl.Attr{{Type: gtp5gnl.FAR_FORWARDING_PARAMETER, Value: param}}
+}
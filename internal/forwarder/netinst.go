@@ -0,0 +1,476 @@
+package forwarder
+
+import (
+	"fmt"
+	"net"
+	"slices"
+	"syscall"
+
+	"github.com/khirono/go-nl"
+	"github.com/khirono/go-rtnlroute"
+	"github.com/pkg/errors"
+	"github.com/wmnsk/go-pfcp/ie"
+
+	"github.com/free5gc/go-upf/pkg/factory"
+)
+
+const (
+	// Priority of the policy routing rules of the DNNs
+	RULE_PRIO_BASE = 1000
+
+	// from linux/fib_rules.h
+	FRA_SRC       = 2
+	FRA_IIFNAME   = 3
+	FRA_PRIORITY  = 6
+	FRA_FWMARK    = 10
+	FRA_TABLE     = 15
+	FR_ACT_TO_TBL = 1
+)
+
+// netInstance is the forwarding context of a Network Instance: the gtp5g
+// link forwarding its sessions and the routing table of its DNN
+type netInstance struct {
+	name  string
+	link  *Gtp5gLink
+	table uint32 // 0: main table
+	// socket of the UL packets sent to the DN by the UPF itself, marked
+	// to be routed by the table of the DNN; nil for the main table
+	raw *rawSocket
+}
+
+// WriteIP sends an IPv4 packet of a session of the Network Instance to the
+// DN, through the routing table of its DNN
+func (ni *netInstance) WriteIP(b []byte) error {
+	if ni.raw == nil {
+		return ni.link.WriteIP(b)
+	}
+	return ni.raw.write(b)
+}
+
+// routeTable returns the table of a route request
+func routeTable(r *rtnlroute.Request, table uint32) {
+	if table == 0 {
+		table = syscall.RT_TABLE_MAIN
+	}
+	if table < 256 {
+		r.Header.Table = uint8(table)
+	} else {
+		r.Header.Table = syscall.RT_TABLE_UNSPEC
+	}
+	r.Attrs = append(r.Attrs, nl.Attr{
+		Type:  syscall.RTA_TABLE,
+		Value: nl.AttrU32(table),
+	})
+}
+
+// rule is a policy routing rule looking up the table of a DNN
+type rule struct {
+	iif   string
+	src   *net.IPNet
+	mark  uint32
+	table uint32
+	prio  uint32
+}
+
+func (r *rule) request(typ int, flags int) (*nl.Request, error) {
+	req := nl.NewRequest(typ, flags)
+	// struct fib_rule_hdr has the layout of struct rtmsg
+	hdr := rtnlroute.Header{
+		Family: syscall.AF_INET,
+		Type:   FR_ACT_TO_TBL,
+	}
+	attrs := nl.AttrList{
+		{Type: FRA_TABLE, Value: nl.AttrU32(r.table)},
+		{Type: FRA_PRIORITY, Value: nl.AttrU32(r.prio)},
+	}
+	if r.table < 256 {
+		hdr.Table = uint8(r.table)
+	}
+	if r.iif != "" {
+		attrs = append(attrs, nl.Attr{Type: FRA_IIFNAME, Value: nl.AttrString(r.iif)})
+	}
+	if r.src != nil {
+		n, _ := r.src.Mask.Size()
+		hdr.Srclen = uint8(n)
+		attrs = append(attrs, nl.Attr{Type: FRA_SRC, Value: nl.AttrBytes(r.src.IP.To4())})
+	}
+	if r.mark != 0 {
+		attrs = append(attrs, nl.Attr{Type: FRA_FWMARK, Value: nl.AttrU32(r.mark)})
+	}
+	err := req.Append(hdr)
+	if err != nil {
+		return nil, err
+	}
+	err = req.Append(attrs)
+	if err != nil {
+		return nil, err
+	}
+	return req, nil
+}
+
+func (g *Gtp5g) ruleAdd(r rule) error {
+	req, err := r.request(syscall.RTM_NEWRULE, syscall.NLM_F_CREATE|syscall.NLM_F_EXCL|syscall.NLM_F_ACK)
+	if err != nil {
+		return err
+	}
+	_, err = g.link.client.Do(req)
+	if err != nil {
+		return err
+	}
+	g.rules = append(g.rules, r)
+	return nil
+}
+
+func (g *Gtp5g) routeAdd(r *rtnlroute.Request) error {
+	err := rtnlroute.Create(g.link.client, r)
+	if err != nil {
+		return err
+	}
+	g.routes = append(g.routes, r)
+	return nil
+}
+
+// AddDnn sets up the forwarding context of the Network Instance of a DNN:
+// the gtp5g link of the DNN, the route of its UEs and the policy routing
+// to its routing table
+func (g *Gtp5g) AddDnn(dnn *factory.DnnList, mtu uint32) error {
+	_, dst, err := net.ParseCIDR(dnn.Cidr)
+	if err != nil {
+		return errors.Wrapf(err, "DNN[%s]", dnn.Dnn)
+	}
+
+	link := g.link
+	if dnn.GtpuAddr != "" {
+		link, err = g.openNILink(dnn.GtpuAddr, mtu)
+		if err != nil {
+			return errors.Wrapf(err, "DNN[%s]", dnn.Dnn)
+		}
+	}
+
+	name := dnn.NetInstance()
+	ni, ok := g.nis[name]
+	if !ok {
+		ni = &netInstance{
+			name:  name,
+			link:  link,
+			table: dnn.Table,
+		}
+		if dnn.Table != 0 {
+			ni.raw = newRawSocket(dnn.Table)
+		}
+		g.nis[name] = ni
+	}
+
+	r := &rtnlroute.Request{
+		Header: rtnlroute.Header{
+			Scope:    syscall.RT_SCOPE_UNIVERSE,
+			Protocol: syscall.RTPROT_STATIC,
+			Type:     syscall.RTN_UNICAST,
+		},
+	}
+	routeTable(r, dnn.Table)
+	err = r.AddDst(dst)
+	if err != nil {
+		return err
+	}
+	err = r.AddIfName(link.link.Name)
+	if err != nil {
+		return err
+	}
+	err = rtnlroute.Create(g.link.client, r)
+	if err != nil {
+		return errors.Wrapf(err, "DNN[%s]: add route", dnn.Dnn)
+	}
+
+	if dnn.Table == 0 {
+		return nil
+	}
+
+	prio := uint32(RULE_PRIO_BASE + len(g.rules))
+	// UL: the packets decapsulated for the DNN
+	ul := rule{iif: link.link.Name, table: dnn.Table, prio: prio}
+	if link == g.link {
+		ul.src = dst
+	}
+	err = g.ruleAdd(ul)
+	if err != nil {
+		return errors.Wrapf(err, "DNN[%s]: add UL rule", dnn.Dnn)
+	}
+	if !ok {
+		// UL: the packets sent to the DN by the UPF itself, see
+		// netInstance.WriteIP
+		err = g.ruleAdd(rule{mark: dnn.Table, table: dnn.Table, prio: prio + 1})
+		if err != nil {
+			return errors.Wrapf(err, "DNN[%s]: add UPF UL rule", dnn.Dnn)
+		}
+	}
+
+	if dnn.IfName == "" {
+		return nil
+	}
+	// DL: the packets received from the DN of the DNN
+	err = g.ruleAdd(rule{iif: dnn.IfName, table: dnn.Table, prio: prio + 2})
+	if err != nil {
+		return errors.Wrapf(err, "DNN[%s]: add DL rule", dnn.Dnn)
+	}
+
+	if dnn.Gateway == "" {
+		return nil
+	}
+	dr := &rtnlroute.Request{
+		Header: rtnlroute.Header{
+			Family:   syscall.AF_INET,
+			Scope:    syscall.RT_SCOPE_UNIVERSE,
+			Protocol: syscall.RTPROT_STATIC,
+			Type:     syscall.RTN_UNICAST,
+		},
+		Attrs: nl.AttrList{
+			{Type: syscall.RTA_GATEWAY, Value: nl.AttrBytes(net.ParseIP(dnn.Gateway).To4())},
+		},
+	}
+	routeTable(dr, dnn.Table)
+	err = dr.AddIfName(dnn.IfName)
+	if err != nil {
+		return err
+	}
+	err = g.routeAdd(dr)
+	return errors.Wrapf(err, "DNN[%s]: add default route", dnn.Dnn)
+}
+
+// openNILink returns the gtp5g link of a GTP-U address of network instances
+func (g *Gtp5g) openNILink(addr string, mtu uint32) (*Gtp5gLink, error) {
+	gtpuAddr := g.gtpuAddr(addr)
+	if laddr, err := net.ResolveUDPAddr("udp4", gtpuAddr); err == nil {
+		if link := g.addrLink(laddr.IP); link == g.link && link.addr.Port == laddr.Port {
+			return link, nil
+		}
+	}
+	if link, ok := g.niLinks[gtpuAddr]; ok {
+		return link, nil
+	}
+	name := fmt.Sprintf("upfgtp%d", len(g.niLinks)+1)
+	link, err := OpenGtp5gLink(g.mux, name, gtpuAddr, mtu, g.log)
+	if err != nil {
+		return nil, errors.Wrapf(err, "open link %s", name)
+	}
+	g.niLinks[gtpuAddr] = link
+	g.setTapPorts()
+	return link, nil
+}
+
+// gtpuAddr returns the GTP-U endpoint of an address of the UPF, on the port
+// of its interface
+func (g *Gtp5g) gtpuAddr(addr string) string {
+	if g.gtpu != nil {
+		for i := range g.gtpu.IfList {
+			if g.gtpu.IfList[i].Addr == addr {
+				return g.gtpu.IfList[i].GtpuAddr()
+			}
+		}
+	}
+	return (&factory.IfInfo{Addr: addr}).GtpuAddr()
+}
+
+// peerPort returns the GTP-U port of a peer of the Outer Header Creation
+func (g *Gtp5g) peerPort(ip net.IP) uint16 {
+	if g.gtpu == nil {
+		return factory.UpfGtpDefaultPort
+	}
+	return g.gtpu.PeerPort(ip)
+}
+
+// setTapPorts lets the taps receive the GTP-U packets of all the links
+func (g *Gtp5g) setTapPorts() {
+	ports := []uint16{uint16(g.link.addr.Port)}
+	for _, link := range g.niLinks {
+		if !slices.Contains(ports, uint16(link.addr.Port)) {
+			ports = append(ports, uint16(link.addr.Port))
+		}
+	}
+	g.tap.setPorts(ports)
+	g.qmp.setPorts(ports)
+}
+
+// closeNetInstances removes the links, rules and routes of the DNNs
+func (g *Gtp5g) closeNetInstances() {
+	for _, r := range g.routes {
+		err := rtnlroute.Remove(g.link.client, r)
+		if err != nil {
+			g.log.Warnf("remove route err: %+v", err)
+		}
+	}
+	for _, r := range g.rules {
+		req, err := r.request(syscall.RTM_DELRULE, syscall.NLM_F_ACK)
+		if err == nil {
+			_, err = g.link.client.Do(req)
+		}
+		if err != nil {
+			g.log.Warnf("remove rule err: %+v", err)
+		}
+	}
+	for _, ni := range g.nis {
+		if ni.raw == nil {
+			continue
+		}
+		err := ni.raw.close()
+		if err != nil {
+			g.log.Warnf("raw socket close err: %+v", err)
+		}
+	}
+	for _, link := range g.niLinks {
+		link.Close()
+	}
+}
+
+// networkInstance returns the Network Instance in a PDI or Forwarding
+// Parameters
+func networkInstance(ies []*ie.IE) string {
+	for _, x := range ies {
+		if x.Type != ie.NetworkInstance {
+			continue
+		}
+		v, err := x.NetworkInstance()
+		if err != nil {
+			return ""
+		}
+		return v
+	}
+	return ""
+}
+
+// fteidAddr returns the IPv4 address of the F-TEID in a PDI
+func fteidAddr(ies []*ie.IE) net.IP {
+	for _, x := range ies {
+		if x.Type != ie.FTEID {
+			continue
+		}
+		v, err := x.FTEID()
+		if err != nil {
+			return nil
+		}
+		return v.IPv4Address
+	}
+	return nil
+}
+
+// destinationInterface returns the Destination Interface in Forwarding
+// Parameters
+func destinationInterface(ies []*ie.IE) *uint8 {
+	for _, x := range ies {
+		if x.Type != ie.DestinationInterface {
+			continue
+		}
+		v, err := x.DestinationInterface()
+		if err != nil {
+			return nil
+		}
+		return &v
+	}
+	return nil
+}
+
+// addrLink returns the gtp5g link receiving GTP-U on the address
+func (g *Gtp5g) addrLink(ip net.IP) *Gtp5gLink {
+	if g.link.addr != nil && g.link.addr.IP.Equal(ip) {
+		return g.link
+	}
+	for _, link := range g.niLinks {
+		if link.addr != nil && link.addr.IP.Equal(ip) {
+			return link
+		}
+	}
+	return nil
+}
+
+// tunnelLink returns the gtp5g link receiving the F-TEIDs of the PDRs in
+// the plan, or nil if none is on a GTP-U address of the UPF. All the tunnels
+// of a session, e.g. N3 and N9 of an ULCL, must be received by one link.
+func (g *Gtp5g) tunnelLink(plan *ModificationPlan) (*Gtp5gLink, error) {
+	var link *Gtp5gLink
+	for _, ps := range [][]*PDRPlan{plan.CreatePDRs, plan.UpdatePDRs} {
+		for _, p := range ps {
+			if p.FTEIDAddr == nil {
+				continue
+			}
+			l := g.addrLink(p.FTEIDAddr)
+			if l == nil {
+				continue
+			}
+			if link != nil && l != link {
+				return nil, errors.Errorf("PDR[%#x]: F-TEID %v on another GTP-U link", p.PDRID, p.FTEIDAddr)
+			}
+			link = l
+		}
+	}
+	return link, nil
+}
+
+// bindSess binds a session to the gtp5g link receiving its F-TEIDs, or else
+// to the forwarding context selected by the Network Instance of its PDIs, or
+// else of its FARs to the core side: the Network Instance of a FAR to the
+// access side names the access network, not a DNN. The Network Instance also
+// routes the UL packets the UPF sends to the DN itself, whichever link
+// receives the session. A session stays in its context until it is released.
+func (g *Gtp5g) bindSess(plan *ModificationPlan) error {
+	g.sessMu.Lock()
+	defer g.sessMu.Unlock()
+	tl, err := g.tunnelLink(plan)
+	if err != nil {
+		return err
+	}
+	if link, ok := g.sessLinks[plan.SEID]; ok {
+		if tl != nil && tl != link {
+			return errors.Errorf("session[%#x]: F-TEID on another GTP-U link", plan.SEID)
+		}
+		return nil
+	}
+	var names []string
+	for _, p := range plan.CreatePDRs {
+		names = append(names, p.NetworkInstance)
+	}
+	for _, p := range plan.CreateFARs {
+		if p.DstIf != nil && *p.DstIf == ie.DstInterfaceAccess {
+			continue
+		}
+		names = append(names, p.NetworkInstance)
+	}
+	link := g.link
+	for _, name := range names {
+		if ni, ok := g.nis[name]; ok {
+			g.log.Debugf("session[%#x] in network instance %q", plan.SEID, name)
+			link = ni.link
+			g.sessNIs[plan.SEID] = ni
+			break
+		}
+	}
+	if tl != nil {
+		link = tl
+	}
+	g.sessLinks[plan.SEID] = link
+	return nil
+}
+
+func (g *Gtp5g) releaseSess(lSeid uint64) {
+	g.sessMu.Lock()
+	defer g.sessMu.Unlock()
+	delete(g.sessLinks, lSeid)
+	delete(g.sessNIs, lSeid)
+}
+
+// sessNI returns the Network Instance of the session, or nil if it is
+// forwarded in the default context
+func (g *Gtp5g) sessNI(lSeid uint64) *netInstance {
+	g.sessMu.Lock()
+	defer g.sessMu.Unlock()
+	return g.sessNIs[lSeid]
+}
+
+// sessLink returns the gtp5g link forwarding the session
+func (g *Gtp5g) sessLink(lSeid uint64) *Gtp5gLink {
+	g.sessMu.Lock()
+	defer g.sessMu.Unlock()
+	if link, ok := g.sessLinks[lSeid]; ok {
+		return link
+	}
+	return g.link
+}
@@ -0,0 +1,137 @@
+package forwarder
+
+import (
+	"bytes"
+	"encoding/binary"
+	"syscall"
+	"testing"
+	"unsafe"
+
+	"github.com/khirono/go-nl"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"github.com/wmnsk/go-pfcp/ie"
+
+	"github.com/free5gc/go-gtp5gnl"
+	"github.com/free5gc/go-upf/internal/logger"
+	"github.com/free5gc/go-upf/pkg/factory"
+)
+
+func TestBindSess(t *testing.T) {
+	dflt, corp := &Gtp5gLink{}, &Gtp5gLink{}
+	g := &Gtp5g{
+		link: dflt,
+		log:  logger.FwderLog,
+		nis: map[string]*netInstance{
+			"internet": {name: "internet", link: dflt},
+			"corp":     {name: "corp", link: corp, table: 100, raw: newRawSocket(100)},
+		},
+		sessLinks: make(map[uint64]*Gtp5gLink),
+		sessNIs:   make(map[uint64]*netInstance),
+	}
+
+	pdr, err := g.BuildCreatePDRPlan(1, ie.NewCreatePDR(
+		ie.NewPDRID(1),
+		ie.NewPDI(
+			ie.NewSourceInterface(ie.SrcInterfaceAccess),
+			ie.NewNetworkInstance("corp"),
+		),
+	))
+	require.NoError(t, err)
+	assert.Equal(t, "corp", pdr.NetworkInstance)
+
+	plan := NewModificationPlan(1)
+	plan.CreatePDRs = append(plan.CreatePDRs, pdr)
+	g.bindSess(plan)
+	assert.Same(t, corp, g.sessLink(1))
+	// the UL sent by the UPF is routed by the table of the DNN
+	assert.Same(t, g.nis["corp"], g.sessNI(1))
+
+	// a session stays in its context until it is released
+	far, err := g.BuildUpdateFARPlan(1, ie.NewUpdateFAR(
+		ie.NewFARID(1),
+		ie.NewUpdateForwardingParameters(ie.NewNetworkInstance("internet")),
+	))
+	require.NoError(t, err)
+	assert.Equal(t, "internet", far.NetworkInstance)
+	plan = NewModificationPlan(1)
+	plan.CreateFARs = append(plan.CreateFARs, far)
+	g.bindSess(plan)
+	assert.Same(t, corp, g.sessLink(1))
+
+	g.releaseSess(1)
+	assert.Same(t, dflt, g.sessLink(1))
+	assert.Nil(t, g.sessNI(1))
+
+	// an unknown network instance is forwarded in the default context
+	far, err = g.BuildCreateFARPlan(2, ie.NewCreateFAR(
+		ie.NewFARID(1),
+		ie.NewForwardingParameters(ie.NewNetworkInstance("unknown")),
+	))
+	require.NoError(t, err)
+	plan = NewModificationPlan(2)
+	plan.CreateFARs = append(plan.CreateFARs, far)
+	g.bindSess(plan)
+	assert.Same(t, dflt, g.sessLink(2))
+	assert.Nil(t, g.sessNI(2))
+}
+
+func TestRuleRequest(t *testing.T) {
+	r := rule{mark: 100, table: 100, prio: RULE_PRIO_BASE}
+	req, err := r.request(syscall.RTM_NEWRULE, syscall.NLM_F_CREATE)
+	require.NoError(t, err)
+	b := requestBytes(req)
+	mark := make([]byte, 8)
+	binary.NativeEndian.PutUint16(mark[0:], 8)
+	binary.NativeEndian.PutUint16(mark[2:], FRA_FWMARK)
+	binary.NativeEndian.PutUint32(mark[4:], 100)
+	assert.True(t, bytes.Contains(b, mark))
+
+	// no mark matched by the rules of the decapsulated packets
+	r = rule{iif: "upfgtp", table: 100, prio: RULE_PRIO_BASE}
+	req, err = r.request(syscall.RTM_NEWRULE, syscall.NLM_F_CREATE)
+	require.NoError(t, err)
+	b = requestBytes(req)
+	assert.False(t, bytes.Contains(b, mark))
+}
+
+func TestPeerPort(t *testing.T) {
+	g := &Gtp5g{
+		log: logger.FwderLog,
+		gtpu: &factory.Gtpu{
+			IfList:    []factory.IfInfo{{Addr: "10.100.0.1", Port: 2153}},
+			PeerPorts: map[string]uint16{"10.200.200.102": 2154},
+		},
+	}
+	assert.Equal(t, "10.100.0.1:2153", g.gtpuAddr("10.100.0.1"))
+	assert.Equal(t, "10.100.0.2:2152", g.gtpuAddr("10.100.0.2"))
+
+	ohcPort := func(addr string) uint16 {
+		attrs, err := g.newForwardingParameter([]*ie.IE{
+			ie.NewOuterHeaderCreation(0x0100, 0x11, addr, "", 0, 0, 0),
+		})
+		require.NoError(t, err)
+		hc := findAttr(attrs, gtp5gnl.FORWARDING_PARAMETER_OUTER_HEADER_CREATION)
+		require.NotNil(t, hc)
+		port := findAttr(hc.Value.(nl.AttrList), gtp5gnl.OUTER_HEADER_CREATION_PORT)
+		require.NotNil(t, port)
+		return uint16(port.Value.(nl.AttrU16))
+	}
+	assert.Equal(t, uint16(2154), ohcPort("10.200.200.102"))
+	assert.Equal(t, uint16(2152), ohcPort("10.200.200.101"))
+
+	d, err := g.newDuplication([]*ie.IE{
+		ie.NewOuterHeaderCreation(0x0100, 0x11, "10.200.200.102", "", 0, 0, 0),
+	})
+	require.NoError(t, err)
+	assert.Equal(t, "10.200.200.102:2154", d.Addr.String())
+}
+
+// requestBytes returns the payload of a netlink request
+func requestBytes(req *nl.Request) []byte {
+	var b []byte
+	for _, iov := range req.Iovs[1:] {
+		b = append(b, unsafe.Slice(iov.Base, iov.Len)...)
+	}
+	return b
+}
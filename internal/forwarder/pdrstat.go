@@ -0,0 +1,87 @@
+package forwarder
+
+import (
+	"bufio"
+	"fmt"
+	"io"
+	"os"
+	"strconv"
+	"strings"
+	"sync"
+
+	"github.com/pkg/errors"
+)
+
+// PROC_PDR is the proc file of gtp5g showing the counters of a PDR: the
+// PDR is selected by writing "<link> <SEID> <PDR ID>" to it
+const PROC_PDR = "/proc/gtp5g/pdr"
+
+// pdrStat is the counters of a kernel PDR
+type pdrStat struct {
+	ULPkts  uint64
+	DLPkts  uint64
+	ULDrops uint64
+	DLDrops uint64
+}
+
+// pdrStats reads the counters of the kernel PDRs; the selection of the proc
+// file is global, so its reads are serialized
+type pdrStats struct {
+	mu   sync.Mutex
+	path string
+}
+
+func (p *pdrStats) read(link string, lSeid uint64, pdrid uint16) (*pdrStat, error) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	f, err := os.OpenFile(p.path, os.O_RDWR, 0)
+	if err != nil {
+		return nil, errors.Wrap(err, "pdrStat")
+	}
+	defer f.Close()
+	if _, err = fmt.Fprintf(f, "%s %d %d", link, lSeid, pdrid); err != nil {
+		return nil, errors.Wrapf(err, "pdrStat: select PDR[%#x:%#x]", lSeid, pdrid)
+	}
+	if _, err = f.Seek(0, io.SeekStart); err != nil {
+		return nil, errors.Wrap(err, "pdrStat")
+	}
+	return parsePDRStat(f)
+}
+
+// parsePDRStat parses the "Name: value" lines of the proc file; the drop
+// counts are printed in hex
+func parsePDRStat(r io.Reader) (*pdrStat, error) {
+	st := new(pdrStat)
+	fields := map[string]*uint64{
+		"UL Packet Count": &st.ULPkts,
+		"DL Packet Count": &st.DLPkts,
+		"UL Drop Count":   &st.ULDrops,
+		"DL Drop Count":   &st.DLDrops,
+	}
+	found := 0
+	sc := bufio.NewScanner(r)
+	for sc.Scan() {
+		name, val, ok := strings.Cut(sc.Text(), ":")
+		if !ok {
+			continue
+		}
+		p, ok := fields[strings.TrimSpace(name)]
+		if !ok {
+			continue
+		}
+		v, err := strconv.ParseUint(strings.TrimSpace(val), 0, 64)
+		if err != nil {
+			return nil, errors.Wrapf(err, "parsePDRStat: %s", name)
+		}
+		*p = v
+		found++
+	}
+	if err := sc.Err(); err != nil {
+		return nil, errors.Wrap(err, "parsePDRStat")
+	}
+	if found == 0 {
+		return nil, errors.New("parsePDRStat: no counters")
+	}
+	return st, nil
+}
@@ -0,0 +1,38 @@
+package forwarder
+
+import (
+	"strings"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestParsePDRStat(t *testing.T) {
+	t.Run("proc file", func(t *testing.T) {
+		st, err := parsePDRStat(strings.NewReader(`PDR:
+	 SEID : 1
+	 ID : 2
+	 Precedence: 255
+	 FAR ID: 2
+	 UL Drop Count: 0x3
+	 DL Drop Count: 0x10
+	 UL Packet Count: 120
+	 DL Packet Count: 340
+	 UL Byte Count: 12000
+	 DL Byte Count: 34000
+`))
+		require.NoError(t, err)
+		assert.Equal(t, &pdrStat{ULPkts: 120, DLPkts: 340, ULDrops: 3, DLDrops: 16}, st)
+	})
+
+	t.Run("no counters", func(t *testing.T) {
+		_, err := parsePDRStat(strings.NewReader("PDR not found\n"))
+		assert.Error(t, err)
+	})
+
+	t.Run("bad counter", func(t *testing.T) {
+		_, err := parsePDRStat(strings.NewReader("UL Packet Count: x\n"))
+		assert.Error(t, err)
+	})
+}
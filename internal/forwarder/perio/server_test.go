@@ -26,6 +26,10 @@ func (h *testHandler) PopBufPkt(lSeid uint64, pdrid uint16) ([]byte, bool) {
 	return nil, true
 }
 
+func (h *testHandler) DropBufPkt(lSeid uint64, pdrid uint16) bool {
+	return false
+}
+
 func testGetUSAReport(lSeidUrridsMap map[uint64][]uint32) (map[uint64][]report.USAReport, error) {
 	sessUsars := make(map[uint64][]report.USAReport)
 
@@ -1,6 +1,7 @@
 package forwarder
 
 import (
+	"net"
 	"time"
 
 	"github.com/khirono/go-nl"
@@ -39,8 +40,14 @@ type PDRPlan struct {
 	Attrs      []nl.Attr
 	OriginalIE *ie.IE
 	// Parsed fields for node.go to use
-	PDRID  uint16
-	URRIDs []uint32
+	PDRID           uint16
+	FARID           *uint32
+	URRIDs          []uint32
+	QERIDs          []uint32
+	NetworkInstance string
+	FTEIDAddr       net.IP  // local GTP-U address of the PDI F-TEID
+	ULTEID          *uint32 // TEID of the PDI F-TEID for the uplink from the access
+	Ethernet        bool    // the PDI identifies the frames of an Ethernet PDU session
 }
 
 // FARPlan contains validated FAR operation parameters
@@ -50,8 +57,16 @@ type FARPlan struct {
 	Attrs      []nl.Attr
 	OriginalIE *ie.IE
 	// Parsed fields
-	FARID       uint32
-	ApplyAction *report.ApplyAction // for UpdateFAR side effects
+	FARID           uint32
+	NetworkInstance string
+	DstIf           *uint8              // Destination Interface of the Forwarding Parameters
+	ApplyAction     *report.ApplyAction // for UpdateFAR side effects
+	Duplications    []Duplication       // nil if the Duplicating Parameters are not provided
+	// nil if the Header Enrichment of the Forwarding Parameters is not provided
+	HeaderEnrichment []HeaderEnrichment
+	Redirect         *Redirect // nil if the Redirect Information is not provided
+	// ToS of the Transport Level Marking of the Forwarding Parameters
+	TransportLevelMarking *uint8
 }
 
 // QERPlan contains validated QER operation parameters
@@ -61,7 +76,10 @@ type QERPlan struct {
 	Attrs      []nl.Attr
 	OriginalIE *ie.IE
 	// Parsed fields
-	QERID uint32
+	QERID                 uint32
+	QFI                   *uint8
+	PPI                   *uint8
+	TransportLevelMarking *uint8 // ToS of the QoS flow of the QER
 }
 
 // URRPlan contains validated URR operation parameters
@@ -76,6 +94,19 @@ type URRPlan struct {
 	ReportingTrigger report.ReportingTrigger
 	MeasurePeriod    time.Duration
 	MeasureInfoIE    *ie.IE // for node.go to extract MeasureInformation
+	// Handled by node.go, not by the forwarder
+	DroppedDLThreshold *report.DroppedDLThreshold
+	EventThreshold     *uint32
+	EventQuota         *uint32
+	LinkedURRIDs       []uint32
+	EthInactivityTimer *time.Duration
+	QuotaFARID         *uint32        // FAR ID for Quota Action
+	TimeQuota          *time.Duration // the Time Quota is enforced by node.go
+	VolumeQuota        bool           // a Volume Quota is granted
+
+	// The Reporting Triggers IE is present, even with no trigger set, in
+	// an UpdateURR
+	HasReportingTrigger bool
 	// For QueryURR
 	QueryURRID uint32
 }
@@ -88,12 +119,18 @@ type BARPlan struct {
 	OriginalIE *ie.IE
 	// Parsed fields
 	BARID uint8
+	// Handled by node.go for the buffering in the UPF
+	DLDataNotificationDelay        *time.Duration
+	SuggestedBufferingPacketsCount *uint16
+	DLBufferingDuration            *time.Duration // only in Session Report Response
 }
 
 // ModificationPlan contains all validated rule operations for a session modification
 // Operations should be executed in the order defined here
 type ModificationPlan struct {
 	SEID uint64
+	// Release indicates the session is released with the plan
+	Release bool
 
 	// Create operations - order: FAR -> QER -> URR -> BAR -> PDR
 	CreateFARs []*FARPlan
@@ -0,0 +1,376 @@
+package forwarder
+
+import (
+	"net"
+	"slices"
+	"sort"
+	"sync"
+	"syscall"
+	"time"
+
+	"github.com/pkg/errors"
+	"github.com/sirupsen/logrus"
+
+	"github.com/free5gc/go-gtp5gnl"
+	"github.com/free5gc/go-upf/internal/gtpv1"
+	"github.com/free5gc/go-upf/internal/report"
+	"github.com/free5gc/go-upf/pkg/factory"
+)
+
+const (
+	// QMP_DELAY_RESULT_UNIT is the unit of the DL/UL Delay Result of the UL
+	// PDU Session Information, TS 38.415 5.5.3.20
+	QMP_DELAY_RESULT_UNIT = 100 * time.Microsecond
+	// QMP_WATCH_TIMEOUT is the time the answers of a session are received
+	// after its last QoS monitoring packet
+	QMP_WATCH_TIMEOUT = 10 * time.Second
+)
+
+// flowFARs returns the FARs encapsulating the packets of the PDRs of a QoS
+// flow, in the order of their PDRs
+func (m *sessMarking) flowFARs(qfi uint8) []uint32 {
+	pdrids := make([]uint16, 0, len(m.pdrs))
+	for pdrid := range m.pdrs {
+		pdrids = append(pdrids, pdrid)
+	}
+	sort.Slice(pdrids, func(i, j int) bool { return pdrids[i] < pdrids[j] })
+
+	var farids []uint32
+	for _, pdrid := range pdrids {
+		r := m.pdrs[pdrid]
+		f, ok := m.fars[r.farid]
+		if !ok || !f.encap {
+			continue
+		}
+		for _, qerid := range r.qerids {
+			if q, ok := m.qers[qerid]; ok && q.qfi != nil && *q.qfi == qfi {
+				farids = append(farids, r.farid)
+				break
+			}
+		}
+	}
+	return farids
+}
+
+// SendQoSMonitoring sends a QoS monitoring packet in the downlink of a QoS
+// flow of a session: a G-PDU without a T-PDU, with the DL Sending Time Stamp
+// in its PDU Session Container. The NG-RAN answers it in the uplink, and the
+// delays measured are reported as a report.QoSMonitoringReport.
+func (g *Gtp5g) SendQoSMonitoring(lSeid uint64, qfi uint8) error {
+	link := g.sessLink(lSeid)
+
+	g.markMu.Lock()
+	var farids []uint32
+	if m, ok := g.marks[lSeid]; ok {
+		farids = m.flowFARs(qfi)
+	}
+	g.markMu.Unlock()
+
+	for _, farid := range farids {
+		oid := gtp5gnl.OID{lSeid, uint64(farid)}
+		if st, ok := g.farState(oid); !ok || !st.access {
+			continue
+		}
+		far, err := g.sessClient(lSeid).GetFAR(link.link, oid)
+		if err != nil {
+			return errors.Wrapf(err, "SendQoSMonitoring: GetFAR[%#x]", farid)
+		}
+		if far.Param == nil || far.Param.Creation == nil {
+			continue
+		}
+		g.qmp.watch(lSeid, time.Now())
+
+		hc := far.Param.Creation
+		msg := gtpv1.Message{
+			Flags: 0x34,
+			Type:  gtpv1.MsgTypeTPDU,
+			TEID:  hc.TEID,
+			Exts: []gtpv1.Encoder{
+				gtpv1.PDUSessionContainer{
+					PDUType:       gtpv1.PDUTypeDL,
+					QoSFlowID:     qfi,
+					QMP:           true,
+					DLSendingTime: gtpv1.NTPTimestamp(time.Now()),
+				},
+			},
+		}
+		b := make([]byte, msg.Len())
+		_, err = msg.Encode(b)
+		if err != nil {
+			return err
+		}
+		addr := &net.UDPAddr{IP: hc.PeerAddr, Port: int(hc.Port)}
+		_, err = link.WriteToTOS(b, addr, far.Param.TosTc)
+		return errors.Wrap(err, "SendQoSMonitoring")
+	}
+	return errors.Errorf("SendQoSMonitoring: no downlink tunnel of QFI %d", qfi)
+}
+
+// StopQoSMonitoring stops receiving the QoS monitoring packets of a session
+// whose QoS flows are no longer monitored
+func (g *Gtp5g) StopQoSMonitoring(lSeid uint64) {
+	g.qmp.unwatch(lSeid)
+}
+
+func (g *Gtp5g) notifyQoSMonitoring(lSeid uint64, r report.QoSMonitoringReport) {
+	if g.handler == nil {
+		return
+	}
+	g.handler.NotifySessReport(report.SessReport{
+		SEID:    lSeid,
+		Reports: []report.Report{r},
+	})
+}
+
+// qmpDelays returns the delays measured by a QoS monitoring packet answered
+// at now. The round trip is measured without synchronized clocks; the DL and
+// UL delays need the NG-RAN synchronized with the UPF. The DL/UL Delay
+// Results add the delays of the radio interface.
+func qmpDelays(info *gtpv1.ULPDUSessionInformation, now time.Time) report.QoSMonitoringReport {
+	t1 := gtpv1.NTPTime(info.DLSendingTimeRepeat)
+	t2 := gtpv1.NTPTime(info.DLReceivedTime)
+	t3 := gtpv1.NTPTime(info.ULSendingTime)
+	r := report.QoSMonitoringReport{
+		QFI:  info.QoSFlowID,
+		DL:   max(t2.Sub(t1), 0),
+		UL:   max(now.Sub(t3), 0),
+		Time: now,
+	}
+	r.RP = max(now.Sub(t1)-t3.Sub(t2), 0)
+	if info.DLDelayResult != nil {
+		d := time.Duration(*info.DLDelayResult) * QMP_DELAY_RESULT_UNIT
+		r.DL += d
+		r.RP += d
+	}
+	if info.ULDelayResult != nil {
+		d := time.Duration(*info.ULDelayResult) * QMP_DELAY_RESULT_UNIT
+		r.UL += d
+		r.RP += d
+	}
+	return r
+}
+
+// qmpTap receives the QoS monitoring packets answered by the NG-RAN. The
+// kernel module does not pass up the G-PDUs it receives, so the uplink GTP-U
+// packets are tapped, only while the QoS of sessions is monitored, as the
+// macTap does. A session is monitored until its monitoring is stopped, or
+// QMP_WATCH_TIMEOUT after its last QoS monitoring packet.
+type qmpTap struct {
+	wg     *sync.WaitGroup
+	log    *logrus.Entry
+	notify func(lSeid uint64, r report.QoSMonitoringReport)
+
+	mu       sync.Mutex
+	ports    []uint16             // GTP-U ports of the links
+	tunnels  map[macKey]uint64    // value: lSeid
+	sessions map[uint64]time.Time // key: lSeid of the sessions monitored, value: last packet
+	done     chan struct{}        // non-nil while the tap is open
+}
+
+func newQMPTap(
+	wg *sync.WaitGroup,
+	log *logrus.Entry,
+	notify func(lSeid uint64, r report.QoSMonitoringReport),
+) *qmpTap {
+	return &qmpTap{
+		wg:       wg,
+		log:      log,
+		notify:   notify,
+		ports:    []uint16{factory.UpfGtpDefaultPort},
+		tunnels:  make(map[macKey]uint64),
+		sessions: make(map[uint64]time.Time),
+	}
+}
+
+// apply follows the uplink tunnels of the sessions of an executed plan
+func (t *qmpTap) apply(plan *ModificationPlan) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	if plan.Release {
+		for k, lSeid := range t.tunnels {
+			if lSeid == plan.SEID {
+				delete(t.tunnels, k)
+			}
+		}
+		delete(t.sessions, plan.SEID)
+		t.update()
+		return
+	}
+	for _, ps := range [][]*PDRPlan{plan.CreatePDRs, plan.UpdatePDRs} {
+		for _, p := range ps {
+			if p.ULTEID == nil {
+				continue
+			}
+			k, ok := newMacKey(p.FTEIDAddr, *p.ULTEID)
+			if !ok {
+				continue
+			}
+			t.tunnels[k] = plan.SEID
+		}
+	}
+}
+
+// watch opens the tap for a session sending QoS monitoring packets
+func (t *qmpTap) watch(lSeid uint64, now time.Time) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	t.sessions[lSeid] = now
+	t.update()
+}
+
+// unwatch closes the tap for a session, once no other session is monitored
+func (t *qmpTap) unwatch(lSeid uint64) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	if _, ok := t.sessions[lSeid]; !ok {
+		return
+	}
+	delete(t.sessions, lSeid)
+	t.update()
+}
+
+// expire stops monitoring the sessions without QoS monitoring packets for
+// QMP_WATCH_TIMEOUT
+func (t *qmpTap) expire(now time.Time) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	n := len(t.sessions)
+	for lSeid, last := range t.sessions {
+		if now.Sub(last) >= QMP_WATCH_TIMEOUT {
+			delete(t.sessions, lSeid)
+		}
+	}
+	if len(t.sessions) != n {
+		t.update()
+	}
+}
+
+// update opens the tap while sessions are monitored, and closes it after
+func (t *qmpTap) update() {
+	if len(t.sessions) == 0 {
+		t.stop()
+		return
+	}
+	if t.done != nil {
+		return
+	}
+	fd, err := openGTPUTapSocket(t.ports)
+	if err != nil {
+		t.log.Errorf("open QoS monitoring tap err: %+v", err)
+		return
+	}
+	t.log.Infoln("QoS monitoring tap opened")
+	done := make(chan struct{})
+	t.done = done
+	t.wg.Add(1)
+	go func() {
+		defer t.wg.Done()
+		t.run(fd, done)
+	}()
+}
+
+// setPorts sets the GTP-U ports tapped from the next opening
+func (t *qmpTap) setPorts(ports []uint16) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	t.ports = ports
+}
+
+func (t *qmpTap) stop() {
+	if t.done == nil {
+		return
+	}
+	close(t.done)
+	t.done = nil
+	t.log.Infoln("QoS monitoring tap closed")
+}
+
+func (t *qmpTap) Close() {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	t.stop()
+}
+
+func (t *qmpTap) run(fd int, done chan struct{}) {
+	defer func() {
+		err := syscall.Close(fd)
+		if err != nil {
+			t.log.Warnf("QoS monitoring tap close err: %+v", err)
+		}
+	}()
+
+	b := make([]byte, MAC_TAP_SNAPLEN)
+	for {
+		select {
+		case <-done:
+			return
+		default:
+		}
+		n, from, err := syscall.Recvfrom(fd, b, 0)
+		if err != nil {
+			if errors.Is(err, syscall.EAGAIN) || errors.Is(err, syscall.EINTR) {
+				t.expire(time.Now())
+				continue
+			}
+			t.log.Errorf("QoS monitoring tap read err: %+v", err)
+			return
+		}
+		if ll, ok := from.(*syscall.SockaddrLinklayer); ok && ll.Pkttype == syscall.PACKET_OUTGOING {
+			continue
+		}
+		t.receive(b[:n], time.Now())
+	}
+}
+
+// receive notifies the delays of a QoS monitoring packet answered in the
+// uplink of a session monitored
+func (t *qmpTap) receive(b []byte, now time.Time) {
+	t.mu.Lock()
+	k, info, ok := parseQMPPacket(b, t.ports)
+	var lSeid uint64
+	if ok {
+		lSeid, ok = t.tunnels[k]
+	}
+	if ok {
+		var last time.Time
+		last, ok = t.sessions[lSeid]
+		ok = ok && now.Sub(last) < QMP_WATCH_TIMEOUT
+	}
+	t.mu.Unlock()
+	if !ok {
+		return
+	}
+	t.notify(lSeid, qmpDelays(info, now))
+}
+
+// parseQMPPacket returns the tunnel and the UL PDU Session Information of a
+// QoS monitoring packet to one of the ports in an IPv4 packet
+func parseQMPPacket(b []byte, ports []uint16) (macKey, *gtpv1.ULPDUSessionInformation, bool) {
+	var k macKey
+	if len(b) < 20 || b[0]>>4 != 4 || b[9] != syscall.IPPROTO_UDP {
+		return k, nil, false
+	}
+	copy(k.addr[:], b[16:20])
+	off := int(b[0]&0x0f) * 4
+	if len(b) < off+8 || !slices.Contains(ports, uint16(b[off+2])<<8|uint16(b[off+3])) {
+		return k, nil, false
+	}
+	msg, err := gtpv1.ParseMessage(b[off+8:])
+	if err != nil || msg.Type != gtpv1.MsgTypeTPDU {
+		return k, nil, false
+	}
+	k.teid = msg.TEID
+	for _, e := range msg.Exts {
+		x, ok := e.(gtpv1.Extension)
+		if !ok || x.Type != gtpv1.ExtTypePDUSessionContainer {
+			continue
+		}
+		info, err := gtpv1.ParseULPDUSessionInformation(x.Content)
+		if err != nil || !info.QMP {
+			return k, nil, false
+		}
+		return k, info, true
+	}
+	return k, nil, false
+}
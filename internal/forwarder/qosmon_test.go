@@ -0,0 +1,166 @@
+package forwarder
+
+import (
+	"encoding/binary"
+	"net"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+
+	"github.com/free5gc/go-upf/internal/gtpv1"
+	"github.com/free5gc/go-upf/internal/logger"
+	"github.com/free5gc/go-upf/internal/report"
+)
+
+// newQMPPacket returns a QoS monitoring packet answered by the NG-RAN in the
+// uplink tunnel 10.200.200.102/teid
+func newQMPPacket(teid uint32, qfi uint8, t1, t2, t3 time.Time, dlResult *uint32) []byte {
+	flags := uint8(gtpv1.PDUTypeUL<<4 | 0x08)
+	content := []byte{flags, qfi}
+	for _, t := range []time.Time{t1, t2, t3} {
+		content = binary.BigEndian.AppendUint64(content, gtpv1.NTPTimestamp(t))
+	}
+	if dlResult != nil {
+		content[0] |= 0x04
+		content = binary.BigEndian.AppendUint32(content, *dlResult)
+	}
+	for (len(content)+2)%4 != 0 {
+		content = append(content, 0)
+	}
+	msg := gtpv1.Message{
+		Flags: 0x34,
+		Type:  gtpv1.MsgTypeTPDU,
+		TEID:  teid,
+		Exts:  []gtpv1.Encoder{gtpv1.Extension{Type: gtpv1.ExtTypePDUSessionContainer, Content: content}},
+	}
+	gtp := make([]byte, msg.Len())
+	_, err := msg.Encode(gtp)
+	if err != nil {
+		panic(err)
+	}
+
+	b := []byte{0x45, 0, 0, 0, 0, 0, 0x40, 0, 64, IP_PROTO_UDP, 0, 0}
+	b = append(b, 10, 200, 200, 1)
+	b = append(b, 10, 200, 200, 102)
+	udp := make([]byte, 8)
+	binary.BigEndian.PutUint16(udp[0:], 2152)
+	binary.BigEndian.PutUint16(udp[2:], 2152)
+	binary.BigEndian.PutUint16(udp[4:], uint16(8+len(gtp)))
+	b = append(b, udp...)
+	b = append(b, gtp...)
+	binary.BigEndian.PutUint16(b[2:], uint16(len(b)))
+	return b
+}
+
+func TestQMPDelays(t *testing.T) {
+	t1 := time.Unix(1700000000, 0)
+	t2 := t1.Add(3 * time.Millisecond)
+	t3 := t2.Add(time.Millisecond)
+	t4 := t3.Add(2 * time.Millisecond)
+
+	k, info, ok := parseQMPPacket(newQMPPacket(0x10, 9, t1, t2, t3, nil), gtpuPorts)
+	require.True(t, ok)
+	assert.Equal(t, uint32(0x10), k.teid)
+	assert.Equal(t, [4]byte{10, 200, 200, 102}, k.addr)
+	r := qmpDelays(info, t4)
+	assert.Equal(t, uint8(9), r.QFI)
+	assertDelay(t, 3*time.Millisecond, r.DL)
+	assertDelay(t, 2*time.Millisecond, r.UL)
+	assertDelay(t, 5*time.Millisecond, r.RP)
+
+	// with the delay of the radio interface, in units of 0.1 ms
+	result := uint32(15)
+	_, info, ok = parseQMPPacket(newQMPPacket(0x10, 9, t1, t2, t3, &result), gtpuPorts)
+	require.True(t, ok)
+	r = qmpDelays(info, t4)
+	assertDelay(t, 4500*time.Microsecond, r.DL)
+	assertDelay(t, 6500*time.Microsecond, r.RP)
+
+	// the round trip does not need synchronized clocks
+	skew := time.Second
+	_, info, ok = parseQMPPacket(newQMPPacket(0x10, 9, t1, t2.Add(skew), t3.Add(skew), nil), gtpuPorts)
+	require.True(t, ok)
+	r = qmpDelays(info, t4)
+	assertDelay(t, 5*time.Millisecond, r.RP)
+	assert.Zero(t, r.UL)
+}
+
+func TestQMPTap(t *testing.T) {
+	var got []report.QoSMonitoringReport
+	tap := newQMPTap(&sync.WaitGroup{}, logger.FwderLog, func(lSeid uint64, r report.QoSMonitoringReport) {
+		assert.Equal(t, uint64(1), lSeid)
+		got = append(got, r)
+	})
+	teid := uint32(0x10)
+	tap.apply(&ModificationPlan{
+		SEID: 1,
+		CreatePDRs: []*PDRPlan{
+			{PDRID: 1, FTEIDAddr: net.IPv4(10, 200, 200, 102), ULTEID: &teid},
+		},
+	})
+	now := time.Now()
+	pkt := newQMPPacket(teid, 9, now, now, now, nil)
+
+	// not monitored
+	tap.receive(pkt, now)
+	assert.Empty(t, got)
+
+	tap.sessions[1] = now
+	tap.receive(pkt, now)
+	require.Len(t, got, 1)
+	assert.Equal(t, uint8(9), got[0].QFI)
+
+	tap.receive(newQMPPacket(0x11, 9, now, now, now, nil), now)
+	assert.Len(t, got, 1)
+
+	// no longer received after the last packet
+	later := now.Add(QMP_WATCH_TIMEOUT)
+	tap.receive(pkt, later)
+	assert.Len(t, got, 1)
+	tap.expire(later)
+	assert.Empty(t, tap.sessions)
+
+	// nor once the monitoring is stopped
+	tap.sessions[1] = now
+	tap.unwatch(1)
+	assert.Empty(t, tap.sessions)
+	tap.receive(pkt, now)
+	assert.Len(t, got, 1)
+
+	tap.sessions[1] = now
+
+	tap.apply(&ModificationPlan{SEID: 1, Release: true})
+	assert.Empty(t, tap.tunnels)
+	assert.Empty(t, tap.sessions)
+}
+
+func TestFlowFARs(t *testing.T) {
+	u32 := func(v uint32) *uint32 { return &v }
+	u8 := func(v uint8) *uint8 { return &v }
+	m := newSessMarking()
+	m.apply(&ModificationPlan{
+		CreateFARs: []*FARPlan{
+			{FARID: 1, Attrs: newFARAttrs(false, nil)},
+			{FARID: 2, Attrs: newFARAttrs(true, nil)},
+			{FARID: 3, Attrs: newFARAttrs(true, nil)},
+		},
+		CreateQERs: []*QERPlan{{QERID: 1, QFI: u8(9)}, {QERID: 2, QFI: u8(1)}},
+		CreatePDRs: []*PDRPlan{
+			{PDRID: 1, FARID: u32(1), QERIDs: []uint32{1}},
+			{PDRID: 2, FARID: u32(2), QERIDs: []uint32{1}},
+			{PDRID: 3, FARID: u32(3), QERIDs: []uint32{2}},
+		},
+	}, nil)
+	assert.Equal(t, []uint32{2}, m.flowFARs(9))
+	assert.Equal(t, []uint32{3}, m.flowFARs(1))
+	assert.Empty(t, m.flowFARs(5))
+}
+
+// assertDelay asserts a delay measured with the NTP timestamps, which are
+// truncated to fractions of a second
+func assertDelay(t *testing.T, expected, actual time.Duration) {
+	assert.InDelta(t, float64(expected), float64(actual), float64(time.Microsecond))
+}
@@ -0,0 +1,286 @@
+package forwarder
+
+import (
+	"sync"
+	"time"
+
+	"github.com/pkg/errors"
+
+	"github.com/free5gc/go-gtp5gnl"
+	"github.com/free5gc/go-upf/internal/report"
+)
+
+// RATE_LIMIT_BURST is the traffic a token bucket holds, at its rate
+const RATE_LIMIT_BURST = 100 * time.Millisecond
+
+// errRateLimited is returned for a packet exceeding the MBR of its QERs
+var errRateLimited = errors.New("MBR exceeded")
+
+// tokenBucket limits the rate of the packets sent by the UPF itself. A
+// packet is sent while the bucket is not empty, and its size is taken from
+// the bucket, which may go into debt; the packets larger than the burst are
+// not dropped forever.
+type tokenBucket struct {
+	rate   float64 // bytes per second
+	tokens float64
+	last   time.Time
+}
+
+func newTokenBucket(rate float64, now time.Time) *tokenBucket {
+	return &tokenBucket{
+		rate:   rate,
+		tokens: rate * RATE_LIMIT_BURST.Seconds(),
+		last:   now,
+	}
+}
+
+// refill adds the tokens since the last refill, at the current rate of the
+// bucket, which follows the MBR updated by the CP function
+func (b *tokenBucket) refill(rate float64, now time.Time) {
+	if d := now.Sub(b.last); d > 0 {
+		b.tokens += b.rate * d.Seconds()
+	}
+	b.rate = rate
+	b.last = now
+	b.tokens = min(b.tokens, rate*RATE_LIMIT_BURST.Seconds())
+}
+
+// mbrRate returns the MBR of a QER in a direction, in bytes per second, or
+// zero if the QER has no MBR
+func mbrRate(q *gtp5gnl.QER, dl bool) float64 {
+	kbps := q.MBR.UL_Kbps
+	if dl {
+		kbps = q.MBR.DL_Kbps
+	}
+	return float64(kbps) * 1000 / 8
+}
+
+type qerBucketKey struct {
+	lSeid uint64
+	qerid uint32
+	dl    bool
+}
+
+type corrBucketKey struct {
+	lSeid  uint64
+	corrID uint32
+	dl     bool
+}
+
+type qerBucket struct {
+	*tokenBucket
+	corrID uint32
+	qfi    uint8
+}
+
+// rateLimiter enforces the MBR of the QERs on the packets sent by the UPF
+// itself, which bypass the kernel module: the packets of a QER are limited
+// by its MBR, and the packets of the QERs of a session sharing a QER
+// Correlation ID by the Session-AMBR in aggregate, i.e. the MBR of the QER of
+// the Correlation ID which applies to no QoS flow in particular. Without such
+// a QER, the QERs sharing the Correlation ID are not limited in aggregate.
+type rateLimiter struct {
+	mu    sync.Mutex
+	qers  map[qerBucketKey]*qerBucket
+	corrs map[corrBucketKey]*tokenBucket
+	// the buckets of the QERs by Correlation ID, key: QER ID
+	corrQERs map[corrBucketKey]map[uint32]*qerBucket
+}
+
+func newRateLimiter() *rateLimiter {
+	return &rateLimiter{
+		qers:     make(map[qerBucketKey]*qerBucket),
+		corrs:    make(map[corrBucketKey]*tokenBucket),
+		corrQERs: make(map[corrBucketKey]map[uint32]*qerBucket),
+	}
+}
+
+// allow takes a packet of n bytes from the buckets of the QERs, and reports
+// whether the packet is within their MBR
+func (l *rateLimiter) allow(lSeid uint64, qers []*gtp5gnl.QER, dl bool, n int, now time.Time) bool {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	var buckets []*tokenBucket
+	seen := make(map[*tokenBucket]struct{})
+	take := func(b *tokenBucket) {
+		if _, ok := seen[b]; !ok {
+			seen[b] = struct{}{}
+			buckets = append(buckets, b)
+		}
+	}
+	for _, q := range qers {
+		rate := mbrRate(q, dl)
+		if rate <= 0 {
+			continue
+		}
+		k := qerBucketKey{lSeid: lSeid, qerid: q.ID, dl: dl}
+		b, ok := l.qers[k]
+		if !ok {
+			b = &qerBucket{tokenBucket: newTokenBucket(rate, now)}
+			l.qers[k] = b
+		}
+		b.refill(rate, now)
+		if !ok || b.corrID != q.CorrID {
+			l.correlate(k, b, q.CorrID)
+		}
+		b.qfi = q.QFI
+		take(b.tokenBucket)
+	}
+	for _, q := range qers {
+		if q.CorrID == 0 || mbrRate(q, dl) <= 0 {
+			continue
+		}
+		ck := corrBucketKey{lSeid: lSeid, corrID: q.CorrID, dl: dl}
+		rate := l.ambr(ck)
+		if rate <= 0 {
+			continue
+		}
+		c, ok := l.corrs[ck]
+		if !ok {
+			c = newTokenBucket(rate, now)
+			l.corrs[ck] = c
+		}
+		c.refill(rate, now)
+		take(c)
+	}
+
+	for _, b := range buckets {
+		if b.tokens <= 0 {
+			return false
+		}
+	}
+	for _, b := range buckets {
+		b.tokens -= float64(n)
+	}
+	return true
+}
+
+// correlate moves the bucket of a QER to the QERs of its Correlation ID
+func (l *rateLimiter) correlate(k qerBucketKey, b *qerBucket, corrID uint32) {
+	l.uncorrelate(k, b)
+	b.corrID = corrID
+	if corrID == 0 {
+		return
+	}
+	ck := corrBucketKey{lSeid: k.lSeid, corrID: corrID, dl: k.dl}
+	group, ok := l.corrQERs[ck]
+	if !ok {
+		group = make(map[uint32]*qerBucket)
+		l.corrQERs[ck] = group
+	}
+	group[k.qerid] = b
+}
+
+// uncorrelate removes the bucket of a QER from the QERs of its Correlation ID
+func (l *rateLimiter) uncorrelate(k qerBucketKey, b *qerBucket) {
+	if b.corrID == 0 {
+		return
+	}
+	ck := corrBucketKey{lSeid: k.lSeid, corrID: b.corrID, dl: k.dl}
+	delete(l.corrQERs[ck], k.qerid)
+	if len(l.corrQERs[ck]) == 0 {
+		delete(l.corrQERs, ck)
+	}
+}
+
+// ambr returns the Session-AMBR of the QERs of a session sharing a QER
+// Correlation ID: the MBR of their QER without QFI, the lowest if several,
+// or zero if none
+func (l *rateLimiter) ambr(ck corrBucketKey) float64 {
+	var rate float64
+	for _, b := range l.corrQERs[ck] {
+		if b.qfi == 0 && (rate == 0 || b.rate < rate) {
+			rate = b.rate
+		}
+	}
+	return rate
+}
+
+// apply forgets the buckets of the QERs removed by an executed plan
+func (l *rateLimiter) apply(plan *ModificationPlan) {
+	if !plan.Release && len(plan.RemoveQERs) == 0 {
+		return
+	}
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	removed := make(map[uint32]struct{}, len(plan.RemoveQERs))
+	for _, p := range plan.RemoveQERs {
+		removed[p.QERID] = struct{}{}
+	}
+	for k, b := range l.qers {
+		if k.lSeid != plan.SEID {
+			continue
+		}
+		if _, ok := removed[k.qerid]; ok || plan.Release {
+			l.uncorrelate(k, b)
+			delete(l.qers, k)
+		}
+	}
+
+	// the aggregate buckets are kept while a QER shares their Correlation ID
+	for k := range l.corrs {
+		if _, ok := l.corrQERs[k]; !ok {
+			delete(l.corrs, k)
+		}
+	}
+}
+
+// pdrQERs returns the QERs of the PDR
+func (g *Gtp5g) pdrQERs(lSeid uint64, pdr *gtp5gnl.PDR) []*gtp5gnl.QER {
+	var qers []*gtp5gnl.QER
+	for _, qerId := range pdr.QERID {
+		oid := gtp5gnl.OID{lSeid, uint64(qerId)}
+		q, err := g.sessClient(lSeid).GetQER(g.sessLink(lSeid).link, oid)
+		if err != nil {
+			g.log.Warnf("pdrQERs GetQEROID err: %+v", err)
+			continue
+		}
+		qers = append(qers, q)
+	}
+	return qers
+}
+
+// flowQER returns the QER indicating the QFI of the packets
+func flowQER(qers []*gtp5gnl.QER) *gtp5gnl.QER {
+	for _, q := range qers {
+		if q.QFI != 0 {
+			return q
+		}
+	}
+	return nil
+}
+
+// forwardPacket forwards a packet of a PDR by the UPF itself, within the MBR
+// of the QERs of the PDR. A packet exceeding the MBR is dropped with
+// errRateLimited.
+func (g *Gtp5g) forwardPacket(
+	link *Gtp5gLink, lSeid uint64, far *gtp5gnl.FAR, qers []*gtp5gnl.QER, pkt []byte,
+) error {
+	if g.limit != nil {
+		st, _ := g.farState(gtp5gnl.OID{lSeid, uint64(far.ID &^ HE_FAR_ID)})
+		if !g.limit.allow(lSeid, qers, st.access, len(pkt), time.Now()) {
+			return errRateLimited
+		}
+	}
+	return g.writePacket(link, g.sessNI(lSeid), far, flowQER(qers), pkt)
+}
+
+// dropReport returns the report of a packet of a PDR dropped for exceeding
+// the MBR, counted by the usage reporting
+func (g *Gtp5g) dropReport(lSeid uint64, pdrid uint16, far *gtp5gnl.FAR, n int) report.Report {
+	g.log.Debugf("PDR[%#x] packet dropped: MBR exceeded", pdrid)
+	st, _ := g.farState(gtp5gnl.OID{lSeid, uint64(far.ID &^ HE_FAR_ID)})
+	return report.DropReport{PDRID: pdrid, Len: n, DL: st.access}
+}
+
+func (g *Gtp5g) notifyDrops(lSeid uint64, rs []report.Report) {
+	if g.handler == nil || len(rs) == 0 {
+		return
+	}
+	g.handler.NotifySessReport(report.SessReport{
+		SEID:    lSeid,
+		Reports: rs,
+	})
+}
@@ -0,0 +1,125 @@
+package forwarder
+
+import (
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+
+	"github.com/free5gc/go-gtp5gnl"
+)
+
+// newMBRQER returns a QER with an MBR of kbps in both directions
+func newMBRQER(id uint32, kbps uint64, corrID uint32) *gtp5gnl.QER {
+	return &gtp5gnl.QER{
+		ID:     id,
+		MBR:    gtp5gnl.MBR{UL_Kbps: kbps, DL_Kbps: kbps},
+		CorrID: corrID,
+	}
+}
+
+func TestRateLimiter(t *testing.T) {
+	now := time.Now()
+
+	t.Run("MBR of a QER", func(t *testing.T) {
+		l := newRateLimiter()
+		// 80 kbps: 10000 bytes per second, a burst of 1000 bytes
+		qers := []*gtp5gnl.QER{newMBRQER(1, 80, 0)}
+		assert.True(t, l.allow(1, qers, true, 600, now))
+		assert.True(t, l.allow(1, qers, true, 600, now))
+		assert.False(t, l.allow(1, qers, true, 600, now))
+
+		// the other direction has a bucket of its own
+		assert.True(t, l.allow(1, qers, false, 600, now))
+
+		// refilled at the MBR
+		assert.False(t, l.allow(1, qers, true, 600, now.Add(10*time.Millisecond)))
+		assert.True(t, l.allow(1, qers, true, 600, now.Add(50*time.Millisecond)))
+	})
+
+	t.Run("no MBR", func(t *testing.T) {
+		l := newRateLimiter()
+		qers := []*gtp5gnl.QER{newMBRQER(1, 0, 0)}
+		for i := 0; i < 100; i++ {
+			assert.True(t, l.allow(1, qers, true, 1500, now))
+		}
+		assert.Empty(t, l.qers)
+	})
+
+	t.Run("Session-AMBR of the QERs sharing a Correlation ID", func(t *testing.T) {
+		l := newRateLimiter()
+		flow1 := []*gtp5gnl.QER{newMBRQER(1, 80, 7)}
+		flow2 := []*gtp5gnl.QER{newMBRQER(2, 80, 7)}
+		assert.True(t, l.allow(1, flow1, true, 600, now))
+		assert.True(t, l.allow(1, flow2, true, 600, now))
+		assert.False(t, l.allow(1, flow2, true, 600, now))
+
+		// a QER without the Correlation ID is not limited by the aggregate
+		assert.True(t, l.allow(1, []*gtp5gnl.QER{newMBRQER(3, 80, 0)}, true, 600, now))
+	})
+
+	t.Run("Correlation ID of another session", func(t *testing.T) {
+		l := newRateLimiter()
+		assert.True(t, l.allow(1, []*gtp5gnl.QER{newMBRQER(1, 80, 7)}, true, 1200, now))
+		assert.True(t, l.allow(2, []*gtp5gnl.QER{newMBRQER(1, 80, 7)}, true, 1200, now))
+		assert.Len(t, l.corrs, 2)
+	})
+
+	t.Run("Session-AMBR from the QER without QFI", func(t *testing.T) {
+		l := newRateLimiter()
+		ambr := newMBRQER(9, 80, 7)
+		flow := newMBRQER(1, 8000, 7)
+		flow.QFI = 9
+		assert.True(t, l.allow(1, []*gtp5gnl.QER{flow, ambr}, true, 1200, now))
+		assert.False(t, l.allow(1, []*gtp5gnl.QER{flow, ambr}, true, 100, now))
+		// the rate does not follow the MBR of the last QER refilling
+		assert.False(t, l.allow(1, []*gtp5gnl.QER{flow}, true, 100, now.Add(10*time.Millisecond)))
+		assert.InDelta(t, 10000, l.corrs[corrBucketKey{lSeid: 1, corrID: 7, dl: true}].rate, 1)
+	})
+
+	t.Run("no QER without QFI of the Correlation ID", func(t *testing.T) {
+		l := newRateLimiter()
+		flow1 := newMBRQER(1, 80, 7)
+		flow1.QFI = 5
+		flow2 := newMBRQER(2, 80, 7)
+		flow2.QFI = 9
+		assert.True(t, l.allow(1, []*gtp5gnl.QER{flow1}, true, 1000, now))
+		assert.True(t, l.allow(1, []*gtp5gnl.QER{flow2}, true, 1000, now))
+		assert.Empty(t, l.corrs)
+	})
+
+	t.Run("Correlation ID of a QER updated", func(t *testing.T) {
+		l := newRateLimiter()
+		ambr := newMBRQER(9, 80, 7)
+		assert.True(t, l.allow(1, []*gtp5gnl.QER{ambr}, true, 600, now))
+		ambr.CorrID = 8
+		assert.True(t, l.allow(1, []*gtp5gnl.QER{ambr}, true, 100, now.Add(time.Millisecond)))
+		assert.Len(t, l.corrQERs, 1)
+		assert.Contains(t, l.corrQERs, corrBucketKey{lSeid: 1, corrID: 8, dl: true})
+	})
+
+	t.Run("MBR of the QoS flow and of the session", func(t *testing.T) {
+		l := newRateLimiter()
+		flow := newMBRQER(1, 800, 0)
+		ambr := newMBRQER(9, 80, 0)
+		assert.True(t, l.allow(1, []*gtp5gnl.QER{flow, ambr}, true, 1200, now))
+		assert.False(t, l.allow(1, []*gtp5gnl.QER{flow, ambr}, true, 100, now))
+		// the flow bucket is not taken by the packets dropped by the session
+		assert.InDelta(t, 10000-1200, l.qers[qerBucketKey{lSeid: 1, qerid: 1, dl: true}].tokens, 1)
+	})
+
+	t.Run("buckets of the QERs removed", func(t *testing.T) {
+		l := newRateLimiter()
+		assert.True(t, l.allow(1, []*gtp5gnl.QER{newMBRQER(1, 80, 7)}, true, 600, now))
+		assert.True(t, l.allow(2, []*gtp5gnl.QER{newMBRQER(1, 80, 7)}, true, 600, now))
+
+		l.apply(&ModificationPlan{SEID: 1, RemoveQERs: []*QERPlan{{QERID: 1}}})
+		assert.Len(t, l.qers, 1)
+		assert.Len(t, l.corrs, 1)
+
+		l.apply(&ModificationPlan{SEID: 2, Release: true})
+		assert.Empty(t, l.qers)
+		assert.Empty(t, l.corrs)
+		assert.Empty(t, l.corrQERs)
+	})
+}
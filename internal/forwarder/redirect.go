@@ -0,0 +1,445 @@
+package forwarder
+
+import (
+	"context"
+	"encoding/binary"
+	"fmt"
+	"hash/fnv"
+	"io"
+	"net"
+	"net/url"
+	"strings"
+	"time"
+
+	"github.com/pkg/errors"
+	"github.com/wmnsk/go-pfcp/ie"
+
+	"github.com/free5gc/go-gtp5gnl"
+	"github.com/free5gc/go-upf/internal/report"
+)
+
+const (
+	SIP_PORT = 5060
+	DNS_PORT = 53
+
+	IP_PROTO_UDP = 17
+
+	// To-tag of the SIP responses redirecting the requests
+	SIP_REDIRECT_TAG = "upf-redirect"
+
+	// timeout of the resolution of the host of a redirect URL
+	REDIRECT_RESOLVE_TIMEOUT = 2 * time.Second
+)
+
+// lookupIP resolves the host of a redirect URL
+var lookupIP = func(host string) ([]net.IP, error) {
+	ctx, cancel := context.WithTimeout(context.Background(), REDIRECT_RESOLVE_TIMEOUT)
+	defer cancel()
+	return net.DefaultResolver.LookupIP(ctx, "ip", host)
+}
+
+// Redirect is the Redirect Information of the Forwarding Parameters of a FAR.
+// The kernel module cannot redirect, so the packets of such a FAR are
+// forwarded by the UPF: the HTTP requests of the UE are answered with a
+// redirection to the server, and so are the SIP requests for a SIP URI.
+// Other traffic is dropped, except DNS and the traffic of the redirect
+// server, so that the UE can resolve and reach the server.
+type Redirect struct {
+	AddrType uint8
+	Addr     string
+	// IPv6 address of an IPv4 and IPv6 redirect server
+	Other string
+	// addresses of the host of a redirect URL, resolved by resolve
+	servers []net.IP
+}
+
+func parseRedirect(b []byte) (*Redirect, error) {
+	if len(b) < 3 {
+		return nil, io.ErrUnexpectedEOF
+	}
+	r := &Redirect{AddrType: b[0] & 0x0f}
+	n := int(binary.BigEndian.Uint16(b[1:]))
+	b = b[3:]
+	if len(b) < n {
+		return nil, io.ErrUnexpectedEOF
+	}
+	r.Addr = string(b[:n])
+	b = b[n:]
+	if len(b) >= 2 {
+		n = int(binary.BigEndian.Uint16(b))
+		b = b[2:]
+		if len(b) < n {
+			return nil, io.ErrUnexpectedEOF
+		}
+		r.Other = string(b[:n])
+	}
+	return r, nil
+}
+
+func newRedirect(x *ie.IE) (*Redirect, error) {
+	r, err := parseRedirect(x.Payload)
+	if err != nil {
+		return nil, errors.Wrap(err, "Redirect Information")
+	}
+	switch r.AddrType {
+	case ie.RedirectAddrIPv4:
+		if ip := net.ParseIP(r.Addr); ip == nil || ip.To4() == nil {
+			return nil, errors.Errorf("Redirect Information: invalid IPv4 address %q", r.Addr)
+		}
+	case ie.RedirectAddrIPv6:
+		if ip := net.ParseIP(r.Addr); ip == nil || ip.To4() != nil {
+			return nil, errors.Errorf("Redirect Information: invalid IPv6 address %q", r.Addr)
+		}
+	case ie.RedirectAddrIPv4AndIPv6:
+		ip := net.ParseIP(r.Addr)
+		other := net.ParseIP(r.Other)
+		if ip == nil || ip.To4() == nil || other == nil || other.To4() != nil {
+			return nil, errors.Errorf("Redirect Information: invalid addresses %q %q", r.Addr, r.Other)
+		}
+	case ie.RedirectAddrURL:
+		u, err := url.Parse(r.Addr)
+		if err != nil || (u.Scheme != "http" && u.Scheme != "https") || u.Host == "" {
+			return nil, errors.Errorf("Redirect Information: invalid URL %q", r.Addr)
+		}
+	case ie.RedirectAddrSIPURI:
+		if !strings.HasPrefix(r.Addr, "sip:") && !strings.HasPrefix(r.Addr, "sips:") ||
+			strings.ContainsAny(r.Addr, "\r\n<> ") {
+			return nil, errors.Errorf("Redirect Information: invalid SIP URI %q", r.Addr)
+		}
+	default:
+		return nil, errors.Wrapf(ErrUnsupported, "Redirect Information: address type %d", r.AddrType)
+	}
+	return r, nil
+}
+
+// redirectInformation returns the Redirect Information of Forwarding
+// Parameters, or nil if none is provided
+func redirectInformation(ies []*ie.IE) (*Redirect, error) {
+	for _, x := range ies {
+		if x.Type == ie.RedirectInformation {
+			return newRedirect(x)
+		}
+	}
+	return nil, nil
+}
+
+// urlHost returns the host of a redirect URL, or "" if none
+func (r *Redirect) urlHost() string {
+	if r.AddrType != ie.RedirectAddrURL {
+		return ""
+	}
+	u, err := url.Parse(r.Addr)
+	if err != nil {
+		return ""
+	}
+	return u.Hostname()
+}
+
+// resolve looks up the addresses of the host of a redirect URL. The host is
+// resolved when the FAR is created or updated, before the redirection is
+// enforced: the traffic of the UE to it is then forwarded.
+func (r *Redirect) resolve() error {
+	host := r.urlHost()
+	if host == "" || net.ParseIP(host) != nil {
+		return nil
+	}
+	ips, err := lookupIP(host)
+	if err != nil {
+		return errors.Wrapf(err, "Redirect Information: resolve %q", host)
+	}
+	r.servers = ips
+	return nil
+}
+
+// serverIPs returns the addresses of the redirect server, none if unknown
+func (r *Redirect) serverIPs() []net.IP {
+	switch r.AddrType {
+	case ie.RedirectAddrIPv4, ie.RedirectAddrIPv6:
+		return []net.IP{net.ParseIP(r.Addr)}
+	case ie.RedirectAddrIPv4AndIPv6:
+		return []net.IP{net.ParseIP(r.Addr), net.ParseIP(r.Other)}
+	case ie.RedirectAddrURL:
+		if ip := net.ParseIP(r.urlHost()); ip != nil {
+			return []net.IP{ip}
+		}
+		return r.servers
+	}
+	return nil
+}
+
+// location returns the URL the HTTP requests are redirected to, or "" if
+// the HTTP requests are not redirected
+func (r *Redirect) location() string {
+	switch r.AddrType {
+	case ie.RedirectAddrIPv4, ie.RedirectAddrIPv4AndIPv6:
+		return "http://" + r.Addr + "/"
+	case ie.RedirectAddrIPv6:
+		return "http://[" + r.Addr + "]/"
+	case ie.RedirectAddrURL:
+		return r.Addr
+	}
+	return ""
+}
+
+// server reports whether an IPv4 packet is of the redirect server: to it in
+// the uplink, or from it in the downlink
+func (r *Redirect) server(pkt []byte, ul bool) bool {
+	if len(pkt) < 20 || pkt[0]>>4 != 4 {
+		return false
+	}
+	peer := net.IP(pkt[12:16])
+	if ul {
+		peer = net.IP(pkt[16:20])
+	}
+	for _, ip := range r.serverIPs() {
+		if peer.Equal(ip) {
+			return true
+		}
+	}
+	return false
+}
+
+// dns reports whether an IPv4 packet is DNS: to a DNS server in the uplink,
+// or from one in the downlink
+func dns(pkt []byte, ul bool) bool {
+	if len(pkt) < 20 || pkt[0]>>4 != 4 {
+		return false
+	}
+	if pkt[9] != IP_PROTO_UDP && pkt[9] != IP_PROTO_TCP {
+		return false
+	}
+	ihl := int(pkt[0]&0x0f) * 4
+	if ihl < 20 || len(pkt) < ihl+4 {
+		return false
+	}
+	port := binary.BigEndian.Uint16(pkt[ihl:])
+	if ul {
+		port = binary.BigEndian.Uint16(pkt[ihl+2:])
+	}
+	return port == DNS_PORT
+}
+
+// respond returns the packet answering an uplink IPv4 packet of the UE, or
+// nil if the packet is dropped silently
+func (r *Redirect) respond(pkt []byte) []byte {
+	if len(pkt) < 20 || pkt[0]>>4 != 4 {
+		return nil
+	}
+	switch pkt[9] {
+	case IP_PROTO_TCP:
+		p, ok := parseTCPPacket(pkt)
+		if !ok {
+			return nil
+		}
+		if loc := r.location(); loc != "" && p.dstPort() == HE_HTTP_PORT {
+			return httpRedirect(p, loc)
+		}
+		return tcpReset(p)
+	case IP_PROTO_UDP:
+		if r.AddrType != ie.RedirectAddrSIPURI {
+			return nil
+		}
+		ihl := int(pkt[0]&0x0f) * 4
+		tot := int(binary.BigEndian.Uint16(pkt[2:]))
+		if ihl < 20 || tot > len(pkt) || tot < ihl+8 {
+			return nil
+		}
+		udp := pkt[ihl:tot]
+		if binary.BigEndian.Uint16(udp[2:]) != SIP_PORT {
+			return nil
+		}
+		rsp := sipRedirect(udp[8:], r.Addr)
+		if rsp == nil {
+			return nil
+		}
+		return udpReply(pkt[:tot], udp, rsp)
+	}
+	return nil
+}
+
+// httpRedirect answers a TCP segment of the UE to an HTTP server without
+// keeping any state: the handshake is accepted, and the request is answered
+// with a redirection before closing the connection
+func httpRedirect(p tcpPacket, location string) []byte {
+	n := uint32(len(p.payload()))
+	switch {
+	case p.flags&TCP_FLAG_RST != 0:
+		return nil
+	case p.flags&TCP_FLAG_SYN != 0:
+		return tcpReply(p, isn(p), p.seq()+1, TCP_FLAG_SYN|TCP_FLAG_ACK, nil)
+	case n > 0:
+		if !httpMethod(p.payload()) {
+			return tcpReply(p, p.ack(), p.seq()+n, TCP_FLAG_ACK, nil)
+		}
+		rsp := fmt.Sprintf("HTTP/1.1 302 Found\r\n"+
+			"Location: %s\r\n"+
+			"Cache-Control: no-cache\r\n"+
+			"Content-Length: 0\r\n"+
+			"Connection: close\r\n\r\n", location)
+		return tcpReply(p, p.ack(), p.seq()+n, TCP_FLAG_ACK|TCP_FLAG_PSH|TCP_FLAG_FIN, []byte(rsp))
+	case p.flags&TCP_FLAG_FIN != 0:
+		return tcpReply(p, p.ack(), p.seq()+1, TCP_FLAG_ACK, nil)
+	}
+	return nil
+}
+
+// tcpReset refuses a TCP segment of the UE
+func tcpReset(p tcpPacket) []byte {
+	if p.flags&TCP_FLAG_RST != 0 {
+		return nil
+	}
+	if p.flags&TCP_FLAG_ACK != 0 {
+		return tcpReply(p, p.ack(), 0, TCP_FLAG_RST, nil)
+	}
+	n := uint32(len(p.payload()))
+	if p.flags&TCP_FLAG_SYN != 0 {
+		n++
+	}
+	return tcpReply(p, 0, p.seq()+n, TCP_FLAG_RST|TCP_FLAG_ACK, nil)
+}
+
+// isn returns the initial sequence number of the connection of a SYN
+func isn(p tcpPacket) uint32 {
+	h := fnv.New32a()
+	_, _ = h.Write(p.b[12:20])
+	_, _ = h.Write(p.tcp()[:4])
+	return h.Sum32()
+}
+
+// newIPv4Reply returns an IPv4 packet answering req with the payload l4
+func newIPv4Reply(req []byte, proto uint8, l4 []byte) []byte {
+	b := make([]byte, 20+len(l4))
+	b[0] = 0x45
+	binary.BigEndian.PutUint16(b[2:], uint16(len(b)))
+	b[6] = 0x40 // DF
+	b[8] = 64
+	b[9] = proto
+	copy(b[12:16], req[16:20])
+	copy(b[16:20], req[12:16])
+	copy(b[20:], l4)
+	binary.BigEndian.PutUint16(b[10:], fold(sum(b[:20], 0)))
+	return b
+}
+
+func tcpReply(p tcpPacket, seq, ack uint32, flags uint8, payload []byte) []byte {
+	tcp := make([]byte, 20+len(payload))
+	binary.BigEndian.PutUint16(tcp[0:], p.dstPort())
+	binary.BigEndian.PutUint16(tcp[2:], p.srcPort())
+	binary.BigEndian.PutUint32(tcp[4:], seq)
+	binary.BigEndian.PutUint32(tcp[8:], ack)
+	tcp[12] = 5 << 4
+	tcp[13] = flags
+	binary.BigEndian.PutUint16(tcp[14:], 0xffff)
+	copy(tcp[20:], payload)
+
+	b := newIPv4Reply(p.b, IP_PROTO_TCP, tcp)
+	q := tcpPacket{b: b, ihl: 20, doff: 20, flags: flags}
+	q.checksum()
+	return b
+}
+
+func udpReply(req, udp, payload []byte) []byte {
+	rsp := make([]byte, 8+len(payload))
+	copy(rsp[0:2], udp[2:4])
+	copy(rsp[2:4], udp[0:2])
+	binary.BigEndian.PutUint16(rsp[4:], uint16(len(rsp)))
+	copy(rsp[8:], payload)
+
+	b := newIPv4Reply(req, IP_PROTO_UDP, rsp)
+	s := sum(b[12:20], uint32(IP_PROTO_UDP)+uint32(len(rsp)))
+	c := fold(sum(b[20:], s))
+	if c == 0 {
+		c = 0xffff
+	}
+	binary.BigEndian.PutUint16(b[26:], c)
+	return b
+}
+
+// sipRedirect returns the response redirecting a SIP request to uri, or nil
+// if the message is not a request to answer
+func sipRedirect(req []byte, uri string) []byte {
+	lines := strings.Split(string(req), "\r\n")
+	if len(lines) < 2 || !strings.HasSuffix(lines[0], " SIP/2.0") {
+		return nil
+	}
+	method, _, _ := strings.Cut(lines[0], " ")
+	if method == "ACK" {
+		return nil
+	}
+
+	var b strings.Builder
+	b.WriteString("SIP/2.0 302 Moved Temporarily\r\n")
+	for _, l := range lines[1:] {
+		if l == "" {
+			break
+		}
+		name, _, ok := strings.Cut(l, ":")
+		if !ok {
+			continue
+		}
+		switch strings.ToLower(strings.TrimSpace(name)) {
+		case "via", "v", "from", "f", "call-id", "i", "cseq":
+		case "to", "t":
+			if !strings.Contains(strings.ToLower(l), ";tag=") {
+				l += ";tag=" + SIP_REDIRECT_TAG
+			}
+		default:
+			continue
+		}
+		b.WriteString(l)
+		b.WriteString("\r\n")
+	}
+	fmt.Fprintf(&b, "Contact: <%s>\r\nContent-Length: 0\r\n\r\n", uri)
+	return []byte(b.String())
+}
+
+// redirect forwards a packet of a FAR with Redirect Information
+func (g *Gtp5g) redirect(link *Gtp5gLink, lSeid uint64, ps *pdrState, r *Redirect, pkt []byte) error {
+	pdr := ps.pdr
+	ul := pdr.PDI != nil && pdr.PDI.SrcIntf != nil && *pdr.PDI.SrcIntf == ie.SrcInterfaceAccess
+	qers := ps.qers
+	if r.server(pkt, ul) || dns(pkt, ul) {
+		if ul {
+			return g.forwardPacket(link, lSeid, ps.far, qers, pkt)
+		}
+		dl, err := g.accessFAR(link, lSeid)
+		if err != nil {
+			return err
+		}
+		return g.forwardPacket(link, lSeid, dl, qers, pkt)
+	}
+	if !ul {
+		return nil
+	}
+	rsp := r.respond(pkt)
+	if rsp == nil {
+		return nil
+	}
+	dl, err := g.accessFAR(link, lSeid)
+	if err != nil {
+		return err
+	}
+	return g.forwardPacket(link, lSeid, dl, qers, rsp)
+}
+
+// accessFAR returns the FAR of the session forwarding to the access, which
+// delivers the packets of the UPF to the UE
+func (g *Gtp5g) accessFAR(link *Gtp5gLink, lSeid uint64) (*gtp5gnl.FAR, error) {
+	var farid uint64
+	var found bool
+	g.duplMu.Lock()
+	for k, f := range g.fars {
+		if k[0] != lSeid || !f.access || f.action&report.APPLY_ACT_FORW == 0 {
+			continue
+		}
+		if !found || k[1] < farid {
+			farid = k[1]
+			found = true
+		}
+	}
+	g.duplMu.Unlock()
+	if !found {
+		return nil, errors.New("no FAR forwarding to the access")
+	}
+	return g.sessClient(lSeid).GetFAR(link.link, gtp5gnl.OID{lSeid, farid})
+}
@@ -0,0 +1,213 @@
+package forwarder
+
+import (
+	"encoding/binary"
+	"net"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/pkg/errors"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"github.com/wmnsk/go-pfcp/ie"
+
+	"github.com/free5gc/go-upf/internal/logger"
+	"github.com/free5gc/go-upf/internal/report"
+)
+
+func TestNewRedirect(t *testing.T) {
+	cases := []struct {
+		name     string
+		addrType uint8
+		addrs    []string
+		location string
+		err      bool
+	}{
+		{"IPv4", ie.RedirectAddrIPv4, []string{"10.0.0.80"}, "http://10.0.0.80/", false},
+		{"IPv6", ie.RedirectAddrIPv6, []string{"2001:db8::80"}, "http://[2001:db8::80]/", false},
+		{"URL", ie.RedirectAddrURL, []string{"http://topup.example.com/"}, "http://topup.example.com/", false},
+		{"SIP URI", ie.RedirectAddrSIPURI, []string{"sip:topup@example.com"}, "", false},
+		{"IPv4 and IPv6", ie.RedirectAddrIPv4AndIPv6, []string{"10.0.0.80", "2001:db8::80"}, "http://10.0.0.80/", false},
+		{"invalid IPv4", ie.RedirectAddrIPv4, []string{"2001:db8::80"}, "", true},
+		{"invalid URL", ie.RedirectAddrURL, []string{"topup.example.com"}, "", true},
+		{"invalid SIP URI", ie.RedirectAddrSIPURI, []string{"http://topup.example.com/"}, "", true},
+	}
+	for _, tc := range cases {
+		t.Run(tc.name, func(t *testing.T) {
+			r, err := newRedirect(ie.NewRedirectInformation(tc.addrType, tc.addrs...))
+			if tc.err {
+				assert.Error(t, err)
+				return
+			}
+			require.NoError(t, err)
+			assert.Equal(t, tc.addrType, r.AddrType)
+			assert.Equal(t, tc.addrs[0], r.Addr)
+			assert.Equal(t, tc.location, r.location())
+		})
+	}
+
+	_, err := newRedirect(ie.NewRedirectInformation(5, "10.0.0.80"))
+	assert.True(t, errors.Is(err, ErrUnsupported))
+}
+
+func TestBuildFARPlanRedirect(t *testing.T) {
+	lookup := lookupIP
+	defer func() { lookupIP = lookup }()
+	lookupIP = func(host string) ([]net.IP, error) {
+		if host != "topup.example.com" {
+			return nil, errors.New("no such host")
+		}
+		return []net.IP{net.IPv4(10, 0, 0, 80)}, nil
+	}
+
+	g := &Gtp5g{log: logger.FwderLog}
+	p, err := g.BuildCreateFARPlan(1, ie.NewCreateFAR(
+		ie.NewFARID(9),
+		ie.NewApplyAction(0x02),
+		ie.NewForwardingParameters(
+			ie.NewDestinationInterface(ie.DstInterfaceCore),
+			ie.NewRedirectInformation(ie.RedirectAddrURL, "http://topup.example.com/"),
+		),
+	))
+	require.NoError(t, err)
+	require.NotNil(t, p.Redirect)
+	assert.Equal(t, "http://topup.example.com/", p.Redirect.Addr)
+	// the portal is resolved before the redirection is enforced
+	assert.True(t, p.Redirect.server(newTCPPacket(false, 1, 0, TCP_FLAG_SYN, nil, nil), true))
+	act, ok := farAttrAction(p.Attrs)
+	require.True(t, ok)
+	assert.Equal(t, uint16(report.APPLY_ACT_BUFF|report.APPLY_ACT_DUPL), act)
+}
+
+func TestHTTPRedirect(t *testing.T) {
+	r := &Redirect{AddrType: ie.RedirectAddrURL, Addr: "http://topup.example.com/"}
+
+	t.Run("handshake", func(t *testing.T) {
+		b := r.respond(newTCPPacket(false, 999, 0, TCP_FLAG_SYN, nil, nil))
+		p := requireChecksums(t, b)
+		assert.Equal(t, uint8(TCP_FLAG_SYN|TCP_FLAG_ACK), p.flags)
+		assert.Equal(t, uint32(1000), p.ack())
+		assert.Equal(t, uint16(HE_HTTP_PORT), p.srcPort())
+		assert.Equal(t, uint16(40000), p.dstPort())
+		assert.Equal(t, []byte{10, 0, 0, 80}, p.b[12:16])
+		assert.Equal(t, []byte{10, 60, 0, 1}, p.b[16:20])
+	})
+
+	t.Run("request", func(t *testing.T) {
+		req := "GET /video HTTP/1.1\r\nHost: example.com\r\n\r\n"
+		b := r.respond(newTCPPacket(false, 1000, 5001, 0x18, nil, []byte(req)))
+		p := requireChecksums(t, b)
+		assert.Equal(t, uint8(TCP_FLAG_ACK|TCP_FLAG_PSH|TCP_FLAG_FIN), p.flags)
+		assert.Equal(t, uint32(5001), p.seq())
+		assert.Equal(t, uint32(1000+len(req)), p.ack())
+		rsp := string(p.payload())
+		assert.True(t, strings.HasPrefix(rsp, "HTTP/1.1 302 Found\r\n"))
+		assert.Contains(t, rsp, "\r\nLocation: http://topup.example.com/\r\n")
+	})
+
+	t.Run("close", func(t *testing.T) {
+		b := r.respond(newTCPPacket(false, 1100, 5200, TCP_FLAG_FIN|TCP_FLAG_ACK, nil, nil))
+		p := requireChecksums(t, b)
+		assert.Equal(t, uint8(TCP_FLAG_ACK), p.flags)
+		assert.Equal(t, uint32(1101), p.ack())
+
+		assert.Nil(t, r.respond(newTCPPacket(false, 1101, 5201, TCP_FLAG_ACK, nil, nil)))
+	})
+
+	t.Run("other ports are reset", func(t *testing.T) {
+		syn := newTCPPacket(false, 999, 0, TCP_FLAG_SYN, nil, nil)
+		binary.BigEndian.PutUint16(syn[22:], 443)
+		b := r.respond(syn)
+		p := requireChecksums(t, b)
+		assert.Equal(t, uint8(TCP_FLAG_RST|TCP_FLAG_ACK), p.flags)
+		assert.Equal(t, uint32(1000), p.ack())
+	})
+}
+
+func TestRedirectServer(t *testing.T) {
+	r := &Redirect{AddrType: ie.RedirectAddrIPv4, Addr: "10.0.0.80"}
+	assert.True(t, r.server(newTCPPacket(false, 1, 0, TCP_FLAG_SYN, nil, nil), true))
+	assert.True(t, r.server(newTCPPacket(true, 1, 0, TCP_FLAG_SYN, nil, nil), false))
+	assert.False(t, r.server(newTCPPacket(true, 1, 0, TCP_FLAG_SYN, nil, nil), true))
+
+	r = &Redirect{AddrType: ie.RedirectAddrURL, Addr: "http://topup.example.com/"}
+	assert.False(t, r.server(newTCPPacket(false, 1, 0, TCP_FLAG_SYN, nil, nil), true))
+	r.servers = []net.IP{net.IPv4(10, 0, 0, 81), net.IPv4(10, 0, 0, 80)}
+	assert.True(t, r.server(newTCPPacket(false, 1, 0, TCP_FLAG_SYN, nil, nil), true))
+}
+
+func TestRedirectDNS(t *testing.T) {
+	query := newTCPPacket(false, 1, 0, TCP_FLAG_SYN, nil, nil)
+	query[9] = IP_PROTO_UDP
+	binary.BigEndian.PutUint16(query[22:], DNS_PORT)
+	assert.True(t, dns(query, true))
+	assert.False(t, dns(query, false))
+
+	answer := newTCPPacket(true, 1, 0, TCP_FLAG_SYN, nil, nil)
+	binary.BigEndian.PutUint16(answer[20:], DNS_PORT)
+	assert.True(t, dns(answer, false))
+
+	assert.False(t, dns(newTCPPacket(false, 1, 0, TCP_FLAG_SYN, nil, nil), true))
+}
+
+func TestSIPRedirect(t *testing.T) {
+	req := "INVITE sip:bob@example.com SIP/2.0\r\n" +
+		"Via: SIP/2.0/UDP 10.60.0.1:5060;branch=z9hG4bK776asdhds\r\n" +
+		"Max-Forwards: 70\r\n" +
+		"To: Bob <sip:bob@example.com>\r\n" +
+		"From: Alice <sip:alice@example.com>;tag=1928301774\r\n" +
+		"Call-ID: a84b4c76e66710@10.60.0.1\r\n" +
+		"CSeq: 314159 INVITE\r\n" +
+		"Content-Length: 0\r\n\r\n"
+	rsp := string(sipRedirect([]byte(req), "sip:topup@example.com"))
+	assert.Equal(t, "SIP/2.0 302 Moved Temporarily\r\n"+
+		"Via: SIP/2.0/UDP 10.60.0.1:5060;branch=z9hG4bK776asdhds\r\n"+
+		"To: Bob <sip:bob@example.com>;tag="+SIP_REDIRECT_TAG+"\r\n"+
+		"From: Alice <sip:alice@example.com>;tag=1928301774\r\n"+
+		"Call-ID: a84b4c76e66710@10.60.0.1\r\n"+
+		"CSeq: 314159 INVITE\r\n"+
+		"Contact: <sip:topup@example.com>\r\n"+
+		"Content-Length: 0\r\n\r\n", rsp)
+
+	assert.Nil(t, sipRedirect([]byte("ACK sip:bob@example.com SIP/2.0\r\nCSeq: 314159 ACK\r\n\r\n"),
+		"sip:topup@example.com"))
+	assert.Nil(t, sipRedirect([]byte("SIP/2.0 200 OK\r\n\r\n"), "sip:topup@example.com"))
+}
+
+func TestBuildURRPlanQuotaAction(t *testing.T) {
+	g := &Gtp5g{log: logger.FwderLog}
+	p, err := g.BuildCreateURRPlan(1, ie.NewCreateURR(
+		ie.NewURRID(1),
+		ie.NewMeasurementMethod(0, 1, 1),
+		ie.NewReportingTriggers(0x00, 0x03),
+		ie.NewVolumeQuota(0x01, 1000000, 0, 0),
+		ie.NewTimeQuota(time.Hour),
+		ie.NewFARID(9),
+	))
+	require.NoError(t, err)
+	require.NotNil(t, p.QuotaFARID)
+	assert.Equal(t, uint32(9), *p.QuotaFARID)
+	require.NotNil(t, p.TimeQuota)
+	assert.Equal(t, time.Hour, *p.TimeQuota)
+	assert.True(t, p.VolumeQuota)
+
+	p, err = g.BuildUpdateURRPlan(1, ie.NewUpdateURR(
+		ie.NewURRID(1),
+		ie.NewVolumeQuota(0x01, 1000000, 0, 0),
+	))
+	require.NoError(t, err)
+	assert.True(t, p.VolumeQuota)
+	assert.Nil(t, p.TimeQuota)
+	assert.Nil(t, p.QuotaFARID)
+	assert.False(t, p.HasReportingTrigger)
+
+	// the triggers are all cleared
+	p, err = g.BuildUpdateURRPlan(1, ie.NewUpdateURR(
+		ie.NewURRID(1),
+		ie.NewReportingTriggers(0x00, 0x00),
+	))
+	require.NoError(t, err)
+	assert.True(t, p.HasReportingTrigger)
+	assert.Zero(t, p.ReportingTrigger.Flags)
+}
@@ -0,0 +1,329 @@
+package forwarder
+
+import (
+	"net"
+	"os"
+	"strconv"
+	"sync"
+	"testing"
+
+	"github.com/khirono/go-nl"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"github.com/wmnsk/go-pfcp/ie"
+
+	"github.com/free5gc/go-gtp5gnl"
+	"github.com/free5gc/go-upf/internal/logger"
+	"github.com/free5gc/go-upf/pkg/factory"
+)
+
+func findAttr(attrs []nl.Attr, typ uint16) *nl.Attr {
+	for i := range attrs {
+		if attrs[i].Type == typ {
+			return &attrs[i]
+		}
+	}
+	return nil
+}
+
+func pdiAttrs(t *testing.T, p *PDRPlan) nl.AttrList {
+	a := findAttr(p.Attrs, gtp5gnl.PDR_PDI)
+	require.NotNil(t, a)
+	return a.Value.(nl.AttrList)
+}
+
+func TestULCL(t *testing.T) {
+	n3 := &Gtp5gLink{addr: &net.UDPAddr{IP: net.IPv4(10, 100, 0, 1), Port: 2152}}
+	n9 := &Gtp5gLink{addr: &net.UDPAddr{IP: net.IPv4(10, 200, 0, 1), Port: 2152}}
+	g := &Gtp5g{
+		link:      n3,
+		log:       logger.FwderLog,
+		nis:       make(map[string]*netInstance),
+		niLinks:   map[string]*Gtp5gLink{"10.200.0.1:2152": n9},
+		sessLinks: make(map[uint64]*Gtp5gLink),
+		sessNIs:   make(map[uint64]*netInstance),
+	}
+
+	t.Run("uplink branching by SDF", func(t *testing.T) {
+		// UL to the local N6 breakout for 10.1.0.0/16, else to the PSA on N9
+		n6 := ie.NewCreatePDR(
+			ie.NewPDRID(1),
+			ie.NewPrecedence(100),
+			ie.NewPDI(
+				ie.NewSourceInterface(ie.SrcInterfaceAccess),
+				ie.NewFTEID(0x01, 0x11, net.IPv4(10, 100, 0, 1), nil, 0),
+				ie.NewUEIPAddress(0x02, "60.60.0.1", "", 0, 0),
+				ie.NewSDFFilter("permit out ip from 10.1.0.0/16 to 60.60.0.1", "", "", "", 0),
+			),
+			ie.NewFARID(1),
+		)
+		p, err := g.BuildCreatePDRPlan(1, n6)
+		require.NoError(t, err)
+		pdi := pdiAttrs(t, p)
+		assert.NotNil(t, findAttr(pdi, gtp5gnl.PDI_UE_ADDR_IPV4))
+		sdf := findAttr(pdi, gtp5gnl.PDI_SDF_FILTER)
+		require.NotNil(t, sdf)
+		fd := findAttr(sdf.Value.(nl.AttrList), gtp5gnl.SDF_FILTER_FLOW_DESCRIPTION)
+		require.NotNil(t, fd)
+		// the uplink filter matches the packets from the UE
+		src := findAttr(fd.Value.(nl.AttrList), gtp5gnl.FLOW_DESCRIPTION_SRC_IPV4)
+		require.NotNil(t, src)
+		assert.Equal(t, nl.AttrBytes(net.IPv4(60, 60, 0, 1).To4()), src.Value)
+		assert.True(t, p.FTEIDAddr.Equal(net.IPv4(10, 100, 0, 1)))
+
+		far, err := g.BuildCreateFARPlan(1, ie.NewCreateFAR(
+			ie.NewFARID(2),
+			ie.NewApplyAction(0x02),
+			ie.NewForwardingParameters(
+				ie.NewDestinationInterface(ie.DstInterfaceCore),
+				ie.NewOuterHeaderCreation(0x0100, 0x22, "10.200.0.2", "", 0, 0, 0),
+			),
+		))
+		require.NoError(t, err)
+		require.NotNil(t, far.DstIf)
+		assert.Equal(t, ie.DstInterfaceCore, *far.DstIf)
+		fp := findAttr(far.Attrs, gtp5gnl.FAR_FORWARDING_PARAMETER)
+		require.NotNil(t, fp)
+		assert.NotNil(t, findAttr(fp.Value.(nl.AttrList), gtp5gnl.FORWARDING_PARAMETER_OUTER_HEADER_CREATION))
+	})
+
+	t.Run("downlink merging from PSAs", func(t *testing.T) {
+		// the DL of each PSA is received on an N9 F-TEID of its own
+		for i, teid := range []uint32{0x31, 0x32} {
+			p, err := g.BuildCreatePDRPlan(1, ie.NewCreatePDR(
+				ie.NewPDRID(uint16(10+i)),
+				ie.NewPrecedence(200),
+				ie.NewPDI(
+					ie.NewSourceInterface(ie.SrcInterfaceCore),
+					ie.NewFTEID(0x01, teid, net.IPv4(10, 100, 0, 1), nil, 0),
+					ie.NewUEIPAddress(0x02, "60.60.0.1", "", 0, 0),
+					ie.NewTGPPInterfaceType(ie.TGPPInterfaceTypeN9),
+				),
+				ie.NewOuterHeaderRemoval(0, 0),
+				ie.NewFARID(3),
+			))
+			require.NoError(t, err)
+			pdi := pdiAttrs(t, p)
+			assert.NotNil(t, findAttr(pdi, gtp5gnl.PDI_F_TEID))
+			assert.Nil(t, findAttr(pdi, gtp5gnl.PDI_UE_ADDR_IPV4))
+		}
+
+		// the DL from the local N6 is matched by the UE IP address
+		p, err := g.BuildCreatePDRPlan(1, ie.NewCreatePDR(
+			ie.NewPDRID(12),
+			ie.NewPDI(
+				ie.NewSourceInterface(ie.SrcInterfaceCore),
+				ie.NewUEIPAddress(0x02, "60.60.0.1", "", 0, 0),
+			),
+			ie.NewFARID(3),
+		))
+		require.NoError(t, err)
+		assert.NotNil(t, findAttr(pdiAttrs(t, p), gtp5gnl.PDI_UE_ADDR_IPV4))
+	})
+
+	t.Run("session on the link of its F-TEIDs", func(t *testing.T) {
+		newPlan := func(seid uint64, addrs ...net.IP) *ModificationPlan {
+			plan := NewModificationPlan(seid)
+			for i, addr := range addrs {
+				plan.CreatePDRs = append(plan.CreatePDRs, &PDRPlan{PDRID: uint16(i + 1), FTEIDAddr: addr})
+			}
+			return plan
+		}
+
+		// a PSA receiving its session over N9
+		require.NoError(t, g.bindSess(newPlan(2, net.IPv4(10, 200, 0, 1))))
+		assert.Same(t, n9, g.sessLink(2))
+
+		// an I-UPF receiving N3 and N9 on one address
+		require.NoError(t, g.bindSess(newPlan(3, net.IPv4(10, 100, 0, 1), net.IPv4(10, 100, 0, 1))))
+		assert.Same(t, n3, g.sessLink(3))
+
+		// the tunnels of a session must be received by one link
+		assert.Error(t, g.bindSess(newPlan(4, net.IPv4(10, 100, 0, 1), net.IPv4(10, 200, 0, 1))))
+		assert.Error(t, g.bindSess(newPlan(3, net.IPv4(10, 200, 0, 1))))
+
+		// an address not of the UPF doesn't bind
+		require.NoError(t, g.bindSess(newPlan(5, net.IPv4(192, 0, 2, 1))))
+		assert.Same(t, n3, g.sessLink(5))
+
+		// without F-TEIDs, by the Network Instance of the FARs to the core
+		g.nis["internet"] = &netInstance{name: "internet", link: n9}
+		defer delete(g.nis, "internet")
+		access, core := uint8(ie.DstInterfaceAccess), uint8(ie.DstInterfaceCore)
+		plan := NewModificationPlan(6)
+		plan.CreateFARs = []*FARPlan{
+			{FARID: 1, NetworkInstance: "internet", DstIf: &access},
+		}
+		require.NoError(t, g.bindSess(plan))
+		assert.Same(t, n3, g.sessLink(6))
+		plan = NewModificationPlan(7)
+		plan.CreateFARs = []*FARPlan{
+			{FARID: 1, NetworkInstance: "access", DstIf: &access},
+			{FARID: 2, NetworkInstance: "internet", DstIf: &core},
+		}
+		require.NoError(t, g.bindSess(plan))
+		assert.Same(t, n9, g.sessLink(7))
+	})
+
+	t.Run("rules of the session", func(t *testing.T) {
+		// the rules TestGtp5g_ULCL creates in the gtp5g module
+		plan := ulclPlan(t, g, 8)
+		pdrs := make(map[uint16]nl.AttrList)
+		for _, p := range plan.CreatePDRs {
+			pdrs[p.PDRID] = pdiAttrs(t, p)
+		}
+		assert.NotNil(t, findAttr(pdrs[1], gtp5gnl.PDI_SDF_FILTER))
+		ueAddr := findAttr(pdrs[1], gtp5gnl.PDI_UE_ADDR_IPV4)
+		require.NotNil(t, ueAddr)
+		assert.Equal(t, nl.AttrBytes(net.IPv4(60, 60, 0, 1).To4()), ueAddr.Value)
+
+		fteid := findAttr(pdrs[3], gtp5gnl.PDI_F_TEID)
+		require.NotNil(t, fteid)
+		teid := findAttr(fteid.Value.(nl.AttrList), gtp5gnl.F_TEID_I_TEID)
+		require.NotNil(t, teid)
+		assert.Equal(t, nl.AttrU32(2), teid.Value)
+		assert.Nil(t, findAttr(pdrs[3], gtp5gnl.PDI_UE_ADDR_IPV4))
+
+		require.Len(t, plan.CreateFARs, 3)
+		fp := findAttr(plan.CreateFARs[1].Attrs, gtp5gnl.FAR_FORWARDING_PARAMETER)
+		require.NotNil(t, fp)
+		ohc := findAttr(fp.Value.(nl.AttrList), gtp5gnl.FORWARDING_PARAMETER_OUTER_HEADER_CREATION)
+		require.NotNil(t, ohc)
+		ohcAttrs := ohc.Value.(nl.AttrList)
+		assert.Equal(t, nl.AttrU32(0x22), findAttr(ohcAttrs, gtp5gnl.OUTER_HEADER_CREATION_O_TEID).Value)
+		assert.Equal(t, nl.AttrBytes(net.IPv4(10, 200, 0, 2).To4()),
+			findAttr(ohcAttrs, gtp5gnl.OUTER_HEADER_CREATION_PEER_ADDR_IPV4).Value)
+	})
+}
+
+// ulclPlan returns the establishment plan of the rules of a ULCL with a
+// local N6 breakout and a PSA on N9
+func ulclPlan(t *testing.T, g *Gtp5g, lSeid uint64) *ModificationPlan {
+	plan := NewModificationPlan(lSeid)
+	for _, far := range []*ie.IE{
+		// UL to the local N6 breakout
+		ie.NewCreateFAR(
+			ie.NewFARID(1),
+			ie.NewApplyAction(0x02),
+			ie.NewForwardingParameters(
+				ie.NewDestinationInterface(ie.DstInterfaceSGiLANN6LAN),
+				ie.NewNetworkInstance("internet"),
+			),
+		),
+		// UL to the PSA on N9
+		ie.NewCreateFAR(
+			ie.NewFARID(2),
+			ie.NewApplyAction(0x02),
+			ie.NewForwardingParameters(
+				ie.NewDestinationInterface(ie.DstInterfaceCore),
+				ie.NewOuterHeaderCreation(0x0100, 0x22, "10.200.0.2", "", 0, 0, 0),
+			),
+		),
+		// DL merged to the AN
+		ie.NewCreateFAR(
+			ie.NewFARID(3),
+			ie.NewApplyAction(0x02),
+			ie.NewForwardingParameters(
+				ie.NewDestinationInterface(ie.DstInterfaceAccess),
+				ie.NewOuterHeaderCreation(0x0100, 0x11, "30.30.30.1", "", 0, 0, 0),
+			),
+		),
+	} {
+		p, err := g.BuildCreateFARPlan(lSeid, far)
+		require.NoError(t, err)
+		plan.CreateFARs = append(plan.CreateFARs, p)
+	}
+	for _, pdr := range []*ie.IE{
+		// UL branched by SDF to the N6 breakout, else to the PSA
+		ie.NewCreatePDR(
+			ie.NewPDRID(1),
+			ie.NewPrecedence(100),
+			ie.NewPDI(
+				ie.NewSourceInterface(ie.SrcInterfaceAccess),
+				ie.NewFTEID(0x01, 1, net.ParseIP("30.30.30.2"), nil, 0),
+				ie.NewUEIPAddress(0x02, "60.60.0.1", "", 0, 0),
+				ie.NewSDFFilter("permit out ip from 10.1.0.0/16 to 60.60.0.1", "", "", "", 0),
+			),
+			ie.NewOuterHeaderRemoval(0, 0),
+			ie.NewFARID(1),
+		),
+		ie.NewCreatePDR(
+			ie.NewPDRID(2),
+			ie.NewPrecedence(200),
+			ie.NewPDI(
+				ie.NewSourceInterface(ie.SrcInterfaceAccess),
+				ie.NewFTEID(0x01, 1, net.ParseIP("30.30.30.2"), nil, 0),
+				ie.NewUEIPAddress(0x02, "60.60.0.1", "", 0, 0),
+			),
+			ie.NewOuterHeaderRemoval(0, 0),
+			ie.NewFARID(2),
+		),
+		// DL from the PSA on an N9 F-TEID, and from the N6 breakout
+		ie.NewCreatePDR(
+			ie.NewPDRID(3),
+			ie.NewPrecedence(200),
+			ie.NewPDI(
+				ie.NewSourceInterface(ie.SrcInterfaceCore),
+				ie.NewFTEID(0x01, 2, net.ParseIP("30.30.30.2"), nil, 0),
+				ie.NewUEIPAddress(0x02, "60.60.0.1", "", 0, 0),
+			),
+			ie.NewOuterHeaderRemoval(0, 0),
+			ie.NewFARID(3),
+		),
+		ie.NewCreatePDR(
+			ie.NewPDRID(4),
+			ie.NewPrecedence(200),
+			ie.NewPDI(
+				ie.NewSourceInterface(ie.SrcInterfaceCore),
+				ie.NewNetworkInstance("internet"),
+				ie.NewUEIPAddress(0x02, "60.60.0.1", "", 0, 0),
+			),
+			ie.NewFARID(3),
+		),
+	} {
+		p, err := g.BuildCreatePDRPlan(lSeid, pdr)
+		require.NoError(t, err)
+		plan.CreatePDRs = append(plan.CreatePDRs, p)
+	}
+	return plan
+}
+
+func TestGtp5g_ULCL(t *testing.T) {
+	if testing.Short() {
+		t.Skip("skipping testing in short mode")
+	}
+	if _, err := os.Stat(PROC_PDR); err != nil {
+		t.Skip("skipping testing without the gtp5g module")
+	}
+
+	var wg sync.WaitGroup
+	g, err := OpenGtp5g(&wg, ":"+strconv.Itoa(factory.UpfGtpDefaultPort), 1400)
+	require.NoError(t, err)
+	defer g.Close()
+
+	lSeid := uint64(2)
+	plan := ulclPlan(t, g, lSeid)
+	_, err = g.ExecuteEstablishmentPlan(plan)
+	require.NoError(t, err)
+
+	link := g.sessLink(lSeid)
+	pdr, err := g.client.GetPDR(link.link, gtp5gnl.OID{lSeid, 1})
+	require.NoError(t, err)
+	require.NotNil(t, pdr.PDI)
+	assert.NotNil(t, pdr.PDI.SDF)
+	assert.True(t, pdr.PDI.UEAddr.Equal(net.IPv4(60, 60, 0, 1)))
+
+	pdr, err = g.client.GetPDR(link.link, gtp5gnl.OID{lSeid, 3})
+	require.NoError(t, err)
+	require.NotNil(t, pdr.PDI)
+	require.NotNil(t, pdr.PDI.FTEID)
+	assert.Equal(t, uint32(2), pdr.PDI.FTEID.TEID)
+	assert.Nil(t, pdr.PDI.UEAddr)
+
+	far, err := g.client.GetFAR(link.link, gtp5gnl.OID{lSeid, 2})
+	require.NoError(t, err)
+	require.NotNil(t, far.Param)
+	require.NotNil(t, far.Param.Creation)
+	assert.Equal(t, uint32(0x22), far.Param.Creation.TEID)
+	assert.True(t, far.Param.Creation.PeerAddr.Equal(net.IPv4(10, 200, 0, 2)))
+}
@@ -2,6 +2,9 @@ package gtpv1
 
 import (
 	"encoding/binary"
+	"time"
+
+	"github.com/pkg/errors"
 )
 
 type Encoder interface {
@@ -14,6 +17,17 @@ const (
 	MsgTypeTPDU uint8 = 255
 )
 
+// Extension Header Type definitions.
+const (
+	ExtTypePDUSessionContainer uint8 = 0x85
+)
+
+// PDU Types of the PDU Session Container, TS 38.415 5.5.2
+const (
+	PDUTypeDL uint8 = 0
+	PDUTypeUL uint8 = 1
+)
+
 type Message struct {
 	Flags          uint8
 	Type           uint8
@@ -80,19 +94,177 @@ func (m Message) Encode(b []byte) (int, error) {
 	return m.Len(), nil
 }
 
+// PDUSessionContainer is the DL PDU SESSION INFORMATION of a G-PDU, with
+// the DL Sending Time Stamp of a QoS monitoring packet if QMP
 type PDUSessionContainer struct {
-	PDUType   uint8
-	QoSFlowID uint8
+	PDUType       uint8
+	QoSFlowID     uint8
+	QMP           bool
+	DLSendingTime uint64 // NTP timestamp
 }
 
 func (e PDUSessionContainer) Len() int {
+	if e.QMP {
+		return 12
+	}
 	return 4
 }
 
 func (e PDUSessionContainer) Encode(b []byte) (int, error) {
-	b[0] = 0x85
-	b[1] = 1
+	l := e.Len()
+	if len(b) < l {
+		return 0, errors.Errorf("PDU Session Container: short buffer %d", len(b))
+	}
+	b[0] = ExtTypePDUSessionContainer
+	b[1] = uint8(l / 4)
 	b[2] = e.PDUType << 4
-	b[3] = e.QoSFlowID & 0xf
+	b[3] = e.QoSFlowID & 0x3f
+	if e.QMP {
+		b[2] |= 0x08
+		binary.BigEndian.PutUint64(b[4:12], e.DLSendingTime)
+	}
+	return l, nil
+}
+
+// ULPDUSessionInformation is the UL PDU SESSION INFORMATION of a G-PDU,
+// TS 38.415 5.5.2.2. A QoS monitoring packet answered by the NG-RAN carries
+// the time stamps of the QoS monitoring packet of the UPF, and the delay
+// results are the delays of the radio interface in units of 0.1 ms.
+type ULPDUSessionInformation struct {
+	QoSFlowID           uint8
+	QMP                 bool
+	DLSendingTimeRepeat uint64 // NTP timestamp
+	DLReceivedTime      uint64 // NTP timestamp
+	ULSendingTime       uint64 // NTP timestamp
+	DLDelayResult       *uint32
+	ULDelayResult       *uint32
+}
+
+// ParseULPDUSessionInformation parses the content of a PDU Session
+// Container extension header, without its length octet
+func ParseULPDUSessionInformation(b []byte) (*ULPDUSessionInformation, error) {
+	if len(b) < 2 {
+		return nil, errors.New("UL PDU Session Information too short")
+	}
+	if b[0]>>4 != PDUTypeUL {
+		return nil, errors.Errorf("PDU type %d is not UL", b[0]>>4)
+	}
+	info := &ULPDUSessionInformation{
+		QoSFlowID: b[1] & 0x3f,
+		QMP:       b[0]&0x08 != 0,
+	}
+	off := 2
+	if info.QMP {
+		if len(b) < off+24 {
+			return nil, errors.New("UL PDU Session Information: time stamps too short")
+		}
+		info.DLSendingTimeRepeat = binary.BigEndian.Uint64(b[off:])
+		info.DLReceivedTime = binary.BigEndian.Uint64(b[off+8:])
+		info.ULSendingTime = binary.BigEndian.Uint64(b[off+16:])
+		off += 24
+	}
+	for _, d := range []struct {
+		ind bool
+		res **uint32
+	}{
+		{b[0]&0x04 != 0, &info.DLDelayResult},
+		{b[0]&0x02 != 0, &info.ULDelayResult},
+	} {
+		if !d.ind {
+			continue
+		}
+		if len(b) < off+4 {
+			return nil, errors.New("UL PDU Session Information: delay result too short")
+		}
+		v := binary.BigEndian.Uint32(b[off:])
+		*d.res = &v
+		off += 4
+	}
+	return info, nil
+}
+
+// Extension is an extension header of a parsed message
+type Extension struct {
+	Type    uint8
+	Content []byte // without the length and the next extension header type
+}
+
+func (e Extension) Len() int {
+	return 2 + len(e.Content)
+}
+
+func (e Extension) Encode(b []byte) (int, error) {
+	if (len(e.Content)+2)%4 != 0 {
+		return 0, errors.Errorf("extension header %#x: unaligned length %d", e.Type, len(e.Content))
+	}
+	b[0] = e.Type
+	b[1] = uint8((len(e.Content) + 2) / 4)
+	copy(b[2:], e.Content)
 	return e.Len(), nil
 }
+
+// ParseMessage parses a GTPv1-U message with its extension headers; the
+// extension headers and the payload refer to b
+func ParseMessage(b []byte) (*Message, error) {
+	if len(b) < 8 {
+		return nil, errors.New("GTP-U header too short")
+	}
+	if b[0]>>5 != 1 {
+		return nil, errors.Errorf("GTP version %d", b[0]>>5)
+	}
+	m := &Message{
+		Flags: b[0],
+		Type:  b[1],
+		TEID:  binary.BigEndian.Uint32(b[4:8]),
+	}
+	// the payload of a message truncated, e.g. by the snap length of a
+	// capture, is cut
+	end := min(8+int(binary.BigEndian.Uint16(b[2:4])), len(b))
+	pos := 8
+	if m.Flags&0x07 == 0 {
+		m.Payload = b[pos:end]
+		return m, nil
+	}
+	if end < pos+4 {
+		return nil, errors.New("GTP-U optional fields too short")
+	}
+	m.SequenceNumber = binary.BigEndian.Uint16(b[pos:])
+	m.NPDUNumber = b[pos+2]
+	next := b[pos+3]
+	pos += 4
+	if m.Flags&0x04 == 0 {
+		next = 0
+	}
+	for next != 0 {
+		if end < pos+1 || b[pos] == 0 {
+			return nil, errors.New("GTP-U extension header too short")
+		}
+		l := int(b[pos]) * 4
+		if end < pos+l {
+			return nil, errors.New("GTP-U extension header truncated")
+		}
+		m.Exts = append(m.Exts, Extension{Type: next, Content: b[pos+1 : pos+l-1]})
+		next = b[pos+l-1]
+		pos += l
+	}
+	m.Payload = b[pos:end]
+	return m, nil
+}
+
+// NTP_EPOCH_OFFSET is the seconds from the NTP epoch 1900 to the Unix epoch
+const NTP_EPOCH_OFFSET = 2208988800
+
+// NTPTimestamp returns the 64-bit NTP timestamp of a time, the format of the
+// time stamps of QoS monitoring
+func NTPTimestamp(t time.Time) uint64 {
+	sec := uint64(t.Unix() + NTP_EPOCH_OFFSET)
+	frac := (uint64(t.Nanosecond()) << 32) / uint64(time.Second)
+	return sec<<32 | frac
+}
+
+// NTPTime returns the time of a 64-bit NTP timestamp
+func NTPTime(ts uint64) time.Time {
+	sec := int64(ts>>32) - NTP_EPOCH_OFFSET
+	nsec := int64(((ts & 0xffffffff) * uint64(time.Second)) >> 32)
+	return time.Unix(sec, nsec)
+}
@@ -2,7 +2,9 @@ package gtpv1
 
 import (
 	"bytes"
+	"encoding/binary"
 	"testing"
+	"time"
 )
 
 func TestMessage(t *testing.T) {
@@ -36,3 +38,80 @@ func TestMessage(t *testing.T) {
 		t.Errorf("want %x; but got %x\n", pkt, b)
 	}
 }
+
+func TestQoSMonitoringPacket(t *testing.T) {
+	ts := NTPTimestamp(time.Unix(1700000000, 500000000))
+	msg := Message{
+		Flags: 0x34,
+		Type:  MsgTypeTPDU,
+		TEID:  1,
+		Exts: []Encoder{
+			PDUSessionContainer{
+				PDUType:       PDUTypeDL,
+				QoSFlowID:     33,
+				QMP:           true,
+				DLSendingTime: ts,
+			},
+		},
+	}
+	b := make([]byte, msg.Len())
+	_, err := msg.Encode(b)
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := []byte{
+		0x34, 0xff, 0x00, 0x10, 0x00, 0x00, 0x00, 0x01,
+		0x00, 0x00, 0x00, 0x85, 0x03, 0x08, 0x21,
+	}
+	if !bytes.Equal(b[:len(want)], want) {
+		t.Errorf("want %x; but got %x\n", want, b[:len(want)])
+	}
+
+	m, err := ParseMessage(b)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(m.Exts) != 1 || len(m.Payload) != 0 {
+		t.Fatalf("unexpected message %+v", m)
+	}
+	e := m.Exts[0].(Extension)
+	if e.Type != ExtTypePDUSessionContainer || binary.BigEndian.Uint64(e.Content[2:]) != ts {
+		t.Errorf("unexpected extension %+v", e)
+	}
+}
+
+func TestParseULPDUSessionInformation(t *testing.T) {
+	b := []byte{0x1c, 0x21}
+	for _, ts := range []uint64{1, 2, 3} {
+		b = binary.BigEndian.AppendUint64(b, ts)
+	}
+	b = binary.BigEndian.AppendUint32(b, 15)
+	info, err := ParseULPDUSessionInformation(b)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !info.QMP || info.QoSFlowID != 33 ||
+		info.DLSendingTimeRepeat != 1 || info.DLReceivedTime != 2 || info.ULSendingTime != 3 {
+		t.Errorf("unexpected information %+v", info)
+	}
+	if info.DLDelayResult == nil || *info.DLDelayResult != 15 || info.ULDelayResult != nil {
+		t.Errorf("unexpected delay results %+v", info)
+	}
+
+	_, err = ParseULPDUSessionInformation([]byte{0x00, 0x21})
+	if err == nil {
+		t.Error("DL PDU Session Information parsed as UL")
+	}
+	_, err = ParseULPDUSessionInformation(b[:20])
+	if err == nil {
+		t.Error("truncated time stamps parsed")
+	}
+}
+
+func TestNTPTimestamp(t *testing.T) {
+	now := time.Unix(1700000000, 123456789)
+	d := NTPTime(NTPTimestamp(now)).Sub(now)
+	if d < -time.Nanosecond || d > time.Nanosecond {
+		t.Errorf("want %v; but got %v\n", now, NTPTime(NTPTimestamp(now)))
+	}
+}
@@ -0,0 +1,311 @@
+// Package journal records the usage reports of the sessions to local files,
+// as CDR-like records, to reconcile them with the reports the SMFs received
+package journal
+
+import (
+	"bytes"
+	"encoding/csv"
+	"encoding/json"
+	"fmt"
+	"io"
+	"os"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/pkg/errors"
+
+	"github.com/free5gc/go-upf/internal/report"
+	"github.com/free5gc/go-upf/pkg/factory"
+)
+
+const (
+	FORMAT_CSV  = "csv"
+	FORMAT_JSON = "json"
+
+	DEFAULT_MAX_SIZE = 64 << 20
+)
+
+// CSV_HEADER is the columns of the records in the CSV format
+var CSV_HEADER = []string{
+	"time", "nodeID", "seid", "cpSeid", "ueIP", "urrID", "urSeqn", "triggers",
+	"startTime", "endTime", "totalVolume", "uplinkVolume", "downlinkVolume",
+	"totalPackets", "uplinkPackets", "downlinkPackets", "duration",
+}
+
+// Record is a usage report of a URR of a session
+type Record struct {
+	Time            time.Time `json:"time"` // recorded
+	NodeID          string    `json:"nodeID"`
+	SEID            uint64    `json:"seid"`   // UP SEID
+	CPSEID          uint64    `json:"cpSeid"` // CP SEID
+	UEIP            string    `json:"ueIP,omitempty"`
+	URRID           uint32    `json:"urrID"`
+	URSEQN          uint32    `json:"urSeqn"`
+	Triggers        []string  `json:"triggers,omitempty"`
+	StartTime       time.Time `json:"startTime"`
+	EndTime         time.Time `json:"endTime"`
+	TotalVolume     uint64    `json:"totalVolume"`
+	UplinkVolume    uint64    `json:"uplinkVolume"`
+	DownlinkVolume  uint64    `json:"downlinkVolume"`
+	TotalPackets    uint64    `json:"totalPackets"`
+	UplinkPackets   uint64    `json:"uplinkPackets"`
+	DownlinkPackets uint64    `json:"downlinkPackets"`
+	Duration        uint64    `json:"duration"` // seconds
+}
+
+// NewRecord returns the record of a usage report, without the session
+func NewRecord(r report.USAReport) *Record {
+	return &Record{
+		URRID:           r.URRID,
+		URSEQN:          r.URSEQN,
+		Triggers:        r.USARTrigger.Names(),
+		StartTime:       r.StartTime,
+		EndTime:         r.EndTime,
+		TotalVolume:     r.VolumMeasure.TotalVolume,
+		UplinkVolume:    r.VolumMeasure.UplinkVolume,
+		DownlinkVolume:  r.VolumMeasure.DownlinkVolume,
+		TotalPackets:    r.VolumMeasure.TotalPktNum,
+		UplinkPackets:   r.VolumMeasure.UplinkPktNum,
+		DownlinkPackets: r.VolumMeasure.DownlinkPktNum,
+		Duration:        uint64(time.Duration(r.DuratMeasure.DurationValue) / time.Second),
+	}
+}
+
+func formatTime(t time.Time) string {
+	if t.IsZero() {
+		return ""
+	}
+	return t.Format(time.RFC3339Nano)
+}
+
+func parseTime(s string) (time.Time, error) {
+	if s == "" {
+		return time.Time{}, nil
+	}
+	return time.Parse(time.RFC3339Nano, s)
+}
+
+func (r *Record) csv() []string {
+	u := func(v uint64) string { return strconv.FormatUint(v, 10) }
+	return []string{
+		formatTime(r.Time), r.NodeID, u(r.SEID), u(r.CPSEID), r.UEIP,
+		u(uint64(r.URRID)), u(uint64(r.URSEQN)), strings.Join(r.Triggers, "|"),
+		formatTime(r.StartTime), formatTime(r.EndTime),
+		u(r.TotalVolume), u(r.UplinkVolume), u(r.DownlinkVolume),
+		u(r.TotalPackets), u(r.UplinkPackets), u(r.DownlinkPackets), u(r.Duration),
+	}
+}
+
+func parseCSV(f []string) (*Record, error) {
+	if len(f) != len(CSV_HEADER) {
+		return nil, errors.Errorf("%d fields, want %d", len(f), len(CSV_HEADER))
+	}
+	r := &Record{NodeID: f[1], UEIP: f[4]}
+	var err error
+	if r.Time, err = parseTime(f[0]); err != nil {
+		return nil, err
+	}
+	if r.StartTime, err = parseTime(f[8]); err != nil {
+		return nil, err
+	}
+	if r.EndTime, err = parseTime(f[9]); err != nil {
+		return nil, err
+	}
+	if f[7] != "" {
+		r.Triggers = strings.Split(f[7], "|")
+	}
+	for col, v := range map[int]*uint64{
+		2: &r.SEID, 3: &r.CPSEID,
+		10: &r.TotalVolume, 11: &r.UplinkVolume, 12: &r.DownlinkVolume,
+		13: &r.TotalPackets, 14: &r.UplinkPackets, 15: &r.DownlinkPackets,
+		16: &r.Duration,
+	} {
+		if *v, err = strconv.ParseUint(f[col], 10, 64); err != nil {
+			return nil, errors.Wrap(err, CSV_HEADER[col])
+		}
+	}
+	for col, v := range map[int]*uint32{5: &r.URRID, 6: &r.URSEQN} {
+		n, err := strconv.ParseUint(f[col], 10, 32)
+		if err != nil {
+			return nil, errors.Wrap(err, CSV_HEADER[col])
+		}
+		*v = uint32(n)
+	}
+	return r, nil
+}
+
+// Encoder writes the records in a format, one a line
+type Encoder struct {
+	w      io.Writer
+	format string
+}
+
+func NewEncoder(w io.Writer, format string) (*Encoder, error) {
+	switch format {
+	case "":
+		format = FORMAT_CSV
+	case FORMAT_CSV, FORMAT_JSON:
+	default:
+		return nil, errors.Errorf("journal: unknown format %q", format)
+	}
+	return &Encoder{w: w, format: format}, nil
+}
+
+// Header writes the CSV header, if the format is CSV
+func (e *Encoder) Header() error {
+	if e.format != FORMAT_CSV {
+		return nil
+	}
+	return e.writeCSV(CSV_HEADER)
+}
+
+func (e *Encoder) Encode(r *Record) error {
+	if e.format == FORMAT_JSON {
+		return json.NewEncoder(e.w).Encode(r)
+	}
+	return e.writeCSV(r.csv())
+}
+
+func (e *Encoder) writeCSV(fields []string) error {
+	// a single write a record, for the size accounting of the journal
+	var b bytes.Buffer
+	w := csv.NewWriter(&b)
+	if err := w.Write(fields); err != nil {
+		return err
+	}
+	w.Flush()
+	_, err := e.w.Write(b.Bytes())
+	return err
+}
+
+// Journal appends the records to a file, which is rotated once it reaches
+// its max size: the file is renamed with the suffix ".1", the former ".1"
+// with ".2", and so on up to the max number of the rotated files kept
+type Journal struct {
+	path     string
+	format   string
+	maxSize  int64
+	maxFiles int
+
+	mu   sync.Mutex
+	f    *os.File
+	enc  *Encoder
+	size int64
+}
+
+// Open opens the journal configured, appending to the file if it exists;
+// a nil Journal is returned if cfg is nil
+func Open(cfg *factory.UsageJournal) (*Journal, error) {
+	if cfg == nil {
+		return nil, nil
+	}
+	j := &Journal{
+		path:     cfg.File,
+		format:   cfg.Format,
+		maxSize:  cfg.MaxSize,
+		maxFiles: cfg.MaxFiles,
+	}
+	if j.maxSize <= 0 {
+		j.maxSize = DEFAULT_MAX_SIZE
+	}
+	if err := j.open(); err != nil {
+		return nil, err
+	}
+	return j, nil
+}
+
+// counter counts the bytes written to the file
+type counter struct {
+	j *Journal
+}
+
+func (c counter) Write(b []byte) (int, error) {
+	n, err := c.j.f.Write(b)
+	c.j.size += int64(n)
+	return n, err
+}
+
+func (j *Journal) open() error {
+	f, err := os.OpenFile(j.path, os.O_WRONLY|os.O_CREATE|os.O_APPEND, 0o600)
+	if err != nil {
+		return errors.Wrap(err, "journal open")
+	}
+	fi, err := f.Stat()
+	if err != nil {
+		f.Close()
+		return errors.Wrap(err, "journal open")
+	}
+	j.f = f
+	j.size = fi.Size()
+	j.enc, err = NewEncoder(counter{j}, j.format)
+	if err != nil {
+		f.Close()
+		j.f = nil
+		return err
+	}
+	if j.size == 0 {
+		if err = j.enc.Header(); err != nil {
+			return errors.Wrap(err, "journal header")
+		}
+	}
+	return nil
+}
+
+func (j *Journal) rotate() error {
+	if err := j.f.Close(); err != nil {
+		return errors.Wrap(err, "journal rotate")
+	}
+	j.f = nil
+	for i := j.maxFiles - 1; i > 0; i-- {
+		err := os.Rename(fmt.Sprintf("%s.%d", j.path, i), fmt.Sprintf("%s.%d", j.path, i+1))
+		if err != nil && !os.IsNotExist(err) {
+			return errors.Wrap(err, "journal rotate")
+		}
+	}
+	if j.maxFiles > 0 {
+		if err := os.Rename(j.path, j.path+".1"); err != nil {
+			return errors.Wrap(err, "journal rotate")
+		}
+	} else if err := os.Remove(j.path); err != nil {
+		return errors.Wrap(err, "journal rotate")
+	}
+	return j.open()
+}
+
+// Write appends a record, timestamped now if not set. A nil Journal
+// discards it.
+func (j *Journal) Write(r *Record) error {
+	if j == nil {
+		return nil
+	}
+	if r.Time.IsZero() {
+		r.Time = time.Now()
+	}
+	j.mu.Lock()
+	defer j.mu.Unlock()
+	if j.f == nil {
+		return errors.New("journal closed")
+	}
+	if j.size >= j.maxSize {
+		if err := j.rotate(); err != nil {
+			return err
+		}
+	}
+	return errors.Wrap(j.enc.Encode(r), "journal write")
+}
+
+func (j *Journal) Close() error {
+	if j == nil {
+		return nil
+	}
+	j.mu.Lock()
+	defer j.mu.Unlock()
+	if j.f == nil {
+		return nil
+	}
+	err := j.f.Close()
+	j.f = nil
+	return errors.Wrap(err, "journal close")
+}
@@ -0,0 +1,120 @@
+package journal
+
+import (
+	"bytes"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+
+	"github.com/free5gc/go-upf/internal/report"
+	"github.com/free5gc/go-upf/pkg/factory"
+)
+
+func testRecord(seid uint64, t time.Time) *Record {
+	r := NewRecord(report.USAReport{
+		URRID:       1,
+		URSEQN:      2,
+		USARTrigger: report.UsageReportTrigger{Flags: report.USAR_TRIG_PERIO | report.USAR_TRIG_VOLTH},
+		VolumMeasure: report.VolumeMeasure{
+			TotalVolume:    300,
+			UplinkVolume:   100,
+			DownlinkVolume: 200,
+			TotalPktNum:    3,
+		},
+		DuratMeasure: report.DurationMeasure{DurationValue: uint64(10 * time.Second)},
+		StartTime:    t.Add(-10 * time.Second),
+		EndTime:      t,
+	})
+	r.Time = t
+	r.NodeID = "10.100.200.3"
+	r.SEID = seid
+	r.CPSEID = seid + 0x100
+	r.UEIP = "10.60.0.1"
+	return r
+}
+
+func TestRecordFormats(t *testing.T) {
+	now := time.Date(2026, 10, 19, 6, 0, 0, 0, time.UTC)
+	r := testRecord(1, now)
+	assert.Equal(t, []string{"PERIO", "VOLTH"}, r.Triggers)
+	assert.Equal(t, uint64(10), r.Duration)
+
+	for _, format := range []string{FORMAT_CSV, FORMAT_JSON} {
+		var b bytes.Buffer
+		enc, err := NewEncoder(&b, format)
+		require.NoError(t, err)
+		require.NoError(t, enc.Header())
+		require.NoError(t, enc.Encode(r))
+
+		lines := strings.Split(strings.TrimSpace(b.String()), "\n")
+		got, err := parseLine(lines[len(lines)-1])
+		require.NoError(t, err, format)
+		assert.Equal(t, r, got, format)
+	}
+
+	_, err := NewEncoder(nil, "xml")
+	assert.Error(t, err)
+}
+
+func TestJournal(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "usage.csv")
+	now := time.Date(2026, 10, 19, 6, 0, 0, 0, time.UTC)
+
+	var b bytes.Buffer
+	enc, err := NewEncoder(&b, FORMAT_CSV)
+	require.NoError(t, err)
+	require.NoError(t, enc.Header())
+	hdr := int64(b.Len())
+	require.NoError(t, enc.Encode(testRecord(1, now)))
+	rec := int64(b.Len()) - hdr
+
+	// rotated every 3 records
+	j, err := Open(&factory.UsageJournal{File: path, MaxSize: hdr + 3*rec, MaxFiles: 2})
+	require.NoError(t, err)
+	for i := range 6 {
+		require.NoError(t, j.Write(testRecord(uint64(i%2+1), now.Add(time.Duration(i)*time.Minute))))
+	}
+	require.NoError(t, j.Close())
+	assert.Error(t, j.Write(testRecord(1, now)))
+
+	assert.Equal(t, []string{path + ".1", path}, Files(path))
+
+	// appended to once reopened, in another format
+	j, err = Open(&factory.UsageJournal{File: path, Format: FORMAT_JSON, MaxSize: 1 << 20})
+	require.NoError(t, err)
+	require.NoError(t, j.Write(testRecord(1, now.Add(6*time.Minute))))
+	require.NoError(t, j.Close())
+
+	var seqs []time.Time
+	collect := func(r *Record) error {
+		seqs = append(seqs, r.Time)
+		return nil
+	}
+	require.NoError(t, Query(path, Filter{}, collect))
+	assert.Len(t, seqs, 7)
+	assert.True(t, seqs[0].Equal(now))
+	assert.True(t, seqs[6].Equal(now.Add(6*time.Minute)))
+
+	seqs = nil
+	require.NoError(t, Query(path, Filter{SEID: 0x101}, collect))
+	assert.Len(t, seqs, 4)
+
+	seqs = nil
+	require.NoError(t, Query(path, Filter{
+		SEID: 2,
+		From: now.Add(2 * time.Minute),
+		To:   now.Add(5 * time.Minute),
+	}, collect))
+	assert.Len(t, seqs, 2)
+
+	var nilJournal *Journal
+	assert.NoError(t, nilJournal.Write(testRecord(1, now)))
+
+	_, err = os.Stat(path + ".2")
+	assert.True(t, os.IsNotExist(err))
+}
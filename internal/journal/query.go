@@ -0,0 +1,102 @@
+package journal
+
+import (
+	"bufio"
+	"encoding/csv"
+	"encoding/json"
+	"fmt"
+	"os"
+	"strings"
+	"time"
+
+	"github.com/pkg/errors"
+)
+
+// Filter selects the records of a session, by its UP or CP SEID, recorded
+// in a time range; the zero values select any
+type Filter struct {
+	SEID uint64
+	From time.Time
+	To   time.Time
+}
+
+func (f *Filter) Match(r *Record) bool {
+	if f.SEID != 0 && r.SEID != f.SEID && r.CPSEID != f.SEID {
+		return false
+	}
+	if !f.From.IsZero() && r.Time.Before(f.From) {
+		return false
+	}
+	if !f.To.IsZero() && r.Time.After(f.To) {
+		return false
+	}
+	return true
+}
+
+// Files returns the files of the journal at path, the oldest rotated first
+func Files(path string) []string {
+	var rotated []string
+	for i := 1; ; i++ {
+		name := fmt.Sprintf("%s.%d", path, i)
+		if _, err := os.Stat(name); err != nil {
+			break
+		}
+		rotated = append([]string{name}, rotated...)
+	}
+	return append(rotated, path)
+}
+
+// Query calls fn with the records of the journal at path matching the
+// filter, in the order recorded; the file may be in either format
+func Query(path string, f Filter, fn func(*Record) error) error {
+	for _, name := range Files(path) {
+		err := queryFile(name, f, fn)
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func queryFile(name string, f Filter, fn func(*Record) error) error {
+	file, err := os.Open(name)
+	if err != nil {
+		return errors.Wrap(err, "journal query")
+	}
+	defer file.Close()
+
+	sc := bufio.NewScanner(file)
+	for n := 1; sc.Scan(); n++ {
+		line := sc.Text()
+		if line == "" || strings.HasPrefix(line, CSV_HEADER[0]+",") {
+			continue
+		}
+		r, err := parseLine(line)
+		if err != nil {
+			return errors.Wrapf(err, "%s:%d", name, n)
+		}
+		if !f.Match(r) {
+			continue
+		}
+		if err = fn(r); err != nil {
+			return err
+		}
+	}
+	return errors.Wrap(sc.Err(), "journal query")
+}
+
+func parseLine(line string) (*Record, error) {
+	if line[0] == '{' {
+		r := new(Record)
+		err := json.Unmarshal([]byte(line), r)
+		if err != nil {
+			return nil, err
+		}
+		return r, nil
+	}
+	fields, err := csv.NewReader(strings.NewReader(line)).Read()
+	if err != nil {
+		return nil, err
+	}
+	return parseCSV(fields)
+}
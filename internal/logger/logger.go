@@ -15,6 +15,9 @@ var (
 	BuffLog  *logrus.Entry
 	PerioLog *logrus.Entry
 	FwderLog *logrus.Entry
+	NatLog   *logrus.Entry
+	MgmtLog  *logrus.Entry
+	EvtLog   *logrus.Entry
 )
 
 func init() {
@@ -36,4 +39,7 @@ func init() {
 	BuffLog = NfLog.WithField(logger_util.FieldCategory, "BUFF")
 	PerioLog = NfLog.WithField(logger_util.FieldCategory, "Perio")
 	FwderLog = NfLog.WithField(logger_util.FieldCategory, "FWD")
+	NatLog = NfLog.WithField(logger_util.FieldCategory, "NAT")
+	MgmtLog = NfLog.WithField(logger_util.FieldCategory, "MGMT")
+	EvtLog = NfLog.WithField(logger_util.FieldCategory, "EVT")
 }
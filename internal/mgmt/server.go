@@ -0,0 +1,118 @@
+package mgmt
+
+import (
+	"context"
+	"encoding/json"
+	"net"
+	"net/http"
+	"net/url"
+	"sync"
+	"time"
+
+	"github.com/pkg/errors"
+	"github.com/sirupsen/logrus"
+
+	"github.com/free5gc/go-upf/internal/logger"
+)
+
+const SHUTDOWN_TIMEOUT = 3 * time.Second
+
+// Server serves the state of the UPF components in JSON over HTTP
+type Server struct {
+	addr string
+	mux  *http.ServeMux
+	srv  *http.Server
+	ln   net.Listener
+	log  *logrus.Entry
+}
+
+func NewServer(addr string) *Server {
+	s := &Server{
+		addr: addr,
+		mux:  http.NewServeMux(),
+		log:  logger.MgmtLog,
+	}
+	s.srv = &http.Server{
+		Handler:           s.mux,
+		ReadHeaderTimeout: SHUTDOWN_TIMEOUT,
+	}
+	return s
+}
+
+// HandleJSON serves the value returned by f at path
+func (s *Server) HandleJSON(path string, f func() any) {
+	s.mux.HandleFunc(path, func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != http.MethodGet {
+			http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+			return
+		}
+		s.writeJSON(w, path, f())
+	})
+}
+
+// HandleControl serves the value returned by get at path, and changes it
+// by set with the query parameters of a POST request
+func (s *Server) HandleControl(path string, get func() any, set func(url.Values) error) {
+	s.mux.HandleFunc(path, func(w http.ResponseWriter, r *http.Request) {
+		switch r.Method {
+		case http.MethodGet:
+		case http.MethodPost:
+			err := set(r.URL.Query())
+			if err != nil {
+				s.log.Warnf("control %s err: %+v", path, err)
+				http.Error(w, err.Error(), http.StatusBadRequest)
+				return
+			}
+		default:
+			http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+			return
+		}
+		s.writeJSON(w, path, get())
+	})
+}
+
+func (s *Server) writeJSON(w http.ResponseWriter, path string, v any) {
+	w.Header().Set("Content-Type", "application/json")
+	enc := json.NewEncoder(w)
+	enc.SetIndent("", "  ")
+	err := enc.Encode(v)
+	if err != nil {
+		s.log.Warnf("encode %s err: %+v", path, err)
+	}
+}
+
+// Addr returns the listening address once started
+func (s *Server) Addr() net.Addr {
+	if s.ln == nil {
+		return nil
+	}
+	return s.ln.Addr()
+}
+
+func (s *Server) Start(wg *sync.WaitGroup) error {
+	ln, err := net.Listen("tcp", s.addr)
+	if err != nil {
+		return errors.Wrap(err, "management listen")
+	}
+	s.ln = ln
+	s.log.Infof("management listen on %v", ln.Addr())
+
+	wg.Add(1)
+	go func() {
+		defer wg.Done()
+		err := s.srv.Serve(ln)
+		if err != nil && !errors.Is(err, http.ErrServerClosed) {
+			s.log.Errorf("management serve err: %+v", err)
+		}
+	}()
+	return nil
+}
+
+func (s *Server) Stop() {
+	ctx, cancel := context.WithTimeout(context.Background(), SHUTDOWN_TIMEOUT)
+	defer cancel()
+	err := s.srv.Shutdown(ctx)
+	if err != nil {
+		s.log.Warnf("management shutdown err: %+v", err)
+	}
+}
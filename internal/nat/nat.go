@@ -0,0 +1,256 @@
+package nat
+
+import (
+	"fmt"
+	"net"
+	"slices"
+	"sync"
+	"syscall"
+	"time"
+
+	"github.com/khirono/go-nl"
+	"github.com/pkg/errors"
+	"github.com/sirupsen/logrus"
+
+	"github.com/free5gc/go-upf/internal/logger"
+	"github.com/free5gc/go-upf/pkg/factory"
+)
+
+const (
+	TABLE_NAME         = "upf-nat"
+	CHAIN_NAME         = "postrouting"
+	RECONCILE_INTERVAL = 30 * time.Second
+)
+
+// Rule masquerades the traffic of the UEs of a DNN towards its NAT interface
+type Rule struct {
+	Dnn    string `json:"dnn"`
+	Cidr   string `json:"cidr"`
+	IfName string `json:"ifname"`
+
+	src *net.IPNet
+}
+
+// userdata tags a rule in the kernel, to detect external changes
+func (r *Rule) userdata() string {
+	return fmt.Sprintf("upf:%s:%s:%s", r.Dnn, r.Cidr, r.IfName)
+}
+
+// Status is the NAT state of the UPF
+type Status struct {
+	Table      string    `json:"table"`
+	Rules      []Rule    `json:"rules"`
+	InSync     bool      `json:"inSync"`
+	Reconciled int       `json:"reconciled"` // times the table was restored
+	LastCheck  time.Time `json:"lastCheck"`
+	LastError  string    `json:"lastError,omitempty"`
+}
+
+// Manager programs the source NAT of the DNNs in a nftables table of its own
+type Manager struct {
+	conn  *nftConn
+	rules []Rule
+	log   *logrus.Entry
+
+	mu     sync.Mutex
+	status Status
+	done   chan struct{}
+}
+
+// Rules returns the NAT rules of the DNNs with a NAT interface
+func Rules(dnns []factory.DnnList) ([]Rule, error) {
+	var rules []Rule
+	for _, d := range dnns {
+		if d.NatIfName == "" {
+			continue
+		}
+		_, src, err := net.ParseCIDR(d.Cidr)
+		if err != nil {
+			return nil, errors.Wrapf(err, "DNN[%s]", d.Dnn)
+		}
+		if src.IP.To4() == nil {
+			return nil, errors.Errorf("DNN[%s]: NAT supports IPv4 only", d.Dnn)
+		}
+		rules = append(rules, Rule{
+			Dnn:    d.Dnn,
+			Cidr:   src.String(),
+			IfName: d.NatIfName,
+			src:    src,
+		})
+	}
+	return rules, nil
+}
+
+// Open programs the rules and starts reconciling them
+func Open(wg *sync.WaitGroup, rules []Rule) (*Manager, error) {
+	conn, err := openNftConn()
+	if err != nil {
+		return nil, err
+	}
+	m := &Manager{
+		conn:  conn,
+		rules: rules,
+		log:   logger.NatLog,
+		status: Status{
+			Table: TABLE_NAME,
+			Rules: rules,
+		},
+		done: make(chan struct{}),
+	}
+	err = m.apply()
+	if err != nil {
+		conn.Close()
+		return nil, errors.Wrap(err, "program NAT")
+	}
+	for _, r := range rules {
+		m.log.Infof("masquerade %s to %s for DNN[%s]", r.Cidr, r.IfName, r.Dnn)
+	}
+	m.setStatus(true, nil)
+
+	wg.Add(1)
+	go func() {
+		defer wg.Done()
+		m.run(RECONCILE_INTERVAL)
+	}()
+	return m, nil
+}
+
+// Close removes the NAT of the UPF
+func (m *Manager) Close() {
+	close(m.done)
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	err := m.conn.commit([]nftMsg{
+		{typ: NFT_MSG_NEWTABLE, flags: syscall.NLM_F_CREATE, attrs: tableAttrs()},
+		{typ: NFT_MSG_DELTABLE, attrs: tableAttrs()},
+	})
+	if err != nil {
+		m.log.Warnf("remove NAT table err: %+v", err)
+	}
+	m.conn.Close()
+	m.log.Infoln("NAT removed")
+}
+
+// Status returns the NAT state
+func (m *Manager) Status() Status {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	return m.status
+}
+
+func (m *Manager) run(interval time.Duration) {
+	t := time.NewTicker(interval)
+	defer t.Stop()
+	for {
+		select {
+		case <-m.done:
+			return
+		case <-t.C:
+			m.Reconcile()
+		}
+	}
+}
+
+// Reconcile restores the NAT table if it has been changed externally
+func (m *Manager) Reconcile() {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	select {
+	case <-m.done:
+		return
+	default:
+	}
+
+	ok, err := m.check()
+	if err == nil && !ok {
+		m.log.Warnf("NAT table %q changed externally, restore it", TABLE_NAME)
+		err = m.apply()
+		if err == nil {
+			m.status.Reconciled++
+		}
+	}
+	if err != nil {
+		m.log.Errorf("reconcile NAT err: %+v", err)
+	}
+	m.status.InSync = err == nil
+	m.status.LastCheck = time.Now()
+	m.status.LastError = errString(err)
+}
+
+func (m *Manager) setStatus(inSync bool, err error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	m.status.InSync = inSync
+	m.status.LastCheck = time.Now()
+	m.status.LastError = errString(err)
+}
+
+func errString(err error) string {
+	if err == nil {
+		return ""
+	}
+	return err.Error()
+}
+
+// check reports whether the chain has exactly the rules of the UPF
+func (m *Manager) check() (bool, error) {
+	msgs, err := m.conn.dump(NFT_MSG_GETRULE, nl.AttrList{
+		{Type: NFTA_RULE_TABLE, Value: nl.AttrString(TABLE_NAME)},
+		{Type: NFTA_RULE_CHAIN, Value: nl.AttrString(CHAIN_NAME)},
+	})
+	if errors.Is(err, syscall.ENOENT) {
+		return false, nil
+	}
+	if err != nil {
+		return false, err
+	}
+	got := ruleUserdata(msgs)
+	var want []string
+	for i := range m.rules {
+		want = append(want, m.rules[i].userdata())
+	}
+	slices.Sort(got)
+	slices.Sort(want)
+	return slices.Equal(got, want), nil
+}
+
+// apply (re)creates the table with the rules in one transaction
+func (m *Manager) apply() error {
+	return m.conn.commit(m.batch())
+}
+
+func (m *Manager) batch() []nftMsg {
+	msgs := []nftMsg{
+		// the table is created before its deletion to not fail if absent
+		{typ: NFT_MSG_NEWTABLE, flags: syscall.NLM_F_CREATE, attrs: tableAttrs()},
+		{typ: NFT_MSG_DELTABLE, attrs: tableAttrs()},
+		{typ: NFT_MSG_NEWTABLE, flags: syscall.NLM_F_CREATE, attrs: tableAttrs()},
+		{typ: NFT_MSG_NEWCHAIN, flags: syscall.NLM_F_CREATE, attrs: nl.AttrList{
+			{Type: NFTA_CHAIN_TABLE, Value: nl.AttrString(TABLE_NAME)},
+			{Type: NFTA_CHAIN_NAME, Value: nl.AttrString(CHAIN_NAME)},
+			{Type: NFTA_CHAIN_HOOK, Value: nl.AttrList{
+				{Type: NFTA_HOOK_HOOKNUM, Value: beU32(NF_INET_POST_ROUTING)},
+				{Type: NFTA_HOOK_PRIORITY, Value: beU32(NF_IP_PRI_NAT_SRC)},
+			}},
+			{Type: NFTA_CHAIN_TYPE, Value: nl.AttrString("nat")},
+		}},
+	}
+	for i := range m.rules {
+		r := &m.rules[i]
+		msgs = append(msgs, nftMsg{
+			typ:   NFT_MSG_NEWRULE,
+			flags: syscall.NLM_F_CREATE | syscall.NLM_F_APPEND,
+			attrs: nl.AttrList{
+				{Type: NFTA_RULE_TABLE, Value: nl.AttrString(TABLE_NAME)},
+				{Type: NFTA_RULE_CHAIN, Value: nl.AttrString(CHAIN_NAME)},
+				{Type: NFTA_RULE_EXPRESSIONS, Value: masqExprs(r.src, r.IfName)},
+				{Type: NFTA_RULE_USERDATA, Value: nl.AttrBytes(r.userdata())},
+			},
+		})
+	}
+	return msgs
+}
+
+func tableAttrs() nl.AttrList {
+	return nl.AttrList{{Type: NFTA_TABLE_NAME, Value: nl.AttrString(TABLE_NAME)}}
+}
@@ -0,0 +1,109 @@
+package nat
+
+import (
+	"net"
+	"sync"
+	"syscall"
+	"testing"
+
+	"github.com/khirono/go-nl"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+
+	"github.com/free5gc/go-upf/pkg/factory"
+)
+
+func TestRules(t *testing.T) {
+	rules, err := Rules([]factory.DnnList{
+		{Dnn: "internet", Cidr: "10.60.0.1/16", NatIfName: "eth0"},
+		{Dnn: "ims", Cidr: "10.61.0.0/16"},
+	})
+	require.NoError(t, err)
+	require.Len(t, rules, 1)
+	assert.Equal(t, "10.60.0.0/16", rules[0].Cidr)
+	assert.Equal(t, "upf:internet:10.60.0.0/16:eth0", rules[0].userdata())
+
+	_, err = Rules([]factory.DnnList{
+		{Dnn: "v6", Cidr: "2001:db8::/64", NatIfName: "eth0"},
+	})
+	assert.Error(t, err)
+}
+
+func TestEncodeBatch(t *testing.T) {
+	rules, err := Rules([]factory.DnnList{
+		{Dnn: "internet", Cidr: "10.60.0.0/16", NatIfName: "eth0"},
+	})
+	require.NoError(t, err)
+	m := &Manager{rules: rules}
+	msgs := m.batch()
+	require.Len(t, msgs, 5)
+
+	b := encodeBatch(100, msgs)
+	native := nl.NativeEndian()
+	var types []uint16
+	var seqs []uint32
+	for len(b) > 0 {
+		l := int(native.Uint32(b[0:4]))
+		require.GreaterOrEqual(t, l, syscall.SizeofNlMsghdr+4)
+		require.LessOrEqual(t, l, len(b))
+		types = append(types, native.Uint16(b[4:6]))
+		seqs = append(seqs, native.Uint32(b[8:12]))
+		b = b[l:]
+	}
+	assert.Equal(t, []uint16{
+		NFNL_MSG_BATCH_BEGIN,
+		NFNL_SUBSYS_NFTABLES<<8 | NFT_MSG_NEWTABLE,
+		NFNL_SUBSYS_NFTABLES<<8 | NFT_MSG_DELTABLE,
+		NFNL_SUBSYS_NFTABLES<<8 | NFT_MSG_NEWTABLE,
+		NFNL_SUBSYS_NFTABLES<<8 | NFT_MSG_NEWCHAIN,
+		NFNL_SUBSYS_NFTABLES<<8 | NFT_MSG_NEWRULE,
+		NFNL_MSG_BATCH_END,
+	}, types)
+	assert.Equal(t, []uint32{100, 101, 102, 103, 104, 105, 106}, seqs)
+}
+
+func TestRuleUserdata(t *testing.T) {
+	_, src, err := net.ParseCIDR("10.60.0.0/16")
+	require.NoError(t, err)
+	attrs := nl.AttrList{
+		{Type: NFTA_RULE_TABLE, Value: nl.AttrString(TABLE_NAME)},
+		{Type: NFTA_RULE_CHAIN, Value: nl.AttrString(CHAIN_NAME)},
+		{Type: NFTA_RULE_EXPRESSIONS, Value: masqExprs(src, "eth0")},
+		{Type: NFTA_RULE_USERDATA, Value: nl.AttrBytes("upf:internet:10.60.0.0/16:eth0")},
+	}
+	body := make([]byte, 4+attrs.Len())
+	_, err = attrs.Encode(body[4:])
+	require.NoError(t, err)
+
+	uds := ruleUserdata([]nl.Msg{{Body: body}, {Body: body[:4]}})
+	assert.Equal(t, []string{"upf:internet:10.60.0.0/16:eth0"}, uds)
+}
+
+func TestManager(t *testing.T) {
+	if testing.Short() {
+		t.Skip("skipping testing in short mode")
+	}
+
+	rules, err := Rules([]factory.DnnList{
+		{Dnn: "internet", Cidr: "10.60.0.0/16", NatIfName: "lo"},
+	})
+	require.NoError(t, err)
+	var wg sync.WaitGroup
+	m, err := Open(&wg, rules)
+	require.NoError(t, err)
+	assert.True(t, m.Status().InSync)
+
+	// an external deletion of the table is restored
+	err = m.conn.commit([]nftMsg{{typ: NFT_MSG_DELTABLE, attrs: tableAttrs()}})
+	require.NoError(t, err)
+	m.Reconcile()
+	st := m.Status()
+	assert.True(t, st.InSync)
+	assert.Equal(t, 1, st.Reconciled)
+
+	m.Reconcile()
+	assert.Equal(t, 1, m.Status().Reconciled)
+
+	m.Close()
+	wg.Wait()
+}
@@ -0,0 +1,286 @@
+package nat
+
+import (
+	"encoding/binary"
+	"net"
+	"syscall"
+	"time"
+
+	"github.com/khirono/go-nl"
+	"github.com/pkg/errors"
+)
+
+// nftables netlink, from linux/netfilter/nfnetlink.h and nf_tables.h
+const (
+	NFNL_SUBSYS_NFTABLES = 10
+	NFNL_MSG_BATCH_BEGIN = syscall.NLMSG_MIN_TYPE
+	NFNL_MSG_BATCH_END   = syscall.NLMSG_MIN_TYPE + 1
+	NFPROTO_IPV4         = 2
+
+	NFT_MSG_NEWTABLE = 0
+	NFT_MSG_DELTABLE = 2
+	NFT_MSG_NEWCHAIN = 3
+	NFT_MSG_NEWRULE  = 6
+	NFT_MSG_GETRULE  = 7
+
+	NFTA_TABLE_NAME       = 1
+	NFTA_CHAIN_TABLE      = 1
+	NFTA_CHAIN_NAME       = 3
+	NFTA_CHAIN_HOOK       = 4
+	NFTA_CHAIN_TYPE       = 7
+	NFTA_HOOK_HOOKNUM     = 1
+	NFTA_HOOK_PRIORITY    = 2
+	NFTA_RULE_TABLE       = 1
+	NFTA_RULE_CHAIN       = 2
+	NFTA_RULE_EXPRESSIONS = 4
+	NFTA_RULE_USERDATA    = 7
+	NFTA_LIST_ELEM        = 1
+	NFTA_EXPR_NAME        = 1
+	NFTA_EXPR_DATA        = 2
+	NFTA_DATA_VALUE       = 1
+
+	NFTA_PAYLOAD_DREG   = 1
+	NFTA_PAYLOAD_BASE   = 2
+	NFTA_PAYLOAD_OFFSET = 3
+	NFTA_PAYLOAD_LEN    = 4
+	NFTA_BITWISE_SREG   = 1
+	NFTA_BITWISE_DREG   = 2
+	NFTA_BITWISE_LEN    = 3
+	NFTA_BITWISE_MASK   = 4
+	NFTA_BITWISE_XOR    = 5
+	NFTA_CMP_SREG       = 1
+	NFTA_CMP_OP         = 2
+	NFTA_CMP_DATA       = 3
+	NFTA_META_DREG      = 1
+	NFTA_META_KEY       = 2
+
+	NF_INET_POST_ROUTING       = 4
+	NF_IP_PRI_NAT_SRC          = 100
+	NFT_REG_1                  = 1
+	NFT_PAYLOAD_NETWORK_HEADER = 1
+	NFT_CMP_EQ                 = 0
+	NFT_META_OIFNAME           = 7
+
+	IFNAMSIZ = 16
+)
+
+// beU32 is a big endian u32 attribute, as nftables expects
+type beU32 uint32
+
+func (u beU32) Len() int {
+	return 4
+}
+
+func (u beU32) Encode(b []byte) (int, error) {
+	binary.BigEndian.PutUint32(b, uint32(u))
+	return 4, nil
+}
+
+// nftConn is a netfilter netlink socket sending nftables batches
+type nftConn struct {
+	conn *nl.Conn
+}
+
+func openNftConn() (*nftConn, error) {
+	conn, err := nl.Open(syscall.NETLINK_NETFILTER)
+	if err != nil {
+		return nil, errors.Wrap(err, "open netfilter netlink")
+	}
+	tv := syscall.NsecToTimeval(int64(time.Second))
+	err = syscall.SetsockoptTimeval(conn.Fd(), syscall.SOL_SOCKET, syscall.SO_RCVTIMEO, &tv)
+	if err != nil {
+		conn.Close()
+		return nil, errors.Wrap(err, "set netlink timeout")
+	}
+	return &nftConn{conn: conn}, nil
+}
+
+func (c *nftConn) Close() {
+	c.conn.Close()
+}
+
+// nftMsg is a nftables message of a batch
+type nftMsg struct {
+	typ   uint16
+	flags uint16
+	attrs nl.AttrList
+}
+
+func encodeMsg(b []byte, typ, flags uint16, seq uint32, family uint8, resID uint16, attrs nl.AttrList) []byte {
+	n := syscall.SizeofNlMsghdr + 4 + attrs.Len()
+	m := make([]byte, n)
+	native := nl.NativeEndian()
+	native.PutUint32(m[0:4], uint32(n))
+	native.PutUint16(m[4:6], typ)
+	native.PutUint16(m[6:8], syscall.NLM_F_REQUEST|flags)
+	native.PutUint32(m[8:12], seq)
+	m[16] = family
+	binary.BigEndian.PutUint16(m[18:20], resID)
+	_, _ = attrs.Encode(m[20:])
+	return append(b, m...)
+}
+
+// encodeBatch returns the batch of the messages in one transaction
+func encodeBatch(seq uint32, msgs []nftMsg) []byte {
+	var b []byte
+	b = encodeMsg(b, NFNL_MSG_BATCH_BEGIN, 0, seq, syscall.AF_UNSPEC, NFNL_SUBSYS_NFTABLES, nil)
+	for i, m := range msgs {
+		b = encodeMsg(b, NFNL_SUBSYS_NFTABLES<<8|m.typ, m.flags|syscall.NLM_F_ACK,
+			seq+uint32(i)+1, NFPROTO_IPV4, 0, m.attrs)
+	}
+	return encodeMsg(b, NFNL_MSG_BATCH_END, 0, seq+uint32(len(msgs))+1, syscall.AF_UNSPEC, NFNL_SUBSYS_NFTABLES, nil)
+}
+
+// commit sends the messages in one transaction and waits for their acks
+func (c *nftConn) commit(msgs []nftMsg) error {
+	seq := uint32(c.conn.TakeSeq())
+	for range msgs {
+		c.conn.TakeSeq()
+	}
+	c.conn.TakeSeq()
+	_, err := c.conn.Write(encodeBatch(seq, msgs))
+	if err != nil {
+		return errors.Wrap(err, "send batch")
+	}
+	acked := 0
+	return c.recv(func(m *nl.Msg) (bool, error) {
+		if m.Header.Type != syscall.NLMSG_ERROR {
+			return false, nil
+		}
+		e, _, _ := nl.DecodeMsgError(m.Body)
+		if e != nil {
+			return true, e
+		}
+		acked++
+		return acked == len(msgs), nil
+	})
+}
+
+// dump sends a dump request and returns the replied messages
+func (c *nftConn) dump(typ uint16, attrs nl.AttrList) ([]nl.Msg, error) {
+	seq := uint32(c.conn.TakeSeq())
+	b := encodeMsg(nil, NFNL_SUBSYS_NFTABLES<<8|typ, syscall.NLM_F_DUMP|syscall.NLM_F_ACK,
+		seq, NFPROTO_IPV4, 0, attrs)
+	_, err := c.conn.Write(b)
+	if err != nil {
+		return nil, errors.Wrap(err, "send dump")
+	}
+	var msgs []nl.Msg
+	err = c.recv(func(m *nl.Msg) (bool, error) {
+		switch m.Header.Type {
+		case syscall.NLMSG_DONE:
+			return true, nil
+		case syscall.NLMSG_ERROR:
+			e, _, _ := nl.DecodeMsgError(m.Body)
+			return true, e
+		}
+		if m.Header.Seq == seq {
+			msgs = append(msgs, *m)
+		}
+		return false, nil
+	})
+	return msgs, err
+}
+
+func (c *nftConn) recv(f func(*nl.Msg) (bool, error)) error {
+	b := make([]byte, 1<<16)
+	for {
+		n, err := c.conn.Read(b)
+		if err != nil {
+			return errors.Wrap(err, "recv")
+		}
+		for p := b[:n]; len(p) >= syscall.SizeofNlMsghdr; {
+			l := int(nl.NativeEndian().Uint32(p[0:4]))
+			if l < syscall.SizeofNlMsghdr || l > len(p) {
+				return errors.New("recv: malformed netlink message")
+			}
+			m, _, err := nl.DecodeMsg(p)
+			if err != nil {
+				return err
+			}
+			done, err := f(m)
+			if done || err != nil {
+				return err
+			}
+			l = (l + syscall.NLMSG_ALIGNTO - 1) &^ (syscall.NLMSG_ALIGNTO - 1)
+			if l >= len(p) {
+				break
+			}
+			p = p[l:]
+		}
+	}
+}
+
+func expr(name string, data nl.AttrList) nl.Attr {
+	attrs := nl.AttrList{{Type: NFTA_EXPR_NAME, Value: nl.AttrString(name)}}
+	if data != nil {
+		attrs = append(attrs, nl.Attr{Type: NFTA_EXPR_DATA, Value: data})
+	}
+	return nl.Attr{Type: NFTA_LIST_ELEM, Value: attrs}
+}
+
+func dataValue(b []byte) nl.AttrList {
+	return nl.AttrList{{Type: NFTA_DATA_VALUE, Value: nl.AttrBytes(b)}}
+}
+
+// masqExprs returns the expressions of
+// "ip saddr <src> oifname <ifname> masquerade"
+func masqExprs(src *net.IPNet, ifname string) nl.AttrList {
+	ifn := make([]byte, IFNAMSIZ)
+	copy(ifn, ifname)
+	return nl.AttrList{
+		expr("payload", nl.AttrList{
+			{Type: NFTA_PAYLOAD_DREG, Value: beU32(NFT_REG_1)},
+			{Type: NFTA_PAYLOAD_BASE, Value: beU32(NFT_PAYLOAD_NETWORK_HEADER)},
+			{Type: NFTA_PAYLOAD_OFFSET, Value: beU32(12)},
+			{Type: NFTA_PAYLOAD_LEN, Value: beU32(4)},
+		}),
+		expr("bitwise", nl.AttrList{
+			{Type: NFTA_BITWISE_SREG, Value: beU32(NFT_REG_1)},
+			{Type: NFTA_BITWISE_DREG, Value: beU32(NFT_REG_1)},
+			{Type: NFTA_BITWISE_LEN, Value: beU32(4)},
+			{Type: NFTA_BITWISE_MASK, Value: dataValue(src.Mask)},
+			{Type: NFTA_BITWISE_XOR, Value: dataValue(make([]byte, 4))},
+		}),
+		expr("cmp", nl.AttrList{
+			{Type: NFTA_CMP_SREG, Value: beU32(NFT_REG_1)},
+			{Type: NFTA_CMP_OP, Value: beU32(NFT_CMP_EQ)},
+			{Type: NFTA_CMP_DATA, Value: dataValue(src.IP.To4())},
+		}),
+		expr("meta", nl.AttrList{
+			{Type: NFTA_META_DREG, Value: beU32(NFT_REG_1)},
+			{Type: NFTA_META_KEY, Value: beU32(NFT_META_OIFNAME)},
+		}),
+		expr("cmp", nl.AttrList{
+			{Type: NFTA_CMP_SREG, Value: beU32(NFT_REG_1)},
+			{Type: NFTA_CMP_OP, Value: beU32(NFT_CMP_EQ)},
+			{Type: NFTA_CMP_DATA, Value: dataValue(ifn)},
+		}),
+		expr("masq", nil),
+	}
+}
+
+// ruleUserdata returns the userdata of the rules in a dump of a chain
+func ruleUserdata(msgs []nl.Msg) []string {
+	var uds []string
+	for _, m := range msgs {
+		if len(m.Body) < 4 {
+			continue
+		}
+		b := m.Body[4:]
+		for len(b) >= 4 {
+			hdr, n, err := nl.DecodeAttrHdr(b)
+			if err != nil || int(hdr.Len) < n || int(hdr.Len) > len(b) {
+				break
+			}
+			if hdr.MaskedType() == NFTA_RULE_USERDATA {
+				uds = append(uds, string(b[n:hdr.Len]))
+			}
+			if hdr.Len.Align() >= len(b) {
+				break
+			}
+			b = b[hdr.Len.Align():]
+		}
+	}
+	return uds
+}
@@ -0,0 +1,210 @@
+// Package pcap writes the UDP datagrams sent and received by the UPF to pcap
+// files, with synthetic IP and UDP headers
+package pcap
+
+import (
+	"encoding/binary"
+	"fmt"
+	"net"
+	"os"
+	"sync"
+	"time"
+
+	"github.com/pkg/errors"
+)
+
+const (
+	MAGIC         = 0xa1b2c3d4
+	VERSION_MAJOR = 2
+	VERSION_MINOR = 4
+	SNAPLEN       = 65535
+	// LINKTYPE_RAW is the link type of the packets beginning with an IPv4 or
+	// an IPv6 header
+	LINKTYPE_RAW = 101
+
+	FILE_HDR_LEN   = 24
+	RECORD_HDR_LEN = 16
+	IPV4_HDR_LEN   = 20
+	IPV6_HDR_LEN   = 40
+	UDP_HDR_LEN    = 8
+
+	DEFAULT_MAX_SIZE = 16 << 20
+	TTL              = 64
+)
+
+// Writer writes the packets to a pcap file, which is rotated once it reaches
+// its max size: the file is renamed with the suffix ".1", the former ".1"
+// with ".2", and so on up to the max number of the rotated files kept
+type Writer struct {
+	path     string
+	maxSize  int64
+	maxFiles int
+
+	mu   sync.Mutex
+	f    *os.File
+	size int64
+}
+
+// Open creates the pcap file at path, truncated if it exists. A maxSize of
+// 0 is DEFAULT_MAX_SIZE.
+func Open(path string, maxSize int64, maxFiles int) (*Writer, error) {
+	if maxSize <= 0 {
+		maxSize = DEFAULT_MAX_SIZE
+	}
+	w := &Writer{
+		path:     path,
+		maxSize:  maxSize,
+		maxFiles: maxFiles,
+	}
+	if err := w.create(); err != nil {
+		return nil, err
+	}
+	return w, nil
+}
+
+func (w *Writer) create() error {
+	f, err := os.OpenFile(w.path, os.O_WRONLY|os.O_CREATE|os.O_TRUNC, 0o600)
+	if err != nil {
+		return errors.Wrap(err, "pcap create")
+	}
+	hdr := make([]byte, FILE_HDR_LEN)
+	binary.LittleEndian.PutUint32(hdr[0:], MAGIC)
+	binary.LittleEndian.PutUint16(hdr[4:], VERSION_MAJOR)
+	binary.LittleEndian.PutUint16(hdr[6:], VERSION_MINOR)
+	binary.LittleEndian.PutUint32(hdr[16:], SNAPLEN)
+	binary.LittleEndian.PutUint32(hdr[20:], LINKTYPE_RAW)
+	if _, err = f.Write(hdr); err != nil {
+		f.Close()
+		return errors.Wrap(err, "pcap header")
+	}
+	w.f = f
+	w.size = FILE_HDR_LEN
+	return nil
+}
+
+func (w *Writer) rotate() error {
+	if err := w.f.Close(); err != nil {
+		return errors.Wrap(err, "pcap rotate")
+	}
+	w.f = nil
+	for i := w.maxFiles - 1; i > 0; i-- {
+		err := os.Rename(fmt.Sprintf("%s.%d", w.path, i), fmt.Sprintf("%s.%d", w.path, i+1))
+		if err != nil && !os.IsNotExist(err) {
+			return errors.Wrap(err, "pcap rotate")
+		}
+	}
+	if w.maxFiles > 0 {
+		if err := os.Rename(w.path, w.path+".1"); err != nil {
+			return errors.Wrap(err, "pcap rotate")
+		}
+	}
+	return w.create()
+}
+
+// WriteUDP writes a UDP datagram from src to dst captured at t
+func (w *Writer) WriteUDP(t time.Time, src, dst *net.UDPAddr, payload []byte) error {
+	pkt := UDPPacket(src, dst, payload)
+	caplen := min(len(pkt), SNAPLEN)
+	rec := make([]byte, RECORD_HDR_LEN+caplen)
+	binary.LittleEndian.PutUint32(rec[0:], uint32(t.Unix()))
+	binary.LittleEndian.PutUint32(rec[4:], uint32(t.Nanosecond()/1000))
+	binary.LittleEndian.PutUint32(rec[8:], uint32(caplen))
+	binary.LittleEndian.PutUint32(rec[12:], uint32(len(pkt)))
+	copy(rec[RECORD_HDR_LEN:], pkt)
+
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	if w.f == nil {
+		return errors.New("pcap writer closed")
+	}
+	if w.size > FILE_HDR_LEN && w.size+int64(len(rec)) > w.maxSize {
+		if err := w.rotate(); err != nil {
+			return err
+		}
+	}
+	n, err := w.f.Write(rec)
+	w.size += int64(n)
+	return errors.Wrap(err, "pcap write")
+}
+
+func (w *Writer) Close() error {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	if w.f == nil {
+		return nil
+	}
+	err := w.f.Close()
+	w.f = nil
+	return errors.Wrap(err, "pcap close")
+}
+
+// UDPPacket returns the IP packet of a UDP datagram from src to dst. The
+// packet is IPv6 if either address is IPv6, with an IPv4 address mapped.
+func UDPPacket(src, dst *net.UDPAddr, payload []byte) []byte {
+	src4, dst4 := src.IP.To4(), dst.IP.To4()
+	v4 := src4 != nil && dst4 != nil
+
+	udpLen := UDP_HDR_LEN + len(payload)
+	hdrLen := IPV6_HDR_LEN
+	if v4 {
+		hdrLen = IPV4_HDR_LEN
+	}
+	pkt := make([]byte, hdrLen+udpLen)
+
+	var pseudo []byte
+	if v4 {
+		ip := pkt[:IPV4_HDR_LEN]
+		ip[0] = 0x45
+		binary.BigEndian.PutUint16(ip[2:], uint16(len(pkt)))
+		binary.BigEndian.PutUint16(ip[6:], 0x4000) // DF
+		ip[8] = TTL
+		ip[9] = 17
+		copy(ip[12:], src4)
+		copy(ip[16:], dst4)
+		binary.BigEndian.PutUint16(ip[10:], checksum(0, ip))
+		pseudo = make([]byte, 12)
+		copy(pseudo, ip[12:20])
+		pseudo[9] = 17
+		binary.BigEndian.PutUint16(pseudo[10:], uint16(udpLen))
+	} else {
+		ip := pkt[:IPV6_HDR_LEN]
+		ip[0] = 0x60
+		binary.BigEndian.PutUint16(ip[4:], uint16(udpLen))
+		ip[6] = 17
+		ip[7] = TTL
+		copy(ip[8:], src.IP.To16())
+		copy(ip[24:], dst.IP.To16())
+		pseudo = make([]byte, 40)
+		copy(pseudo, ip[8:40])
+		binary.BigEndian.PutUint32(pseudo[32:], uint32(udpLen))
+		pseudo[39] = 17
+	}
+
+	udp := pkt[hdrLen:]
+	binary.BigEndian.PutUint16(udp[0:], uint16(src.Port))
+	binary.BigEndian.PutUint16(udp[2:], uint16(dst.Port))
+	binary.BigEndian.PutUint16(udp[4:], uint16(udpLen))
+	copy(udp[UDP_HDR_LEN:], payload)
+	sum := checksum(checksum(0, pseudo)^0xffff, udp)
+	if sum == 0 {
+		sum = 0xffff
+	}
+	binary.BigEndian.PutUint16(udp[6:], sum)
+	return pkt
+}
+
+// checksum returns the Internet checksum of b, continuing the checksum
+// initial of the preceding data
+func checksum(initial uint16, b []byte) uint16 {
+	sum := uint32(initial)
+	for ; len(b) >= 2; b = b[2:] {
+		sum += uint32(binary.BigEndian.Uint16(b))
+	}
+	if len(b) == 1 {
+		sum += uint32(b[0]) << 8
+	}
+	for sum > 0xffff {
+		sum = sum&0xffff + sum>>16
+	}
+	return ^uint16(sum)
+}
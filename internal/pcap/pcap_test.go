@@ -0,0 +1,72 @@
+package pcap
+
+import (
+	"encoding/binary"
+	"net"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestUDPPacket(t *testing.T) {
+	payload := []byte{0x20, 0x01, 0x00, 0x0c, 0x00, 0x00, 0x01, 0x00, 0x00, 0x60, 0x00, 0x04, 0x12}
+
+	t.Run("IPv4", func(t *testing.T) {
+		src := &net.UDPAddr{IP: net.IPv4(10, 100, 200, 3), Port: 8805}
+		dst := &net.UDPAddr{IP: net.IPv4(10, 100, 200, 8), Port: 8805}
+		pkt := UDPPacket(src, dst, payload)
+		require.Len(t, pkt, IPV4_HDR_LEN+UDP_HDR_LEN+len(payload))
+		assert.Equal(t, uint8(0x45), pkt[0])
+		assert.Equal(t, uint16(0), checksum(0, pkt[:IPV4_HDR_LEN]))
+
+		pseudo := append(append([]byte{}, pkt[12:20]...), 0, 17, 0, 0)
+		binary.BigEndian.PutUint16(pseudo[10:], uint16(UDP_HDR_LEN+len(payload)))
+		assert.Equal(t, uint16(0), checksum(checksum(0, pseudo)^0xffff, pkt[IPV4_HDR_LEN:]))
+		assert.Equal(t, payload, pkt[IPV4_HDR_LEN+UDP_HDR_LEN:])
+	})
+
+	t.Run("IPv6", func(t *testing.T) {
+		src := &net.UDPAddr{IP: net.ParseIP("fd00::3"), Port: 8805}
+		dst := &net.UDPAddr{IP: net.IPv4(10, 100, 200, 8), Port: 8806}
+		pkt := UDPPacket(src, dst, payload)
+		require.Len(t, pkt, IPV6_HDR_LEN+UDP_HDR_LEN+len(payload))
+		assert.Equal(t, uint8(0x60), pkt[0])
+		assert.Equal(t, net.IPv4(10, 100, 200, 8).To16(), net.IP(pkt[24:40]))
+		assert.Equal(t, uint16(8806), binary.BigEndian.Uint16(pkt[IPV6_HDR_LEN+2:]))
+	})
+}
+
+func TestWriterRotate(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "n4.pcap")
+	src := &net.UDPAddr{IP: net.IPv4(10, 100, 200, 3), Port: 8805}
+	dst := &net.UDPAddr{IP: net.IPv4(10, 100, 200, 8), Port: 8805}
+	payload := make([]byte, 100)
+	rec := RECORD_HDR_LEN + IPV4_HDR_LEN + UDP_HDR_LEN + len(payload)
+
+	w, err := Open(path, int64(FILE_HDR_LEN+2*rec), 2)
+	require.NoError(t, err)
+	for range 7 {
+		require.NoError(t, w.WriteUDP(time.Now(), src, dst, payload))
+	}
+	require.NoError(t, w.Close())
+	assert.Error(t, w.WriteUDP(time.Now(), src, dst, payload))
+
+	b, err := os.ReadFile(path)
+	require.NoError(t, err)
+	assert.Len(t, b, FILE_HDR_LEN+rec)
+	assert.Equal(t, uint32(MAGIC), binary.LittleEndian.Uint32(b))
+	assert.Equal(t, uint32(LINKTYPE_RAW), binary.LittleEndian.Uint32(b[20:]))
+	assert.Equal(t, uint32(rec-RECORD_HDR_LEN), binary.LittleEndian.Uint32(b[FILE_HDR_LEN+8:]))
+
+	for _, name := range []string{path + ".1", path + ".2"} {
+		fi, err := os.Stat(name)
+		require.NoError(t, err)
+		assert.Equal(t, int64(FILE_HDR_LEN+2*rec), fi.Size())
+	}
+	_, err = os.Stat(path + ".3")
+	assert.True(t, os.IsNotExist(err))
+}
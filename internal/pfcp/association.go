@@ -5,6 +5,8 @@ import (
 
 	"github.com/wmnsk/go-pfcp/ie"
 	"github.com/wmnsk/go-pfcp/message"
+
+	"github.com/free5gc/go-upf/internal/event"
 )
 
 func (s *PfcpServer) handleAssociationSetupRequest(
@@ -16,6 +18,7 @@ func (s *PfcpServer) handleAssociationSetupRequest(
 	// 1. Validate NodeID IE (Mandatory)
 	if req.NodeID == nil {
 		s.log.Errorf("Association Setup failed: mandatory IE missing: NodeID")
+		s.sendRejectRsp(req.MessageType(), req.Sequence(), 0, addr, ie.CauseMandatoryIEMissing, nil)
 		return
 	}
 
@@ -23,18 +26,37 @@ func (s *PfcpServer) handleAssociationSetupRequest(
 	rnodeid, err := req.NodeID.NodeID()
 	if err != nil {
 		s.log.Errorf("Association Setup failed: mandatory IE incorrect: NodeID parse error: %v", err)
+		s.sendRejectRsp(req.MessageType(), req.Sequence(), 0, addr, ie.CauseMandatoryIEIncorrect, nil)
 		return
 	}
 
 	// 3. Validate NodeID is not empty
 	if rnodeid == "" {
 		s.log.Errorf("Association Setup failed: mandatory IE incorrect: NodeID is empty")
+		s.sendRejectRsp(req.MessageType(), req.Sequence(), 0, addr, ie.CauseMandatoryIEIncorrect, nil)
+		return
+	}
+
+	// Only the CP functions allowed may take over an association
+	if !s.filter.allowNodeID(rnodeid, addr) {
+		s.log.Warnf("Association Setup rejected: NodeID %q not allowed from %s", rnodeid, addr)
+		rsp := message.NewAssociationSetupResponse(
+			req.Header.SequenceNumber,
+			newIeNodeID(s.nodeID),
+			ie.NewCause(ie.CauseRequestRejected),
+			ie.NewRecoveryTimeStamp(s.recoveryTime),
+		)
+		err = s.sendRspTo(rsp, addr)
+		if err != nil {
+			s.log.Errorln(err)
+		}
 		return
 	}
 
 	// 4. Validate RecoveryTimeStamp IE (Mandatory)
 	if req.RecoveryTimeStamp == nil {
 		s.log.Errorf("Association Setup failed: mandatory IE missing: RecoveryTimeStamp")
+		s.sendRejectRsp(req.MessageType(), req.Sequence(), 0, addr, ie.CauseMandatoryIEMissing, nil)
 		return
 	}
 
@@ -42,6 +64,7 @@ func (s *PfcpServer) handleAssociationSetupRequest(
 	_, err = req.RecoveryTimeStamp.RecoveryTimeStamp()
 	if err != nil {
 		s.log.Errorf("Association Setup failed: mandatory IE incorrect: RecoveryTimeStamp parse error: %v", err)
+		s.sendRejectRsp(req.MessageType(), req.Sequence(), 0, addr, ie.CauseMandatoryIEIncorrect, nil)
 		return
 	}
 
@@ -49,13 +72,32 @@ func (s *PfcpServer) handleAssociationSetupRequest(
 	// if a PFCP association was already established for the Node ID
 	// received in the request, regardless of the Recovery Timestamp
 	// received in the request.
+	//
+	// The request runs exclusively of the session workers, see reqDispacher.
+	s.nodeMu.Lock()
 	if node, ok := s.rnodes[rnodeid]; ok {
 		s.log.Infof("delete node: %#+v\n", node)
-		node.Reset()
+		sessions := node.NumSess()
+		for _, r := range node.Reset() {
+			e := s.releasedEvent(r.sess, r.usars)
+			e.Reason = "association replaced"
+			s.events.Publish(e)
+		}
 		delete(s.rnodes, rnodeid)
+		s.events.Publish(&event.Event{
+			Type:     event.ASSOCIATION_DOWN,
+			NodeID:   rnodeid,
+			Reason:   "replaced by Association Setup",
+			Sessions: sessions,
+		})
 	}
 	node := s.NewNode(rnodeid, addr, s.driver)
+	if f := req.CPFunctionFeatures; f != nil {
+		node.cpLoad = f.HasLOAD()
+		node.cpOverload = f.HasOVRL()
+	}
 	s.rnodes[rnodeid] = node
+	s.nodeMu.Unlock()
 
 	rsp := message.NewAssociationSetupResponse(
 		req.Header.SequenceNumber,
@@ -71,6 +113,7 @@ func (s *PfcpServer) handleAssociationSetupRequest(
 		s.log.Errorln(err)
 		return
 	}
+	s.events.Publish(&event.Event{Type: event.ASSOCIATION_UP, NodeID: rnodeid})
 }
 
 func (s *PfcpServer) handleAssociationUpdateRequest(
@@ -78,6 +121,9 @@ func (s *PfcpServer) handleAssociationUpdateRequest(
 	addr net.Addr,
 ) {
 	s.log.Infoln("handleAssociationUpdateRequest not supported")
+
+	cause, offending := s.associationCause(req.NodeID)
+	s.sendRejectRsp(req.MessageType(), req.Sequence(), 0, addr, cause, offending)
 }
 
 func (s *PfcpServer) handleAssociationReleaseRequest(
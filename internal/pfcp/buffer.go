@@ -0,0 +1,352 @@
+package pfcp
+
+import (
+	"net"
+	"time"
+
+	"github.com/wmnsk/go-pfcp/ie"
+
+	"github.com/free5gc/go-upf/internal/forwarder"
+	"github.com/free5gc/go-upf/internal/report"
+)
+
+const (
+	BUFFQ_LEN       = 512
+	BUFF_MAX_BYTES  = 64 << 20
+	DDN_DELAY_MAX   = 255 * 50 * time.Millisecond
+	BUFF_DURAT_INFI = time.Duration(1<<63 - 1)
+)
+
+// pktQoS is the QoS of a DL packet, from the QER applied to it
+type pktQoS struct {
+	QFI *uint8
+	PPI *uint8
+}
+
+// ie returns the Downlink Data Service Information of the QoS
+func (q pktQoS) ie() *ie.IE {
+	if q.QFI == nil && q.PPI == nil {
+		return nil
+	}
+	var qfi, ppi uint8
+	if q.QFI != nil {
+		qfi = *q.QFI
+	}
+	if q.PPI != nil {
+		ppi = *q.PPI
+	}
+	return ie.NewDownlinkDataServiceInformation(q.PPI != nil, q.QFI != nil, ppi, qfi)
+}
+
+type bufPkt struct {
+	seq  uint64
+	data []byte
+	qos  pktQoS
+}
+
+// ddnEpisode is a buffering episode of a session: the DL Data Notification
+// is sent for the first buffered packet, after the DL Data Notification
+// Delay if any, and once more for each other QoS flow buffered later
+type ddnEpisode struct {
+	pdrid    uint16 // PDR of the first buffered packet
+	qos      pktQoS // QoS of the first buffered packet
+	notified bool
+	qfis     map[uint8]struct{} // QFIs notified
+	timer    *time.Timer
+}
+
+// notify records the QoS flow of a DL Data Notification of the episode
+func (ep *ddnEpisode) notify(qos pktQoS) {
+	ep.notified = true
+	if qos.QFI != nil {
+		ep.qfis[*qos.QFI] = struct{}{}
+	}
+}
+
+// newFlow reports whether the QoS flow has not been notified in the episode
+func (ep *ddnEpisode) newFlow(qos pktQoS) bool {
+	if qos.QFI == nil {
+		return false
+	}
+	_, ok := ep.qfis[*qos.QFI]
+	return !ok
+}
+
+// ddnDelayReport is notified when the DL Data Notification Delay of the
+// episode expires
+type ddnDelayReport struct {
+	ep *ddnEpisode
+}
+
+func (r ddnDelayReport) Type() report.ReportType {
+	return report.INTERNAL
+}
+
+// buffer holds the DL packets buffered by the UPF for a session
+type buffer struct {
+	q     map[uint16][]bufPkt // key: PDR_ID
+	seq   uint64
+	pkts  int
+	bytes int
+	limit int // max buffered packets, from the BAR or the config
+
+	dropped      uint64
+	droppedBytes uint64
+
+	ddnDelay  time.Duration
+	hold      time.Duration // DL Buffering Duration
+	holdStart time.Time
+	episode   *ddnEpisode
+}
+
+func (b *buffer) Len(pdrid uint16) int {
+	return len(b.q[pdrid])
+}
+
+// oldest returns the PDR whose head packet was buffered first
+func (b *buffer) oldest() (uint16, bool) {
+	var pdrid uint16
+	var seq uint64
+	found := false
+	for id, q := range b.q {
+		if len(q) == 0 {
+			continue
+		}
+		if !found || q[0].seq < seq {
+			pdrid, seq, found = id, q[0].seq, true
+		}
+	}
+	return pdrid, found
+}
+
+func (b *buffer) holdExpired() bool {
+	return b.hold > 0 && b.hold != BUFF_DURAT_INFI && time.Since(b.holdStart) >= b.hold
+}
+
+func (b *buffer) holding() bool {
+	return b.hold > 0 && !b.holdExpired()
+}
+
+// first returns the first buffered packet of the session and its PDR
+func (b *buffer) first() (uint16, bufPkt, bool) {
+	pdrid, ok := b.oldest()
+	if !ok {
+		return 0, bufPkt{}, false
+	}
+	return pdrid, b.q[pdrid][0], true
+}
+
+func (b *buffer) endEpisode() {
+	if b.episode == nil {
+		return
+	}
+	if b.episode.timer != nil {
+		b.episode.timer.Stop()
+	}
+	b.episode = nil
+	b.hold = 0
+}
+
+// stopDDNTimers ends the buffering episodes of the sessions, so that no DL
+// Data Notification Delay expires once the reports are no longer served
+func (s *PfcpServer) stopDDNTimers() {
+	for _, sess := range s.lnode.sess {
+		if sess != nil {
+			sess.buf.endEpisode()
+		}
+	}
+}
+
+// Push buffers a DL packet of the PDR. The oldest packets of the session are
+// dropped when the buffering limit of the session or the global memory cap
+// is reached; the usage reports of the URRs whose Dropped DL Traffic
+// Threshold is reached by the drops are returned.
+func (s *Sess) Push(pdrid uint16, p []byte) []report.USAReport {
+	b := &s.buf
+	var usars []report.USAReport
+
+	// The buffered packets are discarded when the DL Buffering Duration expires
+	if b.holdExpired() {
+		s.log.Infof("DL Buffering Duration(%v) expired, discard %d packets", b.hold, b.pkts)
+		usars = append(usars, s.discardBuffer()...)
+		b.endEpisode()
+	}
+
+	for b.pkts >= b.limit || !s.rnode.bufAvail(len(p)) {
+		oldest, ok := b.oldest()
+		if !ok {
+			s.log.Debugf("buffer is full, drop bufPkt of q[%d]", pdrid)
+			return append(usars, s.accountDrop(pdrid, len(p))...)
+		}
+		pkt, _ := s.pop(oldest)
+		s.log.Debugf("buffer is full, drop oldest bufPkt of q[%d]", oldest)
+		usars = append(usars, s.accountDrop(oldest, len(pkt))...)
+	}
+
+	pkt := make([]byte, len(p))
+	copy(pkt, p)
+	b.seq++
+	b.q[pdrid] = append(b.q[pdrid], bufPkt{seq: b.seq, data: pkt, qos: s.pdrQoS(pdrid)})
+	b.pkts++
+	b.bytes += len(pkt)
+	s.rnode.addBuf(1, len(pkt))
+	s.log.Debugf("Push bufPkt to q[%d](len:%d)", pdrid, len(b.q[pdrid]))
+	return usars
+}
+
+func (s *Sess) Len(pdrid uint16) int {
+	return s.buf.Len(pdrid)
+}
+
+func (s *Sess) pop(pdrid uint16) ([]byte, bool) {
+	b := &s.buf
+	q := b.q[pdrid]
+	if len(q) == 0 {
+		return nil, false
+	}
+	pkt := q[0].data
+	q[0] = bufPkt{}
+	if len(q) == 1 {
+		delete(b.q, pdrid)
+	} else {
+		b.q[pdrid] = q[1:]
+	}
+	b.pkts--
+	b.bytes -= len(pkt)
+	s.rnode.addBuf(-1, -len(pkt))
+	return pkt, true
+}
+
+// Pop dequeues a buffered packet of the PDR; the buffering episode ends
+// when the buffer of the session is drained
+func (s *Sess) Pop(pdrid uint16) ([]byte, bool) {
+	pkt, ok := s.pop(pdrid)
+	if !ok {
+		return nil, false
+	}
+	s.log.Debugf("Pop bufPkt from q[%d](len:%d)", pdrid, s.buf.Len(pdrid))
+	if s.buf.pkts == 0 {
+		s.buf.endEpisode()
+	}
+	return pkt, true
+}
+
+// Drop discards a buffered packet of the PDR, and returns the usage reports
+// of the URRs whose Dropped DL Traffic Threshold has been reached
+func (s *Sess) Drop(pdrid uint16) ([]report.USAReport, bool) {
+	pkt, ok := s.Pop(pdrid)
+	if !ok {
+		return nil, false
+	}
+	return s.accountDrop(pdrid, len(pkt)), true
+}
+
+func (s *Sess) accountDrop(pdrid uint16, n int) []report.USAReport {
+	s.buf.dropped++
+	s.buf.droppedBytes += uint64(n)
+	s.rnode.local.countBufDrop()
+	return s.dropDL(pdrid, 1, uint64(n))
+}
+
+// discardBuffer drops all the buffered packets of the session
+func (s *Sess) discardBuffer() []report.USAReport {
+	var usars []report.USAReport
+	for {
+		pdrid, ok := s.buf.oldest()
+		if !ok {
+			return usars
+		}
+		pkt, _ := s.pop(pdrid)
+		usars = append(usars, s.accountDrop(pdrid, len(pkt))...)
+	}
+}
+
+// releaseBuffer frees the buffer of a closing session
+func (s *Sess) releaseBuffer() {
+	b := &s.buf
+	b.endEpisode()
+	if b.pkts > 0 || b.dropped > 0 {
+		s.log.Infof("release buffer: buffered(%d pkts, %d bytes) dropped(%d pkts, %d bytes)",
+			b.pkts, b.bytes, b.dropped, b.droppedBytes)
+	}
+	if s.rnode != nil {
+		s.rnode.addBuf(-b.pkts, -b.bytes)
+	}
+	b.q = make(map[uint16][]bufPkt)
+	b.pkts = 0
+	b.bytes = 0
+}
+
+// applyBAR updates the buffering parameters of the session from the BAR
+func (s *Sess) applyBAR(plan *forwarder.BARPlan) {
+	b := &s.buf
+	if plan.SuggestedBufferingPacketsCount != nil && *plan.SuggestedBufferingPacketsCount > 0 {
+		b.limit = int(*plan.SuggestedBufferingPacketsCount)
+	}
+	if plan.DLDataNotificationDelay != nil {
+		b.ddnDelay = min(*plan.DLDataNotificationDelay, DDN_DELAY_MAX)
+	}
+	if plan.DLBufferingDuration != nil {
+		b.hold = *plan.DLBufferingDuration
+		b.holdStart = time.Now()
+	}
+}
+
+// resetBAR restores the default buffering parameters of the session
+func (s *Sess) resetBAR() {
+	s.buf.limit = s.rnode.local.bufLimit()
+	s.buf.ddnDelay = 0
+}
+
+// notifyDLData starts a buffering episode of the session on a DL data
+// arrival and sends the DL Data Notification with the QoS of the first
+// buffered packet, after the DL Data Notification Delay of the BAR if any.
+// Within an episode, a DL data arrival for a QoS flow not notified yet is
+// notified again, but no notification is sent while the DL Buffering
+// Duration indicated by the CP function is running.
+func (s *PfcpServer) notifyDLData(addr net.Addr, sess *Sess, pdrid uint16) error {
+	b := &sess.buf
+	qos := sess.pdrQoS(pdrid)
+	if ep := b.episode; ep != nil {
+		if !ep.notified || b.holding() || !ep.newFlow(qos) {
+			return nil
+		}
+		ep.notify(qos)
+		return s.serveDLDReport(addr, sess.LocalID, pdrid, qos)
+	}
+
+	ep := &ddnEpisode{
+		pdrid: pdrid,
+		qos:   qos,
+		qfis:  make(map[uint8]struct{}),
+	}
+	if id, pkt, ok := b.first(); ok {
+		ep.pdrid = id
+		ep.qos = pkt.qos
+	}
+	b.episode = ep
+	if b.ddnDelay > 0 {
+		lSeid := sess.LocalID
+		ep.timer = time.AfterFunc(b.ddnDelay, func() {
+			s.NotifySessReport(report.SessReport{
+				SEID:    lSeid,
+				Reports: []report.Report{ddnDelayReport{ep: ep}},
+			})
+		})
+		return nil
+	}
+	ep.notify(ep.qos)
+	return s.serveDLDReport(addr, sess.LocalID, ep.pdrid, ep.qos)
+}
+
+// serveDDNDelay sends the DL Data Notification of the episode when its
+// DL Data Notification Delay expires
+func (s *PfcpServer) serveDDNDelay(addr net.Addr, sess *Sess, r ddnDelayReport) error {
+	ep := sess.buf.episode
+	if ep != r.ep || ep.notified {
+		// stale timeout of an ended episode
+		return nil
+	}
+	ep.notify(ep.qos)
+	return s.serveDLDReport(addr, sess.LocalID, ep.pdrid, ep.qos)
+}
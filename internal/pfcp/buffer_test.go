@@ -0,0 +1,261 @@
+package pfcp
+
+import (
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"github.com/wmnsk/go-pfcp/ie"
+
+	"github.com/free5gc/go-upf/internal/forwarder"
+	"github.com/free5gc/go-upf/internal/logger"
+	"github.com/free5gc/go-upf/internal/report"
+	logger_util "github.com/free5gc/util/logger"
+)
+
+func TestSessBuffer(t *testing.T) {
+	newSess := func(lnode *LocalNode) *Sess {
+		rnode := NewRemoteNode(
+			"smf1",
+			nil,
+			lnode,
+			forwarder.Empty{},
+			logger.PfcpLog.WithField(logger_util.FieldControlPlaneNodeID, "smf1"),
+		)
+		return rnode.NewSess(10)
+	}
+
+	t.Run("drop oldest packet over the BAR limit", func(t *testing.T) {
+		lnode := &LocalNode{}
+		sess := newSess(lnode)
+		cnt := uint16(2)
+		sess.ApplyCreateBAR(&forwarder.BARPlan{
+			BARID:                          1,
+			SuggestedBufferingPacketsCount: &cnt,
+		})
+
+		sess.Push(1, []byte{1})
+		sess.Push(2, []byte{2})
+		sess.Push(1, []byte{3})
+		assert.Equal(t, 1, sess.Len(1))
+		assert.Equal(t, 1, sess.Len(2))
+		assert.Equal(t, uint64(1), sess.buf.dropped)
+
+		pkt, ok := sess.Pop(1)
+		assert.True(t, ok)
+		assert.Equal(t, []byte{3}, pkt)
+		assert.Equal(t, 1, lnode.bufBytes)
+
+		sess.ApplyRemoveBAR(&forwarder.BARPlan{BARID: 1})
+		assert.Equal(t, BUFFQ_LEN, sess.buf.limit)
+	})
+
+	t.Run("global memory cap", func(t *testing.T) {
+		lnode := &LocalNode{}
+		lnode.SetBufferLimits(0, 4)
+		sess1 := newSess(lnode)
+		sess2 := newSess(lnode)
+
+		sess1.Push(1, []byte{1, 2, 3})
+		// no room in sess2 to drop from, the new packet is dropped
+		sess2.Push(1, []byte{4, 5})
+		assert.Equal(t, 0, sess2.Len(1))
+		assert.Equal(t, uint64(1), sess2.buf.dropped)
+
+		// sess1 drops its oldest packet
+		sess1.Push(1, []byte{6, 7})
+		assert.Equal(t, 1, sess1.Len(1))
+		assert.Equal(t, 2, lnode.bufBytes)
+
+		lnode.DeleteSess(sess1.LocalID)
+		assert.Equal(t, 0, lnode.bufBytes)
+	})
+
+	t.Run("discard on DL Buffering Duration expiry", func(t *testing.T) {
+		sess := newSess(&LocalNode{})
+		sess.ApplyCreateBAR(&forwarder.BARPlan{BARID: 1})
+		sess.buf.episode = &ddnEpisode{notified: true}
+		d := time.Second
+		sess.ApplyUpdateBAR(&forwarder.BARPlan{BARID: 1, DLBufferingDuration: &d})
+		sess.Push(1, []byte{1})
+		sess.buf.holdStart = time.Now().Add(-2 * time.Second)
+
+		sess.Push(1, []byte{2})
+		assert.Equal(t, 1, sess.Len(1))
+		assert.Nil(t, sess.buf.episode)
+		assert.Equal(t, uint64(1), sess.buf.dropped)
+	})
+}
+
+func TestNotifyDLData(t *testing.T) {
+	s, rnode, peer := newUDPTestServer(t, forwarder.Empty{})
+
+	t.Run("DDN once per buffering episode", func(t *testing.T) {
+		sess := rnode.NewSess(0x1efce)
+		qfi, ppi := uint8(5), uint8(2)
+		sess.ApplyCreateQER(&forwarder.QERPlan{QERID: 1, QFI: &qfi, PPI: &ppi})
+		sess.ApplyCreatePDR(&forwarder.PDRPlan{PDRID: 1, QERIDs: []uint32{1}})
+
+		sess.Push(1, []byte{1})
+		require.NoError(t, s.notifyDLData(peer.LocalAddr(), sess, 1))
+		req, ok := recvSessReportReq(t, peer)
+		require.True(t, ok)
+		require.NotNil(t, req.DownlinkDataReport)
+		ies, err := req.DownlinkDataReport.DownlinkDataReport()
+		require.NoError(t, err)
+		var ddsi *ie.IE
+		for _, i := range ies {
+			if i.Type == ie.DownlinkDataServiceInformation {
+				ddsi = i
+			}
+		}
+		if assert.NotNil(t, ddsi) {
+			v, err := ddsi.QFI()
+			assert.NoError(t, err)
+			assert.Equal(t, qfi, v)
+			v, err = ddsi.PPI()
+			assert.NoError(t, err)
+			assert.Equal(t, ppi, v)
+		}
+
+		sess.Push(1, []byte{2})
+		require.NoError(t, s.notifyDLData(peer.LocalAddr(), sess, 1))
+		_, ok = recvSessReportReq(t, peer)
+		assert.False(t, ok)
+
+		// the episode ends when the buffer is drained
+		sess.Pop(1)
+		sess.Pop(1)
+		sess.Push(1, []byte{3})
+		require.NoError(t, s.notifyDLData(peer.LocalAddr(), sess, 1))
+		_, ok = recvSessReportReq(t, peer)
+		assert.True(t, ok)
+	})
+
+	t.Run("DDN counted as an event", func(t *testing.T) {
+		sess := rnode.NewSess(0x1efd1)
+		sess.ApplyCreatePDR(&forwarder.PDRPlan{PDRID: 1, URRIDs: []uint32{1}})
+		sess.URRIDs[1] = &URRInfo{
+			MeasureMethod:  report.MeasureMethod{EVENT: true},
+			RptTrig:        report.ReportingTrigger{Flags: report.RPT_TRIG_EVETH},
+			EventThreshold: 1,
+		}
+
+		sess.Push(1, []byte{1})
+		require.NoError(t, s.notifyDLData(peer.LocalAddr(), sess, 1))
+		req, ok := recvSessReportReq(t, peer)
+		require.True(t, ok)
+		assert.NotNil(t, req.DownlinkDataReport)
+		req, ok = recvSessReportReq(t, peer)
+		require.True(t, ok)
+		assert.Len(t, req.UsageReport, 1)
+
+		// the DL packets of the episode are no events
+		sess.Push(1, []byte{2})
+		require.NoError(t, s.notifyDLData(peer.LocalAddr(), sess, 1))
+		_, ok = recvSessReportReq(t, peer)
+		assert.False(t, ok)
+	})
+
+	t.Run("DDN after DL Data Notification Delay", func(t *testing.T) {
+		sess := rnode.NewSess(0x1efcf)
+		delay := 50 * time.Millisecond
+		sess.ApplyCreateBAR(&forwarder.BARPlan{BARID: 1, DLDataNotificationDelay: &delay})
+
+		require.NoError(t, s.notifyDLData(peer.LocalAddr(), sess, 1))
+		_, ok := recvSessReportReq(t, peer)
+		assert.False(t, ok)
+
+		sr := <-s.srCh
+		require.Len(t, sr.Reports, 1)
+		r, ok := sr.Reports[0].(ddnDelayReport)
+		require.True(t, ok)
+		// no DL Data Report of the forwarder
+		assert.Equal(t, report.INTERNAL, r.Type())
+		require.NoError(t, s.serveDDNDelay(peer.LocalAddr(), sess, r))
+		_, ok = recvSessReportReq(t, peer)
+		assert.True(t, ok)
+
+		// stale delay of the same episode is ignored
+		require.NoError(t, s.serveDDNDelay(peer.LocalAddr(), sess, r))
+		_, ok = recvSessReportReq(t, peer)
+		assert.False(t, ok)
+	})
+
+	t.Run("DDN delay stopped with the server", func(t *testing.T) {
+		sess := rnode.NewSess(0x1efd0)
+		delay := 50 * time.Millisecond
+		sess.ApplyCreateBAR(&forwarder.BARPlan{BARID: 1, DLDataNotificationDelay: &delay})
+
+		require.NoError(t, s.notifyDLData(peer.LocalAddr(), sess, 1))
+		require.NotNil(t, sess.buf.episode)
+		s.stopDDNTimers()
+		assert.Nil(t, sess.buf.episode)
+		select {
+		case <-s.srCh:
+			t.Fatal("DL Data Notification Delay expired")
+		case <-time.After(2 * delay):
+		}
+	})
+}
+
+func TestNotifyDLDataPerQoSFlow(t *testing.T) {
+	s, rnode, peer := newUDPTestServer(t, forwarder.Empty{})
+	sess := rnode.NewSess(0x1efce)
+	qfi1, qfi2, ppi2 := uint8(1), uint8(5), uint8(3)
+	sess.ApplyCreateQER(&forwarder.QERPlan{QERID: 1, QFI: &qfi1})
+	sess.ApplyCreateQER(&forwarder.QERPlan{QERID: 2, QFI: &qfi2, PPI: &ppi2})
+	sess.ApplyCreatePDR(&forwarder.PDRPlan{PDRID: 1, QERIDs: []uint32{1}})
+	sess.ApplyCreatePDR(&forwarder.PDRPlan{PDRID: 2, QERIDs: []uint32{2}})
+
+	recvQoS := func() (*uint8, *uint8, bool) {
+		req, ok := recvSessReportReq(t, peer)
+		if !ok {
+			return nil, nil, false
+		}
+		ies, err := req.DownlinkDataReport.DownlinkDataReport()
+		require.NoError(t, err)
+		var qfi, ppi *uint8
+		for _, i := range ies {
+			if i.Type != ie.DownlinkDataServiceInformation {
+				continue
+			}
+			// decoded by hand: ie.QFI() expects the PPI to be present
+			b := i.Payload[1:]
+			if i.HasPPI() {
+				v := b[0]
+				ppi = &v
+				b = b[1:]
+			}
+			if i.HasQFI() {
+				v := b[0]
+				qfi = &v
+			}
+		}
+		return qfi, ppi, true
+	}
+
+	sess.Push(1, []byte{1})
+	// the QoS of a buffered packet doesn't change with its QER
+	qfi3 := uint8(9)
+	sess.ApplyUpdateQER(&forwarder.QERPlan{QERID: 1, QFI: &qfi3})
+	require.NoError(t, s.notifyDLData(peer.LocalAddr(), sess, 1))
+	qfi, ppi, ok := recvQoS()
+	require.True(t, ok)
+	assert.Equal(t, &qfi1, qfi)
+	assert.Nil(t, ppi)
+
+	// a new QoS flow is notified again
+	sess.Push(2, []byte{2})
+	require.NoError(t, s.notifyDLData(peer.LocalAddr(), sess, 2))
+	qfi, ppi, ok = recvQoS()
+	require.True(t, ok)
+	assert.Equal(t, &qfi2, qfi)
+	assert.Equal(t, &ppi2, ppi)
+
+	sess.Push(2, []byte{3})
+	require.NoError(t, s.notifyDLData(peer.LocalAddr(), sess, 2))
+	_, _, ok = recvQoS()
+	assert.False(t, ok)
+}
@@ -0,0 +1,283 @@
+package pfcp
+
+import (
+	"encoding/binary"
+	"net"
+	"net/url"
+	"os"
+	"path/filepath"
+	"strconv"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/pkg/errors"
+	"github.com/wmnsk/go-pfcp/message"
+
+	"github.com/free5gc/go-upf/internal/pcap"
+	"github.com/free5gc/go-upf/pkg/factory"
+)
+
+// CAPTURE_FILE is the pcap file of a capture started at runtime without a
+// file configured, in the temporary directory
+const CAPTURE_FILE = "upf-n4.pcap"
+
+// capture writes the PFCP messages sent and received to a pcap file, only
+// those of the CP functions or the sessions filtered if any
+type capture struct {
+	w       *pcap.Writer
+	file    string
+	nodeIDs map[string]struct{}
+	seids   map[uint64]struct{} // UP or CP SEIDs
+	packets atomic.Uint64
+
+	mu    sync.RWMutex
+	peers map[string]struct{} // key: IP of a CP function filtered
+}
+
+// CaptureStatus is the state of the capture of the PFCP messages
+type CaptureStatus struct {
+	Enabled bool     `json:"enabled"`
+	File    string   `json:"file,omitempty"`
+	Packets uint64   `json:"packets"`
+	NodeIDs []string `json:"nodeIDs,omitempty"`
+	SEIDs   []uint64 `json:"seids,omitempty"`
+}
+
+// StartCapture starts capturing the PFCP messages, replacing the running
+// capture if any
+func (s *PfcpServer) StartCapture(cfg factory.PfcpCapture) error {
+	if cfg.File == "" {
+		cfg.File = filepath.Join(os.TempDir(), CAPTURE_FILE)
+	}
+	w, err := pcap.Open(cfg.File, cfg.MaxSize, cfg.MaxFiles)
+	if err != nil {
+		return errors.Wrap(err, "StartCapture")
+	}
+	c := &capture{
+		w:       w,
+		file:    cfg.File,
+		nodeIDs: make(map[string]struct{}),
+		seids:   make(map[uint64]struct{}),
+		peers:   make(map[string]struct{}),
+	}
+	for _, id := range cfg.NodeIDs {
+		c.nodeIDs[id] = struct{}{}
+		if ip := net.ParseIP(id); ip != nil {
+			c.peers[ip.String()] = struct{}{}
+		}
+	}
+	for _, seid := range cfg.SEIDs {
+		c.seids[seid] = struct{}{}
+	}
+
+	s.nodeMu.RLock()
+	for id, rnode := range s.rnodes {
+		c.addNode(id, rnode.addr)
+	}
+	s.nodeMu.RUnlock()
+
+	s.log.Infof("start capture to %s, nodeIDs %v, seids %v", cfg.File, cfg.NodeIDs, cfg.SEIDs)
+	s.stopCapture(s.capture.Swap(c))
+	return nil
+}
+
+// StopCapture stops capturing the PFCP messages
+func (s *PfcpServer) StopCapture() {
+	s.stopCapture(s.capture.Swap(nil))
+}
+
+func (s *PfcpServer) stopCapture(c *capture) {
+	if c == nil {
+		return
+	}
+	s.log.Infof("stop capture to %s: %d packets", c.file, c.packets.Load())
+	if err := c.w.Close(); err != nil {
+		s.log.Warnln(err)
+	}
+}
+
+// CaptureStatus returns the state of the capture of the PFCP messages
+func (s *PfcpServer) CaptureStatus() CaptureStatus {
+	c := s.capture.Load()
+	if c == nil {
+		return CaptureStatus{}
+	}
+	st := CaptureStatus{
+		Enabled: true,
+		File:    c.file,
+		Packets: c.packets.Load(),
+	}
+	for id := range c.nodeIDs {
+		st.NodeIDs = append(st.NodeIDs, id)
+	}
+	for seid := range c.seids {
+		st.SEIDs = append(st.SEIDs, seid)
+	}
+	return st
+}
+
+// ControlCapture starts or stops the capture at runtime by the query
+// parameters enable, nodeID and seid; the file and the rotation are those
+// configured
+func (s *PfcpServer) ControlCapture(q url.Values) error {
+	enable, err := strconv.ParseBool(q.Get("enable"))
+	if err != nil {
+		return errors.Wrap(err, "ControlCapture: enable")
+	}
+	if !enable {
+		s.StopCapture()
+		return nil
+	}
+
+	var cfg factory.PfcpCapture
+	if s.cfg != nil && s.cfg.Pfcp != nil && s.cfg.Pfcp.Capture != nil {
+		cfg.File = s.cfg.Pfcp.Capture.File
+		cfg.MaxSize = s.cfg.Pfcp.Capture.MaxSize
+		cfg.MaxFiles = s.cfg.Pfcp.Capture.MaxFiles
+	}
+	cfg.NodeIDs = q["nodeID"]
+	for _, v := range q["seid"] {
+		seid, err1 := strconv.ParseUint(v, 0, 64)
+		if err1 != nil {
+			return errors.Wrapf(err1, "ControlCapture: seid %q", v)
+		}
+		cfg.SEIDs = append(cfg.SEIDs, seid)
+	}
+	return s.StartCapture(cfg)
+}
+
+// captureNode records the address of a CP function associated, whose
+// messages are captured if its Node ID is filtered
+func (s *PfcpServer) captureNode(id string, addr net.Addr) {
+	if c := s.capture.Load(); c != nil {
+		c.addNode(id, addr)
+	}
+}
+
+func (c *capture) addNode(id string, addr net.Addr) {
+	if _, ok := c.nodeIDs[id]; !ok {
+		return
+	}
+	if a := udpAddr(addr); a != nil {
+		c.mu.Lock()
+		c.peers[a.IP.String()] = struct{}{}
+		c.mu.Unlock()
+	}
+}
+
+// captureMsg captures a PFCP message b sent to, or received from, the
+// remote address through the local address
+func (s *PfcpServer) captureMsg(local, remote net.Addr, sent bool, b []byte) {
+	c := s.capture.Load()
+	if c == nil || !s.captureMatch(c, remote, sent, b) {
+		return
+	}
+	src, dst := udpAddr(local), udpAddr(remote)
+	if src == nil || dst == nil {
+		return
+	}
+	if !sent {
+		src, dst = dst, src
+	}
+	err := c.w.WriteUDP(time.Now(), src, dst, b)
+	if err != nil {
+		// stopped meanwhile
+		s.log.Debugf("capture: %v", err)
+		return
+	}
+	c.packets.Add(1)
+}
+
+// captureMatch reports whether a message is of a CP function or a session
+// filtered by the capture
+func (s *PfcpServer) captureMatch(c *capture, remote net.Addr, sent bool, b []byte) bool {
+	if len(c.nodeIDs) == 0 && len(c.seids) == 0 {
+		return true
+	}
+	if a := udpAddr(remote); a != nil {
+		c.mu.RLock()
+		_, ok := c.peers[a.IP.String()]
+		c.mu.RUnlock()
+		if ok {
+			return true
+		}
+	}
+	if len(c.seids) == 0 || len(b) < 12 || b[0]&0x01 == 0 {
+		return false
+	}
+
+	seid := binary.BigEndian.Uint64(b[4:12])
+	if _, ok := c.seids[seid]; ok {
+		return true
+	}
+	if sent {
+		// the CP SEID of a session of the UP SEIDs filtered
+		return s.lnode.hasRemoteSess(seid, c.seids)
+	}
+	if seid != 0 {
+		sess, err := s.lnode.Sess(seid)
+		if err != nil {
+			return false
+		}
+		_, ok := c.seids[sess.RemoteID]
+		return ok
+	}
+	// the CP SEID of a session being established
+	if b[1] != message.MsgTypeSessionEstablishmentRequest {
+		return false
+	}
+	msg, err := message.ParseSessionEstablishmentRequest(b)
+	if err != nil || msg.CPFSEID == nil {
+		return false
+	}
+	fseid, err := msg.CPFSEID.FSEID()
+	if err != nil {
+		return false
+	}
+	_, ok := c.seids[fseid.SEID]
+	return ok
+}
+
+// hasRemoteSess reports whether a session of the CP SEID has one of the
+// UP SEIDs
+func (n *LocalNode) hasRemoteSess(rSeid uint64, lSeids map[uint64]struct{}) bool {
+	n.mu.RLock()
+	defer n.mu.RUnlock()
+	for _, s := range n.sess {
+		if s == nil || s.RemoteID != rSeid {
+			continue
+		}
+		if _, ok := lSeids[s.LocalID]; ok {
+			return true
+		}
+	}
+	return false
+}
+
+// writeTo sends a PFCP message to addr from the endpoint bound to the peer,
+// and captures it
+func (s *PfcpServer) writeTo(b []byte, addr net.Addr) error {
+	conn := s.connTo(addr)
+	_, err := conn.WriteTo(b, addr)
+	if err != nil {
+		return err
+	}
+	s.captureMsg(conn.LocalAddr(), addr, true, b)
+	return nil
+}
+
+func udpAddr(addr net.Addr) *net.UDPAddr {
+	switch a := addr.(type) {
+	case *net.UDPAddr:
+		return a
+	case nil:
+		return nil
+	default:
+		u, err := net.ResolveUDPAddr("udp", a.String())
+		if err != nil {
+			return nil
+		}
+		return u
+	}
+}
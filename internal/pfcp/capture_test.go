@@ -0,0 +1,93 @@
+package pfcp
+
+import (
+	"net"
+	"net/url"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"github.com/wmnsk/go-pfcp/ie"
+	"github.com/wmnsk/go-pfcp/message"
+
+	"github.com/free5gc/go-upf/internal/forwarder"
+	"github.com/free5gc/go-upf/internal/pcap"
+	"github.com/free5gc/go-upf/pkg/factory"
+)
+
+func TestCapture(t *testing.T) {
+	s, _, peer := newUDPTestServer(t, forwarder.Empty{})
+	smf := peer.LocalAddr()
+	local := s.conn.LocalAddr()
+	file := filepath.Join(t.TempDir(), "n4.pcap")
+
+	marshal := func(m message.Message) []byte {
+		b := make([]byte, m.MarshalLen())
+		require.NoError(t, m.MarshalTo(b))
+		return b
+	}
+	hb := marshal(message.NewHeartbeatRequest(1, ie.NewRecoveryTimeStamp(time.Now()), nil))
+	mod5 := marshal(message.NewSessionModificationRequest(0, 0, 5, 2, 0))
+	mod6 := marshal(message.NewSessionModificationRequest(0, 0, 6, 3, 0))
+	est5 := marshal(message.NewSessionEstablishmentRequest(0, 0, 0, 4, 0,
+		ie.NewNodeID("10.100.200.3", "", ""),
+		ie.NewFSEID(5, net.IPv4(10, 100, 200, 3), nil),
+	))
+
+	t.Run("all messages", func(t *testing.T) {
+		require.NoError(t, s.StartCapture(factory.PfcpCapture{File: file}))
+		require.NoError(t, s.writeTo(hb, smf))
+		s.captureMsg(local, smf, false, mod6)
+		_, _, err := peer.ReadFrom(make([]byte, MAX_PFCP_MSG_LEN))
+		require.NoError(t, err)
+
+		st := s.CaptureStatus()
+		assert.True(t, st.Enabled)
+		assert.Equal(t, file, st.File)
+		assert.Equal(t, uint64(2), st.Packets)
+		s.StopCapture()
+		assert.False(t, s.CaptureStatus().Enabled)
+
+		b, err := os.ReadFile(file)
+		require.NoError(t, err)
+		rec := pcap.RECORD_HDR_LEN + pcap.IPV4_HDR_LEN + pcap.UDP_HDR_LEN
+		assert.Len(t, b, pcap.FILE_HDR_LEN+2*rec+len(hb)+len(mod6))
+	})
+
+	t.Run("SEID filter", func(t *testing.T) {
+		require.NoError(t, s.StartCapture(factory.PfcpCapture{File: file, SEIDs: []uint64{5}}))
+		for _, b := range [][]byte{hb, mod5, mod6, est5} {
+			s.captureMsg(local, smf, false, b)
+		}
+		assert.Equal(t, uint64(2), s.CaptureStatus().Packets)
+		s.StopCapture()
+	})
+
+	t.Run("Node ID filter", func(t *testing.T) {
+		require.NoError(t, s.StartCapture(factory.PfcpCapture{File: file, NodeIDs: []string{"10.100.200.3"}}))
+		s.captureMsg(local, smf, false, hb)
+		assert.Equal(t, uint64(0), s.CaptureStatus().Packets)
+
+		// associated from the address of the peer
+		s.captureNode("10.100.200.3", smf)
+		s.captureMsg(local, smf, false, hb)
+		assert.Equal(t, uint64(1), s.CaptureStatus().Packets)
+		s.StopCapture()
+	})
+
+	t.Run("control", func(t *testing.T) {
+		s.cfg.Pfcp.Capture = &factory.PfcpCapture{File: file}
+		require.NoError(t, s.ControlCapture(url.Values{"enable": {"true"}, "seid": {"0x5", "6"}}))
+		st := s.CaptureStatus()
+		assert.Equal(t, file, st.File)
+		assert.ElementsMatch(t, []uint64{5, 6}, st.SEIDs)
+
+		assert.Error(t, s.ControlCapture(url.Values{"enable": {"true"}, "seid": {"x"}}))
+		assert.Error(t, s.ControlCapture(url.Values{}))
+		require.NoError(t, s.ControlCapture(url.Values{"enable": {"false"}}))
+		assert.False(t, s.CaptureStatus().Enabled)
+	})
+}
@@ -4,15 +4,20 @@ import (
 	"net"
 
 	"github.com/pkg/errors"
+	"github.com/wmnsk/go-pfcp/ie"
 	"github.com/wmnsk/go-pfcp/message"
 )
 
+// reqDispacher handles the association level requests, and dispatches the
+// session level requests to the worker of their session
 func (s *PfcpServer) reqDispacher(msg message.Message, addr net.Addr) error {
 	switch req := msg.(type) {
 	case *message.HeartbeatRequest:
 		s.handleHeartbeatRequest(req, addr)
 	case *message.AssociationSetupRequest:
-		s.handleAssociationSetupRequest(req, addr)
+		s.workers.exclusive(func() {
+			s.handleAssociationSetupRequest(req, addr)
+		})
 	case *message.AssociationUpdateRequest:
 		s.handleAssociationUpdateRequest(req, addr)
 	case *message.AssociationReleaseRequest:
@@ -20,19 +25,60 @@ func (s *PfcpServer) reqDispacher(msg message.Message, addr net.Addr) error {
 	case *message.SessionEstablishmentRequest:
 		s.handleSessionEstablishmentRequest(req, addr)
 	case *message.SessionModificationRequest:
-		s.handleSessionModificationRequest(req, addr)
+		if req.NodeID != nil {
+			s.workers.exclusive(func() {
+				s.takeOverSess(req)
+			})
+		}
+		ok := s.workers.dispatch(req.SEID(), func() {
+			s.handleSessionModificationRequest(req, addr)
+		})
+		if !ok {
+			s.rejectCongested(req, addr)
+		}
 	case *message.SessionDeletionRequest:
-		s.handleSessionDeletionRequest(req, addr)
+		ok := s.workers.dispatch(req.SEID(), func() {
+			s.handleSessionDeletionRequest(req, addr)
+		})
+		if !ok {
+			s.rejectCongested(req, addr)
+		}
+	case *message.PFDManagementRequest,
+		*message.NodeReportRequest,
+		*message.SessionSetDeletionRequest,
+		*message.SessionReportRequest:
+		s.handleUnsupportedRequest(msg, addr)
 	default:
 		return errors.Errorf("pfcp reqDispacher unknown msg type: %d", msg.MessageType())
 	}
 	return nil
 }
 
+// rejectCongested answers a session request the worker of the session is
+// too congested to queue, with the workerQueueLen requests of the
+// configuration queued already
+func (s *PfcpServer) rejectCongested(req message.Message, addr net.Addr) {
+	s.log.Warnf("reject %s of SEID[%#x]: worker congested", req.MessageTypeName(), req.SEID())
+	var rSeid uint64
+	if sess, err := s.lnode.Sess(req.SEID()); err == nil {
+		rSeid = sess.RemoteID
+	}
+	s.sendRejectRsp(req.MessageType(), req.Sequence(), rSeid, addr, ie.CausePFCPEntityInCongestion, nil)
+}
+
 func (s *PfcpServer) rspDispacher(msg message.Message, addr net.Addr, req message.Message) error {
 	switch rsp := msg.(type) {
 	case *message.SessionReportResponse:
-		s.handleSessionReportResponse(rsp, addr, req)
+		lSeid := rsp.SEID()
+		if lSeid == 0 {
+			// answered for a session unknown to the CP function
+			if sess, err := s.lnode.RemoteSess(req.SEID(), addr); err == nil {
+				lSeid = sess.LocalID
+			}
+		}
+		s.workers.post(lSeid, func() {
+			s.handleSessionReportResponse(rsp, addr, req)
+		})
 	default:
 		return errors.Errorf("pfcp rspDispacher unknown msg type: %d", msg.MessageType())
 	}
@@ -0,0 +1,119 @@
+package pfcp
+
+import (
+	"time"
+
+	"github.com/free5gc/go-upf/internal/forwarder"
+	"github.com/free5gc/go-upf/internal/report"
+)
+
+// DROP_SAMPLE_INTERVAL is the period the DL drop counters of the forwarder
+// are sampled with for the Dropped DL Traffic Threshold
+const DROP_SAMPLE_INTERVAL = 5 * time.Second
+
+// dropSampleReport is notified to sample the DL packets the forwarder
+// dropped without reporting them, e.g. by a FAR dropping them in the kernel
+// module. The kernel module counts no bytes, so these drops count toward
+// the packets of the Dropped DL Traffic Threshold only.
+type dropSampleReport struct {
+	gen uint32
+}
+
+func (r dropSampleReport) Type() report.ReportType {
+	return report.INTERNAL
+}
+
+func (s *Sess) stopDropSample() {
+	if s.dropSample == nil {
+		return
+	}
+	s.dropSample.Stop()
+	s.dropSample = nil
+}
+
+func (s *PfcpServer) stopDropSampleTimers() {
+	for _, sess := range s.lnode.sess {
+		if sess != nil {
+			sess.stopDropSample()
+		}
+	}
+}
+
+// droppedDLPDRs returns the PDRs of the URRs with a Dropped DL Traffic
+// Threshold
+func (s *Sess) droppedDLPDRs() []uint16 {
+	var pdrids []uint16
+	for pdrid, pdrInfo := range s.PDRIDs {
+		for urrid := range pdrInfo.RelatedURRIDs {
+			urrInfo, ok := s.URRIDs[urrid]
+			if ok && !urrInfo.removed && urrInfo.RptTrig.DROTH() {
+				pdrids = append(pdrids, pdrid)
+				break
+			}
+		}
+	}
+	return pdrids
+}
+
+// applyDropSample samples the DL drops of the session while URRs with a
+// Dropped DL Traffic Threshold exist. The first sample of the PDRs created
+// by the plan is taken at once, the next ones are compared with.
+func (s *PfcpServer) applyDropSample(sess *Sess, plan *forwarder.ModificationPlan) {
+	pdrids := sess.droppedDLPDRs()
+	if len(pdrids) == 0 {
+		sess.stopDropSample()
+		return
+	}
+	created := make(map[uint16]struct{}, len(plan.CreatePDRs))
+	for _, p := range plan.CreatePDRs {
+		created[p.PDRID] = struct{}{}
+	}
+	var first []uint16
+	for _, pdrid := range pdrids {
+		if _, ok := created[pdrid]; ok || sess.dropSample == nil {
+			first = append(first, pdrid)
+		}
+	}
+	if len(first) > 0 {
+		sess.rnode.driver.DroppedDL(sess.LocalID, first)
+	}
+	s.armDropSample(sess)
+}
+
+func (s *PfcpServer) armDropSample(sess *Sess) {
+	if sess.dropSample != nil {
+		return
+	}
+	sess.dropSampleGen++
+	lSeid := sess.LocalID
+	r := dropSampleReport{gen: sess.dropSampleGen}
+	sess.dropSample = time.AfterFunc(DROP_SAMPLE_INTERVAL, func() {
+		s.NotifySessReport(report.SessReport{
+			SEID:    lSeid,
+			Reports: []report.Report{r},
+		})
+	})
+}
+
+// sampleDrops accounts the DL packets the forwarder dropped since the
+// previous sample, and returns the usage reports of the URRs whose Dropped
+// DL Traffic Threshold has been reached
+func (s *PfcpServer) sampleDrops(sess *Sess, r dropSampleReport) []report.USAReport {
+	if r.gen != sess.dropSampleGen {
+		// a stale timer of a stopped sampling
+		return nil
+	}
+	sess.dropSample = nil
+	pdrids := sess.droppedDLPDRs()
+	if len(pdrids) == 0 {
+		return nil
+	}
+	var usars []report.USAReport
+	for pdrid, n := range sess.rnode.driver.DroppedDL(sess.LocalID, pdrids) {
+		if n > 0 {
+			usars = append(usars, sess.dropDL(pdrid, n, 0)...)
+		}
+	}
+	s.armDropSample(sess)
+	return usars
+}
@@ -0,0 +1,68 @@
+package pfcp
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+
+	"github.com/free5gc/go-upf/internal/forwarder"
+	"github.com/free5gc/go-upf/internal/report"
+)
+
+// dropDriver reports the DL drops set, and records the PDRs sampled
+type dropDriver struct {
+	forwarder.Empty
+	drops   map[uint16]uint64
+	sampled [][]uint16
+}
+
+func (d *dropDriver) DroppedDL(_ uint64, pdrids []uint16) map[uint16]uint64 {
+	d.sampled = append(d.sampled, pdrids)
+	drops := d.drops
+	d.drops = nil
+	return drops
+}
+
+func TestDropSample(t *testing.T) {
+	d := &dropDriver{}
+	s, rnode, _ := newUDPTestServer(t, d)
+	sess := rnode.NewSess(0xd0)
+	defer sess.stopDropSample()
+
+	sess.PDRIDs[1] = &PDRInfo{RelatedURRIDs: map[uint32]struct{}{1: {}}}
+	sess.PDRIDs[2] = &PDRInfo{RelatedURRIDs: map[uint32]struct{}{}}
+	sess.URRIDs[1] = &URRInfo{
+		RptTrig: report.ReportingTrigger{Flags: report.RPT_TRIG_DROTH},
+		DroppedDLThreshold: report.DroppedDLThreshold{
+			Flags:   report.DLPA,
+			Packets: 3,
+		},
+	}
+
+	plan := forwarder.NewModificationPlan(sess.LocalID)
+	plan.CreatePDRs = []*forwarder.PDRPlan{{PDRID: 1}, {PDRID: 2}}
+	s.applyDropSample(sess, plan)
+	require.NotNil(t, sess.dropSample)
+	// the first sample of the PDRs of the URR
+	assert.Equal(t, [][]uint16{{1}}, d.sampled)
+
+	r := dropSampleReport{gen: sess.dropSampleGen}
+	d.drops = map[uint16]uint64{1: 2}
+	assert.Empty(t, s.sampleDrops(sess, r))
+	require.NotNil(t, sess.dropSample)
+
+	r = dropSampleReport{gen: sess.dropSampleGen}
+	d.drops = map[uint16]uint64{1: 1}
+	usars := s.sampleDrops(sess, r)
+	require.Len(t, usars, 1)
+	assert.True(t, usars[0].USARTrigger.DROTH())
+
+	// a stale timer is ignored
+	assert.Empty(t, s.sampleDrops(sess, dropSampleReport{gen: r.gen - 1}))
+
+	// no sampling without a Dropped DL Traffic Threshold
+	sess.URRIDs[1].RptTrig = report.ReportingTrigger{}
+	s.applyDropSample(sess, forwarder.NewModificationPlan(sess.LocalID))
+	assert.Nil(t, sess.dropSample)
+}
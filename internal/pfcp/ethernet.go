@@ -0,0 +1,125 @@
+package pfcp
+
+import (
+	"net"
+	"time"
+
+	"github.com/free5gc/go-upf/internal/report"
+)
+
+// macAgingReport is notified when a MAC address learnt for the session may
+// have been inactive for the Ethernet Inactivity Timer of its URR
+type macAgingReport struct{}
+
+func (r macAgingReport) Type() report.ReportType {
+	return report.INTERNAL
+}
+
+func (s *Sess) stopMACAging() {
+	if s.macAging == nil {
+		return
+	}
+	s.macAging.Stop()
+	s.macAging = nil
+}
+
+func (s *PfcpServer) stopMACAgingTimers() {
+	for _, sess := range s.lnode.sess {
+		if sess != nil {
+			sess.stopMACAging()
+		}
+	}
+}
+
+// detectMACs records the MAC addresses seen on the PDR for the URRs with
+// MAC Addresses Reporting, and returns the usage reports of the URRs which
+// detected new MAC addresses
+func (s *Sess) detectMACs(pdrid uint16, macs []net.HardwareAddr, now time.Time) []report.USAReport {
+	pdrInfo, ok := s.PDRIDs[pdrid]
+	if !ok {
+		return nil
+	}
+
+	var usars []report.USAReport
+	for urrid := range pdrInfo.RelatedURRIDs {
+		urrInfo, ok := s.URRIDs[urrid]
+		if !ok || urrInfo.removed || !urrInfo.RptTrig.MACAR() {
+			continue
+		}
+		if urrInfo.macs == nil {
+			urrInfo.macs = make(map[string]time.Time)
+		}
+
+		var detected []net.HardwareAddr
+		for _, mac := range macs {
+			if _, ok := urrInfo.macs[string(mac)]; !ok {
+				detected = append(detected, mac)
+			}
+			urrInfo.macs[string(mac)] = now
+		}
+		if len(detected) == 0 {
+			continue
+		}
+		s.log.Infof("URR[%#x] MAC addresses detected: %v", urrid, detected)
+		r := report.USAReport{
+			URRID:       urrid,
+			MACDetected: detected,
+		}
+		r.USARTrigger.Flags = report.USAR_TRIG_MACAR
+		usars = append(usars, r)
+	}
+	return usars
+}
+
+// ageMACs removes the MAC addresses not seen during the Ethernet Inactivity
+// Timer of their URR. It returns the usage reports of the URRs which removed
+// MAC addresses, and the time until the next MAC address may expire.
+func (s *Sess) ageMACs(now time.Time) ([]report.USAReport, time.Duration) {
+	var usars []report.USAReport
+	var next time.Duration
+	for urrid, urrInfo := range s.URRIDs {
+		if urrInfo.removed || urrInfo.EthInactivity == 0 {
+			continue
+		}
+
+		var removed []net.HardwareAddr
+		for mac, last := range urrInfo.macs {
+			idle := now.Sub(last)
+			if idle >= urrInfo.EthInactivity {
+				delete(urrInfo.macs, mac)
+				removed = append(removed, net.HardwareAddr(mac))
+				continue
+			}
+			if d := urrInfo.EthInactivity - idle; next == 0 || d < next {
+				next = d
+			}
+		}
+		if len(removed) == 0 {
+			continue
+		}
+		s.log.Infof("URR[%#x] MAC addresses removed: %v", urrid, removed)
+		r := report.USAReport{
+			URRID:      urrid,
+			MACRemoved: removed,
+		}
+		r.USARTrigger.Flags = report.USAR_TRIG_MACAR
+		usars = append(usars, r)
+	}
+	return usars, next
+}
+
+// ageMACs ages the MAC addresses of the session, and arms the aging timer
+// for the next MAC address to expire
+func (s *PfcpServer) ageMACs(sess *Sess) []report.USAReport {
+	usars, next := sess.ageMACs(time.Now())
+	if next > 0 && sess.macAging == nil {
+		lSeid := sess.LocalID
+		sess.macAging = time.AfterFunc(next, func() {
+			s.NotifySessReport(report.SessReport{
+				SEID:    lSeid,
+				Reports: []report.Report{macAgingReport{}},
+			})
+		})
+	}
+	return usars
+}
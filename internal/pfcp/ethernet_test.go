@@ -0,0 +1,68 @@
+package pfcp
+
+import (
+	"net"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+
+	"github.com/free5gc/go-upf/internal/forwarder"
+	"github.com/free5gc/go-upf/internal/report"
+)
+
+func TestMACAddressesReporting(t *testing.T) {
+	s, rnode, _ := newUDPTestServer(t, forwarder.Empty{})
+	sess := rnode.NewSess(0x1efce)
+	defer sess.stopMACAging()
+
+	sess.PDRIDs[1] = &PDRInfo{RelatedURRIDs: map[uint32]struct{}{1: {}, 2: {}}}
+	sess.URRIDs[1] = &URRInfo{
+		RptTrig:       report.ReportingTrigger{Flags: report.RPT_TRIG_MACAR},
+		EthInactivity: time.Minute,
+	}
+	sess.URRIDs[2] = &URRInfo{
+		RptTrig: report.ReportingTrigger{Flags: report.RPT_TRIG_VOLTH},
+	}
+
+	ue1 := net.HardwareAddr{0x02, 0x00, 0x00, 0x00, 0x00, 0x01}
+	ue2 := net.HardwareAddr{0x02, 0x00, 0x00, 0x00, 0x00, 0x02}
+	now := time.Now()
+
+	t.Run("new MAC addresses are detected", func(t *testing.T) {
+		usars := sess.detectMACs(1, []net.HardwareAddr{ue1}, now)
+		require.Len(t, usars, 1)
+		assert.Equal(t, uint32(1), usars[0].URRID)
+		assert.True(t, usars[0].USARTrigger.MACAR())
+		assert.Equal(t, []net.HardwareAddr{ue1}, usars[0].MACDetected)
+
+		// a known MAC address is refreshed only
+		assert.Empty(t, sess.detectMACs(1, []net.HardwareAddr{ue1}, now.Add(30*time.Second)))
+
+		usars = sess.detectMACs(1, []net.HardwareAddr{ue2}, now)
+		require.Len(t, usars, 1)
+		assert.Equal(t, []net.HardwareAddr{ue2}, usars[0].MACDetected)
+	})
+
+	t.Run("inactive MAC addresses are removed", func(t *testing.T) {
+		usars, next := sess.ageMACs(now.Add(time.Minute))
+		require.Len(t, usars, 1)
+		assert.True(t, usars[0].USARTrigger.MACAR())
+		assert.Equal(t, []net.HardwareAddr{ue2}, usars[0].MACRemoved)
+		assert.Equal(t, 30*time.Second, next)
+
+		usars, next = sess.ageMACs(now.Add(2 * time.Minute))
+		require.Len(t, usars, 1)
+		assert.Equal(t, []net.HardwareAddr{ue1}, usars[0].MACRemoved)
+		assert.Zero(t, next)
+	})
+
+	t.Run("aging timer", func(t *testing.T) {
+		sess.detectMACs(1, []net.HardwareAddr{ue1}, time.Now())
+		assert.Empty(t, s.ageMACs(sess))
+		assert.NotNil(t, sess.macAging)
+		sess.stopMACAging()
+		assert.Nil(t, sess.macAging)
+	})
+}
@@ -0,0 +1,153 @@
+package pfcp
+
+import (
+	"net"
+
+	"github.com/wmnsk/go-pfcp/message"
+
+	"github.com/free5gc/go-upf/internal/event"
+	"github.com/free5gc/go-upf/internal/forwarder"
+	"github.com/free5gc/go-upf/internal/report"
+)
+
+// reportTypeNames is the names of the Report Type bits, in bit order
+var reportTypeNames = [...]string{"DLDR", "USAR", "ERIR", "UPIR", "TMIR", "SESR", "UISR"}
+
+// SetEvents sets the stream the session lifecycle events are published to
+func (s *PfcpServer) SetEvents(events *event.Stream) {
+	s.events = events
+}
+
+// sessEvent returns an event of a session
+func sessEvent(t event.Type, sess *Sess) *event.Event {
+	return &event.Event{
+		Type:   t,
+		NodeID: sess.rnode.ID,
+		SEID:   sess.LocalID,
+		CPSEID: sess.RemoteID,
+	}
+}
+
+// releasedEvent journals the final usage reports of a session released
+// without a Session Deletion Request, as reported for its termination, and
+// returns the SESSION_DELETED event of the session with them
+func (s *PfcpServer) releasedEvent(sess *Sess, usars []report.USAReport) *event.Event {
+	e := sessEvent(event.SESSION_DELETED, sess)
+	for _, r := range usars {
+		if _, ok := sess.URRIDs[r.URRID]; !ok {
+			continue
+		}
+		sess.sealUSAReport(&r)
+		r.USARTrigger.Flags |= report.USAR_TRIG_TERMR
+		e.Usage = append(e.Usage, event.NewUsage(r))
+		s.recordUsage(sess, r)
+	}
+	return e
+}
+
+// sendSessReport sends a Session Report Request of a session, and publishes
+// it with the usage reported if any
+func (s *PfcpServer) sendSessReport(
+	sess *Sess,
+	req *message.SessionReportRequest,
+	addr net.Addr,
+	usage []event.Usage,
+) error {
+	err := s.sendReqTo(req, addr)
+	if err != nil {
+		return err
+	}
+	e := sessEvent(event.REPORT_SENT, sess)
+	e.Sequence = req.Sequence()
+	e.Reports = reportTypes(req)
+	e.Usage = usage
+	s.events.Publish(e)
+	return nil
+}
+
+func reportTypes(req *message.SessionReportRequest) []string {
+	if req.ReportType == nil || len(req.ReportType.Payload) == 0 {
+		return nil
+	}
+	var names []string
+	for i, name := range reportTypeNames {
+		if req.ReportType.Payload[0]&(1<<i) != 0 {
+			names = append(names, name)
+		}
+	}
+	return names
+}
+
+// planDiff returns the rules created, updated and removed by the plans of
+// a request
+func planDiff(plan *forwarder.ModificationPlan, srrs *srrPlans) *event.RuleDiff {
+	d := &event.RuleDiff{
+		Created: make(map[string][]uint32),
+		Updated: make(map[string][]uint32),
+		Removed: make(map[string][]uint32),
+	}
+	add := func(m map[string][]uint32, rule string, id uint32) {
+		m[rule] = append(m[rule], id)
+	}
+
+	for _, p := range plan.CreatePDRs {
+		add(d.Created, "PDR", uint32(p.PDRID))
+	}
+	for _, p := range plan.CreateFARs {
+		add(d.Created, "FAR", p.FARID)
+	}
+	for _, p := range plan.CreateQERs {
+		add(d.Created, "QER", p.QERID)
+	}
+	for _, p := range plan.CreateURRs {
+		add(d.Created, "URR", p.URRID)
+	}
+	for _, p := range plan.CreateBARs {
+		add(d.Created, "BAR", uint32(p.BARID))
+	}
+
+	for _, p := range plan.UpdatePDRs {
+		add(d.Updated, "PDR", uint32(p.PDRID))
+	}
+	for _, p := range plan.UpdateFARs {
+		add(d.Updated, "FAR", p.FARID)
+	}
+	for _, p := range plan.UpdateQERs {
+		add(d.Updated, "QER", p.QERID)
+	}
+	for _, p := range plan.UpdateURRs {
+		add(d.Updated, "URR", p.URRID)
+	}
+	for _, p := range plan.UpdateBARs {
+		add(d.Updated, "BAR", uint32(p.BARID))
+	}
+
+	for _, p := range plan.RemovePDRs {
+		add(d.Removed, "PDR", uint32(p.PDRID))
+	}
+	for _, p := range plan.RemoveFARs {
+		add(d.Removed, "FAR", p.FARID)
+	}
+	for _, p := range plan.RemoveQERs {
+		add(d.Removed, "QER", p.QERID)
+	}
+	for _, p := range plan.RemoveURRs {
+		add(d.Removed, "URR", p.URRID)
+	}
+	for _, p := range plan.RemoveBARs {
+		add(d.Removed, "BAR", uint32(p.BARID))
+	}
+
+	if srrs != nil {
+		for _, p := range srrs.create {
+			add(d.Created, "SRR", uint32(p.SRRID))
+		}
+		for _, p := range srrs.update {
+			add(d.Updated, "SRR", uint32(p.SRRID))
+		}
+		for _, id := range srrs.remove {
+			add(d.Removed, "SRR", uint32(id))
+		}
+	}
+	return d
+}
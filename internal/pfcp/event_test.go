@@ -0,0 +1,146 @@
+package pfcp
+
+import (
+	"net"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"github.com/wmnsk/go-pfcp/ie"
+	"github.com/wmnsk/go-pfcp/message"
+
+	"github.com/free5gc/go-upf/internal/event"
+	"github.com/free5gc/go-upf/internal/forwarder"
+)
+
+type chanSink chan *event.Event
+
+func (c chanSink) Write(e *event.Event) error {
+	c <- e
+	return nil
+}
+
+func (c chanSink) Close() error { return nil }
+
+func TestSessionEvents(t *testing.T) {
+	s, rnode, peer := newUDPTestServer(t, forwarder.Empty{})
+	s.nodeID = "127.0.0.8"
+	s.rxTrans = make(map[string]*RxTransaction)
+	s.rnodes = map[string]*RemoteNode{rnode.ID: rnode}
+	smf := peer.LocalAddr()
+
+	var wg sync.WaitGroup
+	sink := make(chanSink, 8)
+	s.SetEvents(event.NewStream(&wg, sink))
+	defer func() {
+		s.events.Close()
+		wg.Wait()
+	}()
+	next := func() *event.Event {
+		select {
+		case e := <-sink:
+			return e
+		case <-time.After(time.Second):
+			require.FailNow(t, "no event")
+			return nil
+		}
+	}
+
+	req := message.NewSessionEstablishmentRequest(0, 0, 0, 1, 0,
+		ie.NewNodeID(rnode.ID, "", ""),
+		ie.NewFSEID(0x10, net.IPv4(127, 0, 0, 1), nil),
+		ie.NewCreateFAR(ie.NewFARID(2), ie.NewApplyAction(0x02)),
+	)
+	rx := NewRxTransaction(s, smf, 1)
+	s.rxTrans[rx.id] = rx
+	s.handleSessionEstablishmentRequest(req, smf)
+	rsp, ok := readMsg(t, peer).(*message.SessionEstablishmentResponse)
+	require.True(t, ok)
+	fseid, err := rsp.UPFSEID.FSEID()
+	require.NoError(t, err)
+
+	e := next()
+	assert.Equal(t, event.SESSION_ESTABLISHED, e.Type)
+	assert.Equal(t, rnode.ID, e.NodeID)
+	assert.Equal(t, fseid.SEID, e.SEID)
+	assert.Equal(t, uint64(0x10), e.CPSEID)
+	// the IDs are parsed by the forwarder
+	assert.Len(t, e.Diff.Created["FAR"], 1)
+
+	del := message.NewSessionDeletionRequest(0, 0, fseid.SEID, 2, 0)
+	rx = NewRxTransaction(s, smf, 2)
+	s.rxTrans[rx.id] = rx
+	s.handleSessionDeletionRequest(del, smf)
+	_, ok = readMsg(t, peer).(*message.SessionDeletionResponse)
+	require.True(t, ok)
+
+	e = next()
+	assert.Equal(t, event.SESSION_DELETED, e.Type)
+	assert.Equal(t, fseid.SEID, e.SEID)
+}
+
+func TestAssociationReplacedEvents(t *testing.T) {
+	s, rnode, peer := newUDPTestServer(t, releaseDriver{})
+	s.nodeID = "127.0.0.8"
+	s.rxTrans = make(map[string]*RxTransaction)
+	s.rnodes = map[string]*RemoteNode{rnode.ID: rnode}
+	smf := peer.LocalAddr()
+
+	var wg sync.WaitGroup
+	sink := make(chanSink, 8)
+	s.SetEvents(event.NewStream(&wg, sink))
+	defer func() {
+		s.events.Close()
+		wg.Wait()
+	}()
+
+	sess := rnode.NewSess(0x30)
+	sess.URRIDs[1] = &URRInfo{}
+
+	req := message.NewAssociationSetupRequest(1,
+		ie.NewNodeID(rnode.ID, "", ""),
+		ie.NewRecoveryTimeStamp(time.Now()),
+	)
+	rx := NewRxTransaction(s, smf, 1)
+	s.rxTrans[rx.id] = rx
+	s.handleAssociationSetupRequest(req, smf)
+	_, ok := readMsg(t, peer).(*message.AssociationSetupResponse)
+	require.True(t, ok)
+
+	var events []*event.Event
+	for len(events) < 2 {
+		select {
+		case e := <-sink:
+			events = append(events, e)
+		case <-time.After(time.Second):
+			require.FailNow(t, "no event")
+		}
+	}
+	assert.Equal(t, event.SESSION_DELETED, events[0].Type)
+	assert.Equal(t, sess.LocalID, events[0].SEID)
+	assert.Equal(t, uint64(0x30), events[0].CPSEID)
+	require.Len(t, events[0].Usage, 1)
+	assert.Equal(t, []string{"TERMR"}, events[0].Usage[0].Triggers)
+	assert.Equal(t, uint64(300), events[0].Usage[0].TotalVolume)
+	assert.Equal(t, event.ASSOCIATION_DOWN, events[1].Type)
+	assert.Equal(t, 1, events[1].Sessions)
+}
+
+func TestPlanDiff(t *testing.T) {
+	far := uint32(1)
+	plan := forwarder.NewModificationPlan(1)
+	plan.CreatePDRs = append(plan.CreatePDRs, &forwarder.PDRPlan{PDRID: 1, FARID: &far})
+	plan.UpdateFARs = append(plan.UpdateFARs, &forwarder.FARPlan{FARID: far})
+	plan.RemoveURRs = append(plan.RemoveURRs, &forwarder.URRPlan{URRID: 3}, &forwarder.URRPlan{URRID: 4})
+	srrs := &srrPlans{create: []*SRRPlan{{SRRID: 5}}, remove: []uint8{6}}
+
+	d := planDiff(plan, srrs)
+	assert.Equal(t, map[string][]uint32{"PDR": {1}, "SRR": {5}}, d.Created)
+	assert.Equal(t, map[string][]uint32{"FAR": {1}}, d.Updated)
+	assert.Equal(t, map[string][]uint32{"URR": {3, 4}, "SRR": {6}}, d.Removed)
+
+	req := message.NewSessionReportRequest(0, 0, 1, 1, 0, ie.NewReportType(0, 0, 1, 1))
+	assert.Equal(t, []string{"DLDR", "USAR"}, reportTypes(req))
+}
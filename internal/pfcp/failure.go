@@ -0,0 +1,127 @@
+package pfcp
+
+import (
+	"github.com/pkg/errors"
+	"github.com/wmnsk/go-pfcp/ie"
+
+	"github.com/free5gc/go-upf/internal/forwarder"
+)
+
+// ruleIDs is the Rule ID Type and the type of the Rule ID IE of the rule
+// level IEs of the session requests
+var ruleIDs = map[uint16]struct {
+	typ uint8
+	id  uint16
+}{
+	ie.CreatePDR: {ie.RuleIDTypePDR, ie.PDRID},
+	ie.UpdatePDR: {ie.RuleIDTypePDR, ie.PDRID},
+	ie.RemovePDR: {ie.RuleIDTypePDR, ie.PDRID},
+	ie.CreateFAR: {ie.RuleIDTypeFAR, ie.FARID},
+	ie.UpdateFAR: {ie.RuleIDTypeFAR, ie.FARID},
+	ie.RemoveFAR: {ie.RuleIDTypeFAR, ie.FARID},
+	ie.CreateQER: {ie.RuleIDTypeQER, ie.QERID},
+	ie.UpdateQER: {ie.RuleIDTypeQER, ie.QERID},
+	ie.RemoveQER: {ie.RuleIDTypeQER, ie.QERID},
+	ie.CreateURR: {ie.RuleIDTypeURR, ie.URRID},
+	ie.UpdateURR: {ie.RuleIDTypeURR, ie.URRID},
+	ie.RemoveURR: {ie.RuleIDTypeURR, ie.URRID},
+	ie.QueryURR:  {ie.RuleIDTypeURR, ie.URRID},
+	ie.CreateBAR: {ie.RuleIDTypeBAR, ie.BARID},
+	ie.RemoveBAR: {ie.RuleIDTypeBAR, ie.BARID},
+	ie.CreateSRR: {forwarder.RULE_ID_TYPE_SRR, ie.SRRID},
+	ie.UpdateSRR: {forwarder.RULE_ID_TYPE_SRR, ie.SRRID},
+	ie.RemoveSRR: {forwarder.RULE_ID_TYPE_SRR, ie.SRRID},
+
+	ie.UpdateBARWithinSessionModificationRequest: {ie.RuleIDTypeBAR, ie.BARID},
+}
+
+// ruleError returns err, one of the Err* errors, for the rule of req with
+// its Rule ID, and with the Offending IE for a missing or incorrect IE.
+// cause is the error of the forwarder, if any.
+func ruleError(req *ie.IE, err, cause error) error {
+	if cause != nil {
+		err = errors.Wrap(err, cause.Error())
+	}
+	r, ok := ruleIDs[req.Type]
+	if !ok {
+		return err
+	}
+
+	var id *uint32
+	for _, x := range req.ChildIEs {
+		if x.Type != r.id {
+			continue
+		}
+		if v, err1 := ruleIDValue(x); err1 == nil {
+			id = &v
+		}
+		break
+	}
+	if id != nil {
+		err = &forwarder.RuleError{Type: r.typ, ID: *id, Err: err}
+	}
+
+	if !errors.Is(err, ErrMissingMandatoryIE) && !errors.Is(err, ErrMissingConditionalIE) {
+		return err
+	}
+	offending := forwarder.OffendingIE(cause)
+	switch {
+	case offending != 0:
+	case id == nil:
+		offending = r.id
+	default:
+		offending = req.Type
+	}
+	return &forwarder.IEError{Type: offending, Err: err}
+}
+
+func ruleIDValue(i *ie.IE) (uint32, error) {
+	switch i.Type {
+	case ie.PDRID:
+		v, err := i.PDRID()
+		return uint32(v), err
+	case ie.FARID:
+		return i.FARID()
+	case ie.QERID:
+		return i.QERID()
+	case ie.URRID:
+		return i.URRID()
+	case ie.BARID:
+		v, err := i.BARID()
+		return uint32(v), err
+	case ie.SRRID:
+		v, err := i.SRRID()
+		return uint32(v), err
+	default:
+		return 0, errors.Errorf("ruleIDValue: IE type %d", i.Type)
+	}
+}
+
+// failureIEs returns the IEs a session response rejected with cause
+// reports of err: the Offending IE of a missing or incorrect IE, and the
+// Failed Rule ID of a rule creation or modification failure
+func failureIEs(cause uint8, err error) []*ie.IE {
+	var ies []*ie.IE
+	switch cause {
+	case ie.CauseMandatoryIEMissing,
+		ie.CauseConditionalIEMissing,
+		ie.CauseInvalidLength,
+		ie.CauseMandatoryIEIncorrect:
+		if t := forwarder.OffendingIE(err); t != 0 {
+			ies = append(ies, ie.NewOffendingIE(t))
+		}
+	case ie.CauseRuleCreationModificationFailure:
+		var e *forwarder.RuleError
+		if errors.As(err, &e) {
+			ies = append(ies, newIeFailedRuleID(e.Type, e.ID))
+		}
+	}
+	return ies
+}
+
+func newIeFailedRuleID(typ uint8, id uint32) *ie.IE {
+	if typ == forwarder.RULE_ID_TYPE_SRR {
+		return ie.New(ie.FailedRuleID, []byte{typ, uint8(id)})
+	}
+	return ie.NewFailedRuleID(typ, id)
+}
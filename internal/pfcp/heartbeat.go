@@ -7,6 +7,27 @@ import (
 	"github.com/wmnsk/go-pfcp/message"
 )
 
+// serveHeartbeat answers a Heartbeat Request on the receiver goroutine,
+// ahead of the messages queued for the main goroutine, so that a backlog
+// of session requests does not let the CP function consider the UP function
+// failed. It reports whether buf was a Heartbeat Request.
+func (s *PfcpServer) serveHeartbeat(buf []byte, addr net.Addr) bool {
+	if len(buf) < 2 || buf[0]>>5 != PFCP_VERSION || buf[1] != message.MsgTypeHeartbeatRequest {
+		return false
+	}
+	if validatePfcpPacketLength(buf) != nil {
+		return false
+	}
+	req, err := message.ParseHeartbeatRequest(buf)
+	if err != nil {
+		return false
+	}
+	s.handleHeartbeatRequest(req, addr)
+	return true
+}
+
+// handleHeartbeatRequest answers without a transaction: a Heartbeat Request
+// retransmitted is answered again with the same response
 func (s *PfcpServer) handleHeartbeatRequest(req *message.HeartbeatRequest, addr net.Addr) {
 	s.log.Infoln("handleHeartbeatRequest")
 
@@ -15,7 +36,13 @@ func (s *PfcpServer) handleHeartbeatRequest(req *message.HeartbeatRequest, addr
 		ie.NewRecoveryTimeStamp(s.recoveryTime),
 	)
 
-	err := s.sendRspTo(rsp, addr)
+	b := make([]byte, rsp.MarshalLen())
+	err := rsp.MarshalTo(b)
+	if err != nil {
+		s.log.Errorln(err)
+		return
+	}
+	err = s.writeTo(b, addr)
 	if err != nil {
 		s.log.Errorln(err)
 		return
@@ -0,0 +1,40 @@
+package pfcp
+
+import (
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"github.com/wmnsk/go-pfcp/ie"
+	"github.com/wmnsk/go-pfcp/message"
+
+	"github.com/free5gc/go-upf/internal/forwarder"
+)
+
+func TestServeHeartbeat(t *testing.T) {
+	s, _, peer := newUDPTestServer(t, forwarder.Empty{})
+	s.recoveryTime = time.Unix(1700000000, 0)
+
+	req, err := message.NewHeartbeatRequest(7, ie.NewRecoveryTimeStamp(time.Now()), nil).Marshal()
+	require.NoError(t, err)
+	assert.True(t, s.serveHeartbeat(req, peer.LocalAddr()))
+
+	err = peer.SetReadDeadline(time.Now().Add(100 * time.Millisecond))
+	require.NoError(t, err)
+	b := make([]byte, MAX_PFCP_MSG_LEN)
+	n, _, err := peer.ReadFrom(b)
+	require.NoError(t, err)
+	rsp, err := message.ParseHeartbeatResponse(b[:n])
+	require.NoError(t, err)
+	assert.Equal(t, uint32(7), rsp.Sequence())
+	ts, err := rsp.RecoveryTimeStamp.RecoveryTimeStamp()
+	require.NoError(t, err)
+	assert.True(t, s.recoveryTime.Equal(ts))
+
+	// the other messages are left to the main goroutine
+	mod, err := message.NewSessionModificationRequest(0, 0, 1, 8, 0).Marshal()
+	require.NoError(t, err)
+	assert.False(t, s.serveHeartbeat(mod, peer.LocalAddr()))
+	assert.False(t, s.serveHeartbeat(req[:len(req)-1], peer.LocalAddr()))
+}
@@ -0,0 +1,122 @@
+package pfcp
+
+import (
+	"net"
+	"time"
+
+	"github.com/pkg/errors"
+	"github.com/wmnsk/go-pfcp/ie"
+	"github.com/wmnsk/go-pfcp/message"
+
+	"github.com/free5gc/go-upf/internal/report"
+)
+
+// inactivityTimer supervises the User Plane Inactivity Timer of a session
+type inactivityTimer struct {
+	timeout  time.Duration
+	timer    *time.Timer
+	last     time.Time // last activity seen
+	reported bool
+}
+
+func (s *Sess) stopInactivityTimer() {
+	if s.inactivity == nil {
+		return
+	}
+	s.inactivity.timer.Stop()
+	s.inactivity = nil
+}
+
+// setInactivityTimer (re)starts the inactivity timer of the session;
+// a zero timeout stops it
+func (s *PfcpServer) setInactivityTimer(sess *Sess, i *ie.IE) error {
+	timeout, err := i.UserPlaneInactivityTimer()
+	if err != nil {
+		return errors.Wrap(err, "setInactivityTimer")
+	}
+
+	sess.stopInactivityTimer()
+	if timeout == 0 {
+		sess.log.Infoln("User Plane Inactivity Timer stopped")
+		return nil
+	}
+
+	sess.log.Infof("User Plane Inactivity Timer started: %v", timeout)
+	// the first sample of the PDR counters, the next ones are compared with
+	sess.lastActivity()
+	lSeid := sess.LocalID
+	sess.inactivity = &inactivityTimer{
+		timeout: timeout,
+		last:    time.Now(),
+		timer: time.AfterFunc(timeout, func() {
+			s.NotifySessReport(report.SessReport{
+				SEID:    lSeid,
+				Reports: []report.Report{report.UPIRReport{}},
+			})
+		}),
+	}
+	return nil
+}
+
+// lastActivity returns the last user plane activity the forwarder saw on
+// the PDRs of the session
+func (s *Sess) lastActivity() time.Time {
+	pdrids := make([]uint16, 0, len(s.PDRIDs))
+	for id := range s.PDRIDs {
+		pdrids = append(pdrids, id)
+	}
+	return s.rnode.driver.LastActivity(s.LocalID, pdrids)
+}
+
+func (s *PfcpServer) stopInactivityTimers() {
+	for _, sess := range s.lnode.sess {
+		if sess != nil {
+			sess.stopInactivityTimer()
+		}
+	}
+}
+
+// checkInactivity is called when the inactivity timer of the session fires.
+// The session is reported as inactive once if no user plane activity is seen
+// by the forwarder during the timeout; the timer is then rearmed to detect
+// the traffic resuming.
+func (s *PfcpServer) checkInactivity(addr net.Addr, sess *Sess) error {
+	t := sess.inactivity
+	if t == nil {
+		// stale timeout of a stopped timer
+		return nil
+	}
+
+	if last := sess.lastActivity(); last.After(t.last) {
+		t.last = last
+		t.reported = false
+	}
+
+	idle := time.Since(t.last)
+	if idle < t.timeout {
+		t.timer.Reset(t.timeout - idle)
+		return nil
+	}
+	t.timer.Reset(t.timeout)
+	if t.reported {
+		return nil
+	}
+	t.reported = true
+	return s.serveUPIReport(addr, sess)
+}
+
+func (s *PfcpServer) serveUPIReport(addr net.Addr, sess *Sess) error {
+	sess.log.Infoln("serveUPIReport")
+
+	req := message.NewSessionReportRequest(
+		0,
+		0,
+		sess.RemoteID,
+		0,
+		0,
+		ie.NewReportType(1, 0, 0, 0),
+	)
+
+	err := s.sendSessReport(sess, req, addr, nil)
+	return errors.Wrap(err, "serveUPIReport")
+}
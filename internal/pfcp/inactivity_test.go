@@ -0,0 +1,127 @@
+package pfcp
+
+import (
+	"net"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"github.com/wmnsk/go-pfcp/ie"
+	"github.com/wmnsk/go-pfcp/message"
+
+	"github.com/free5gc/go-upf/internal/forwarder"
+	"github.com/free5gc/go-upf/internal/logger"
+	"github.com/free5gc/go-upf/internal/report"
+	"github.com/free5gc/go-upf/pkg/factory"
+	logger_util "github.com/free5gc/util/logger"
+)
+
+type activityDriver struct {
+	forwarder.Empty
+	last time.Time
+}
+
+func (d *activityDriver) LastActivity(uint64, []uint16) time.Time {
+	return d.last
+}
+
+// newUDPTestServer returns a server sending to a peer which stands for the SMF
+func newUDPTestServer(t testing.TB, driver forwarder.Driver) (*PfcpServer, *RemoteNode, *net.UDPConn) {
+	conn, err := net.ListenUDP("udp4", &net.UDPAddr{IP: net.IPv4(127, 0, 0, 1)})
+	require.NoError(t, err)
+	peer, err := net.ListenUDP("udp4", &net.UDPAddr{IP: net.IPv4(127, 0, 0, 1)})
+	require.NoError(t, err)
+
+	s := &PfcpServer{
+		cfg: &factory.Config{
+			Pfcp: &factory.Pfcp{
+				RetransTimeout: time.Hour,
+				PeerPorts: map[string]uint16{
+					"127.0.0.1": uint16(peer.LocalAddr().(*net.UDPAddr).Port),
+				},
+			},
+		},
+		conn:    conn,
+		srCh:    make(chan report.SessReport, REPORT_CHANNEL_LEN),
+		txTrans: make(map[string]*TxTransaction),
+		log:     logger.PfcpLog.WithField(logger_util.FieldListenAddr, conn.LocalAddr().String()),
+	}
+	rnode := NewRemoteNode(
+		"127.0.0.1",
+		peer.LocalAddr(),
+		&s.lnode,
+		driver,
+		s.log.WithField(logger_util.FieldControlPlaneNodeID, "127.0.0.1"),
+	)
+	t.Cleanup(func() {
+		s.stopTrTimers()
+		conn.Close()
+		peer.Close()
+	})
+	return s, rnode, peer
+}
+
+// recvSessReportReq receives a Session Report Request sent to the peer
+func recvSessReportReq(t *testing.T, peer *net.UDPConn) (*message.SessionReportRequest, bool) {
+	err := peer.SetReadDeadline(time.Now().Add(100 * time.Millisecond))
+	require.NoError(t, err)
+	b := make([]byte, MAX_PFCP_MSG_LEN)
+	n, _, err := peer.ReadFrom(b)
+	if err != nil {
+		return nil, false
+	}
+	msg, err := message.ParseSessionReportRequest(b[:n])
+	require.NoError(t, err)
+	return msg, true
+}
+
+func TestCheckInactivity(t *testing.T) {
+	driver := &activityDriver{}
+	s, rnode, peer := newUDPTestServer(t, driver)
+	sess := rnode.NewSess(0x1efce)
+	err := s.setInactivityTimer(sess, ie.NewUserPlaneInactivityTimer(time.Hour))
+	require.NoError(t, err)
+	defer sess.stopInactivityTimer()
+
+	recvReportType := func() (uint8, bool) {
+		msg, ok := recvSessReportReq(t, peer)
+		if !ok {
+			return 0, false
+		}
+		rt, err := msg.ReportType.ReportType()
+		require.NoError(t, err)
+		return rt, true
+	}
+
+	t.Run("active session is not reported", func(t *testing.T) {
+		driver.last = time.Now()
+		err := s.checkInactivity(peer.LocalAddr(), sess)
+		assert.NoError(t, err)
+		_, ok := recvReportType()
+		assert.False(t, ok)
+	})
+
+	t.Run("inactive session is reported once", func(t *testing.T) {
+		sess.inactivity.last = time.Now().Add(-2 * time.Hour)
+		driver.last = time.Time{}
+
+		err := s.checkInactivity(peer.LocalAddr(), sess)
+		assert.NoError(t, err)
+		rt, ok := recvReportType()
+		assert.True(t, ok)
+		assert.Equal(t, uint8(0x08), rt)
+
+		err = s.checkInactivity(peer.LocalAddr(), sess)
+		assert.NoError(t, err)
+		_, ok = recvReportType()
+		assert.False(t, ok)
+	})
+
+	t.Run("zero timeout stops the timer", func(t *testing.T) {
+		err := s.setInactivityTimer(sess, ie.NewUserPlaneInactivityTimer(0))
+		assert.NoError(t, err)
+		assert.Nil(t, sess.inactivity)
+		assert.NoError(t, s.checkInactivity(peer.LocalAddr(), sess))
+	})
+}
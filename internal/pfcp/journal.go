@@ -0,0 +1,44 @@
+package pfcp
+
+import (
+	"github.com/wmnsk/go-pfcp/ie"
+
+	"github.com/free5gc/go-upf/internal/journal"
+	"github.com/free5gc/go-upf/internal/report"
+)
+
+// SetJournal sets the journal the usage reports are recorded to
+func (s *PfcpServer) SetJournal(j *journal.Journal) {
+	s.journal = j
+}
+
+// recordUsage records a usage report of a session sent to the SMF
+func (s *PfcpServer) recordUsage(sess *Sess, r report.USAReport) {
+	if s.journal == nil {
+		return
+	}
+	rec := journal.NewRecord(r)
+	rec.NodeID = sess.rnode.ID
+	rec.SEID = sess.LocalID
+	rec.CPSEID = sess.RemoteID
+	if sess.ueIP != nil {
+		rec.UEIP = sess.ueIP.String()
+	}
+	if err := s.journal.Write(rec); err != nil {
+		sess.log.Errorf("record usage of URR[%#x]: %v", r.URRID, err)
+	}
+}
+
+// setUEIP keeps the UE IP address of a PDI of the session, the IPv4 one if
+// any
+func (s *Sess) setUEIP(f *ie.UEIPAddressFields) {
+	if f == nil {
+		return
+	}
+	switch {
+	case f.IPv4Address != nil && !f.IPv4Address.IsUnspecified():
+		s.ueIP = f.IPv4Address
+	case f.IPv6Address != nil && !f.IPv6Address.IsUnspecified() && s.ueIP == nil:
+		s.ueIP = f.IPv6Address
+	}
+}
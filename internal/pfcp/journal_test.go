@@ -0,0 +1,103 @@
+package pfcp
+
+import (
+	"net"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"github.com/wmnsk/go-pfcp/ie"
+	"github.com/wmnsk/go-pfcp/message"
+
+	"github.com/free5gc/go-upf/internal/forwarder"
+	"github.com/free5gc/go-upf/internal/journal"
+	"github.com/free5gc/go-upf/internal/report"
+	"github.com/free5gc/go-upf/pkg/factory"
+)
+
+func TestUsageJournal(t *testing.T) {
+	s, rnode, peer := newUDPTestServer(t, forwarder.Empty{})
+	path := filepath.Join(t.TempDir(), "usage.csv")
+	j, err := journal.Open(&factory.UsageJournal{File: path})
+	require.NoError(t, err)
+	s.SetJournal(j)
+
+	sess := rnode.NewSess(0x10)
+	sess.URRIDs[1] = &URRInfo{SEQN: 4}
+	sess.setUEIP(&ie.UEIPAddressFields{IPv4Address: net.IPv4(10, 60, 0, 1)})
+
+	err = s.serveUSAReport(peer.LocalAddr(), sess.LocalID, []report.USAReport{{
+		URRID:        1,
+		USARTrigger:  report.UsageReportTrigger{Flags: report.USAR_TRIG_PERIO},
+		VolumMeasure: report.VolumeMeasure{TotalVolume: 1000},
+		EndTime:      time.Now(),
+	}})
+	require.NoError(t, err)
+	_, ok := readMsg(t, peer).(*message.SessionReportRequest)
+	require.True(t, ok)
+	require.NoError(t, j.Close())
+
+	var recs []*journal.Record
+	err = journal.Query(path, journal.Filter{SEID: 0x10}, func(r *journal.Record) error {
+		recs = append(recs, r)
+		return nil
+	})
+	require.NoError(t, err)
+	require.Len(t, recs, 1)
+	assert.Equal(t, rnode.ID, recs[0].NodeID)
+	assert.Equal(t, sess.LocalID, recs[0].SEID)
+	assert.Equal(t, "10.60.0.1", recs[0].UEIP)
+	assert.Equal(t, uint32(4), recs[0].URSEQN)
+	assert.Equal(t, []string{"PERIO"}, recs[0].Triggers)
+	assert.Equal(t, uint64(1000), recs[0].TotalVolume)
+}
+
+// releaseDriver reports the final usage of URR 1 when a session is released
+type releaseDriver struct {
+	forwarder.Empty
+}
+
+func (releaseDriver) ExecuteModificationPlan(plan *forwarder.ModificationPlan) (*forwarder.ExecutionResult, error) {
+	if !plan.Release {
+		return nil, nil
+	}
+	return &forwarder.ExecutionResult{USAReports: []report.USAReport{{
+		URRID:        1,
+		VolumMeasure: report.VolumeMeasure{TotalVolume: 300},
+		EndTime:      time.Now(),
+	}}}, nil
+}
+
+func TestUsageJournalReset(t *testing.T) {
+	s, rnode, _ := newUDPTestServer(t, releaseDriver{})
+	path := filepath.Join(t.TempDir(), "usage.csv")
+	j, err := journal.Open(&factory.UsageJournal{File: path})
+	require.NoError(t, err)
+	s.SetJournal(j)
+
+	sess := rnode.NewSess(0x20)
+	sess.URRIDs[1] = &URRInfo{SEQN: 2}
+
+	released := rnode.Reset()
+	require.Len(t, released, 1)
+	assert.Same(t, sess, released[0].sess)
+	e := s.releasedEvent(released[0].sess, released[0].usars)
+	require.NoError(t, j.Close())
+	require.Len(t, e.Usage, 1)
+	assert.Equal(t, []string{"TERMR"}, e.Usage[0].Triggers)
+	assert.Equal(t, uint64(300), e.Usage[0].TotalVolume)
+
+	var recs []*journal.Record
+	err = journal.Query(path, journal.Filter{SEID: sess.LocalID}, func(r *journal.Record) error {
+		recs = append(recs, r)
+		return nil
+	})
+	require.NoError(t, err)
+	require.Len(t, recs, 1)
+	assert.Equal(t, uint32(2), recs[0].URSEQN)
+	assert.Equal(t, []string{"TERMR"}, recs[0].Triggers)
+	assert.Equal(t, uint64(300), recs[0].TotalVolume)
+	assert.Equal(t, 0, rnode.NumSess())
+}
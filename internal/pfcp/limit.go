@@ -0,0 +1,162 @@
+package pfcp
+
+import (
+	"github.com/pkg/errors"
+	"github.com/wmnsk/go-pfcp/ie"
+
+	"github.com/free5gc/go-upf/internal/forwarder"
+	"github.com/free5gc/go-upf/pkg/factory"
+)
+
+// ResourceUsage is the usage and the limits of the resources of all
+// associations or of an association
+type ResourceUsage struct {
+	Sessions        int                    `json:"sessions"`
+	Rules           int                    `json:"rules"`
+	BufferedPackets int                    `json:"bufferedPackets"`
+	BufferedBytes   int                    `json:"bufferedBytes"`
+	Rejected        uint64                 `json:"rejected"`
+	Limits          factory.ResourceLimits `json:"limits"`
+}
+
+// Usage is the usage of the resources of the UPF
+type Usage struct {
+	Global       ResourceUsage            `json:"global"`
+	Associations map[string]ResourceUsage `json:"associations"` // key: Node ID
+}
+
+// Usage returns the usage and the limits of the resources
+func (s *PfcpServer) Usage() Usage {
+	n := &s.lnode
+	sessions := n.NumSess()
+	n.bufMu.Lock()
+	u := Usage{
+		Global: ResourceUsage{
+			Sessions:        sessions,
+			Rules:           n.NumRules(),
+			BufferedPackets: n.bufPkts,
+			BufferedBytes:   n.bufBytes,
+			Rejected:        n.rejected.Load(),
+			Limits:          n.limit,
+		},
+		Associations: make(map[string]ResourceUsage),
+	}
+	n.bufMu.Unlock()
+
+	s.nodeMu.RLock()
+	defer s.nodeMu.RUnlock()
+	for id, rnode := range s.rnodes {
+		rnode.mu.Lock()
+		u.Associations[id] = ResourceUsage{
+			Sessions:        len(rnode.sess),
+			Rules:           int(rnode.rules.Load()),
+			BufferedPackets: rnode.bufPkts,
+			BufferedBytes:   rnode.bufBytes,
+			Rejected:        rnode.rejected.Load(),
+			Limits:          rnode.limit,
+		}
+		rnode.mu.Unlock()
+	}
+	return u
+}
+
+// sessAvail reports whether a new session of the association is within
+// the limits of the association and the global ones
+func (n *RemoteNode) sessAvail() bool {
+	if l := n.local.limit.Sessions; l > 0 && n.local.NumSess() >= l {
+		n.log.Warnf("global session limit %d reached", l)
+		return false
+	}
+	if l := n.limit.Sessions; l > 0 && n.NumSess() >= l {
+		n.log.Warnf("session limit %d of the association reached", l)
+		return false
+	}
+	return true
+}
+
+// admitSess reports whether a new session of rnode is within the limits of
+// the sessions and below the load at which new sessions are rejected
+func (s *PfcpServer) admitSess(rnode *RemoteNode) bool {
+	if !rnode.sessAvail() {
+		return false
+	}
+	if s.overloaded() {
+		rnode.log.Warnf("load above %d%% reached", s.loadCtl.cfg.RejectAbove)
+		return false
+	}
+	return true
+}
+
+// rejectLimit counts a request rejected for the limits or the load
+func (n *RemoteNode) rejectLimit() {
+	n.rejected.Add(1)
+	n.local.rejected.Add(1)
+}
+
+// checkLimits checks the rules of the session after the plan, and the SDF
+// Filters of its PDRs, against the limits of its association. The error
+// reports the Rule ID of a rule exceeding the limit.
+func (s *Sess) checkLimits(plan *forwarder.ModificationPlan) error {
+	l := s.rnode.limit
+
+	exceeded := func(typ uint8, id uint32, limit int) error {
+		return &forwarder.RuleError{
+			Type: typ,
+			ID:   id,
+			Err: errors.Wrapf(ErrLimitExceeded, "%d %ss per session",
+				limit, forwarder.RuleTypeName(typ)),
+		}
+	}
+
+	if n := len(plan.CreatePDRs); l.PDRs > 0 && n > 0 &&
+		len(s.PDRIDs)+n-len(plan.RemovePDRs) > l.PDRs {
+		return exceeded(ie.RuleIDTypePDR, uint32(plan.CreatePDRs[n-1].PDRID), l.PDRs)
+	}
+	if n := len(plan.CreateFARs); l.FARs > 0 && n > 0 &&
+		len(s.FARIDs)+n-len(plan.RemoveFARs) > l.FARs {
+		return exceeded(ie.RuleIDTypeFAR, plan.CreateFARs[n-1].FARID, l.FARs)
+	}
+	if n := len(plan.CreateQERs); l.QERs > 0 && n > 0 &&
+		len(s.QERIDs)+n-len(plan.RemoveQERs) > l.QERs {
+		return exceeded(ie.RuleIDTypeQER, plan.CreateQERs[n-1].QERID, l.QERs)
+	}
+	if n := len(plan.CreateURRs); l.URRs > 0 && n > 0 &&
+		len(s.URRIDs)+n-len(plan.RemoveURRs) > l.URRs {
+		return exceeded(ie.RuleIDTypeURR, plan.CreateURRs[n-1].URRID, l.URRs)
+	}
+
+	if l.SDFFilters > 0 {
+		for _, pdrs := range [][]*forwarder.PDRPlan{plan.CreatePDRs, plan.UpdatePDRs} {
+			for _, p := range pdrs {
+				if sdfFilters(p.OriginalIE) > l.SDFFilters {
+					return &forwarder.RuleError{
+						Type: ie.RuleIDTypePDR,
+						ID:   uint32(p.PDRID),
+						Err:  errors.Wrapf(ErrLimitExceeded, "%d SDF Filters per PDR", l.SDFFilters),
+					}
+				}
+			}
+		}
+	}
+	return nil
+}
+
+// sdfFilters returns the number of SDF Filters of the PDI of a Create PDR
+// or an Update PDR
+func sdfFilters(pdr *ie.IE) int {
+	if pdr == nil {
+		return 0
+	}
+	var n int
+	for _, x := range pdr.ChildIEs {
+		if x.Type != ie.PDI {
+			continue
+		}
+		for _, y := range x.ChildIEs {
+			if y.Type == ie.SDFFilter {
+				n++
+			}
+		}
+	}
+	return n
+}
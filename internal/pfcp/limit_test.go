@@ -0,0 +1,123 @@
+package pfcp
+
+import (
+	"net"
+	"testing"
+
+	"github.com/pkg/errors"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"github.com/wmnsk/go-pfcp/ie"
+	"github.com/wmnsk/go-pfcp/message"
+
+	"github.com/free5gc/go-upf/internal/forwarder"
+	"github.com/free5gc/go-upf/internal/logger"
+	"github.com/free5gc/go-upf/pkg/factory"
+)
+
+func TestCheckLimits(t *testing.T) {
+	rnode := NewRemoteNode("smf1", nil, &LocalNode{}, forwarder.Empty{}, logger.PfcpLog)
+	rnode.limit = factory.ResourceLimits{PDRs: 2, FARs: 1, SDFFilters: 1}
+	sess := rnode.NewSess(1)
+	sess.PDRIDs[1] = &PDRInfo{}
+
+	plan := forwarder.NewModificationPlan(sess.LocalID)
+	plan.CreatePDRs = []*forwarder.PDRPlan{{PDRID: 2}}
+	require.NoError(t, sess.checkLimits(plan))
+
+	plan.CreatePDRs = append(plan.CreatePDRs, &forwarder.PDRPlan{PDRID: 3})
+	err := sess.checkLimits(plan)
+	require.True(t, errors.Is(err, ErrLimitExceeded))
+	cause := pfcpCauseFromError(err)
+	assert.Equal(t, ie.CauseRuleCreationModificationFailure, cause)
+	ies := failureIEs(cause, err)
+	require.Len(t, ies, 1)
+	id, err := ies[0].FailedRuleID()
+	require.NoError(t, err)
+	assert.Equal(t, uint32(3), id)
+
+	// a PDR removed by the same request makes room
+	plan.RemovePDRs = []*forwarder.PDRPlan{{PDRID: 1}}
+	require.NoError(t, sess.checkLimits(plan))
+
+	plan.CreateFARs = []*forwarder.FARPlan{{FARID: 1}, {FARID: 2}}
+	var ruleErr *forwarder.RuleError
+	require.True(t, errors.As(sess.checkLimits(plan), &ruleErr))
+	assert.Equal(t, ie.RuleIDTypeFAR, ruleErr.Type)
+	plan.CreateFARs = nil
+
+	plan.UpdatePDRs = []*forwarder.PDRPlan{{
+		PDRID: 1,
+		OriginalIE: ie.NewUpdatePDR(ie.NewPDRID(1), ie.NewPDI(
+			ie.NewSourceInterface(ie.SrcInterfaceCore),
+			ie.NewSDFFilter("permit out ip from 10.0.0.1 to assigned", "", "", "", 1),
+			ie.NewSDFFilter("permit out ip from 10.0.0.2 to assigned", "", "", "", 2),
+		)),
+	}}
+	require.True(t, errors.As(sess.checkLimits(plan), &ruleErr))
+	assert.Equal(t, ie.RuleIDTypePDR, ruleErr.Type)
+	assert.Equal(t, uint32(1), ruleErr.ID)
+}
+
+func TestBufferLimits(t *testing.T) {
+	lnode := &LocalNode{}
+	lnode.SetLimits(factory.ResourceLimits{BufferedBytes: 8})
+	rnode := NewRemoteNode("smf1", nil, lnode, forwarder.Empty{}, logger.PfcpLog)
+	rnode.limit = factory.ResourceLimits{BufferedPackets: 2}
+	sess1 := rnode.NewSess(1)
+	sess2 := rnode.NewSess(2)
+
+	sess1.Push(1, []byte{1})
+	sess1.Push(1, []byte{2})
+	// no room in sess2 to drop from within the association
+	sess2.Push(1, []byte{3})
+	assert.Equal(t, 0, sess2.Len(1))
+	assert.Equal(t, 2, rnode.bufPkts)
+
+	// the global byte limit drops the oldest packets of sess1
+	sess1.Push(1, []byte{4, 5, 6, 7, 8, 9, 10, 11})
+	assert.Equal(t, 1, sess1.Len(1))
+	assert.Equal(t, 8, lnode.bufBytes)
+	assert.Equal(t, 1, lnode.bufPkts)
+
+	rnode.DeleteSess(sess1.LocalID)
+	assert.Equal(t, 0, rnode.bufPkts)
+	assert.Equal(t, 0, rnode.bufBytes)
+	assert.Equal(t, 0, lnode.bufBytes)
+}
+
+func TestSessionLimits(t *testing.T) {
+	s, rnode, peer := newUDPTestServer(t, forwarder.Empty{})
+	s.nodeID = "127.0.0.8"
+	s.rxTrans = make(map[string]*RxTransaction)
+	s.rnodes = map[string]*RemoteNode{rnode.ID: rnode}
+	s.lnode.SetLimits(factory.ResourceLimits{Sessions: 2})
+	rnode.limit = factory.ResourceLimits{Sessions: 1}
+	smf := peer.LocalAddr()
+
+	establish := func(seq uint32) uint8 {
+		req := message.NewSessionEstablishmentRequest(0, 0, 0, seq, 0,
+			ie.NewNodeID(rnode.ID, "", ""),
+			ie.NewFSEID(uint64(seq), net.IPv4(127, 0, 0, 1), nil),
+		)
+		rx := NewRxTransaction(s, smf, seq)
+		s.rxTrans[rx.id] = rx
+		s.handleSessionEstablishmentRequest(req, smf)
+		rsp, ok := readMsg(t, peer).(*message.SessionEstablishmentResponse)
+		require.True(t, ok)
+		cause, err := rsp.Cause.Cause()
+		require.NoError(t, err)
+		return cause
+	}
+
+	assert.Equal(t, ie.CauseRequestAccepted, establish(1))
+	assert.Equal(t, ie.CauseNoResourcesAvailable, establish(2))
+
+	u := s.Usage()
+	assert.Equal(t, 1, u.Global.Sessions)
+	assert.Equal(t, uint64(1), u.Global.Rejected)
+	assert.Equal(t, 2, u.Global.Limits.Sessions)
+	require.Contains(t, u.Associations, rnode.ID)
+	assert.Equal(t, 1, u.Associations[rnode.ID].Sessions)
+	assert.Equal(t, uint64(1), u.Associations[rnode.ID].Rejected)
+}
@@ -0,0 +1,264 @@
+package pfcp
+
+import (
+	"bufio"
+	"os"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/pkg/errors"
+	"github.com/wmnsk/go-pfcp/ie"
+
+	"github.com/free5gc/go-upf/pkg/factory"
+)
+
+const (
+	// OVERLOAD_VALIDITY is the Period of Validity of the Overload Control
+	// Information if not configured
+	OVERLOAD_VALIDITY = 10 * time.Minute
+	// CPU_SAMPLE_INTERVAL is the shortest interval of sampling the CPU usage
+	CPU_SAMPLE_INTERVAL = time.Second
+	// OCI_FLAG_AOCI associates the Overload Control Information with the
+	// Node ID of the UP function
+	OCI_FLAG_AOCI = 0x01
+)
+
+// loadControl reports the load of the UP function to the CP functions
+// supporting the Load Control and the Overload Control features, see
+// TS 29.244 clause 6.2.3 and 6.2.4. A nil loadControl reports nothing.
+type loadControl struct {
+	cfg *factory.LoadControl
+	cpu cpuSampler
+
+	mu        sync.Mutex
+	metric    uint8
+	lciSeq    uint32
+	overload  bool
+	reduction uint8
+	ociSeq    uint32
+	ociExpiry time.Time // the OCI is sent until then after the overload ended
+}
+
+func newLoadControl(cfg *factory.LoadControl, recoveryTime time.Time) *loadControl {
+	if cfg == nil {
+		return nil
+	}
+	// the sequence numbers keep increasing over the restarts of the UPF
+	seq := uint32(recoveryTime.Unix())
+	return &loadControl{
+		cfg:    cfg,
+		lciSeq: seq,
+		ociSeq: seq,
+	}
+}
+
+func (l *loadControl) validity() time.Duration {
+	if l.cfg.OverloadValidity > 0 {
+		// the Timer IE counts in units of 2 seconds at least
+		return l.cfg.OverloadValidity.Round(2 * time.Second)
+	}
+	return OVERLOAD_VALIDITY
+}
+
+func (l *loadControl) lowWater() uint8 {
+	if l.cfg.OverloadLowWater > 0 {
+		return l.cfg.OverloadLowWater
+	}
+	return l.cfg.OverloadHighWater
+}
+
+// update records the load metric, entering the overload at the high-water
+// mark and leaving it below the low-water mark
+func (l *loadControl) update(metric uint8, now time.Time) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	if metric != l.metric {
+		l.metric = metric
+		l.lciSeq++
+	}
+
+	high := l.cfg.OverloadHighWater
+	if high == 0 {
+		return
+	}
+	switch {
+	case metric >= high:
+		l.overload = true
+	case metric < l.lowWater():
+		l.overload = false
+	}
+
+	var reduction uint8
+	if l.overload {
+		// reduce the traffic in proportion to the load above the high-water mark
+		reduction = 100
+		if high < 100 && metric < 100 {
+			reduction = uint8(max(1, (int(metric)-int(high))*100/(100-int(high))))
+		}
+		l.ociExpiry = now.Add(l.validity())
+	}
+	if reduction != l.reduction {
+		l.reduction = reduction
+		l.ociSeq++
+	}
+}
+
+// ies returns the Load Control Information and the Overload Control
+// Information for a CP function supporting them
+func (l *loadControl) ies(load, ovrl bool, now time.Time) []*ie.IE {
+	if l == nil {
+		return nil
+	}
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	var ies []*ie.IE
+	if load {
+		ies = append(ies, ie.NewLoadControlInformation(
+			ie.NewSequenceNumber(l.lciSeq),
+			ie.NewMetric(l.metric),
+		))
+	}
+	// the end of the overload is reported with a reduction of 0 until the
+	// information reported during the overload expires
+	if ovrl && (l.overload || now.Before(l.ociExpiry)) {
+		ies = append(ies, ie.NewOverloadControlInformation(
+			ie.NewSequenceNumber(l.ociSeq),
+			ie.NewMetric(l.reduction),
+			ie.NewTimer(l.validity()),
+			ie.NewOCIFlags(OCI_FLAG_AOCI),
+		))
+	}
+	return ies
+}
+
+// rejects reports whether the load is above the limit of new sessions
+func (l *loadControl) rejects() bool {
+	if l == nil || l.cfg.RejectAbove == 0 {
+		return false
+	}
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	return l.metric > l.cfg.RejectAbove
+}
+
+// load returns the load of the UP function in percent: the most loaded of
+// the sessions, the rules, the queues of the session workers and the CPU
+func (s *PfcpServer) load(now time.Time) uint8 {
+	cfg := s.loadCtl.cfg
+	var load int
+	if cfg.MaxSessions > 0 {
+		load = max(load, s.lnode.NumSess()*100/cfg.MaxSessions)
+	}
+	if cfg.MaxRules > 0 {
+		load = max(load, s.lnode.NumRules()*100/cfg.MaxRules)
+	}
+	load = max(load, s.workers.load())
+	if cfg.CPU {
+		cpu, err := s.loadCtl.cpu.usage(now)
+		if err != nil {
+			s.log.Debugf("load: %v", err)
+		}
+		load = max(load, int(cpu))
+	}
+	return uint8(min(load, 100))
+}
+
+// loadIEs updates the load and returns the Load Control Information and
+// the Overload Control Information for the CP function of rnode
+func (s *PfcpServer) loadIEs(rnode *RemoteNode) []*ie.IE {
+	if s.loadCtl == nil || rnode == nil {
+		return nil
+	}
+	now := time.Now()
+	s.loadCtl.update(s.load(now), now)
+	return s.loadCtl.ies(rnode.cpLoad, rnode.cpOverload, now)
+}
+
+// setLoadIEs sets the load IEs for the CP function of rnode in the fields
+// of a session response
+func (s *PfcpServer) setLoadIEs(lci, oci **ie.IE, rnode *RemoteNode) {
+	for _, i := range s.loadIEs(rnode) {
+		switch i.Type {
+		case ie.LoadControlInformation:
+			*lci = i
+		case ie.OverloadControlInformation:
+			*oci = i
+		}
+	}
+}
+
+// overloaded reports whether new sessions are rejected for the load
+func (s *PfcpServer) overloaded() bool {
+	if s.loadCtl == nil {
+		return false
+	}
+	now := time.Now()
+	s.loadCtl.update(s.load(now), now)
+	return s.loadCtl.rejects()
+}
+
+// cpuSampler samples the CPU usage of the node from /proc/stat
+type cpuSampler struct {
+	mu          sync.Mutex
+	last        time.Time
+	busy, total uint64
+	pct         uint8
+}
+
+// usage returns the CPU usage in percent since the previous sample, which
+// is kept if sampled less than CPU_SAMPLE_INTERVAL ago
+func (c *cpuSampler) usage(now time.Time) (uint8, error) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if !c.last.IsZero() && now.Sub(c.last) < CPU_SAMPLE_INTERVAL {
+		return c.pct, nil
+	}
+	busy, total, err := readCPUStat()
+	if err != nil {
+		return c.pct, err
+	}
+	if !c.last.IsZero() && total > c.total {
+		c.pct = uint8((busy - c.busy) * 100 / (total - c.total))
+	}
+	c.last = now
+	c.busy, c.total = busy, total
+	return c.pct, nil
+}
+
+// readCPUStat returns the busy and the total CPU time of the node
+func readCPUStat() (busy, total uint64, err error) {
+	f, err := os.Open("/proc/stat")
+	if err != nil {
+		return 0, 0, errors.Wrap(err, "readCPUStat")
+	}
+	defer f.Close()
+
+	sc := bufio.NewScanner(f)
+	if !sc.Scan() {
+		return 0, 0, errors.New("readCPUStat: empty /proc/stat")
+	}
+	fields := strings.Fields(sc.Text())
+	if len(fields) < 5 || fields[0] != "cpu" {
+		return 0, 0, errors.Errorf("readCPUStat: unexpected line %q", sc.Text())
+	}
+	// user nice system idle iowait irq softirq steal; guest is in user
+	if len(fields) > 9 {
+		fields = fields[:9]
+	}
+	for i, f := range fields[1:] {
+		v, err := strconv.ParseUint(f, 10, 64)
+		if err != nil {
+			return 0, 0, errors.Wrapf(err, "readCPUStat: field %d", i+1)
+		}
+		total += v
+		// idle and iowait
+		if i != 3 && i != 4 {
+			busy += v
+		}
+	}
+	return busy, total, nil
+}
@@ -0,0 +1,145 @@
+package pfcp
+
+import (
+	"net"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"github.com/wmnsk/go-pfcp/ie"
+	"github.com/wmnsk/go-pfcp/message"
+
+	"github.com/free5gc/go-upf/internal/forwarder"
+	"github.com/free5gc/go-upf/internal/logger"
+	"github.com/free5gc/go-upf/pkg/factory"
+)
+
+func TestLoadControlUpdate(t *testing.T) {
+	now := time.Unix(1000, 0)
+	l := newLoadControl(&factory.LoadControl{
+		OverloadHighWater: 80,
+		OverloadLowWater:  70,
+		OverloadValidity:  time.Minute,
+	}, now)
+
+	oci := func(ies []*ie.IE) (uint32, uint8, bool) {
+		for _, i := range ies {
+			if i.Type != ie.OverloadControlInformation {
+				continue
+			}
+			seq, err := i.SequenceNumber()
+			require.NoError(t, err)
+			metric, err := i.Metric()
+			require.NoError(t, err)
+			return seq, metric, true
+		}
+		return 0, 0, false
+	}
+
+	l.update(50, now)
+	ies := l.ies(true, true, now)
+	require.Len(t, ies, 1)
+	seq, err := ies[0].SequenceNumber()
+	require.NoError(t, err)
+	assert.Equal(t, uint32(1001), seq)
+	metric, err := ies[0].Metric()
+	require.NoError(t, err)
+	assert.Equal(t, uint8(50), metric)
+
+	l.update(90, now)
+	seq, reduction, ok := oci(l.ies(true, true, now))
+	require.True(t, ok)
+	assert.Equal(t, uint32(1001), seq)
+	assert.Equal(t, uint8(50), reduction)
+	assert.Empty(t, l.ies(false, false, now))
+
+	// still overloaded above the low-water mark
+	l.update(75, now)
+	_, reduction, ok = oci(l.ies(false, true, now))
+	require.True(t, ok)
+	assert.Equal(t, uint8(1), reduction)
+
+	// the end of the overload is reported until the validity expires
+	l.update(60, now)
+	seq, reduction, ok = oci(l.ies(false, true, now))
+	require.True(t, ok)
+	assert.Equal(t, uint32(1003), seq)
+	assert.Equal(t, uint8(0), reduction)
+	_, _, ok = oci(l.ies(false, true, now.Add(time.Minute)))
+	assert.False(t, ok)
+
+	assert.False(t, l.rejects())
+	assert.Nil(t, (*loadControl)(nil).ies(true, true, now))
+}
+
+func TestSessionLoadControl(t *testing.T) {
+	s, rnode, peer := newUDPTestServer(t, forwarder.Empty{})
+	s.nodeID = "127.0.0.8"
+	s.rxTrans = make(map[string]*RxTransaction)
+	s.rnodes = map[string]*RemoteNode{rnode.ID: rnode}
+	s.loadCtl = newLoadControl(&factory.LoadControl{
+		MaxSessions:       2,
+		OverloadHighWater: 50,
+		RejectAbove:       90,
+	}, time.Now())
+	rnode.cpLoad = true
+	rnode.cpOverload = true
+	smf := peer.LocalAddr()
+
+	establish := func(seq uint32) *message.SessionEstablishmentResponse {
+		req := message.NewSessionEstablishmentRequest(0, 0, 0, seq, 0,
+			ie.NewNodeID(rnode.ID, "", ""),
+			ie.NewFSEID(uint64(seq), net.IPv4(127, 0, 0, 1), nil),
+		)
+		rx := NewRxTransaction(s, smf, seq)
+		s.rxTrans[rx.id] = rx
+		s.handleSessionEstablishmentRequest(req, smf)
+		rsp, ok := readMsg(t, peer).(*message.SessionEstablishmentResponse)
+		require.True(t, ok)
+		return rsp
+	}
+	metric := func(i *ie.IE) uint8 {
+		require.NotNil(t, i)
+		v, err := i.Metric()
+		require.NoError(t, err)
+		return v
+	}
+
+	rsp := establish(1)
+	cause, err := rsp.Cause.Cause()
+	require.NoError(t, err)
+	assert.Equal(t, ie.CauseRequestAccepted, cause)
+	assert.Equal(t, uint8(50), metric(rsp.LoadControlInformation))
+	assert.Equal(t, uint8(1), metric(rsp.OverloadControlInformation))
+
+	rsp = establish(2)
+	assert.Equal(t, uint8(100), metric(rsp.LoadControlInformation))
+	assert.Equal(t, uint8(100), metric(rsp.OverloadControlInformation))
+
+	rsp = establish(3)
+	cause, err = rsp.Cause.Cause()
+	require.NoError(t, err)
+	assert.Equal(t, ie.CauseNoResourcesAvailable, cause)
+	assert.Equal(t, uint8(100), metric(rsp.LoadControlInformation))
+	assert.Equal(t, 2, s.lnode.NumSess())
+	assert.Equal(t, uint64(1), rnode.rejected.Load())
+}
+
+func TestLocalNodeRules(t *testing.T) {
+	var n LocalNode
+	rnode := NewRemoteNode("127.0.0.1", nil, &n, forwarder.Empty{}, logger.PfcpLog)
+	sess := rnode.NewSess(1)
+	sess.PDRIDs[1] = &PDRInfo{}
+	sess.FARIDs[1] = struct{}{}
+	n.syncRules(sess)
+	assert.Equal(t, 2, n.NumRules())
+
+	delete(sess.FARIDs, 1)
+	n.syncRules(sess)
+	assert.Equal(t, 1, n.NumRules())
+
+	rnode.DeleteSess(sess.LocalID)
+	assert.Equal(t, 0, n.NumRules())
+	assert.Equal(t, 0, n.NumSess())
+}
@@ -3,6 +3,10 @@ package pfcp
 import (
 	"fmt"
 	"net"
+	"slices"
+	"sync"
+	"sync/atomic"
+	"time"
 
 	"github.com/pkg/errors"
 	"github.com/sirupsen/logrus"
@@ -10,15 +14,23 @@ import (
 
 	"github.com/free5gc/go-upf/internal/forwarder"
 	"github.com/free5gc/go-upf/internal/report"
+	"github.com/free5gc/go-upf/pkg/factory"
 	logger_util "github.com/free5gc/util/logger"
 )
 
-const (
-	BUFFQ_LEN = 512
-)
-
 type PDRInfo struct {
 	RelatedURRIDs map[uint32]struct{}
+	QERIDs        []uint32
+	FARID         uint32
+	// FAR ID of the PDR switched to the FAR ID for Quota Action of the URR
+	// quotaURRID, restored when the URR is granted a new quota
+	restoreFARID *uint32
+	quotaURRID   uint32
+}
+
+type QERInfo struct {
+	QFI *uint8
+	PPI *uint8
 }
 
 type URRInfo struct {
@@ -27,20 +39,50 @@ type URRInfo struct {
 	report.MeasureMethod
 	report.MeasureInformation
 	refPdrNum uint16
+
+	RptTrig            report.ReportingTrigger
+	DroppedDLThreshold report.DroppedDLThreshold
+	EventThreshold     uint32
+	EventQuota         uint32
+	LinkedURRIDs       []uint32
+	droppedDLPkts      uint64
+	droppedDLBytes     uint64
+	dropped            report.VolumeMeasure // by the UPF, not measured by the forwarder
+	events             uint32
+	quotaEvents        uint32
+	startTime          time.Time
+	EthInactivity      time.Duration
+	macs               map[string]time.Time // key: MAC address learnt, value: last seen
+	QuotaFARID         *uint32              // FAR ID for Quota Action
+	TimeQuota          time.Duration
+	timeQuota          *time.Timer
+	timeQuotaGen       uint32
+	timeUsed           time.Duration // of the Time Quota
+	timeChecked        time.Time     // last measure of the time used
 }
 
 type Sess struct {
 	rnode    *RemoteNode
 	LocalID  uint64
 	RemoteID uint64
-	PDRIDs   map[uint16]*PDRInfo    // key: PDR_ID
-	FARIDs   map[uint32]struct{}    // key: FAR_ID
-	QERIDs   map[uint32]struct{}    // key: QER_ID
-	URRIDs   map[uint32]*URRInfo    // key: URR_ID
-	BARIDs   map[uint8]struct{}     // key: BAR_ID
-	q        map[uint16]chan []byte // key: PDR_ID
-	qlen     int
+	PDRIDs   map[uint16]*PDRInfo // key: PDR_ID
+	FARIDs   map[uint32]struct{} // key: FAR_ID
+	QERIDs   map[uint32]*QERInfo // key: QER_ID
+	URRIDs   map[uint32]*URRInfo // key: URR_ID
+	BARIDs   map[uint8]struct{}  // key: BAR_ID
+	SRRIDs   map[uint8]*SRRInfo  // key: SRR_ID
+	ueIP     net.IP              // for the usage journal
+	buf      buffer
+	rules    int // accounted in the LocalNode
 	log      *logrus.Entry
+
+	inactivity  *inactivityTimer
+	macAging    *time.Timer
+	qosProbe    *time.Timer
+	qosProbeGen uint32
+
+	dropSample    *time.Timer
+	dropSampleGen uint32
 }
 
 var (
@@ -49,10 +91,12 @@ var (
 	ErrRuleNotFound                   = errors.New("rule not found")
 	ErrRuleCreationModificationFailed = errors.New("rule creation/modification failed")
 	ErrMutualExclusionConflict        = errors.New("conflicting operations on same rule")
+	ErrLimitExceeded                  = errors.New("resource limit exceeded")
 )
 
 func (s *Sess) Close() []report.USAReport {
 	plan := forwarder.NewModificationPlan(s.LocalID)
+	plan.Release = true
 
 	// Build Remove plans for all rules
 	for id := range s.FARIDs {
@@ -119,9 +163,6 @@ func (s *Sess) Close() []report.USAReport {
 	for _, p := range plan.RemoveBARs {
 		s.ApplyRemoveBAR(p)
 	}
-	for _, p := range plan.RemoveURRs {
-		s.ApplyRemoveURR(p)
-	}
 	for _, p := range plan.RemoveQERs {
 		s.ApplyRemoveQER(p)
 	}
@@ -136,10 +177,19 @@ func (s *Sess) Close() []report.USAReport {
 		}
 		usars = append(usars, execResult.USAReports...)
 	}
-
-	for _, q := range s.q {
-		close(q)
+	// The URRs linked to the reported ones are reported before they are
+	// removed
+	usars = s.linkUSAReports(usars)
+	for _, p := range plan.RemoveURRs {
+		s.ApplyRemoveURR(p)
 	}
+
+	s.stopInactivityTimer()
+	s.stopMACAging()
+	s.stopTimeQuotas()
+	s.stopQoSMonitoring()
+	s.stopDropSample()
+	s.releaseBuffer()
 	return usars
 }
 
@@ -168,42 +218,201 @@ func (s *Sess) diassociateURR(urrid uint32) []report.USAReport {
 	return nil
 }
 
-func (s *Sess) Push(pdrid uint16, p []byte) {
-	pkt := make([]byte, len(p))
-	copy(pkt, p)
-	q, ok := s.q[pdrid]
+// queryURRReport queries the current measurement of the URR to report it
+// with the given Usage Report Trigger
+func (s *Sess) queryURRReport(urrid uint32, trigger uint32) []report.USAReport {
+	urrInfo, ok := s.URRIDs[urrid]
+	if !ok {
+		return nil
+	}
+
+	usars, err := s.rnode.driver.QueryURR(s.LocalID, urrid)
+	if err != nil {
+		s.log.Warnf("queryURRReport[%#x]: %v", urrid, err)
+	}
+	now := time.Now()
+	if len(usars) == 0 {
+		usars = []report.USAReport{
+			{
+				URRID:     urrid,
+				StartTime: urrInfo.startTime,
+				EndTime:   now,
+			},
+		}
+	}
+	urrInfo.startTime = now
+	for i := range usars {
+		usars[i].USARTrigger.Flags |= trigger
+	}
+	return usars
+}
+
+// linkUSAReports appends a usage report with the Linked Usage Reporting
+// trigger for every URR linked to a URR being reported; the linked usage
+// report shares the start/end time of the report which triggered it
+func (s *Sess) linkUSAReports(usars []report.USAReport) []report.USAReport {
+	reported := make(map[uint32]struct{}, len(usars))
+	for _, r := range usars {
+		reported[r.URRID] = struct{}{}
+	}
+
+	n := len(usars)
+	for i := 0; i < n; i++ {
+		r := usars[i]
+		for urrid, urrInfo := range s.URRIDs {
+			if urrInfo.removed || !urrInfo.RptTrig.LIUSA() {
+				continue
+			}
+			if _, ok := reported[urrid]; ok {
+				continue
+			}
+			if !slices.Contains(urrInfo.LinkedURRIDs, r.URRID) {
+				continue
+			}
+			reported[urrid] = struct{}{}
+			for _, lr := range s.queryURRReport(urrid, report.USAR_TRIG_LIUSA) {
+				lr.StartTime = r.StartTime
+				lr.EndTime = r.EndTime
+				usars = append(usars, lr)
+			}
+		}
+	}
+	return usars
+}
+
+// pdrQoS returns the QoS applied to the packets of the PDR, from the QFI and
+// the Paging Policy Indicator of its QERs
+func (s *Sess) pdrQoS(pdrid uint16) pktQoS {
+	var qos pktQoS
+	pdrInfo, ok := s.PDRIDs[pdrid]
 	if !ok {
-		s.q[pdrid] = make(chan []byte, s.qlen)
-		q = s.q[pdrid]
+		return qos
 	}
 
-	select {
-	case q <- pkt:
-		s.log.Debugf("Push bufPkt to q[%d](len:%d)", pdrid, len(q))
-	default:
-		s.log.Debugf("q[%d](len:%d) is full, drop it", pdrid, len(q))
+	for _, qerid := range pdrInfo.QERIDs {
+		qerInfo, ok := s.QERIDs[qerid]
+		if !ok {
+			continue
+		}
+		if qos.QFI == nil && qerInfo.QFI != nil {
+			qfi := *qerInfo.QFI
+			qos.QFI = &qfi
+		}
+		if qos.PPI == nil && qerInfo.PPI != nil {
+			ppi := *qerInfo.PPI
+			qos.PPI = &ppi
+		}
 	}
+	return qos
 }
 
-func (s *Sess) Len(pdrid uint16) int {
-	q, ok := s.q[pdrid]
+// dropLimited accounts a packet of the PDR the forwarder dropped for
+// exceeding the MBR: the packet counts toward the usage of the URRs of the
+// PDR, and a DL packet toward their Dropped DL Traffic Threshold
+func (s *Sess) dropLimited(pdrid uint16, n int, dl bool) []report.USAReport {
+	pdrInfo, ok := s.PDRIDs[pdrid]
 	if !ok {
-		return 0
+		return nil
+	}
+	for urrid := range pdrInfo.RelatedURRIDs {
+		urrInfo, ok := s.URRIDs[urrid]
+		if !ok || urrInfo.removed {
+			continue
+		}
+		d := &urrInfo.dropped
+		d.TotalVolume += uint64(n)
+		d.TotalPktNum++
+		if dl {
+			d.DownlinkVolume += uint64(n)
+			d.DownlinkPktNum++
+		} else {
+			d.UplinkVolume += uint64(n)
+			d.UplinkPktNum++
+		}
+	}
+	if !dl {
+		return nil
 	}
-	return len(q)
+	return s.dropDL(pdrid, 1, uint64(n))
 }
 
-func (s *Sess) Pop(pdrid uint16) ([]byte, bool) {
-	q, ok := s.q[pdrid]
+// dropDL accounts DL packets dropped on the PDR to the URRs associated
+// with it, and returns the usage reports of the URRs whose Dropped DL
+// Traffic Threshold has been reached
+func (s *Sess) dropDL(pdrid uint16, pkts, bytes uint64) []report.USAReport {
+	pdrInfo, ok := s.PDRIDs[pdrid]
 	if !ok {
-		return nil, ok
+		return nil
+	}
+
+	var usars []report.USAReport
+	for urrid := range pdrInfo.RelatedURRIDs {
+		urrInfo, ok := s.URRIDs[urrid]
+		if !ok || urrInfo.removed {
+			continue
+		}
+		urrInfo.droppedDLPkts += pkts
+		urrInfo.droppedDLBytes += bytes
+		if !urrInfo.RptTrig.DROTH() ||
+			!urrInfo.DroppedDLThreshold.Reached(urrInfo.droppedDLPkts, urrInfo.droppedDLBytes) {
+			continue
+		}
+		s.log.Infof("URR[%#x] dropped DL threshold reached: pkts(%d) bytes(%d)",
+			urrid, urrInfo.droppedDLPkts, urrInfo.droppedDLBytes)
+		urrInfo.droppedDLPkts = 0
+		urrInfo.droppedDLBytes = 0
+		usars = append(usars, s.queryURRReport(urrid, report.USAR_TRIG_DROTH)...)
+	}
+	return usars
+}
+
+// detectEvent counts an event detected on the PDR for the URRs measuring
+// events, and returns the usage reports of the URRs whose Event Threshold
+// or Event Quota has been reached.
+// The only event the UPF detects is a Downlink Data Report sent to the CP
+// function for the PDR, not each DL packet arriving while buffering.
+func (s *Sess) detectEvent(pdrid uint16) []report.USAReport {
+	pdrInfo, ok := s.PDRIDs[pdrid]
+	if !ok {
+		return nil
 	}
-	select {
-	case pkt := <-q:
-		s.log.Debugf("Pop bufPkt from q[%d](len:%d)", pdrid, len(q))
-		return pkt, true
-	default:
-		return nil, false
+
+	var usars []report.USAReport
+	for urrid := range pdrInfo.RelatedURRIDs {
+		urrInfo, ok := s.URRIDs[urrid]
+		if !ok || urrInfo.removed || !urrInfo.EVENT {
+			continue
+		}
+
+		var trigger uint32
+		urrInfo.events++
+		if urrInfo.RptTrig.EVETH() && urrInfo.EventThreshold > 0 &&
+			urrInfo.events >= urrInfo.EventThreshold {
+			trigger |= report.USAR_TRIG_EVETH
+			urrInfo.events = 0
+		}
+		if urrInfo.RptTrig.EVEQU() && urrInfo.EventQuota > 0 &&
+			urrInfo.quotaEvents < urrInfo.EventQuota {
+			urrInfo.quotaEvents++
+			if urrInfo.quotaEvents == urrInfo.EventQuota {
+				trigger |= report.USAR_TRIG_EVEQU
+			}
+		}
+		if trigger == 0 {
+			continue
+		}
+		usars = append(usars, s.queryURRReport(urrid, trigger)...)
+	}
+	return usars
+}
+
+// sealUSAReport numbers a usage report of a URR sent to the CP function, and
+// adds the usage the UPF dropped since the previous report of the URR
+func (s *Sess) sealUSAReport(r *report.USAReport) {
+	r.URSEQN = s.URRSeq(r.URRID)
+	if info, ok := s.URRIDs[r.URRID]; ok {
+		r.VolumMeasure.Add(info.dropped)
+		info.dropped = report.VolumeMeasure{}
 	}
 }
 
@@ -225,13 +434,13 @@ func (s *Sess) URRSeq(urrid uint32) uint32 {
 func (s *Sess) ValidateCreatePDR(req *ie.IE, modPlan *forwarder.ModificationPlan) (*forwarder.PDRPlan, error) {
 	plan, err := s.rnode.driver.BuildCreatePDRPlan(s.LocalID, req)
 	if err != nil {
-		return nil, ErrRuleCreationModificationFailed
+		return nil, ruleError(req, ErrRuleCreationModificationFailed, err)
 	}
 
 	// Validate URR references exist (in session state or in-flight creates)
 	for _, urrid := range plan.URRIDs {
 		if _, ok := s.URRIDs[urrid]; !ok && !modPlan.HasCreateURR(urrid) {
-			return nil, ErrRuleCreationModificationFailed
+			return nil, ruleError(req, ErrRuleCreationModificationFailed, nil)
 		}
 	}
 
@@ -242,12 +451,12 @@ func (s *Sess) ValidateCreatePDR(req *ie.IE, modPlan *forwarder.ModificationPlan
 func (s *Sess) ValidateUpdatePDR(req *ie.IE, modPlan *forwarder.ModificationPlan) (*forwarder.PDRPlan, error) {
 	plan, err := s.rnode.driver.BuildUpdatePDRPlan(s.LocalID, req)
 	if err != nil {
-		return nil, ErrMissingMandatoryIE
+		return nil, ruleError(req, ErrMissingMandatoryIE, err)
 	}
 
 	// Validate PDR exists (in session state or in-flight creates)
 	if _, ok := s.PDRIDs[plan.PDRID]; !ok && !modPlan.HasCreatePDR(plan.PDRID) {
-		return nil, ErrRuleNotFound
+		return nil, ruleError(req, ErrRuleNotFound, nil)
 	}
 
 	return plan, nil
@@ -257,12 +466,12 @@ func (s *Sess) ValidateUpdatePDR(req *ie.IE, modPlan *forwarder.ModificationPlan
 func (s *Sess) ValidateRemovePDR(req *ie.IE, modPlan *forwarder.ModificationPlan) (*forwarder.PDRPlan, error) {
 	plan, err := s.rnode.driver.BuildRemovePDRPlan(s.LocalID, req)
 	if err != nil {
-		return nil, ErrMissingMandatoryIE
+		return nil, ruleError(req, ErrMissingMandatoryIE, err)
 	}
 
 	// Validate PDR exists (in session state or in-flight creates)
 	if _, ok := s.PDRIDs[plan.PDRID]; !ok && !modPlan.HasCreatePDR(plan.PDRID) {
-		return nil, ErrRuleNotFound
+		return nil, ruleError(req, ErrRuleNotFound, nil)
 	}
 
 	return plan, nil
@@ -272,7 +481,10 @@ func (s *Sess) ValidateRemovePDR(req *ie.IE, modPlan *forwarder.ModificationPlan
 func (s *Sess) ValidateCreateFAR(req *ie.IE) (*forwarder.FARPlan, error) {
 	plan, err := s.rnode.driver.BuildCreateFARPlan(s.LocalID, req)
 	if err != nil {
-		return nil, ErrMissingMandatoryIE
+		if errors.Is(err, forwarder.ErrUnsupported) {
+			return nil, ruleError(req, ErrRuleCreationModificationFailed, err)
+		}
+		return nil, ruleError(req, ErrMissingMandatoryIE, err)
 	}
 
 	return plan, nil
@@ -282,12 +494,15 @@ func (s *Sess) ValidateCreateFAR(req *ie.IE) (*forwarder.FARPlan, error) {
 func (s *Sess) ValidateUpdateFAR(req *ie.IE, modPlan *forwarder.ModificationPlan) (*forwarder.FARPlan, error) {
 	plan, err := s.rnode.driver.BuildUpdateFARPlan(s.LocalID, req)
 	if err != nil {
-		return nil, ErrMissingMandatoryIE
+		if errors.Is(err, forwarder.ErrUnsupported) {
+			return nil, ruleError(req, ErrRuleCreationModificationFailed, err)
+		}
+		return nil, ruleError(req, ErrMissingMandatoryIE, err)
 	}
 
 	// Validate FAR exists (in session state or in-flight creates)
 	if _, ok := s.FARIDs[plan.FARID]; !ok && !modPlan.HasCreateFAR(plan.FARID) {
-		return nil, ErrRuleNotFound
+		return nil, ruleError(req, ErrRuleNotFound, nil)
 	}
 
 	return plan, nil
@@ -297,12 +512,12 @@ func (s *Sess) ValidateUpdateFAR(req *ie.IE, modPlan *forwarder.ModificationPlan
 func (s *Sess) ValidateRemoveFAR(req *ie.IE, modPlan *forwarder.ModificationPlan) (*forwarder.FARPlan, error) {
 	plan, err := s.rnode.driver.BuildRemoveFARPlan(s.LocalID, req)
 	if err != nil {
-		return nil, ErrMissingMandatoryIE
+		return nil, ruleError(req, ErrMissingMandatoryIE, err)
 	}
 
 	// Validate FAR exists (in session state or in-flight creates)
 	if _, ok := s.FARIDs[plan.FARID]; !ok && !modPlan.HasCreateFAR(plan.FARID) {
-		return nil, ErrRuleNotFound
+		return nil, ruleError(req, ErrRuleNotFound, nil)
 	}
 
 	return plan, nil
@@ -312,7 +527,7 @@ func (s *Sess) ValidateRemoveFAR(req *ie.IE, modPlan *forwarder.ModificationPlan
 func (s *Sess) ValidateCreateQER(req *ie.IE) (*forwarder.QERPlan, error) {
 	plan, err := s.rnode.driver.BuildCreateQERPlan(s.LocalID, req)
 	if err != nil {
-		return nil, ErrMissingMandatoryIE
+		return nil, ruleError(req, ErrMissingMandatoryIE, err)
 	}
 
 	return plan, nil
@@ -322,12 +537,12 @@ func (s *Sess) ValidateCreateQER(req *ie.IE) (*forwarder.QERPlan, error) {
 func (s *Sess) ValidateUpdateQER(req *ie.IE, modPlan *forwarder.ModificationPlan) (*forwarder.QERPlan, error) {
 	plan, err := s.rnode.driver.BuildUpdateQERPlan(s.LocalID, req)
 	if err != nil {
-		return nil, ErrMissingMandatoryIE
+		return nil, ruleError(req, ErrMissingMandatoryIE, err)
 	}
 
 	// Validate QER exists (in session state or in-flight creates)
 	if _, ok := s.QERIDs[plan.QERID]; !ok && !modPlan.HasCreateQER(plan.QERID) {
-		return nil, ErrRuleNotFound
+		return nil, ruleError(req, ErrRuleNotFound, nil)
 	}
 
 	return plan, nil
@@ -337,12 +552,12 @@ func (s *Sess) ValidateUpdateQER(req *ie.IE, modPlan *forwarder.ModificationPlan
 func (s *Sess) ValidateRemoveQER(req *ie.IE, modPlan *forwarder.ModificationPlan) (*forwarder.QERPlan, error) {
 	plan, err := s.rnode.driver.BuildRemoveQERPlan(s.LocalID, req)
 	if err != nil {
-		return nil, ErrMissingMandatoryIE
+		return nil, ruleError(req, ErrMissingMandatoryIE, err)
 	}
 
 	// Validate QER exists (in session state or in-flight creates)
 	if _, ok := s.QERIDs[plan.QERID]; !ok && !modPlan.HasCreateQER(plan.QERID) {
-		return nil, ErrRuleNotFound
+		return nil, ruleError(req, ErrRuleNotFound, nil)
 	}
 
 	return plan, nil
@@ -352,7 +567,7 @@ func (s *Sess) ValidateRemoveQER(req *ie.IE, modPlan *forwarder.ModificationPlan
 func (s *Sess) ValidateCreateURR(req *ie.IE) (*forwarder.URRPlan, error) {
 	plan, err := s.rnode.driver.BuildCreateURRPlan(s.LocalID, req)
 	if err != nil {
-		return nil, ErrMissingMandatoryIE
+		return nil, ruleError(req, ErrMissingMandatoryIE, err)
 	}
 
 	return plan, nil
@@ -362,12 +577,12 @@ func (s *Sess) ValidateCreateURR(req *ie.IE) (*forwarder.URRPlan, error) {
 func (s *Sess) ValidateUpdateURR(req *ie.IE, modPlan *forwarder.ModificationPlan) (*forwarder.URRPlan, error) {
 	plan, err := s.rnode.driver.BuildUpdateURRPlan(s.LocalID, req)
 	if err != nil {
-		return nil, ErrMissingMandatoryIE
+		return nil, ruleError(req, ErrMissingMandatoryIE, err)
 	}
 
 	// Validate URR exists (in session state or in-flight creates)
 	if _, ok := s.URRIDs[plan.URRID]; !ok && !modPlan.HasCreateURR(plan.URRID) {
-		return nil, ErrRuleNotFound
+		return nil, ruleError(req, ErrRuleNotFound, nil)
 	}
 
 	return plan, nil
@@ -377,12 +592,12 @@ func (s *Sess) ValidateUpdateURR(req *ie.IE, modPlan *forwarder.ModificationPlan
 func (s *Sess) ValidateRemoveURR(req *ie.IE, modPlan *forwarder.ModificationPlan) (*forwarder.URRPlan, error) {
 	plan, err := s.rnode.driver.BuildRemoveURRPlan(s.LocalID, req)
 	if err != nil {
-		return nil, ErrMissingMandatoryIE
+		return nil, ruleError(req, ErrMissingMandatoryIE, err)
 	}
 
 	// Validate URR exists (in session state or in-flight creates)
 	if _, ok := s.URRIDs[plan.URRID]; !ok && !modPlan.HasCreateURR(plan.URRID) {
-		return nil, ErrRuleNotFound
+		return nil, ruleError(req, ErrRuleNotFound, nil)
 	}
 
 	return plan, nil
@@ -392,12 +607,12 @@ func (s *Sess) ValidateRemoveURR(req *ie.IE, modPlan *forwarder.ModificationPlan
 func (s *Sess) ValidateQueryURR(req *ie.IE, modPlan *forwarder.ModificationPlan) (*forwarder.URRPlan, error) {
 	plan, err := s.rnode.driver.BuildQueryURRPlan(s.LocalID, req)
 	if err != nil {
-		return nil, ErrMissingMandatoryIE
+		return nil, ruleError(req, ErrMissingMandatoryIE, err)
 	}
 
 	// Validate URR exists (in session state or in-flight creates)
 	if _, ok := s.URRIDs[plan.QueryURRID]; !ok && !modPlan.HasCreateURR(plan.QueryURRID) {
-		return nil, ErrRuleNotFound
+		return nil, ruleError(req, ErrRuleNotFound, nil)
 	}
 
 	return plan, nil
@@ -407,7 +622,7 @@ func (s *Sess) ValidateQueryURR(req *ie.IE, modPlan *forwarder.ModificationPlan)
 func (s *Sess) ValidateCreateBAR(req *ie.IE) (*forwarder.BARPlan, error) {
 	plan, err := s.rnode.driver.BuildCreateBARPlan(s.LocalID, req)
 	if err != nil {
-		return nil, ErrMissingMandatoryIE
+		return nil, ruleError(req, ErrMissingMandatoryIE, err)
 	}
 
 	return plan, nil
@@ -417,12 +632,12 @@ func (s *Sess) ValidateCreateBAR(req *ie.IE) (*forwarder.BARPlan, error) {
 func (s *Sess) ValidateUpdateBAR(req *ie.IE, modPlan *forwarder.ModificationPlan) (*forwarder.BARPlan, error) {
 	plan, err := s.rnode.driver.BuildUpdateBARPlan(s.LocalID, req)
 	if err != nil {
-		return nil, ErrMissingMandatoryIE
+		return nil, ruleError(req, ErrMissingMandatoryIE, err)
 	}
 
 	// Validate BAR exists (in session state or in-flight creates)
 	if _, ok := s.BARIDs[plan.BARID]; !ok && !modPlan.HasCreateBAR(plan.BARID) {
-		return nil, ErrRuleNotFound
+		return nil, ruleError(req, ErrRuleNotFound, nil)
 	}
 
 	return plan, nil
@@ -432,12 +647,12 @@ func (s *Sess) ValidateUpdateBAR(req *ie.IE, modPlan *forwarder.ModificationPlan
 func (s *Sess) ValidateRemoveBAR(req *ie.IE, modPlan *forwarder.ModificationPlan) (*forwarder.BARPlan, error) {
 	plan, err := s.rnode.driver.BuildRemoveBARPlan(s.LocalID, req)
 	if err != nil {
-		return nil, ErrMissingMandatoryIE
+		return nil, ruleError(req, ErrMissingMandatoryIE, err)
 	}
 
 	// Validate BAR exists (in session state or in-flight creates)
 	if _, ok := s.BARIDs[plan.BARID]; !ok && !modPlan.HasCreateBAR(plan.BARID) {
-		return nil, ErrRuleNotFound
+		return nil, ruleError(req, ErrRuleNotFound, nil)
 	}
 
 	return plan, nil
@@ -457,9 +672,14 @@ func (s *Sess) ApplyCreatePDR(plan *forwarder.PDRPlan) {
 		}
 	}
 
-	s.PDRIDs[plan.PDRID] = &PDRInfo{
+	pdrInfo := &PDRInfo{
 		RelatedURRIDs: urrids,
+		QERIDs:        plan.QERIDs,
+	}
+	if plan.FARID != nil {
+		pdrInfo.FARID = *plan.FARID
 	}
+	s.PDRIDs[plan.PDRID] = pdrInfo
 }
 
 // ApplyUpdatePDR updates session state after UpdatePDR execution
@@ -485,6 +705,14 @@ func (s *Sess) ApplyUpdatePDR(plan *forwarder.PDRPlan) []report.USAReport {
 		}
 	}
 	pdrInfo.RelatedURRIDs = newUrrids
+	if len(plan.QERIDs) > 0 {
+		pdrInfo.QERIDs = plan.QERIDs
+	}
+	// A FAR given by the CP function replaces the FAR ID for Quota Action
+	if plan.FARID != nil {
+		pdrInfo.FARID = *plan.FARID
+		pdrInfo.restoreFARID = nil
+	}
 
 	return usars
 }
@@ -521,7 +749,24 @@ func (s *Sess) ApplyRemoveFAR(plan *forwarder.FARPlan) {
 
 // ApplyCreateQER updates session state after CreateQER execution
 func (s *Sess) ApplyCreateQER(plan *forwarder.QERPlan) {
-	s.QERIDs[plan.QERID] = struct{}{}
+	s.QERIDs[plan.QERID] = &QERInfo{
+		QFI: plan.QFI,
+		PPI: plan.PPI,
+	}
+}
+
+// ApplyUpdateQER updates session state after UpdateQER execution
+func (s *Sess) ApplyUpdateQER(plan *forwarder.QERPlan) {
+	qerInfo, ok := s.QERIDs[plan.QERID]
+	if !ok {
+		return
+	}
+	if plan.QFI != nil {
+		qerInfo.QFI = plan.QFI
+	}
+	if plan.PPI != nil {
+		qerInfo.PPI = plan.PPI
+	}
 }
 
 // ApplyRemoveQER updates session state after RemoveQER execution
@@ -536,7 +781,7 @@ func (s *Sess) ApplyCreateURR(plan *forwarder.URRPlan) {
 		mInfo = plan.MeasureInfoIE
 	}
 
-	s.URRIDs[plan.URRID] = &URRInfo{
+	urrInfo := &URRInfo{
 		MeasureMethod: report.MeasureMethod{
 			DURAT: plan.OriginalIE.HasDURAT(),
 			VOLUM: plan.OriginalIE.HasVOLUM(),
@@ -549,7 +794,29 @@ func (s *Sess) ApplyCreateURR(plan *forwarder.URRPlan) {
 			ISTM: mInfo.HasISTM(),
 			MNOP: mInfo.HasMNOP(),
 		},
+		RptTrig:   plan.ReportingTrigger,
+		startTime: time.Now(),
+	}
+	if plan.DroppedDLThreshold != nil {
+		urrInfo.DroppedDLThreshold = *plan.DroppedDLThreshold
+	}
+	if plan.EventThreshold != nil {
+		urrInfo.EventThreshold = *plan.EventThreshold
+	}
+	if plan.EventQuota != nil {
+		urrInfo.EventQuota = *plan.EventQuota
+	}
+	if urrInfo.RptTrig.LIUSA() {
+		urrInfo.LinkedURRIDs = plan.LinkedURRIDs
 	}
+	if plan.EthInactivityTimer != nil {
+		urrInfo.EthInactivity = *plan.EthInactivityTimer
+	}
+	urrInfo.QuotaFARID = plan.QuotaFARID
+	if plan.TimeQuota != nil {
+		urrInfo.TimeQuota = *plan.TimeQuota
+	}
+	s.URRIDs[plan.URRID] = urrInfo
 }
 
 // ApplyUpdateURR updates session state after UpdateURR execution
@@ -574,6 +841,45 @@ func (s *Sess) ApplyUpdateURR(plan *forwarder.URRPlan) {
 		urrInfo.ISTM = plan.MeasureInfoIE.HasISTM()
 		urrInfo.MNOP = plan.MeasureInfoIE.HasMNOP()
 	}
+
+	// Update Reporting Triggers if present, even if none is set
+	if plan.HasReportingTrigger {
+		urrInfo.RptTrig = plan.ReportingTrigger
+	}
+
+	if plan.DroppedDLThreshold != nil {
+		urrInfo.DroppedDLThreshold = *plan.DroppedDLThreshold
+		urrInfo.droppedDLPkts = 0
+		urrInfo.droppedDLBytes = 0
+	}
+	if plan.EventThreshold != nil {
+		urrInfo.EventThreshold = *plan.EventThreshold
+		urrInfo.events = 0
+	}
+	// A new Event Quota is granted by the CP function
+	if plan.EventQuota != nil {
+		urrInfo.EventQuota = *plan.EventQuota
+		urrInfo.quotaEvents = 0
+	}
+
+	if len(plan.LinkedURRIDs) > 0 {
+		urrInfo.LinkedURRIDs = plan.LinkedURRIDs
+	}
+	if !urrInfo.RptTrig.LIUSA() {
+		urrInfo.LinkedURRIDs = nil
+	}
+	if plan.EthInactivityTimer != nil {
+		urrInfo.EthInactivity = *plan.EthInactivityTimer
+	}
+	if !urrInfo.RptTrig.MACAR() {
+		urrInfo.macs = nil
+	}
+	if plan.QuotaFARID != nil {
+		urrInfo.QuotaFARID = plan.QuotaFARID
+	}
+	if plan.TimeQuota != nil {
+		urrInfo.TimeQuota = *plan.TimeQuota
+	}
 }
 
 // ApplyRemoveURR updates session state after RemoveURR execution
@@ -586,11 +892,21 @@ func (s *Sess) ApplyRemoveURR(plan *forwarder.URRPlan) {
 // ApplyCreateBAR updates session state after CreateBAR execution
 func (s *Sess) ApplyCreateBAR(plan *forwarder.BARPlan) {
 	s.BARIDs[plan.BARID] = struct{}{}
+	s.applyBAR(plan)
+}
+
+// ApplyUpdateBAR updates session state after UpdateBAR execution
+func (s *Sess) ApplyUpdateBAR(plan *forwarder.BARPlan) {
+	if _, ok := s.BARIDs[plan.BARID]; !ok {
+		return
+	}
+	s.applyBAR(plan)
 }
 
 // ApplyRemoveBAR updates session state after RemoveBAR execution
 func (s *Sess) ApplyRemoveBAR(plan *forwarder.BARPlan) {
 	delete(s.BARIDs, plan.BARID)
+	s.resetBAR()
 }
 
 // CleanupRemovedURRs removes URRInfo entries marked as removed
@@ -606,9 +922,20 @@ type RemoteNode struct {
 	ID     string
 	addr   net.Addr
 	local  *LocalNode
+	mu     sync.Mutex
 	sess   map[uint64]struct{} // key: Local SEID
 	driver forwarder.Driver
 	log    *logrus.Entry
+
+	// CP Function Features of the Load Control and the Overload Control
+	cpLoad     bool
+	cpOverload bool
+
+	limit    factory.ResourceLimits
+	rules    atomic.Int64 // of all sessions
+	rejected atomic.Uint64
+	bufPkts  int // guarded by mu
+	bufBytes int // guarded by mu
 }
 
 func NewRemoteNode(
@@ -628,15 +955,65 @@ func NewRemoteNode(
 	return n
 }
 
-func (n *RemoteNode) Reset() {
+// NumSess returns the number of sessions of the association
+func (n *RemoteNode) NumSess() int {
+	n.mu.Lock()
+	defer n.mu.Unlock()
+	return len(n.sess)
+}
+
+// bufAvail reports whether a packet of size bytes may be buffered within
+// the limits of the association and the global ones
+func (n *RemoteNode) bufAvail(size int) bool {
+	n.mu.Lock()
+	ok := (n.limit.BufferedPackets <= 0 || n.bufPkts < n.limit.BufferedPackets) &&
+		(n.limit.BufferedBytes <= 0 || n.bufBytes+size <= n.limit.BufferedBytes)
+	n.mu.Unlock()
+	return ok && n.local.bufAvail(size)
+}
+
+// addBuf accounts the packets and the bytes buffered, or freed if
+// negative, by a session of the association
+func (n *RemoteNode) addBuf(pkts, size int) {
+	n.mu.Lock()
+	n.bufPkts += pkts
+	n.bufBytes += size
+	n.mu.Unlock()
+	n.local.addBuf(pkts, size)
+}
+
+// releasedSess is a session released by the UPF, with its final usage
+// reports
+type releasedSess struct {
+	sess  *Sess
+	usars []report.USAReport
+}
+
+// Reset releases the sessions of the node and returns them
+func (n *RemoteNode) Reset() []releasedSess {
+	n.mu.Lock()
+	ids := make([]uint64, 0, len(n.sess))
 	for id := range n.sess {
-		n.DeleteSess(id)
+		ids = append(ids, id)
 	}
-	n.sess = make(map[uint64]struct{})
+	n.mu.Unlock()
+
+	released := make([]releasedSess, 0, len(ids))
+	for _, id := range ids {
+		sess, err := n.local.Sess(id)
+		if err != nil {
+			n.log.Warnln(err)
+			continue
+		}
+		released = append(released, releasedSess{sess: sess, usars: n.DeleteSess(id)})
+	}
+	return released
 }
 
 func (n *RemoteNode) Sess(lSeid uint64) (*Sess, error) {
+	n.mu.Lock()
 	_, ok := n.sess[lSeid]
+	n.mu.Unlock()
 	if !ok {
 		return nil, errors.Errorf("Sess: sess not found (lSeid:%#x)", lSeid)
 	}
@@ -644,9 +1021,11 @@ func (n *RemoteNode) Sess(lSeid uint64) (*Sess, error) {
 }
 
 func (n *RemoteNode) NewSess(rSeid uint64) *Sess {
-	s := n.local.NewSess(rSeid, BUFFQ_LEN)
-	n.sess[s.LocalID] = struct{}{}
+	s := n.local.NewSess(rSeid, n.local.bufLimit())
 	s.rnode = n
+	n.mu.Lock()
+	n.sess[s.LocalID] = struct{}{}
+	n.mu.Unlock()
 	s.log = n.log.WithFields(
 		logrus.Fields{
 			logger_util.FieldUserPlaneSEID:    fmt.Sprintf("%#x", s.LocalID),
@@ -657,11 +1036,13 @@ func (n *RemoteNode) NewSess(rSeid uint64) *Sess {
 }
 
 func (n *RemoteNode) DeleteSess(lSeid uint64) []report.USAReport {
+	n.mu.Lock()
 	_, ok := n.sess[lSeid]
+	delete(n.sess, lSeid)
+	n.mu.Unlock()
 	if !ok {
 		return nil
 	}
-	delete(n.sess, lSeid)
 	usars, err := n.local.DeleteSess(lSeid)
 	if err != nil {
 		n.log.Warnln(err)
@@ -670,19 +1051,112 @@ func (n *RemoteNode) DeleteSess(lSeid uint64) []report.USAReport {
 	return usars
 }
 
+// LocalNode allocates the sessions, which are handled concurrently by the
+// session workers
 type LocalNode struct {
-	sess []*Sess
-	free []uint64
+	mu       sync.RWMutex
+	sess     []*Sess
+	free     []uint64
+	limit    factory.ResourceLimits // of all associations
+	rules    atomic.Int64           // of all sessions
+	rejected atomic.Uint64
+
+	// DL data buffering of all sessions
+	bufMaxPkts  int // per session
+	bufMaxBytes int
+	bufMu       sync.Mutex
+	bufPkts     int
+	bufBytes    int
+	bufDropped  uint64
 }
 
-func (n *LocalNode) Reset() {
-	for _, sess := range n.sess {
-		if sess != nil {
-			sess.Close()
-		}
+// SetLimits sets the limits of the resources of all associations
+func (n *LocalNode) SetLimits(limit factory.ResourceLimits) {
+	n.limit = limit
+}
+
+// SetBufferLimits sets the default buffering limit of the sessions and the
+// memory cap of the buffered packets of all sessions
+func (n *LocalNode) SetBufferLimits(maxPkts, maxBytes int) {
+	n.bufMaxPkts = maxPkts
+	n.bufMaxBytes = maxBytes
+}
+
+func (n *LocalNode) bufLimit() int {
+	if n.bufMaxPkts > 0 {
+		return n.bufMaxPkts
+	}
+	return BUFFQ_LEN
+}
+
+func (n *LocalNode) bufAvail(size int) bool {
+	maxBytes := n.bufMaxBytes
+	if maxBytes <= 0 {
+		maxBytes = BUFF_MAX_BYTES
+	}
+	if l := n.limit.BufferedBytes; l > 0 {
+		maxBytes = min(maxBytes, l)
+	}
+	n.bufMu.Lock()
+	defer n.bufMu.Unlock()
+	if l := n.limit.BufferedPackets; l > 0 && n.bufPkts >= l {
+		return false
 	}
+	return n.bufBytes+size <= maxBytes
+}
+
+// addBuf accounts the packets and the bytes buffered, or freed if
+// negative, by a session
+func (n *LocalNode) addBuf(pkts, size int) {
+	n.bufMu.Lock()
+	defer n.bufMu.Unlock()
+	n.bufPkts += pkts
+	n.bufBytes += size
+}
+
+func (n *LocalNode) countBufDrop() {
+	n.bufMu.Lock()
+	defer n.bufMu.Unlock()
+	n.bufDropped++
+}
+
+// NumSess returns the number of sessions
+func (n *LocalNode) NumSess() int {
+	n.mu.RLock()
+	defer n.mu.RUnlock()
+	return len(n.sess) - len(n.free)
+}
+
+// NumRules returns the number of rules of all sessions
+func (n *LocalNode) NumRules() int {
+	return int(n.rules.Load())
+}
+
+// syncRules accounts the rules of a session after they are changed, on
+// the worker of the session
+func (n *LocalNode) syncRules(sess *Sess) {
+	rules := len(sess.PDRIDs) + len(sess.FARIDs) + len(sess.QERIDs) +
+		len(sess.URRIDs) + len(sess.BARIDs) + len(sess.SRRIDs)
+	n.rules.Add(int64(rules - sess.rules))
+	if sess.rnode != nil {
+		sess.rnode.rules.Add(int64(rules - sess.rules))
+	}
+	sess.rules = rules
+}
+
+func (n *LocalNode) Reset() {
+	n.mu.Lock()
+	sess := n.sess
 	n.sess = []*Sess{}
 	n.free = []uint64{}
+	n.rules.Store(0)
+	n.mu.Unlock()
+
+	for _, s := range sess {
+		if s != nil {
+			s.Close()
+		}
+	}
 }
 
 func (n *LocalNode) Sess(lSeid uint64) (*Sess, error) {
@@ -690,6 +1164,9 @@ func (n *LocalNode) Sess(lSeid uint64) (*Sess, error) {
 		return nil, errors.New("Sess: invalid lSeid:0")
 	}
 
+	n.mu.RLock()
+	defer n.mu.RUnlock()
+
 	// Length as int; compare as uint64 to match lSeid type.
 	sessLen := len(n.sess)
 	if lSeid > uint64(sessLen) {
@@ -711,6 +1188,8 @@ func (n *LocalNode) RemoteSess(rSeid uint64, addr net.Addr) (*Sess, error) {
 		addrString = addr.String()
 	}
 
+	n.mu.RLock()
+	defer n.mu.RUnlock()
 	for _, s := range n.sess {
 		if s == nil || s.rnode == nil || s.rnode.addr == nil {
 			continue
@@ -727,12 +1206,17 @@ func (n *LocalNode) NewSess(rSeid uint64, qlen int) *Sess {
 		RemoteID: rSeid,
 		PDRIDs:   make(map[uint16]*PDRInfo),
 		FARIDs:   make(map[uint32]struct{}),
-		QERIDs:   make(map[uint32]struct{}),
+		QERIDs:   make(map[uint32]*QERInfo),
 		URRIDs:   make(map[uint32]*URRInfo),
 		BARIDs:   make(map[uint8]struct{}),
-		q:        make(map[uint16]chan []byte),
-		qlen:     qlen,
+		SRRIDs:   make(map[uint8]*SRRInfo),
+		buf: buffer{
+			q:     make(map[uint16][]bufPkt),
+			limit: qlen,
+		},
 	}
+	n.mu.Lock()
+	defer n.mu.Unlock()
 	last := len(n.free) - 1
 	if last >= 0 {
 		s.LocalID = n.free[last]
@@ -750,21 +1234,22 @@ func (n *LocalNode) DeleteSess(lSeid uint64) ([]report.USAReport, error) {
 		return nil, errors.New("DeleteSess: invalid lSeid:0")
 	}
 
-	// Capacity as int; compare as uint64 to match lSeid type.
-	sessCap := len(n.sess)
-	if lSeid > uint64(sessCap) {
+	sess, err := n.Sess(lSeid)
+	if err != nil {
 		return nil, errors.Errorf("DeleteSess: sess not found (lSeid:%#x)", lSeid)
 	}
 
-	// Safe: 1 <= lSeid <= sessCap ensures valid conversion and index.
-	idx := int(lSeid) - 1
-	if n.sess[idx] == nil {
-		return nil, errors.Errorf("DeleteSess: sess not found (lSeid:%#x)", lSeid)
+	sess.log.Infoln("sess deleted")
+	// The lSeid is reused after the rules of the session are released
+	usars := sess.Close()
+	n.rules.Add(-int64(sess.rules))
+	if sess.rnode != nil {
+		sess.rnode.rules.Add(-int64(sess.rules))
 	}
 
-	n.sess[idx].log.Infoln("sess deleted")
-	usars := n.sess[idx].Close()
-	n.sess[idx] = nil
+	n.mu.Lock()
+	defer n.mu.Unlock()
+	n.sess[lSeid-1] = nil
 	n.free = append(n.free, lSeid)
 
 	return usars, nil
@@ -3,11 +3,15 @@ package pfcp
 import (
 	"net"
 	"testing"
+	"time"
 
+	"github.com/pkg/errors"
 	"github.com/stretchr/testify/assert"
+	"github.com/wmnsk/go-pfcp/ie"
 
 	"github.com/free5gc/go-upf/internal/forwarder"
 	"github.com/free5gc/go-upf/internal/logger"
+	"github.com/free5gc/go-upf/internal/report"
 	logger_util "github.com/free5gc/util/logger"
 )
 
@@ -262,3 +266,213 @@ func TestLocalNode(t *testing.T) {
 		assert.Error(t, err)
 	})
 }
+
+func TestSessURRThresholds(t *testing.T) {
+	newSess := func() *Sess {
+		rnode := NewRemoteNode(
+			"smf1",
+			nil,
+			&LocalNode{},
+			forwarder.Empty{},
+			logger.PfcpLog.WithField(logger_util.FieldControlPlaneNodeID, "smf1"),
+		)
+		sess := rnode.NewSess(10)
+		sess.PDRIDs[1] = &PDRInfo{
+			RelatedURRIDs: map[uint32]struct{}{1: {}},
+		}
+		return sess
+	}
+
+	t.Run("dropped DL traffic threshold", func(t *testing.T) {
+		sess := newSess()
+		sess.URRIDs[1] = &URRInfo{
+			RptTrig: report.ReportingTrigger{Flags: report.RPT_TRIG_DROTH},
+			DroppedDLThreshold: report.DroppedDLThreshold{
+				Flags:   report.DLPA,
+				Packets: 2,
+			},
+		}
+
+		assert.Empty(t, sess.dropDL(1, 1, 100))
+		usars := sess.dropDL(1, 1, 100)
+		if assert.Len(t, usars, 1) {
+			assert.Equal(t, uint32(1), usars[0].URRID)
+			assert.True(t, usars[0].USARTrigger.DROTH())
+		}
+		// counters are reset after reporting
+		assert.Empty(t, sess.dropDL(1, 1, 100))
+	})
+
+	t.Run("packets dropped for the MBR", func(t *testing.T) {
+		sess := newSess()
+		sess.URRIDs[1] = &URRInfo{}
+
+		assert.Empty(t, sess.dropLimited(1, 100, false))
+		assert.Empty(t, sess.dropLimited(1, 300, true))
+		r := report.USAReport{
+			URRID:        1,
+			VolumMeasure: report.VolumeMeasure{TotalVolume: 1000, UplinkVolume: 1000},
+		}
+		sess.sealUSAReport(&r)
+		assert.Equal(t, report.VolumeMeasure{
+			TotalVolume:    1400,
+			UplinkVolume:   1100,
+			DownlinkVolume: 300,
+			TotalPktNum:    2,
+			UplinkPktNum:   1,
+			DownlinkPktNum: 1,
+		}, r.VolumMeasure)
+
+		// counted once
+		r = report.USAReport{URRID: 1}
+		sess.sealUSAReport(&r)
+		assert.Zero(t, r.VolumMeasure.TotalVolume)
+		assert.Equal(t, uint32(1), r.URSEQN)
+	})
+
+	t.Run("drop buffered packet", func(t *testing.T) {
+		sess := newSess()
+		sess.URRIDs[1] = &URRInfo{
+			RptTrig: report.ReportingTrigger{Flags: report.RPT_TRIG_DROTH},
+			DroppedDLThreshold: report.DroppedDLThreshold{
+				Flags: report.DLBY,
+				Bytes: 3,
+			},
+		}
+
+		assert.Empty(t, sess.Push(1, []byte{1, 2, 3}))
+		usars, ok := sess.Drop(1)
+		assert.True(t, ok)
+		assert.Len(t, usars, 1)
+		_, ok = sess.Drop(1)
+		assert.False(t, ok)
+	})
+
+	t.Run("event threshold and quota", func(t *testing.T) {
+		sess := newSess()
+		sess.URRIDs[1] = &URRInfo{
+			MeasureMethod: report.MeasureMethod{EVENT: true},
+			RptTrig: report.ReportingTrigger{
+				Flags: report.RPT_TRIG_EVETH | report.RPT_TRIG_EVEQU,
+			},
+			EventThreshold: 2,
+			EventQuota:     3,
+		}
+
+		assert.Empty(t, sess.detectEvent(1))
+		usars := sess.detectEvent(1)
+		if assert.Len(t, usars, 1) {
+			assert.True(t, usars[0].USARTrigger.EVETH())
+			assert.False(t, usars[0].USARTrigger.EVEQU())
+		}
+		usars = sess.detectEvent(1)
+		if assert.Len(t, usars, 1) {
+			assert.False(t, usars[0].USARTrigger.EVETH())
+			assert.True(t, usars[0].USARTrigger.EVEQU())
+		}
+		// quota is reported only once
+		usars = sess.detectEvent(1)
+		if assert.Len(t, usars, 1) {
+			assert.False(t, usars[0].USARTrigger.EVEQU())
+		}
+	})
+
+	t.Run("reporting triggers cleared", func(t *testing.T) {
+		sess := newSess()
+		sess.URRIDs[1] = &URRInfo{
+			RptTrig: report.ReportingTrigger{Flags: report.RPT_TRIG_DROTH},
+		}
+
+		sess.ApplyUpdateURR(&forwarder.URRPlan{URRID: 1})
+		assert.True(t, sess.URRIDs[1].RptTrig.DROTH())
+		sess.ApplyUpdateURR(&forwarder.URRPlan{URRID: 1, HasReportingTrigger: true})
+		assert.Zero(t, sess.URRIDs[1].RptTrig.Flags)
+		assert.Empty(t, sess.dropDL(1, 1, 100))
+	})
+}
+
+func TestSessLinkUSAReports(t *testing.T) {
+	rnode := NewRemoteNode(
+		"smf1",
+		nil,
+		&LocalNode{},
+		forwarder.Empty{},
+		logger.PfcpLog.WithField(logger_util.FieldControlPlaneNodeID, "smf1"),
+	)
+	sess := rnode.NewSess(10)
+	sess.URRIDs[1] = &URRInfo{}
+	sess.URRIDs[2] = &URRInfo{
+		RptTrig:      report.ReportingTrigger{Flags: report.RPT_TRIG_LIUSA},
+		LinkedURRIDs: []uint32{1},
+	}
+	sess.URRIDs[3] = &URRInfo{
+		RptTrig:      report.ReportingTrigger{Flags: report.RPT_TRIG_LIUSA},
+		LinkedURRIDs: []uint32{4},
+	}
+
+	start := time.Now().Add(-time.Minute)
+	end := time.Now()
+	usars := sess.linkUSAReports([]report.USAReport{
+		{
+			URRID:       1,
+			USARTrigger: report.UsageReportTrigger{Flags: report.USAR_TRIG_PERIO},
+			StartTime:   start,
+			EndTime:     end,
+		},
+	})
+	if assert.Len(t, usars, 2) {
+		assert.Equal(t, uint32(2), usars[1].URRID)
+		assert.True(t, usars[1].USARTrigger.LIUSA())
+		assert.Equal(t, start, usars[1].StartTime)
+		assert.Equal(t, end, usars[1].EndTime)
+	}
+
+	// the linked URR is not reported twice
+	usars = sess.linkUSAReports([]report.USAReport{{URRID: 1}, {URRID: 2}})
+	assert.Len(t, usars, 2)
+
+	// the final usage of the session deleted
+	rnode = NewRemoteNode(
+		"smf1",
+		nil,
+		&LocalNode{},
+		releaseDriver{},
+		logger.PfcpLog.WithField(logger_util.FieldControlPlaneNodeID, "smf1"),
+	)
+	sess = rnode.NewSess(11)
+	sess.URRIDs[1] = &URRInfo{}
+	sess.URRIDs[2] = &URRInfo{
+		RptTrig:      report.ReportingTrigger{Flags: report.RPT_TRIG_LIUSA},
+		LinkedURRIDs: []uint32{1},
+	}
+	usars = rnode.DeleteSess(sess.LocalID)
+	if assert.Len(t, usars, 2) {
+		assert.Equal(t, uint32(2), usars[1].URRID)
+		assert.True(t, usars[1].USARTrigger.LIUSA())
+		assert.Equal(t, usars[0].EndTime, usars[1].EndTime)
+	}
+}
+
+type unsupportedDriver struct {
+	forwarder.Empty
+}
+
+func (unsupportedDriver) BuildCreateFARPlan(uint64, *ie.IE) (*forwarder.FARPlan, error) {
+	return nil, errors.Wrap(forwarder.ErrUnsupported, "Header Enrichment")
+}
+
+func (unsupportedDriver) BuildUpdateFARPlan(uint64, *ie.IE) (*forwarder.FARPlan, error) {
+	return nil, errors.New("invalid Update FAR")
+}
+
+func TestValidateFARUnsupported(t *testing.T) {
+	_, rnode, _ := newUDPTestServer(t, unsupportedDriver{})
+	sess := rnode.NewSess(1)
+
+	_, err := sess.ValidateCreateFAR(ie.NewCreateFAR(ie.NewFARID(1)))
+	assert.ErrorIs(t, err, ErrRuleCreationModificationFailed)
+	assert.Equal(t, ie.CauseRuleCreationModificationFailure, pfcpCauseFromError(err))
+
+	_, err = sess.ValidateUpdateFAR(ie.NewUpdateFAR(ie.NewFARID(1)), forwarder.NewModificationPlan(1))
+	assert.ErrorIs(t, err, ErrMissingMandatoryIE)
+}
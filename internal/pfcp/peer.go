@@ -0,0 +1,273 @@
+package pfcp
+
+import (
+	"context"
+	"net"
+	"slices"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/sirupsen/logrus"
+
+	"github.com/free5gc/go-upf/pkg/factory"
+)
+
+const (
+	// PEER_LOG_INTERVAL is the minimum interval of the warnings of the
+	// messages dropped from a source address
+	PEER_LOG_INTERVAL = time.Minute
+	// PEER_PRUNE_INTERVAL is the interval of forgetting the idle sources
+	PEER_PRUNE_INTERVAL = time.Minute
+	// NODE_ID_LOOKUP_TIMEOUT is the timeout of resolving an FQDN Node ID
+	NODE_ID_LOOKUP_TIMEOUT = 5 * time.Second
+	// NODE_ID_REFRESH_INTERVAL is the age of the addresses of an FQDN Node ID
+	// above which they are resolved again
+	NODE_ID_REFRESH_INTERVAL = time.Minute
+)
+
+// PeerDrops counts the PFCP messages dropped from the peers
+type PeerDrops struct {
+	NotAllowed  uint64 `json:"notAllowed"`
+	RateLimited uint64 `json:"rateLimited"`
+	// Association Setup Requests of the Node IDs not allowed
+	Rejected uint64 `json:"rejected"`
+}
+
+// dropLog counts the messages dropped since the last warning
+type dropLog struct {
+	dropped uint64
+	warned  time.Time
+}
+
+type peerSource struct {
+	tokens float64
+	last   time.Time
+	dropLog
+}
+
+// nodeIDAddrs is the addresses an allowed FQDN Node ID resolved to
+type nodeIDAddrs struct {
+	ips      []net.IP
+	resolved time.Time
+	pending  bool
+}
+
+// lookupNodeID resolves the FQDN Node ID of a CP function
+var lookupNodeID = func(ctx context.Context, host string) ([]net.IP, error) {
+	return net.DefaultResolver.LookupIP(ctx, "ip", host)
+}
+
+// peerFilter drops the PFCP messages of the source addresses outside the
+// allowed CIDRs, or beyond their rate limit, and rejects the associations of
+// the Node IDs not allowed. The sources are accounted under a lock, as each
+// listen endpoint has a receiver goroutine of its own; the sources outside
+// the CIDRs share one account, so that spoofed sources can't grow the map.
+//
+// The allowed FQDN Node IDs are resolved in the background from the
+// creation on, and again once their addresses are NODE_ID_REFRESH_INTERVAL
+// old, so that an Association Setup Request never waits for the DNS.
+type peerFilter struct {
+	cidrs   []*net.IPNet
+	nodeIDs []string
+	rate    float64 // messages per second
+	burst   float64
+
+	// guards sources, outside and lastPrune
+	mu        sync.Mutex
+	sources   map[string]*peerSource // key: source IP
+	outside   dropLog                // the sources outside the CIDRs
+	lastPrune time.Time
+
+	// guards addrs
+	addrMu sync.Mutex
+	addrs  map[string]*nodeIDAddrs // key: FQDN Node ID
+	// the lookups in progress
+	lookups sync.WaitGroup
+
+	notAllowed  atomic.Uint64
+	rateLimited atomic.Uint64
+	rejected    atomic.Uint64
+	log         *logrus.Entry
+}
+
+func newPeerFilter(cfg *factory.Pfcp, log *logrus.Entry) *peerFilter {
+	f := &peerFilter{
+		nodeIDs: cfg.AllowedNodeIDs,
+		sources: make(map[string]*peerSource),
+		addrs:   make(map[string]*nodeIDAddrs),
+		log:     log,
+	}
+	f.addrMu.Lock()
+	for _, id := range f.nodeIDs {
+		if net.ParseIP(id) == nil {
+			f.addrs[id] = &nodeIDAddrs{}
+			f.resolve(id)
+		}
+	}
+	f.addrMu.Unlock()
+	for _, c := range cfg.AllowedCIDRs {
+		_, n, err := net.ParseCIDR(c)
+		if err != nil {
+			// validated with the config
+			log.Warnf("allowed CIDR %q: %v", c, err)
+			continue
+		}
+		f.cidrs = append(f.cidrs, n)
+	}
+	if r := cfg.RateLimit; r != nil && r.Rate > 0 {
+		f.rate = r.Rate
+		f.burst = float64(r.Burst)
+		if f.burst <= 0 {
+			f.burst = max(r.Rate, 1)
+		}
+	}
+	return f
+}
+
+// accept reports whether a message received from addr is handled
+func (f *peerFilter) accept(addr net.Addr, now time.Time) bool {
+	if f == nil {
+		return true
+	}
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	if now.Sub(f.lastPrune) >= PEER_PRUNE_INTERVAL {
+		f.prune(now)
+	}
+	var ip net.IP
+	if a, ok := addr.(*net.UDPAddr); ok {
+		ip = a.IP
+	}
+	if len(f.cidrs) > 0 && !slices.ContainsFunc(f.cidrs, func(n *net.IPNet) bool {
+		return n.Contains(ip)
+	}) {
+		f.notAllowed.Add(1)
+		f.drop(&f.outside, ip.String(), "source not allowed", now)
+		return false
+	}
+	if f.rate <= 0 {
+		return true
+	}
+
+	src := f.source(ip.String(), now)
+	if d := now.Sub(src.last); d > 0 {
+		src.tokens = min(src.tokens+f.rate*d.Seconds(), f.burst)
+	}
+	src.last = now
+	if src.tokens < 1 {
+		f.rateLimited.Add(1)
+		f.drop(&src.dropLog, ip.String(), "rate limited", now)
+		return false
+	}
+	src.tokens--
+	return true
+}
+
+func (f *peerFilter) source(ip string, now time.Time) *peerSource {
+	src, ok := f.sources[ip]
+	if !ok {
+		src = &peerSource{tokens: f.burst, last: now}
+		f.sources[ip] = src
+	}
+	return src
+}
+
+// drop logs the messages dropped from a source, warning once per
+// PEER_LOG_INTERVAL of the account
+func (f *peerFilter) drop(l *dropLog, ip, reason string, now time.Time) {
+	f.log.Debugf("drop message from %s: %s", ip, reason)
+	l.dropped++
+	if now.Sub(l.warned) < PEER_LOG_INTERVAL {
+		return
+	}
+	f.log.Warnf("drop messages from %s: %s (%d dropped)", ip, reason, l.dropped)
+	l.warned = now
+	l.dropped = 0
+}
+
+// prune forgets the sources with a full bucket and no recent warning
+func (f *peerFilter) prune(now time.Time) {
+	f.lastPrune = now
+	for ip, src := range f.sources {
+		full := f.rate <= 0 || src.tokens+f.rate*now.Sub(src.last).Seconds() >= f.burst
+		if full && now.Sub(src.warned) >= PEER_LOG_INTERVAL {
+			delete(f.sources, ip)
+		}
+	}
+}
+
+// allowNodeID reports whether a CP function may set up an association: its
+// Node ID must be allowed and be the address the request comes from
+func (f *peerFilter) allowNodeID(id string, addr net.Addr) bool {
+	if f == nil || len(f.nodeIDs) == 0 {
+		return true
+	}
+	if slices.Contains(f.nodeIDs, id) && f.nodeIDAddr(id, addr, time.Now()) {
+		return true
+	}
+	f.rejected.Add(1)
+	return false
+}
+
+// nodeIDAddr reports whether an allowed Node ID, an IP address or an FQDN,
+// is the source address of a message. An FQDN is matched against the
+// addresses it last resolved to, refreshed in the background if they are
+// old.
+func (f *peerFilter) nodeIDAddr(id string, addr net.Addr, now time.Time) bool {
+	a, ok := addr.(*net.UDPAddr)
+	if !ok {
+		return false
+	}
+	if ip := net.ParseIP(id); ip != nil {
+		return ip.Equal(a.IP)
+	}
+	f.addrMu.Lock()
+	defer f.addrMu.Unlock()
+	n, ok := f.addrs[id]
+	if !ok {
+		return false
+	}
+	if !n.pending && now.Sub(n.resolved) >= NODE_ID_REFRESH_INTERVAL {
+		f.resolve(id)
+	}
+	return slices.ContainsFunc(n.ips, a.IP.Equal)
+}
+
+// resolve looks an FQDN Node ID up in the background; the addresses it
+// resolved to before are kept if the lookup fails. The caller holds addrMu.
+func (f *peerFilter) resolve(id string) {
+	f.addrs[id].pending = true
+	f.lookups.Add(1)
+	lookup := lookupNodeID
+	go func() {
+		defer f.lookups.Done()
+		ctx, cancel := context.WithTimeout(context.Background(), NODE_ID_LOOKUP_TIMEOUT)
+		defer cancel()
+		ips, err := lookup(ctx, id)
+
+		f.addrMu.Lock()
+		defer f.addrMu.Unlock()
+		n := f.addrs[id]
+		n.pending = false
+		n.resolved = time.Now()
+		if err != nil {
+			f.log.Warnf("resolve Node ID %s: %v", id, err)
+			return
+		}
+		n.ips = ips
+	}()
+}
+
+// Drops returns the counters of the PFCP messages dropped from the peers
+func (s *PfcpServer) Drops() PeerDrops {
+	f := s.filter
+	if f == nil {
+		return PeerDrops{}
+	}
+	return PeerDrops{
+		NotAllowed:  f.notAllowed.Load(),
+		RateLimited: f.rateLimited.Load(),
+		Rejected:    f.rejected.Load(),
+	}
+}
@@ -0,0 +1,163 @@
+package pfcp
+
+import (
+	"context"
+	"net"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/pkg/errors"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"github.com/wmnsk/go-pfcp/ie"
+	"github.com/wmnsk/go-pfcp/message"
+
+	"github.com/free5gc/go-upf/internal/forwarder"
+	"github.com/free5gc/go-upf/internal/logger"
+	"github.com/free5gc/go-upf/pkg/factory"
+)
+
+func TestPeerFilter(t *testing.T) {
+	smf := &net.UDPAddr{IP: net.IPv4(10, 100, 200, 3), Port: 8805}
+	other := &net.UDPAddr{IP: net.IPv4(10, 100, 201, 3), Port: 8805}
+	now := time.Now()
+
+	t.Run("allowed CIDRs", func(t *testing.T) {
+		f := newPeerFilter(&factory.Pfcp{AllowedCIDRs: []string{"10.100.200.0/24"}}, logger.PfcpLog)
+		assert.True(t, f.accept(smf, now))
+		assert.False(t, f.accept(other, now))
+		assert.Equal(t, PeerDrops{NotAllowed: 1}, (&PfcpServer{filter: f}).Drops())
+
+		// the sources outside the CIDRs are not kept
+		for i := 0; i < 100; i++ {
+			assert.False(t, f.accept(&net.UDPAddr{IP: net.IPv4(192, 0, 2, byte(i)), Port: 8805}, now))
+		}
+		assert.Empty(t, f.sources)
+		assert.Equal(t, uint64(100), f.outside.dropped)
+	})
+
+	t.Run("rate limit per source", func(t *testing.T) {
+		f := newPeerFilter(&factory.Pfcp{
+			RateLimit: &factory.PfcpRateLimit{Rate: 10, Burst: 2},
+		}, logger.PfcpLog)
+		assert.True(t, f.accept(smf, now))
+		assert.True(t, f.accept(smf, now))
+		assert.False(t, f.accept(smf, now))
+		assert.True(t, f.accept(other, now))
+
+		// refilled at the rate
+		assert.False(t, f.accept(smf, now.Add(50*time.Millisecond)))
+		assert.True(t, f.accept(smf, now.Add(100*time.Millisecond)))
+		assert.Equal(t, uint64(2), f.rateLimited.Load())
+
+		// the idle sources are forgotten
+		f.prune(now.Add(PEER_LOG_INTERVAL))
+		assert.Empty(t, f.sources)
+	})
+
+	t.Run("receivers", func(t *testing.T) {
+		f := newPeerFilter(&factory.Pfcp{
+			AllowedCIDRs: []string{"10.100.200.0/24"},
+			RateLimit:    &factory.PfcpRateLimit{Rate: 10, Burst: 100},
+		}, logger.PfcpLog)
+		// one receiver goroutine per listen endpoint
+		var wg sync.WaitGroup
+		for i := 0; i < 4; i++ {
+			wg.Add(1)
+			go func() {
+				defer wg.Done()
+				for j := 0; j < 50; j++ {
+					f.accept(smf, now)
+					f.accept(other, now)
+				}
+			}()
+		}
+		wg.Wait()
+		assert.Equal(t, uint64(100), f.rateLimited.Load())
+		assert.Equal(t, uint64(200), f.notAllowed.Load())
+	})
+
+	t.Run("allowed Node IDs", func(t *testing.T) {
+		setHost := stubLookupNodeID(t)
+		setHost("smf.example.org", smf.IP)
+
+		f := newPeerFilter(&factory.Pfcp{
+			AllowedNodeIDs: []string{"smf.example.org", "smf2.example.org", "10.100.200.3"},
+		}, logger.PfcpLog)
+		f.lookups.Wait()
+		assert.True(t, f.allowNodeID("smf.example.org", smf))
+		assert.True(t, f.allowNodeID("10.100.200.3", smf))
+		assert.False(t, f.allowNodeID("10.100.201.3", other))
+		// an allowed Node ID from another address
+		assert.False(t, f.allowNodeID("smf.example.org", other))
+		assert.False(t, f.allowNodeID("10.100.200.3", other))
+		assert.Equal(t, uint64(3), f.rejected.Load())
+
+		// resolved again in the background once old, and meanwhile matched
+		// against the addresses resolved before
+		setHost("smf.example.org", other.IP)
+		assert.True(t, f.nodeIDAddr("smf.example.org", smf, time.Now().Add(NODE_ID_REFRESH_INTERVAL)))
+		f.lookups.Wait()
+		assert.True(t, f.nodeIDAddr("smf.example.org", other, time.Now()))
+		assert.False(t, f.nodeIDAddr("smf.example.org", smf, time.Now()))
+
+		// unresolved
+		assert.False(t, f.allowNodeID("smf2.example.org", smf))
+
+		var none *peerFilter
+		assert.True(t, none.accept(other, now))
+		assert.True(t, none.allowNodeID("10.100.201.3", other))
+	})
+}
+
+// stubLookupNodeID resolves the FQDN Node IDs to the addresses set with
+// the returned function for the duration of a test
+func stubLookupNodeID(t *testing.T) func(host string, ips ...net.IP) {
+	var mu sync.Mutex
+	hosts := make(map[string][]net.IP)
+	lookup := lookupNodeID
+	t.Cleanup(func() { lookupNodeID = lookup })
+	lookupNodeID = func(ctx context.Context, host string) ([]net.IP, error) {
+		mu.Lock()
+		defer mu.Unlock()
+		if ips, ok := hosts[host]; ok {
+			return ips, nil
+		}
+		return nil, errors.New("no such host")
+	}
+	return func(host string, ips ...net.IP) {
+		mu.Lock()
+		defer mu.Unlock()
+		hosts[host] = ips
+	}
+}
+
+func TestAssociationSetupRejected(t *testing.T) {
+	s, _, peer := newUDPTestServer(t, forwarder.Empty{})
+	s.nodeID = "127.0.0.8"
+	s.rnodes = make(map[string]*RemoteNode)
+	s.rxTrans = make(map[string]*RxTransaction)
+	stubLookupNodeID(t)
+	s.filter = newPeerFilter(&factory.Pfcp{AllowedNodeIDs: []string{"smf.example.org"}}, s.log)
+
+	req := message.NewAssociationSetupRequest(1,
+		ie.NewNodeID("10.100.201.3", "", ""),
+		ie.NewRecoveryTimeStamp(time.Now()),
+	)
+	rx := NewRxTransaction(s, peer.LocalAddr(), 1)
+	s.rxTrans[rx.id] = rx
+	s.handleAssociationSetupRequest(req, peer.LocalAddr())
+	assert.Empty(t, s.rnodes)
+
+	err := peer.SetReadDeadline(time.Now().Add(100 * time.Millisecond))
+	require.NoError(t, err)
+	b := make([]byte, MAX_PFCP_MSG_LEN)
+	n, _, err := peer.ReadFrom(b)
+	require.NoError(t, err)
+	rsp, err := message.ParseAssociationSetupResponse(b[:n])
+	require.NoError(t, err)
+	cause, err := rsp.Cause.Cause()
+	require.NoError(t, err)
+	assert.Equal(t, ie.CauseRequestRejected, cause)
+}
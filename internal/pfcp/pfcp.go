@@ -5,14 +5,18 @@ import (
 	"fmt"
 	"net"
 	"runtime/debug"
+	"strings"
 	"sync"
+	"sync/atomic"
 	"time"
 
 	"github.com/pkg/errors"
 	"github.com/sirupsen/logrus"
 	"github.com/wmnsk/go-pfcp/message"
 
+	"github.com/free5gc/go-upf/internal/event"
 	"github.com/free5gc/go-upf/internal/forwarder"
+	"github.com/free5gc/go-upf/internal/journal"
 	"github.com/free5gc/go-upf/internal/logger"
 	"github.com/free5gc/go-upf/internal/report"
 	"github.com/free5gc/go-upf/pkg/factory"
@@ -45,16 +49,27 @@ type TransactionTimeout struct {
 
 type PfcpServer struct {
 	cfg          *factory.Config
-	listen       string
+	listens      []string
 	nodeID       string
 	rcvCh        chan ReceivePacket
 	srCh         chan report.SessReport
 	trToCh       chan TransactionTimeout
-	conn         *net.UDPConn
+	conn         *net.UDPConn   // the first endpoint
+	extraConns   []*net.UDPConn // the other endpoints
+	peerMu       sync.RWMutex
+	peerConns    map[string]*net.UDPConn // key: IP of a peer on an extra endpoint
 	recoveryTime time.Time
 	driver       forwarder.Driver
 	lnode        LocalNode
+	workers      *sessWorkers
+	filter       *peerFilter
+	loadCtl      *loadControl
+	capture      atomic.Pointer[capture]
+	events       *event.Stream
+	journal      *journal.Journal
+	nodeMu       sync.RWMutex
 	rnodes       map[string]*RemoteNode
+	trMu         sync.Mutex
 	txTrans      map[string]*TxTransaction // key: RemoteAddr-Sequence
 	rxTrans      map[string]*RxTransaction // key: RemoteAddr-Sequence
 	txSeq        uint32
@@ -62,10 +77,13 @@ type PfcpServer struct {
 }
 
 func NewPfcpServer(cfg *factory.Config, driver forwarder.Driver) *PfcpServer {
-	listen := fmt.Sprintf("%s:%d", cfg.Pfcp.Addr, factory.UpfPfcpDefaultPort)
-	return &PfcpServer{
+	var listens []string
+	for _, e := range cfg.Pfcp.Endpoints() {
+		listens = append(listens, e.String())
+	}
+	s := &PfcpServer{
 		cfg:          cfg,
-		listen:       listen,
+		listens:      listens,
 		nodeID:       cfg.Pfcp.NodeID,
 		rcvCh:        make(chan ReceivePacket, RECEIVE_CHANNEL_LEN),
 		srCh:         make(chan report.SessReport, REPORT_CHANNEL_LEN),
@@ -75,8 +93,16 @@ func NewPfcpServer(cfg *factory.Config, driver forwarder.Driver) *PfcpServer {
 		rnodes:       make(map[string]*RemoteNode),
 		txTrans:      make(map[string]*TxTransaction),
 		rxTrans:      make(map[string]*RxTransaction),
-		log:          logger.PfcpLog.WithField(logger_util.FieldListenAddr, listen),
+		peerConns:    make(map[string]*net.UDPConn),
+		log:          logger.PfcpLog.WithField(logger_util.FieldListenAddr, strings.Join(listens, ",")),
+	}
+	s.filter = newPeerFilter(cfg.Pfcp, s.log)
+	s.loadCtl = newLoadControl(cfg.LoadControl, s.recoveryTime)
+	s.lnode.SetLimits(cfg.Limits.GlobalLimits())
+	if cfg.Buffer != nil {
+		s.lnode.SetBufferLimits(cfg.Buffer.MaxPackets, cfg.Buffer.MaxBytes)
 	}
+	return s
 }
 
 func (s *PfcpServer) main(wg *sync.WaitGroup) {
@@ -87,113 +113,154 @@ func (s *PfcpServer) main(wg *sync.WaitGroup) {
 		}
 
 		s.log.Infoln("pfcp server stopped")
+		s.workers.stop()
 		s.stopTrTimers()
+		s.stopInactivityTimers()
+		s.stopMACAgingTimers()
+		s.stopTimeQuotaTimers()
+		s.stopQoSMonitoringTimers()
+		s.stopDropSampleTimers()
+		s.stopDDNTimers()
+		s.StopCapture()
 		close(s.rcvCh)
 		close(s.srCh)
 		close(s.trToCh)
 		wg.Done()
 	}()
 
-	var err error
-	laddr, err := net.ResolveUDPAddr("udp4", s.listen)
-	if err != nil {
-		s.log.Errorf("Resolve err: %+v", err)
-		return
+	conns := make([]*net.UDPConn, 0, len(s.listens))
+	for _, listen := range s.listens {
+		laddr, err := net.ResolveUDPAddr("udp4", listen)
+		if err != nil {
+			s.log.Errorf("Resolve err: %+v", err)
+			closeConns(conns)
+			return
+		}
+		conn, err := net.ListenUDP("udp4", laddr)
+		if err != nil {
+			s.log.Errorf("Listen err: %+v", err)
+			closeConns(conns)
+			return
+		}
+		conns = append(conns, conn)
 	}
+	s.conn = conns[0]
+	s.extraConns = conns[1:]
 
-	conn, err := net.ListenUDP("udp4", laddr)
-	if err != nil {
-		s.log.Errorf("Listen err: %+v", err)
-		return
-	}
-	s.conn = conn
+	s.workers = newSessWorkers(s.numWorkers(), s.cfg.Pfcp.QueueLen(), s.log)
 
-	wg.Add(1)
-	go s.receiver(wg)
+	for _, conn := range conns {
+		wg.Add(1)
+		go s.receiver(wg, conn)
+	}
+	receivers := len(conns)
 
 	for {
 		select {
 		case sr := <-s.srCh:
 			s.log.Tracef("receive SessReport from srCh")
-			s.ServeReport(&sr)
+			s.workers.post(sr.SEID, func() {
+				s.ServeReport(&sr)
+			})
 		case rcvPkt := <-s.rcvCh:
 			s.log.Tracef("receive buf(len=%d) from rcvCh", len(rcvPkt.Buf))
 			if len(rcvPkt.Buf) == 0 {
 				// receiver closed
-				return
-			}
-
-			msg, err := message.Parse(rcvPkt.Buf)
-			if err != nil {
-				s.log.Errorln(err)
-				s.log.Tracef("ignored undecodable message:\n%+v", hex.Dump(rcvPkt.Buf))
-				continue
-			}
-
-			// This prevents malformed packets with inconsistent length fields
-			if err = validatePfcpPacketLength(rcvPkt.Buf); err != nil {
-				s.log.Warnf("Invalid PFCP packet from %s: %v", rcvPkt.RemoteAddr, err)
-				s.log.Tracef("Rejected packet:\n%+v", hex.Dump(rcvPkt.Buf))
+				receivers--
+				if receivers == 0 {
+					return
+				}
 				continue
 			}
 
-			trID := fmt.Sprintf("%s-%d", rcvPkt.RemoteAddr, msg.Sequence())
-			if isRequest(msg) {
-				s.log.Tracef("receive req pkt from %s", trID)
-				rx, ok := s.rxTrans[trID]
-				if !ok {
-					rx = NewRxTransaction(s, rcvPkt.RemoteAddr, msg.Sequence())
-					s.rxTrans[trID] = rx
-				}
-				needDispatch, err1 := rx.recv(msg, ok)
-				if err1 != nil {
-					s.log.Warnf("rcvCh: %v", err1)
-					continue
-				} else if !needDispatch {
-					s.log.Debugf("rcvCh: rxtr[%s] req no need to dispatch", trID)
-					continue
-				}
-				err = s.reqDispacher(msg, rcvPkt.RemoteAddr)
-				if err != nil {
-					s.log.Errorln(err)
-					s.log.Tracef("ignored undecodable message:\n%+v", hex.Dump(rcvPkt.Buf))
-				}
-			} else if isResponse(msg) {
-				s.log.Tracef("receive rsp pkt from %s", trID)
-				tx, ok := s.txTrans[trID]
-				if !ok {
-					s.log.Debugf("rcvCh: No txtr[%s] found for rsp", trID)
-					continue
-				}
-				req := tx.recv(msg)
-				err = s.rspDispacher(msg, rcvPkt.RemoteAddr, req)
-				if err != nil {
-					s.log.Errorln(err)
-					s.log.Tracef("ignored undecodable message:\n%+v", hex.Dump(rcvPkt.Buf))
-				}
-			}
+			s.serveMsg(rcvPkt)
 		case trTo := <-s.trToCh:
 			s.log.Tracef("receive tr timeout (%v) from trToCh", trTo)
-			if trTo.TrType == TX {
-				tx, ok := s.txTrans[trTo.TrID]
-				if !ok {
-					s.log.Warnf("trToCh: txtr[%s] not found", trTo.TrID)
-					continue
-				}
-				tx.handleTimeout()
-			} else { // RX
-				rx, ok := s.rxTrans[trTo.TrID]
-				if !ok {
-					s.log.Warnf("trToCh: rxtr[%s] not found", trTo.TrID)
-					continue
-				}
-				rx.handleTimeout()
-			}
+			s.handleTransTimeout(trTo)
 		}
 	}
 }
 
-func (s *PfcpServer) receiver(wg *sync.WaitGroup) {
+// serveMsg handles a received message on the main goroutine: the requests
+// go through their rx transaction, the responses end their tx transaction
+func (s *PfcpServer) serveMsg(rcvPkt ReceivePacket) {
+	if s.serveVersionNotSupported(rcvPkt.Buf, rcvPkt.RemoteAddr) {
+		return
+	}
+
+	msg, err := message.Parse(rcvPkt.Buf)
+	if err != nil {
+		s.log.Errorln(err)
+		s.log.Tracef("ignored undecodable message:\n%+v", hex.Dump(rcvPkt.Buf))
+		if validatePfcpPacketLength(rcvPkt.Buf) == nil {
+			s.serveMalformed(rcvPkt.Buf, rcvPkt.RemoteAddr)
+		}
+		return
+	}
+
+	// This prevents malformed packets with inconsistent length fields
+	if err = validatePfcpPacketLength(rcvPkt.Buf); err != nil {
+		s.log.Warnf("Invalid PFCP packet from %s: %v", rcvPkt.RemoteAddr, err)
+		s.log.Tracef("Rejected packet:\n%+v", hex.Dump(rcvPkt.Buf))
+		return
+	}
+
+	trID := fmt.Sprintf("%s-%d", rcvPkt.RemoteAddr, msg.Sequence())
+	if isRequest(msg) {
+		s.log.Tracef("receive req pkt from %s", trID)
+		if !s.recvReq(rcvPkt.RemoteAddr, msg.Sequence()) {
+			return
+		}
+		err = s.reqDispacher(msg, rcvPkt.RemoteAddr)
+		if err != nil {
+			s.log.Errorln(err)
+			s.log.Tracef("ignored undecodable message:\n%+v", hex.Dump(rcvPkt.Buf))
+		}
+	} else if isResponse(msg) {
+		s.log.Tracef("receive rsp pkt from %s", trID)
+		s.trMu.Lock()
+		tx, ok := s.txTrans[trID]
+		if !ok {
+			s.trMu.Unlock()
+			s.log.Debugf("rcvCh: No txtr[%s] found for rsp", trID)
+			return
+		}
+		req := tx.recv(msg)
+		s.trMu.Unlock()
+		err = s.rspDispacher(msg, rcvPkt.RemoteAddr, req)
+		if err != nil {
+			s.log.Errorln(err)
+			s.log.Tracef("ignored undecodable message:\n%+v", hex.Dump(rcvPkt.Buf))
+		}
+	} else {
+		// an unknown message type is silently discarded
+		s.log.Debugf("ignored message type %d from %s", msg.MessageType(), rcvPkt.RemoteAddr)
+	}
+}
+
+// recvReq starts the rx transaction of a received request, or retransmits
+// its response; it reports whether the request is to be handled
+func (s *PfcpServer) recvReq(addr net.Addr, seq uint32) bool {
+	trID := fmt.Sprintf("%s-%d", addr, seq)
+	s.trMu.Lock()
+	rx, ok := s.rxTrans[trID]
+	if !ok {
+		rx = NewRxTransaction(s, addr, seq)
+		s.rxTrans[trID] = rx
+	}
+	needDispatch, err := rx.recv(nil, ok)
+	s.trMu.Unlock()
+	if err != nil {
+		s.log.Warnf("rcvCh: %v", err)
+		return false
+	} else if !needDispatch {
+		s.log.Debugf("rcvCh: rxtr[%s] req no need to dispatch", trID)
+		return false
+	}
+	return true
+}
+
+func (s *PfcpServer) receiver(wg *sync.WaitGroup, conn *net.UDPConn) {
 	defer func() {
 		if p := recover(); p != nil {
 			// Print stack for panic to log. Fatalf() will let program exit.
@@ -207,7 +274,7 @@ func (s *PfcpServer) receiver(wg *sync.WaitGroup) {
 	buf := make([]byte, MAX_PFCP_MSG_LEN)
 	for {
 		s.log.Tracef("receiver starts to read...")
-		n, addr, err := s.conn.ReadFrom(buf)
+		n, addr, err := conn.ReadFrom(buf)
 		if err != nil {
 			s.log.Errorf("%+v", err)
 			s.rcvCh <- ReceivePacket{}
@@ -215,6 +282,14 @@ func (s *PfcpServer) receiver(wg *sync.WaitGroup) {
 		}
 
 		s.log.Tracef("receiver reads message(len=%d)", n)
+		if !s.filter.accept(addr, time.Now()) {
+			continue
+		}
+		s.bindPeer(addr, conn)
+		s.captureMsg(conn.LocalAddr(), addr, false, buf[:n])
+		if s.serveHeartbeat(buf[:n], addr) {
+			continue
+		}
 		msgBuf := make([]byte, n)
 		copy(msgBuf, buf)
 		s.rcvCh <- ReceivePacket{
@@ -224,8 +299,52 @@ func (s *PfcpServer) receiver(wg *sync.WaitGroup) {
 	}
 }
 
+// handleTransTimeout retransmits a request or forgets a transaction; the
+// requests never answered are dispatched once the transaction is gone
+func (s *PfcpServer) handleTransTimeout(trTo TransactionTimeout) {
+	s.trMu.Lock()
+	if trTo.TrType == RX {
+		rx, ok := s.rxTrans[trTo.TrID]
+		if ok {
+			rx.handleTimeout()
+		}
+		s.trMu.Unlock()
+		if !ok {
+			s.log.Warnf("trToCh: rxtr[%s] not found", trTo.TrID)
+		}
+		return
+	}
+
+	tx, ok := s.txTrans[trTo.TrID]
+	if !ok {
+		s.trMu.Unlock()
+		s.log.Warnf("trToCh: txtr[%s] not found", trTo.TrID)
+		return
+	}
+	expired := tx.handleTimeout()
+	s.trMu.Unlock()
+	if !expired {
+		return
+	}
+	err := s.txtoDispacher(tx.req, tx.raddr)
+	if err != nil {
+		tx.log.Errorf("txtoDispacher: %v", err)
+	}
+}
+
+// numWorkers returns the number of session workers configured, or else the
+// number of CPUs
+func (s *PfcpServer) numWorkers() int {
+	return s.cfg.Pfcp.NumWorkers()
+}
+
 func (s *PfcpServer) Start(wg *sync.WaitGroup) {
 	s.log.Infoln("starting pfcp server")
+	if c := s.cfg.Pfcp.Capture; c != nil && c.Enable {
+		if err := s.StartCapture(*c); err != nil {
+			s.log.Errorln(err)
+		}
+	}
 	wg.Add(1)
 	go s.main(wg)
 	s.log.Infoln("pfcp server started")
@@ -233,14 +352,61 @@ func (s *PfcpServer) Start(wg *sync.WaitGroup) {
 
 func (s *PfcpServer) Stop() {
 	s.log.Infoln("Stopping pfcp server")
-	if s.conn != nil {
-		err := s.conn.Close()
+	for _, conn := range append([]*net.UDPConn{s.conn}, s.extraConns...) {
+		if conn == nil {
+			continue
+		}
+		err := conn.Close()
 		if err != nil {
 			s.log.Errorf("Stop pfcp server err: %+v", err)
 		}
 	}
 }
 
+func closeConns(conns []*net.UDPConn) {
+	for _, conn := range conns {
+		conn.Close()
+	}
+}
+
+// bindPeer records the endpoint a peer sends to, so that the messages to
+// the peer are sent from the same address and port
+func (s *PfcpServer) bindPeer(addr net.Addr, conn *net.UDPConn) {
+	a, ok := addr.(*net.UDPAddr)
+	if !ok {
+		return
+	}
+	ip := a.IP.String()
+	s.peerMu.RLock()
+	c, found := s.peerConns[ip]
+	s.peerMu.RUnlock()
+	if conn == s.conn && !found || conn == c {
+		return
+	}
+	s.peerMu.Lock()
+	if conn == s.conn {
+		delete(s.peerConns, ip)
+	} else {
+		s.peerConns[ip] = conn
+	}
+	s.peerMu.Unlock()
+}
+
+// connTo returns the connection of the endpoint a peer sends to, the first
+// endpoint if the peer is unknown
+func (s *PfcpServer) connTo(addr net.Addr) *net.UDPConn {
+	a, ok := addr.(*net.UDPAddr)
+	if !ok {
+		return s.conn
+	}
+	s.peerMu.RLock()
+	defer s.peerMu.RUnlock()
+	if c, ok := s.peerConns[a.IP.String()]; ok {
+		return c
+	}
+	return s.conn
+}
+
 func (s *PfcpServer) NewNode(id string, addr net.Addr, driver forwarder.Driver) *RemoteNode {
 	n := NewRemoteNode(
 		id,
@@ -249,16 +415,31 @@ func (s *PfcpServer) NewNode(id string, addr net.Addr, driver forwarder.Driver)
 		driver,
 		s.log.WithField(logger_util.FieldControlPlaneNodeID, id),
 	)
+	if s.cfg != nil {
+		n.limit = s.cfg.Limits.NodeLimits(id)
+	}
+	s.captureNode(id, addr)
 	n.log.Infoln("New node")
 	return n
 }
 
+// rnode returns the remote node associated with a Node ID
+func (s *PfcpServer) rnode(id string) (*RemoteNode, bool) {
+	s.nodeMu.RLock()
+	defer s.nodeMu.RUnlock()
+	n, ok := s.rnodes[id]
+	return n, ok
+}
+
 func (s *PfcpServer) UpdateNodeID(n *RemoteNode, newId string) {
 	s.log.Infof("Update nodeId %q to %q", n.ID, newId)
+	s.nodeMu.Lock()
+	defer s.nodeMu.Unlock()
 	delete(s.rnodes, n.ID)
 	n.ID = newId
 	n.log = s.log.WithField(logger_util.FieldControlPlaneNodeID, newId)
 	s.rnodes[newId] = n
+	s.captureNode(newId, n.addr)
 }
 
 func (s *PfcpServer) NotifySessReport(sr report.SessReport) {
@@ -278,11 +459,34 @@ func (s *PfcpServer) PopBufPkt(seid uint64, pdrid uint16) ([]byte, bool) {
 	return sess.Pop(pdrid)
 }
 
+func (s *PfcpServer) DropBufPkt(seid uint64, pdrid uint16) bool {
+	sess, err := s.lnode.Sess(seid)
+	if err != nil {
+		s.log.Errorln(err)
+		return false
+	}
+	usars, ok := sess.Drop(pdrid)
+	if len(usars) > 0 {
+		addr, err := s.reportAddr(sess)
+		if err != nil {
+			s.log.Errorln(err)
+			return ok
+		}
+		err = s.serveUSAReport(addr, seid, usars)
+		if err != nil {
+			s.log.Errorln(err)
+		}
+	}
+	return ok
+}
+
 func (s *PfcpServer) sendReqTo(msg message.Message, addr net.Addr) error {
 	if !isRequest(msg) {
 		return errors.Errorf("sendReqTo: invalid req type(%d)", msg.MessageType())
 	}
 
+	s.trMu.Lock()
+	defer s.trMu.Unlock()
 	txtr := NewTxTransaction(s, addr, s.txSeq)
 	s.txSeq++
 	s.txTrans[txtr.id] = txtr
@@ -297,6 +501,8 @@ func (s *PfcpServer) sendRspTo(msg message.Message, addr net.Addr) error {
 
 	// find transaction
 	trID := fmt.Sprintf("%s-%d", addr, msg.Sequence())
+	s.trMu.Lock()
+	defer s.trMu.Unlock()
 	rxtr, ok := s.rxTrans[trID]
 	if !ok {
 		return errors.Errorf("sendRspTo: rxtr(%s) not found", trID)
@@ -306,6 +512,8 @@ func (s *PfcpServer) sendRspTo(msg message.Message, addr net.Addr) error {
 }
 
 func (s *PfcpServer) stopTrTimers() {
+	s.trMu.Lock()
+	defer s.trMu.Unlock()
 	for _, tx := range s.txTrans {
 		if tx.timer == nil {
 			continue
@@ -323,7 +531,11 @@ func (s *PfcpServer) stopTrTimers() {
 }
 
 func isRequest(msg message.Message) bool {
-	switch msg.MessageType() {
+	return isRequestType(msg.MessageType())
+}
+
+func isRequestType(msgType uint8) bool {
+	switch msgType {
 	case message.MsgTypeHeartbeatRequest:
 		return true
 	case message.MsgTypePFDManagementRequest:
@@ -8,6 +8,9 @@ import (
 
 	"github.com/sirupsen/logrus"
 	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"github.com/wmnsk/go-pfcp/ie"
+	"github.com/wmnsk/go-pfcp/message"
 
 	"github.com/free5gc/go-upf/internal/forwarder"
 	"github.com/free5gc/go-upf/internal/report"
@@ -56,6 +59,38 @@ func TestStop(t *testing.T) {
 	}
 }
 
+func TestConnTo(t *testing.T) {
+	s, _, peer := newUDPTestServer(t, forwarder.Empty{})
+	extra, err := net.ListenUDP("udp4", &net.UDPAddr{IP: net.IPv4(127, 0, 0, 1)})
+	require.NoError(t, err)
+	s.extraConns = []*net.UDPConn{extra}
+	s.peerConns = make(map[string]*net.UDPConn)
+
+	smf := peer.LocalAddr()
+	assert.Equal(t, s.conn, s.connTo(smf))
+
+	// answered from the endpoint the peer sends to
+	s.bindPeer(smf, extra)
+	assert.Equal(t, extra, s.connTo(smf))
+	req, err := message.NewHeartbeatRequest(1, ie.NewRecoveryTimeStamp(time.Now()), nil).Marshal()
+	require.NoError(t, err)
+	assert.True(t, s.serveHeartbeat(req, smf))
+	err = peer.SetReadDeadline(time.Now().Add(100 * time.Millisecond))
+	require.NoError(t, err)
+	b := make([]byte, MAX_PFCP_MSG_LEN)
+	_, from, err := peer.ReadFrom(b)
+	require.NoError(t, err)
+	assert.Equal(t, extra.LocalAddr().String(), from.String())
+
+	s.bindPeer(smf, s.conn)
+	assert.Equal(t, s.conn, s.connTo(smf))
+	assert.Empty(t, s.peerConns)
+
+	s.Stop()
+	assert.True(t, isConnClosed(s.conn))
+	assert.True(t, isConnClosed(extra))
+}
+
 func TestNewNode(t *testing.T) {
 	s := &PfcpServer{
 		log: logrus.WithField(logger_util.FieldControlPlaneNodeID, "127.0.0.1"),
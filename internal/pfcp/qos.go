@@ -0,0 +1,548 @@
+package pfcp
+
+import (
+	"net"
+	"sort"
+	"time"
+
+	"github.com/pkg/errors"
+	"github.com/wmnsk/go-pfcp/ie"
+	"github.com/wmnsk/go-pfcp/message"
+
+	"github.com/free5gc/go-upf/internal/report"
+)
+
+// QOS_PROBE_INTERVAL is the interval of the QoS monitoring packets sent in
+// the QoS flows monitored
+const QOS_PROBE_INTERVAL = time.Second
+
+const (
+	// Requested QoS Monitoring, Packet Delay Thresholds and QoS Monitoring
+	// Measurement flags
+	QOS_MON_DL = 0x01
+	QOS_MON_UL = 0x02
+	QOS_MON_RP = 0x04
+
+	// Reporting Frequency flags
+	QOS_RPT_EVETT = 0x01
+	QOS_RPT_PERIO = 0x02
+	QOS_RPT_SESRL = 0x04
+
+	// Report Type of the Session Reports, TS 29.244 8.2.21
+	REPORT_TYPE_SESR = 0x20
+)
+
+// qosProbeReport is notified when the QoS monitoring packets of a session
+// are to be sent
+type qosProbeReport struct {
+	gen uint32
+}
+
+func (r qosProbeReport) Type() report.ReportType {
+	return report.INTERNAL
+}
+
+// qosPeriodReport is notified when the Measurement Period of an SRR has
+// elapsed
+type qosPeriodReport struct {
+	SRRID uint8
+	gen   uint32
+}
+
+func (r qosPeriodReport) Type() report.ReportType {
+	return report.INTERNAL
+}
+
+// QoSMonitoring is a QoS Monitoring per QoS flow Control Information of an
+// SRR. The thresholds are in milliseconds.
+type QoSMonitoring struct {
+	QFIs       []uint8
+	Requested  uint8 // QOS_MON_*
+	Frequency  uint8 // QOS_RPT_*
+	Thresholds *ie.PacketDelayThresholdsFields
+	MinWait    time.Duration
+	Period     time.Duration
+	lastEvent  map[uint8]time.Time // key: QFI
+}
+
+func (m *QoSMonitoring) monitors(qfi uint8) bool {
+	for _, q := range m.QFIs {
+		if q == qfi {
+			return true
+		}
+	}
+	return false
+}
+
+// exceeded reports whether a requested delay of a measurement exceeds its
+// Packet Delay Threshold
+func (m *QoSMonitoring) exceeded(r report.QoSMonitoringReport) bool {
+	t := m.Thresholds
+	if t == nil {
+		return false
+	}
+	over := func(flag uint8, d time.Duration, ms uint32) bool {
+		return m.Requested&flag != 0 && t.Flags&flag != 0 && d > time.Duration(ms)*time.Millisecond
+	}
+	return over(QOS_MON_DL, r.DL, t.DownlinkPacketDelayThresholds) ||
+		over(QOS_MON_UL, r.UL, t.UplinkPacketDelayThresholds) ||
+		over(QOS_MON_RP, r.RP, t.RoundTripPacketDelayThresholds)
+}
+
+// SRRInfo is a Session Reporting Rule of a session
+type SRRInfo struct {
+	QoSMonitoring []*QoSMonitoring
+	measured      map[uint8]report.QoSMonitoringReport // key: QFI, latest measurement
+	period        *time.Timer
+	periodGen     uint32
+}
+
+func (i *SRRInfo) stopPeriod() {
+	if i.period == nil {
+		return
+	}
+	i.period.Stop()
+	i.period = nil
+}
+
+// measurementPeriod returns the shortest Measurement Period of the periodic
+// QoS monitoring of the SRR
+func (i *SRRInfo) measurementPeriod() time.Duration {
+	var period time.Duration
+	for _, m := range i.QoSMonitoring {
+		if m.Frequency&QOS_RPT_PERIO == 0 || m.Period <= 0 {
+			continue
+		}
+		if period == 0 || m.Period < period {
+			period = m.Period
+		}
+	}
+	return period
+}
+
+// srrPlans is the SRRs created, updated and removed by a request
+type srrPlans struct {
+	create []*SRRPlan
+	update []*SRRPlan
+	remove []uint8
+}
+
+// SRRPlan is a Create SRR or an Update SRR of a request
+type SRRPlan struct {
+	SRRID         uint8
+	QoSMonitoring []*QoSMonitoring
+}
+
+// parseSRR parses a Create SRR or an Update SRR
+func parseSRR(i *ie.IE) (*SRRPlan, error) {
+	var ies []*ie.IE
+	var err error
+	switch i.Type {
+	case ie.CreateSRR:
+		ies, err = i.CreateSRR()
+	case ie.UpdateSRR:
+		ies, err = i.UpdateSRR()
+	default:
+		return nil, errors.Errorf("parseSRR: unexpected IE type %d", i.Type)
+	}
+	if err != nil {
+		return nil, errors.Wrap(err, "parseSRR")
+	}
+
+	r := new(SRRPlan)
+	hasID := false
+	for _, x := range ies {
+		switch x.Type {
+		case ie.SRRID:
+			r.SRRID, err = x.SRRID()
+			if err != nil {
+				return nil, errors.Wrap(err, "parseSRR: SRRID")
+			}
+			hasID = true
+		case ie.QoSMonitoringPerQoSFlowControlInformation:
+			m, err1 := parseQoSMonitoring(x)
+			if err1 != nil {
+				return nil, err1
+			}
+			r.QoSMonitoring = append(r.QoSMonitoring, m)
+		}
+	}
+	if !hasID {
+		return nil, errors.Wrap(ErrMissingMandatoryIE, "parseSRR: SRRID")
+	}
+	return r, nil
+}
+
+func parseQoSMonitoring(i *ie.IE) (*QoSMonitoring, error) {
+	ies, err := i.QoSMonitoringPerQoSFlowControlInformation()
+	if err != nil {
+		return nil, errors.Wrap(err, "parseQoSMonitoring")
+	}
+
+	m := &QoSMonitoring{lastEvent: make(map[uint8]time.Time)}
+	hasRequested, hasFrequency := false, false
+	for _, x := range ies {
+		switch x.Type {
+		case ie.QFI:
+			qfi, err1 := x.QFI()
+			if err1 != nil {
+				return nil, errors.Wrap(err1, "parseQoSMonitoring: QFI")
+			}
+			m.QFIs = append(m.QFIs, qfi)
+		case ie.RequestedQoSMonitoring:
+			m.Requested, err = x.RequestedQoSMonitoring()
+			if err != nil {
+				return nil, errors.Wrap(err, "parseQoSMonitoring: RequestedQoSMonitoring")
+			}
+			m.Requested &= QOS_MON_DL | QOS_MON_UL | QOS_MON_RP
+			hasRequested = true
+		case ie.ReportingFrequency:
+			m.Frequency, err = x.ReportingFrequency()
+			if err != nil {
+				return nil, errors.Wrap(err, "parseQoSMonitoring: ReportingFrequency")
+			}
+			m.Frequency &= QOS_RPT_EVETT | QOS_RPT_PERIO | QOS_RPT_SESRL
+			hasFrequency = true
+		case ie.PacketDelayThresholds:
+			m.Thresholds, err = x.PacketDelayThresholds()
+			if err != nil {
+				return nil, errors.Wrap(err, "parseQoSMonitoring: PacketDelayThresholds")
+			}
+		case ie.MinimumWaitTime:
+			m.MinWait, err = x.MinimumWaitTime()
+			if err != nil {
+				return nil, errors.Wrap(err, "parseQoSMonitoring: MinimumWaitTime")
+			}
+		case ie.MeasurementPeriod:
+			m.Period, err = x.MeasurementPeriod()
+			if err != nil {
+				return nil, errors.Wrap(err, "parseQoSMonitoring: MeasurementPeriod")
+			}
+		}
+	}
+	if len(m.QFIs) == 0 || !hasRequested || !hasFrequency {
+		return nil, errors.Wrap(ErrMissingMandatoryIE, "parseQoSMonitoring")
+	}
+	if m.Frequency&QOS_RPT_EVETT != 0 && m.Thresholds == nil {
+		return nil, errors.Wrap(ErrMissingConditionalIE, "parseQoSMonitoring: PacketDelayThresholds")
+	}
+	if m.Frequency&QOS_RPT_PERIO != 0 && m.Period <= 0 {
+		return nil, errors.Wrap(ErrMissingConditionalIE, "parseQoSMonitoring: MeasurementPeriod")
+	}
+	return m, nil
+}
+
+// srrError returns the error of an SRR which failed to parse
+func srrError(err error) error {
+	if errors.Is(err, ErrMissingConditionalIE) {
+		return ErrMissingConditionalIE
+	}
+	return ErrMissingMandatoryIE
+}
+
+// ValidateCreateSRR validates CreateSRR without modifying state
+func (s *Sess) ValidateCreateSRR(req *ie.IE) (*SRRPlan, error) {
+	r, err := parseSRR(req)
+	if err != nil {
+		return nil, ruleError(req, srrError(err), err)
+	}
+	return r, nil
+}
+
+// ValidateUpdateSRR validates UpdateSRR without modifying state
+func (s *Sess) ValidateUpdateSRR(req *ie.IE, plan *srrPlans) (*SRRPlan, error) {
+	r, err := parseSRR(req)
+	if err != nil {
+		return nil, ruleError(req, srrError(err), err)
+	}
+	if _, ok := s.SRRIDs[r.SRRID]; !ok && !plan.hasCreate(r.SRRID) {
+		return nil, ruleError(req, ErrRuleNotFound, nil)
+	}
+	return r, nil
+}
+
+// ValidateRemoveSRR validates RemoveSRR without modifying state
+func (s *Sess) ValidateRemoveSRR(req *ie.IE, plan *srrPlans) (uint8, error) {
+	id, err := req.SRRID()
+	if err != nil {
+		return 0, ruleError(req, ErrMissingMandatoryIE, err)
+	}
+	if _, ok := s.SRRIDs[id]; !ok && !plan.hasCreate(id) {
+		return 0, ruleError(req, ErrRuleNotFound, nil)
+	}
+	return id, nil
+}
+
+func (p *srrPlans) hasCreate(id uint8) bool {
+	for _, r := range p.create {
+		if r.SRRID == id {
+			return true
+		}
+	}
+	return false
+}
+
+// applySRRs updates the SRRs of the session from the plan, and arms the
+// QoS monitoring of the session
+func (s *PfcpServer) applySRRs(sess *Sess, plan *srrPlans) {
+	for _, r := range plan.create {
+		if old, ok := sess.SRRIDs[r.SRRID]; ok {
+			old.stopPeriod()
+		}
+		srrInfo := &SRRInfo{
+			QoSMonitoring: r.QoSMonitoring,
+			measured:      make(map[uint8]report.QoSMonitoringReport),
+		}
+		sess.SRRIDs[r.SRRID] = srrInfo
+		s.armQoSPeriod(sess, r.SRRID, srrInfo)
+	}
+	for _, r := range plan.update {
+		srrInfo, ok := sess.SRRIDs[r.SRRID]
+		if !ok {
+			continue
+		}
+		// The QoS Monitoring per QoS flow Control Information replaces the
+		// one of the SRR
+		if len(r.QoSMonitoring) > 0 {
+			srrInfo.QoSMonitoring = r.QoSMonitoring
+			srrInfo.measured = make(map[uint8]report.QoSMonitoringReport)
+		}
+		s.armQoSPeriod(sess, r.SRRID, srrInfo)
+	}
+	for _, id := range plan.remove {
+		if srrInfo, ok := sess.SRRIDs[id]; ok {
+			srrInfo.stopPeriod()
+			delete(sess.SRRIDs, id)
+		}
+	}
+	s.armQoSProbe(sess)
+}
+
+// monitoredQFIs returns the QFIs monitored by the SRRs of the session
+func (s *Sess) monitoredQFIs() []uint8 {
+	set := make(map[uint8]struct{})
+	for _, srrInfo := range s.SRRIDs {
+		for _, m := range srrInfo.QoSMonitoring {
+			for _, qfi := range m.QFIs {
+				set[qfi] = struct{}{}
+			}
+		}
+	}
+	qfis := make([]uint8, 0, len(set))
+	for qfi := range set {
+		qfis = append(qfis, qfi)
+	}
+	sort.Slice(qfis, func(i, j int) bool { return qfis[i] < qfis[j] })
+	return qfis
+}
+
+func (s *Sess) stopQoSProbe() {
+	if s.qosProbe == nil {
+		return
+	}
+	s.qosProbe.Stop()
+	s.qosProbe = nil
+}
+
+func (s *Sess) stopQoSMonitoring() {
+	s.stopQoSProbe()
+	for _, srrInfo := range s.SRRIDs {
+		srrInfo.stopPeriod()
+	}
+}
+
+func (s *PfcpServer) stopQoSMonitoringTimers() {
+	for _, sess := range s.lnode.sess {
+		if sess != nil {
+			sess.stopQoSMonitoring()
+		}
+	}
+}
+
+// armQoSProbe sends QoS monitoring packets every QOS_PROBE_INTERVAL while
+// QoS flows of the session are monitored
+func (s *PfcpServer) armQoSProbe(sess *Sess) {
+	if len(sess.monitoredQFIs()) == 0 {
+		if sess.qosProbe != nil {
+			sess.rnode.driver.StopQoSMonitoring(sess.LocalID)
+		}
+		sess.stopQoSProbe()
+		return
+	}
+	if sess.qosProbe != nil {
+		return
+	}
+	sess.qosProbeGen++
+	lSeid := sess.LocalID
+	r := qosProbeReport{gen: sess.qosProbeGen}
+	sess.qosProbe = time.AfterFunc(QOS_PROBE_INTERVAL, func() {
+		s.NotifySessReport(report.SessReport{
+			SEID:    lSeid,
+			Reports: []report.Report{r},
+		})
+	})
+}
+
+// probeQoS sends a QoS monitoring packet in the QoS flows monitored
+func (s *PfcpServer) probeQoS(sess *Sess, r qosProbeReport) {
+	if r.gen != sess.qosProbeGen {
+		return
+	}
+	sess.qosProbe = nil
+	for _, qfi := range sess.monitoredQFIs() {
+		err := sess.rnode.driver.SendQoSMonitoring(sess.LocalID, qfi)
+		if err != nil {
+			sess.log.Debugf("QFI[%d] QoS monitoring: %v", qfi, err)
+		}
+	}
+	s.armQoSProbe(sess)
+}
+
+func (s *PfcpServer) armQoSPeriod(sess *Sess, srrid uint8, srrInfo *SRRInfo) {
+	srrInfo.stopPeriod()
+	srrInfo.periodGen++
+	period := srrInfo.measurementPeriod()
+	if period <= 0 {
+		return
+	}
+	lSeid := sess.LocalID
+	r := qosPeriodReport{SRRID: srrid, gen: srrInfo.periodGen}
+	srrInfo.period = time.AfterFunc(period, func() {
+		s.NotifySessReport(report.SessReport{
+			SEID:    lSeid,
+			Reports: []report.Report{r},
+		})
+	})
+}
+
+// qosReport is a QoS Monitoring Report of an SRR
+type qosReport struct {
+	SRRID     uint8
+	Requested uint8
+	report.QoSMonitoringReport
+}
+
+// measureQoS records the delays measured in a QoS flow, and returns the
+// reports of the SRRs whose Packet Delay Thresholds are exceeded, at most
+// once per Minimum Wait Time
+func (s *Sess) measureQoS(r report.QoSMonitoringReport) []qosReport {
+	var rpts []qosReport
+	for _, srrid := range s.srrIDs() {
+		srrInfo := s.SRRIDs[srrid]
+		for _, m := range srrInfo.QoSMonitoring {
+			if !m.monitors(r.QFI) {
+				continue
+			}
+			srrInfo.measured[r.QFI] = r
+			if m.Frequency&QOS_RPT_EVETT == 0 || !m.exceeded(r) {
+				continue
+			}
+			if last, ok := m.lastEvent[r.QFI]; ok && r.Time.Sub(last) < m.MinWait {
+				continue
+			}
+			m.lastEvent[r.QFI] = r.Time
+			s.log.Infof("SRR[%#x] QFI[%d] packet delay threshold exceeded", srrid, r.QFI)
+			rpts = append(rpts, qosReport{SRRID: srrid, Requested: m.Requested, QoSMonitoringReport: r})
+		}
+	}
+	return rpts
+}
+
+// expireQoSPeriod returns the reports of the periodic QoS monitoring of an
+// SRR whose Measurement Period has elapsed
+func (s *PfcpServer) expireQoSPeriod(sess *Sess, r qosPeriodReport) []qosReport {
+	srrInfo, ok := sess.SRRIDs[r.SRRID]
+	if !ok || r.gen != srrInfo.periodGen {
+		// a stale timer of an SRR updated or removed
+		return nil
+	}
+	srrInfo.period = nil
+	rpts := srrInfo.reports(r.SRRID, QOS_RPT_PERIO)
+	s.armQoSPeriod(sess, r.SRRID, srrInfo)
+	return rpts
+}
+
+// reports returns the reports of the latest measurements of the QoS
+// monitoring of the SRR with the Reporting Frequency
+func (i *SRRInfo) reports(srrid uint8, frequency uint8) []qosReport {
+	var rpts []qosReport
+	for _, m := range i.QoSMonitoring {
+		if m.Frequency&frequency == 0 {
+			continue
+		}
+		for _, qfi := range m.QFIs {
+			r, ok := i.measured[qfi]
+			if !ok {
+				continue
+			}
+			rpts = append(rpts, qosReport{SRRID: srrid, Requested: m.Requested, QoSMonitoringReport: r})
+		}
+	}
+	return rpts
+}
+
+// releaseQoSReports returns the reports of the QoS monitoring reported on
+// the release of the session
+func (s *Sess) releaseQoSReports() []qosReport {
+	var rpts []qosReport
+	for _, srrid := range s.srrIDs() {
+		rpts = append(rpts, s.SRRIDs[srrid].reports(srrid, QOS_RPT_SESRL)...)
+	}
+	return rpts
+}
+
+func (s *Sess) srrIDs() []uint8 {
+	ids := make([]uint8, 0, len(s.SRRIDs))
+	for id := range s.SRRIDs {
+		ids = append(ids, id)
+	}
+	sort.Slice(ids, func(i, j int) bool { return ids[i] < ids[j] })
+	return ids
+}
+
+// delayMs returns a delay in milliseconds, rounded up
+func delayMs(d time.Duration) uint32 {
+	return uint32((d + time.Millisecond - 1) / time.Millisecond)
+}
+
+// sessionReportIEs returns a Session Report per SRR of the reports
+func sessionReportIEs(rpts []qosReport) []*ie.IE {
+	var ies []*ie.IE
+	srrs := make(map[uint8]int) // value: index of the Session Report
+	var groups [][]*ie.IE
+	for _, r := range rpts {
+		idx, ok := srrs[r.SRRID]
+		if !ok {
+			idx = len(groups)
+			srrs[r.SRRID] = idx
+			groups = append(groups, []*ie.IE{ie.NewSRRID(r.SRRID)})
+		}
+		groups[idx] = append(groups[idx], ie.NewQoSMonitoringReport(
+			ie.NewQFI(r.QFI),
+			ie.NewQoSMonitoringMeasurement(r.Requested,
+				delayMs(r.DL), delayMs(r.UL), delayMs(r.RP)),
+			ie.NewEventTimeStamp(r.Time),
+		))
+	}
+	for _, g := range groups {
+		ies = append(ies, ie.NewSessionReport(g...))
+	}
+	return ies
+}
+
+func (s *PfcpServer) serveSessionReport(addr net.Addr, sess *Sess, rpts []qosReport) error {
+	s.log.Infoln("serveSessionReport")
+
+	req := message.NewSessionReportRequest(
+		0,
+		0,
+		sess.RemoteID,
+		0,
+		0,
+		ie.New(ie.ReportType, []byte{REPORT_TYPE_SESR}),
+	)
+	req.SessionReport = append(req.SessionReport, sessionReportIEs(rpts)...)
+
+	err := s.sendSessReport(sess, req, addr, nil)
+	return errors.Wrap(err, "serveSessionReport")
+}
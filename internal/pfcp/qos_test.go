@@ -0,0 +1,201 @@
+package pfcp
+
+import (
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"github.com/wmnsk/go-pfcp/ie"
+
+	"github.com/free5gc/go-upf/internal/forwarder"
+	"github.com/free5gc/go-upf/internal/report"
+)
+
+// probeDriver records the QFIs of the QoS monitoring packets sent
+type probeDriver struct {
+	forwarder.Empty
+	qfis    []uint8
+	stopped []uint64
+}
+
+func (d *probeDriver) SendQoSMonitoring(lSeid uint64, qfi uint8) error {
+	d.qfis = append(d.qfis, qfi)
+	return nil
+}
+
+func (d *probeDriver) StopQoSMonitoring(lSeid uint64) {
+	d.stopped = append(d.stopped, lSeid)
+}
+
+func TestParseSRR(t *testing.T) {
+	r, err := parseSRR(ie.NewCreateSRR(
+		ie.NewSRRID(1),
+		ie.NewQoSMonitoringPerQoSFlowControlInformation(
+			ie.NewQFI(9),
+			ie.NewQFI(5),
+			ie.NewRequestedQoSMonitoring(1, 0, 1),
+			ie.NewReportingFrequency(1, 1, 1),
+			ie.NewPacketDelayThresholds(0x04, 0, 0, 20),
+			ie.NewMinimumWaitTime(5*time.Second),
+			ie.NewMeasurementPeriod(10*time.Second),
+		),
+	))
+	require.NoError(t, err)
+	assert.Equal(t, uint8(1), r.SRRID)
+	require.Len(t, r.QoSMonitoring, 1)
+	m := r.QoSMonitoring[0]
+	assert.Equal(t, []uint8{9, 5}, m.QFIs)
+	assert.Equal(t, uint8(QOS_MON_DL|QOS_MON_RP), m.Requested)
+	assert.Equal(t, uint8(QOS_RPT_EVETT|QOS_RPT_PERIO|QOS_RPT_SESRL), m.Frequency)
+	require.NotNil(t, m.Thresholds)
+	assert.Equal(t, uint32(20), m.Thresholds.RoundTripPacketDelayThresholds)
+	assert.Equal(t, 5*time.Second, m.MinWait)
+	assert.Equal(t, 10*time.Second, m.Period)
+
+	// event triggered reporting without the Packet Delay Thresholds
+	_, err = parseSRR(ie.NewCreateSRR(
+		ie.NewSRRID(1),
+		ie.NewQoSMonitoringPerQoSFlowControlInformation(
+			ie.NewQFI(9),
+			ie.NewRequestedQoSMonitoring(1, 0, 0),
+			ie.NewReportingFrequency(0, 0, 1),
+		),
+	))
+	assert.ErrorIs(t, err, ErrMissingConditionalIE)
+
+	_, err = parseSRR(ie.NewCreateSRR(ie.NewQoSMonitoringPerQoSFlowControlInformation(
+		ie.NewQFI(9),
+		ie.NewRequestedQoSMonitoring(1, 0, 0),
+		ie.NewReportingFrequency(1, 0, 0),
+	)))
+	assert.ErrorIs(t, err, ErrMissingMandatoryIE)
+}
+
+func TestQoSMonitoring(t *testing.T) {
+	d := &probeDriver{}
+	s, rnode, peer := newUDPTestServer(t, d)
+	sess := rnode.NewSess(0x9a0)
+	defer sess.stopQoSMonitoring()
+
+	s.applySRRs(sess, &srrPlans{
+		create: []*SRRPlan{
+			{
+				SRRID: 1,
+				QoSMonitoring: []*QoSMonitoring{
+					{
+						QFIs:       []uint8{9},
+						Requested:  QOS_MON_RP,
+						Frequency:  QOS_RPT_EVETT | QOS_RPT_SESRL,
+						Thresholds: ie.NewPacketDelayThresholdsFields(0x04, 0, 0, 20),
+						MinWait:    time.Minute,
+						lastEvent:  make(map[uint8]time.Time),
+					},
+				},
+			},
+			{
+				SRRID: 2,
+				QoSMonitoring: []*QoSMonitoring{
+					{
+						QFIs:      []uint8{1},
+						Requested: QOS_MON_DL | QOS_MON_UL,
+						Frequency: QOS_RPT_PERIO,
+						Period:    time.Hour,
+						lastEvent: make(map[uint8]time.Time),
+					},
+				},
+			},
+		},
+	})
+	require.NotNil(t, sess.qosProbe)
+	require.NotNil(t, sess.SRRIDs[2].period)
+	now := time.Now()
+
+	t.Run("probe", func(t *testing.T) {
+		stale := qosProbeReport{gen: sess.qosProbeGen - 1}
+		s.probeQoS(sess, stale)
+		assert.Empty(t, d.qfis)
+
+		s.probeQoS(sess, qosProbeReport{gen: sess.qosProbeGen})
+		assert.Equal(t, []uint8{1, 9}, d.qfis)
+		assert.NotNil(t, sess.qosProbe)
+	})
+
+	t.Run("threshold exceeded", func(t *testing.T) {
+		r := report.QoSMonitoringReport{QFI: 9, RP: 10 * time.Millisecond, Time: now}
+		assert.Empty(t, sess.measureQoS(r))
+
+		r.RP = 25 * time.Millisecond
+		rpts := sess.measureQoS(r)
+		require.Len(t, rpts, 1)
+		assert.Equal(t, uint8(1), rpts[0].SRRID)
+
+		// reported again after the Minimum Wait Time only
+		r.Time = now.Add(30 * time.Second)
+		assert.Empty(t, sess.measureQoS(r))
+		r.Time = now.Add(time.Minute)
+		assert.Len(t, sess.measureQoS(r), 1)
+	})
+
+	t.Run("periodic", func(t *testing.T) {
+		r := report.QoSMonitoringReport{QFI: 1, DL: 3 * time.Millisecond, UL: 2 * time.Millisecond, Time: now}
+		assert.Empty(t, sess.measureQoS(r))
+
+		gen := sess.SRRIDs[2].periodGen
+		rpts := s.expireQoSPeriod(sess, qosPeriodReport{SRRID: 2, gen: gen})
+		require.Len(t, rpts, 1)
+		assert.Equal(t, uint8(2), rpts[0].SRRID)
+		assert.NotEqual(t, gen, sess.SRRIDs[2].periodGen)
+		assert.Empty(t, s.expireQoSPeriod(sess, qosPeriodReport{SRRID: 2, gen: gen}))
+
+		err := s.serveSessionReport(peer.LocalAddr(), sess, rpts)
+		require.NoError(t, err)
+		msg, ok := recvSessReportReq(t, peer)
+		require.True(t, ok)
+		assert.Equal(t, []byte{REPORT_TYPE_SESR}, msg.ReportType.Payload)
+		require.Len(t, msg.SessionReport, 1)
+		id, err := msg.SessionReport[0].SRRID()
+		require.NoError(t, err)
+		assert.Equal(t, uint8(2), id)
+		ies, err := msg.SessionReport[0].SessionReport()
+		require.NoError(t, err)
+		var qmr []*ie.IE
+		for _, x := range ies {
+			if x.Type == ie.QoSMonitoringReport {
+				qmr, err = x.QoSMonitoringReport()
+				require.NoError(t, err)
+			}
+		}
+		require.NotEmpty(t, qmr)
+		for _, x := range qmr {
+			if x.Type != ie.QoSMonitoringMeasurement {
+				continue
+			}
+			f, err := x.QoSMonitoringMeasurement()
+			require.NoError(t, err)
+			assert.True(t, f.HasDL())
+			assert.True(t, f.HasUL())
+			assert.False(t, f.HasRP())
+			assert.Equal(t, uint32(3), f.DownlinkPacketDelay)
+			assert.Equal(t, uint32(2), f.UplinkPacketDelay)
+		}
+	})
+
+	t.Run("session release", func(t *testing.T) {
+		rpts := sess.releaseQoSReports()
+		require.Len(t, rpts, 1)
+		assert.Equal(t, uint8(1), rpts[0].SRRID)
+		assert.Equal(t, uint8(9), rpts[0].QFI)
+	})
+
+	t.Run("removed", func(t *testing.T) {
+		s.applySRRs(sess, &srrPlans{remove: []uint8{1}})
+		assert.NotNil(t, sess.qosProbe)
+		assert.Empty(t, d.stopped)
+
+		s.applySRRs(sess, &srrPlans{remove: []uint8{2}})
+		assert.Empty(t, sess.SRRIDs)
+		assert.Nil(t, sess.qosProbe)
+		assert.Equal(t, []uint64{sess.LocalID}, d.stopped)
+	})
+}
@@ -0,0 +1,224 @@
+package pfcp
+
+import (
+	"time"
+
+	"github.com/wmnsk/go-pfcp/ie"
+
+	"github.com/free5gc/go-upf/internal/forwarder"
+	"github.com/free5gc/go-upf/internal/report"
+)
+
+// TIME_QUOTA_SAMPLE is the period the activity of a session is sampled with
+// to measure the time used of a Time Quota
+const TIME_QUOTA_SAMPLE = 5 * time.Second
+
+// timeQuotaReport is notified to measure the time used of the Time Quota of
+// a URR. The forwarder does not measure time quotas: the sample periods the
+// session was active in are counted, those without user plane traffic are
+// not, as the time is measured with an inactivity detection.
+type timeQuotaReport struct {
+	URRID uint32
+	gen   uint32
+}
+
+func (r timeQuotaReport) Type() report.ReportType {
+	return report.INTERNAL
+}
+
+func (u *URRInfo) stopTimeQuota() {
+	if u.timeQuota == nil {
+		return
+	}
+	u.timeQuota.Stop()
+	u.timeQuota = nil
+}
+
+func (s *Sess) stopTimeQuotas() {
+	for _, urrInfo := range s.URRIDs {
+		urrInfo.stopTimeQuota()
+	}
+}
+
+func (s *PfcpServer) stopTimeQuotaTimers() {
+	for _, sess := range s.lnode.sess {
+		if sess != nil {
+			sess.stopTimeQuotas()
+		}
+	}
+}
+
+// applyQuotas arms the Time Quota of the URRs granted one by the plan, and
+// switches the PDRs of the URRs granted a new quota back from the FAR ID
+// for Quota Action
+func (s *PfcpServer) applyQuotas(sess *Sess, plan *forwarder.ModificationPlan) {
+	for _, p := range plan.RemoveURRs {
+		if urrInfo, ok := sess.URRIDs[p.URRID]; ok {
+			urrInfo.stopTimeQuota()
+		}
+	}
+	for _, ps := range [][]*forwarder.URRPlan{plan.CreateURRs, plan.UpdateURRs} {
+		for _, p := range ps {
+			urrInfo, ok := sess.URRIDs[p.URRID]
+			if !ok || urrInfo.removed {
+				continue
+			}
+			if p.TimeQuota != nil {
+				s.armTimeQuota(sess, p.URRID, urrInfo)
+			}
+			if p.Op == forwarder.OpUpdate && (p.VolumeQuota || p.TimeQuota != nil) {
+				sess.restoreQuotaAction(p.URRID)
+			}
+		}
+	}
+}
+
+func (s *PfcpServer) armTimeQuota(sess *Sess, urrid uint32, urrInfo *URRInfo) {
+	urrInfo.stopTimeQuota()
+	urrInfo.timeQuotaGen++
+	if urrInfo.TimeQuota <= 0 {
+		return
+	}
+	urrInfo.timeUsed = 0
+	urrInfo.timeChecked = sess.lastActivity()
+	if urrInfo.timeChecked.IsZero() {
+		urrInfo.timeChecked = time.Now()
+	}
+	s.sampleTimeQuota(sess, urrid, urrInfo)
+}
+
+// sampleTimeQuota schedules the next measure of the time used of a Time
+// Quota
+func (s *PfcpServer) sampleTimeQuota(sess *Sess, urrid uint32, urrInfo *URRInfo) {
+	d := urrInfo.TimeQuota - urrInfo.timeUsed
+	if d > TIME_QUOTA_SAMPLE {
+		d = TIME_QUOTA_SAMPLE
+	}
+	lSeid := sess.LocalID
+	r := timeQuotaReport{URRID: urrid, gen: urrInfo.timeQuotaGen}
+	urrInfo.timeQuota = time.AfterFunc(d, func() {
+		s.NotifySessReport(report.SessReport{
+			SEID:    lSeid,
+			Reports: []report.Report{r},
+		})
+	})
+}
+
+// checkTimeQuota measures the time used of the Time Quota of a URR: the
+// time since the previous measure is counted if user plane traffic was seen
+// since. Once the Time Quota is used up, it returns the usage report of the
+// URR and applies its quota action.
+func (s *PfcpServer) checkTimeQuota(sess *Sess, r timeQuotaReport) []report.USAReport {
+	urrInfo, ok := sess.URRIDs[r.URRID]
+	if !ok || urrInfo.removed || r.gen != urrInfo.timeQuotaGen {
+		// a stale timer of a Time Quota granted again
+		return nil
+	}
+	urrInfo.timeQuota = nil
+
+	now := time.Now()
+	if last := sess.lastActivity(); last.After(urrInfo.timeChecked) {
+		urrInfo.timeUsed += now.Sub(urrInfo.timeChecked)
+	}
+	urrInfo.timeChecked = now
+	if urrInfo.timeUsed < urrInfo.TimeQuota {
+		s.sampleTimeQuota(sess, r.URRID, urrInfo)
+		return nil
+	}
+	return sess.expireTimeQuota(r.URRID)
+}
+
+// expireTimeQuota returns the usage report of a URR whose Time Quota is
+// used up, and applies its quota action
+func (s *Sess) expireTimeQuota(urrid uint32) []report.USAReport {
+	urrInfo := s.URRIDs[urrid]
+	s.log.Infof("URR[%#x] time quota exhausted", urrid)
+
+	var usars []report.USAReport
+	if urrInfo.RptTrig.TIMQU() {
+		usars = s.queryURRReport(urrid, report.USAR_TRIG_TIMQU)
+	}
+	s.applyQuotaAction(urrid)
+	return usars
+}
+
+// applyQuotaAction switches the PDRs of a URR whose quota is exhausted to
+// the FAR ID for Quota Action of the URR, e.g. a FAR redirecting the traffic
+// to a top-up portal
+func (s *Sess) applyQuotaAction(urrid uint32) {
+	urrInfo, ok := s.URRIDs[urrid]
+	if !ok || urrInfo.removed || urrInfo.QuotaFARID == nil {
+		return
+	}
+	farid := *urrInfo.QuotaFARID
+	if _, ok := s.FARIDs[farid]; !ok {
+		s.log.Warnf("URR[%#x] FAR ID for Quota Action[%#x] not found", urrid, farid)
+		return
+	}
+
+	switched := s.switchPDRFARs(func(pdrInfo *PDRInfo) (uint32, bool) {
+		if _, ok := pdrInfo.RelatedURRIDs[urrid]; !ok || pdrInfo.restoreFARID != nil {
+			return 0, false
+		}
+		return farid, true
+	})
+	for _, pdrInfo := range switched {
+		restore := pdrInfo.FARID
+		pdrInfo.restoreFARID = &restore
+		pdrInfo.quotaURRID = urrid
+		pdrInfo.FARID = farid
+	}
+}
+
+// restoreQuotaAction switches the PDRs switched by the quota action of a URR
+// back to their FAR
+func (s *Sess) restoreQuotaAction(urrid uint32) {
+	switched := s.switchPDRFARs(func(pdrInfo *PDRInfo) (uint32, bool) {
+		if pdrInfo.restoreFARID == nil || pdrInfo.quotaURRID != urrid {
+			return 0, false
+		}
+		return *pdrInfo.restoreFARID, true
+	})
+	for _, pdrInfo := range switched {
+		pdrInfo.FARID = *pdrInfo.restoreFARID
+		pdrInfo.restoreFARID = nil
+	}
+}
+
+// switchPDRFARs updates the FAR ID of the PDRs selected by farOf, and
+// returns the PDRs updated; none is if the forwarder fails to update them
+func (s *Sess) switchPDRFARs(farOf func(*PDRInfo) (uint32, bool)) []*PDRInfo {
+	plan := forwarder.NewModificationPlan(s.LocalID)
+	var pdrInfos []*PDRInfo
+	var pdrids []uint16
+	var farids []uint32
+	for pdrid, pdrInfo := range s.PDRIDs {
+		farid, ok := farOf(pdrInfo)
+		if !ok {
+			continue
+		}
+		req := ie.NewUpdatePDR(ie.NewPDRID(pdrid), ie.NewFARID(farid))
+		p, err := s.rnode.driver.BuildUpdatePDRPlan(s.LocalID, req)
+		if err != nil {
+			s.log.Errorf("switchPDRFARs BuildUpdatePDRPlan[%#x] err: %v", pdrid, err)
+			continue
+		}
+		plan.UpdatePDRs = append(plan.UpdatePDRs, p)
+		pdrInfos = append(pdrInfos, pdrInfo)
+		pdrids = append(pdrids, pdrid)
+		farids = append(farids, farid)
+	}
+	if len(pdrInfos) == 0 {
+		return nil
+	}
+	_, err := s.rnode.driver.ExecuteModificationPlan(plan)
+	if err != nil {
+		// the PDRs keep their FAR, switched again by the next quota event
+		s.log.Errorf("switchPDRFARs execution error: %v", err)
+		return nil
+	}
+	for i, pdrid := range pdrids {
+		s.log.Infof("PDR[%#x] switched to FAR[%#x]", pdrid, farids[i])
+	}
+	return pdrInfos
+}
@@ -0,0 +1,149 @@
+package pfcp
+
+import (
+	"testing"
+	"time"
+
+	"github.com/pkg/errors"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"github.com/wmnsk/go-pfcp/ie"
+
+	"github.com/free5gc/go-upf/internal/forwarder"
+	"github.com/free5gc/go-upf/internal/report"
+)
+
+// quotaDriver records the FAR IDs of the PDRs updated
+type quotaDriver struct {
+	forwarder.Empty
+	fars map[uint16]uint32
+	fail bool
+	last time.Time
+}
+
+func (d *quotaDriver) ExecuteModificationPlan(plan *forwarder.ModificationPlan) (*forwarder.ExecutionResult, error) {
+	if d.fail {
+		return nil, errors.New("netlink failure")
+	}
+	return d.Empty.ExecuteModificationPlan(plan)
+}
+
+func (d *quotaDriver) LastActivity(uint64, []uint16) time.Time {
+	return d.last
+}
+
+func (d *quotaDriver) BuildUpdatePDRPlan(lSeid uint64, req *ie.IE) (*forwarder.PDRPlan, error) {
+	pdrid, err := req.PDRID()
+	if err != nil {
+		return nil, err
+	}
+	farid, err := req.FARID()
+	if err != nil {
+		return nil, err
+	}
+	d.fars[pdrid] = farid
+	return &forwarder.PDRPlan{Op: forwarder.OpUpdate, PDRID: pdrid, FARID: &farid}, nil
+}
+
+func TestQuotaAction(t *testing.T) {
+	d := &quotaDriver{fars: make(map[uint16]uint32)}
+	s, rnode, _ := newUDPTestServer(t, d)
+	sess := rnode.NewSess(0x9a0)
+	defer sess.stopTimeQuotas()
+
+	sess.FARIDs[1] = struct{}{}
+	sess.FARIDs[2] = struct{}{}
+	sess.FARIDs[9] = struct{}{}
+	sess.PDRIDs[1] = &PDRInfo{RelatedURRIDs: map[uint32]struct{}{1: {}}, FARID: 1}
+	sess.PDRIDs[2] = &PDRInfo{RelatedURRIDs: map[uint32]struct{}{1: {}}, FARID: 2}
+	sess.PDRIDs[3] = &PDRInfo{RelatedURRIDs: map[uint32]struct{}{}, FARID: 2}
+	quotaFARID := uint32(9)
+	sess.URRIDs[1] = &URRInfo{
+		RptTrig:    report.ReportingTrigger{Flags: report.RPT_TRIG_VOLQU | report.RPT_TRIG_TIMQU},
+		QuotaFARID: &quotaFARID,
+		startTime:  time.Now(),
+	}
+
+	t.Run("switch failed", func(t *testing.T) {
+		d.fail = true
+		sess.applyQuotaAction(1)
+		d.fail = false
+		assert.Equal(t, uint32(1), sess.PDRIDs[1].FARID)
+		assert.Nil(t, sess.PDRIDs[1].restoreFARID)
+		d.fars = make(map[uint16]uint32)
+	})
+
+	t.Run("quota exhausted", func(t *testing.T) {
+		sess.applyQuotaAction(1)
+		assert.Equal(t, map[uint16]uint32{1: 9, 2: 9}, d.fars)
+		assert.Equal(t, uint32(9), sess.PDRIDs[1].FARID)
+		assert.Equal(t, uint32(2), sess.PDRIDs[3].FARID)
+
+		// already switched
+		d.fars = make(map[uint16]uint32)
+		sess.applyQuotaAction(1)
+		assert.Empty(t, d.fars)
+	})
+
+	t.Run("new quota granted", func(t *testing.T) {
+		plan := forwarder.NewModificationPlan(sess.LocalID)
+		plan.UpdateURRs = append(plan.UpdateURRs, &forwarder.URRPlan{
+			Op:          forwarder.OpUpdate,
+			URRID:       1,
+			VolumeQuota: true,
+		})
+		s.applyQuotas(sess, plan)
+		assert.Equal(t, map[uint16]uint32{1: 1, 2: 2}, d.fars)
+		assert.Equal(t, uint32(1), sess.PDRIDs[1].FARID)
+		assert.Nil(t, sess.PDRIDs[1].restoreFARID)
+	})
+
+	t.Run("time quota", func(t *testing.T) {
+		d.fars = make(map[uint16]uint32)
+		quota := 8 * time.Second
+		urrInfo := sess.URRIDs[1]
+		urrInfo.TimeQuota = quota
+		plan := forwarder.NewModificationPlan(sess.LocalID)
+		plan.UpdateURRs = append(plan.UpdateURRs, &forwarder.URRPlan{
+			Op:        forwarder.OpUpdate,
+			URRID:     1,
+			TimeQuota: &quota,
+		})
+		s.applyQuotas(sess, plan)
+		require.NotNil(t, urrInfo.timeQuota)
+		stale := timeQuotaReport{URRID: 1, gen: urrInfo.timeQuotaGen}
+
+		// granted again before the report of the previous grant is served
+		s.applyQuotas(sess, plan)
+		assert.Empty(t, s.checkTimeQuota(sess, stale))
+		assert.Empty(t, d.fars)
+		r := timeQuotaReport{URRID: 1, gen: urrInfo.timeQuotaGen}
+
+		// no traffic: the time is not used
+		urrInfo.timeChecked = time.Now().Add(-6 * time.Second)
+		assert.Empty(t, s.checkTimeQuota(sess, r))
+		assert.Zero(t, urrInfo.timeUsed)
+		require.NotNil(t, urrInfo.timeQuota)
+
+		// traffic
+		d.last = time.Now()
+		urrInfo.timeChecked = time.Now().Add(-9 * time.Second)
+		usars := s.checkTimeQuota(sess, r)
+		require.Len(t, usars, 1)
+		assert.True(t, usars[0].USARTrigger.TIMQU())
+		assert.Equal(t, map[uint16]uint32{1: 9, 2: 9}, d.fars)
+	})
+
+	t.Run("FAR given by the CP function", func(t *testing.T) {
+		farid := uint32(2)
+		sess.ApplyUpdatePDR(&forwarder.PDRPlan{
+			PDRID:  1,
+			FARID:  &farid,
+			URRIDs: []uint32{1},
+		})
+		d.fars = make(map[uint16]uint32)
+		sess.restoreQuotaAction(1)
+		assert.Equal(t, map[uint16]uint32{2: 2}, d.fars)
+		assert.Equal(t, uint32(2), sess.PDRIDs[1].FARID)
+	})
+}
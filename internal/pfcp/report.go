@@ -1,15 +1,16 @@
 package pfcp
 
 import (
-	"fmt"
 	"net"
+	"strconv"
+	"time"
 
 	"github.com/pkg/errors"
 	"github.com/wmnsk/go-pfcp/ie"
 	"github.com/wmnsk/go-pfcp/message"
 
+	"github.com/free5gc/go-upf/internal/event"
 	"github.com/free5gc/go-upf/internal/report"
-	"github.com/free5gc/go-upf/pkg/factory"
 )
 
 func (s *PfcpServer) ServeReport(sr *report.SessReport) {
@@ -20,30 +21,68 @@ func (s *PfcpServer) ServeReport(sr *report.SessReport) {
 		return
 	}
 
-	addr := fmt.Sprintf("%s:%d", sess.rnode.ID, factory.UpfPfcpDefaultPort)
-	laddr, err := net.ResolveUDPAddr("udp4", addr)
+	laddr, err := s.reportAddr(sess)
 	if err != nil {
+		s.log.Errorln(err)
 		return
 	}
 
 	var usars []report.USAReport
+	var qosrs []qosReport
 	for _, rpt := range sr.Reports {
 		switch r := rpt.(type) {
 		case report.DLDReport:
 			s.log.Debugf("ServeReport: SEID(%#x), type(%s)", sr.SEID, r.Type())
 			if r.Action&report.APPLY_ACT_BUFF != 0 && len(r.BufPkt) > 0 {
-				sess.Push(r.PDRID, r.BufPkt)
+				usars = append(usars, sess.Push(r.PDRID, r.BufPkt)...)
 			}
 			if r.Action&report.APPLY_ACT_NOCP == 0 {
-				return
+				break
 			}
-			err := s.serveDLDReport(laddr, sr.SEID, r.PDRID)
+			err := s.notifyDLData(laddr, sess, r.PDRID)
+			if err != nil {
+				s.log.Errorln(err)
+			}
+		case ddnDelayReport:
+			err := s.serveDDNDelay(laddr, sess, r)
 			if err != nil {
 				s.log.Errorln(err)
 			}
 		case report.USAReport:
 			s.log.Debugf("ServeReport: SEID(%#x), type(%s)", sr.SEID, r.Type())
 			usars = append(usars, r)
+			if r.USARTrigger.VOLQU() {
+				sess.applyQuotaAction(r.URRID)
+			}
+		case report.DropReport:
+			s.log.Debugf("ServeReport: SEID(%#x), type(%s)", sr.SEID, r.Type())
+			usars = append(usars, sess.dropLimited(r.PDRID, r.Len, r.DL)...)
+		case timeQuotaReport:
+			usars = append(usars, s.checkTimeQuota(sess, r)...)
+		case dropSampleReport:
+			usars = append(usars, s.sampleDrops(sess, r)...)
+		case report.MACReport:
+			s.log.Debugf("ServeReport: SEID(%#x), type(%s)", sr.SEID, r.Type())
+			usars = append(usars, sess.detectMACs(r.PDRID, r.MACs, time.Now())...)
+			if sess.macAging == nil {
+				usars = append(usars, s.ageMACs(sess)...)
+			}
+		case macAgingReport:
+			sess.macAging = nil
+			usars = append(usars, s.ageMACs(sess)...)
+		case report.UPIRReport:
+			s.log.Debugf("ServeReport: SEID(%#x), type(%s)", sr.SEID, r.Type())
+			err := s.checkInactivity(laddr, sess)
+			if err != nil {
+				s.log.Errorln(err)
+			}
+		case report.QoSMonitoringReport:
+			s.log.Debugf("ServeReport: SEID(%#x), type(%s)", sr.SEID, r.Type())
+			qosrs = append(qosrs, sess.measureQoS(r)...)
+		case qosProbeReport:
+			s.probeQoS(sess, r)
+		case qosPeriodReport:
+			qosrs = append(qosrs, s.expireQoSPeriod(sess, r)...)
 		default:
 			s.log.Warnf("Unsupported Report: SEID(%#x), type(%d)", sr.SEID, rpt.Type())
 		}
@@ -55,9 +94,24 @@ func (s *PfcpServer) ServeReport(sr *report.SessReport) {
 			s.log.Errorln(err)
 		}
 	}
+	if len(qosrs) > 0 {
+		err := s.serveSessionReport(laddr, sess, qosrs)
+		if err != nil {
+			s.log.Errorln(err)
+		}
+	}
+}
+
+func (s *PfcpServer) reportAddr(sess *Sess) (net.Addr, error) {
+	// the requests go to the PFCP port of the CP function, not to the port
+	// its own requests are sent from (TS 29.244 clause 7.2)
+	port := s.cfg.Pfcp.PeerPort(sess.rnode.ID)
+	addr := net.JoinHostPort(sess.rnode.ID, strconv.Itoa(int(port)))
+	laddr, err := net.ResolveUDPAddr("udp4", addr)
+	return laddr, errors.Wrap(err, "reportAddr")
 }
 
-func (s *PfcpServer) serveDLDReport(addr net.Addr, lSeid uint64, pdrid uint16) error {
+func (s *PfcpServer) serveDLDReport(addr net.Addr, lSeid uint64, pdrid uint16, qos pktQoS) error {
 	s.log.Infoln("serveDLDReport")
 
 	sess, err := s.lnode.Sess(lSeid)
@@ -65,6 +119,11 @@ func (s *PfcpServer) serveDLDReport(addr net.Addr, lSeid uint64, pdrid uint16) e
 		return errors.Wrap(err, "serveDLDReport")
 	}
 
+	dldrIEs := []*ie.IE{ie.NewPDRID(pdrid)}
+	if ddsi := qos.ie(); ddsi != nil {
+		dldrIEs = append(dldrIEs, ddsi)
+	}
+
 	req := message.NewSessionReportRequest(
 		0,
 		0,
@@ -72,21 +131,18 @@ func (s *PfcpServer) serveDLDReport(addr net.Addr, lSeid uint64, pdrid uint16) e
 		0,
 		0,
 		ie.NewReportType(0, 0, 0, 1),
-		ie.NewDownlinkDataReport(
-			ie.NewPDRID(pdrid),
-			/*
-				ie.NewDownlinkDataServiceInformation(
-					true,
-					true,
-					ppi,
-					qfi,
-				),
-			*/
-		),
+		ie.NewDownlinkDataReport(dldrIEs...),
 	)
 
-	err = s.sendReqTo(req, addr)
-	return errors.Wrap(err, "serveDLDReport")
+	err = s.sendSessReport(sess, req, addr, nil)
+	if err != nil {
+		return errors.Wrap(err, "serveDLDReport")
+	}
+	// the report is the event measured by the URRs of the PDR
+	if usars := sess.detectEvent(pdrid); len(usars) > 0 {
+		return s.serveUSAReport(addr, lSeid, usars)
+	}
+	return nil
 }
 
 func (s *PfcpServer) serveUSAReport(addr net.Addr, lSeid uint64, usars []report.USAReport) error {
@@ -105,13 +161,17 @@ func (s *PfcpServer) serveUSAReport(addr net.Addr, lSeid uint64, usars []report.
 		0,
 		ie.NewReportType(0, 0, 1, 0),
 	)
+	usars = sess.linkUSAReports(usars)
+	var usage []event.Usage
 	for _, r := range usars {
 		urrInfo, ok := sess.URRIDs[r.URRID]
 		if !ok {
 			sess.log.Warnf("serveUSAReport: URRInfo[%#x] not found", r.URRID)
 			continue
 		}
-		r.URSEQN = sess.URRSeq(r.URRID)
+		sess.sealUSAReport(&r)
+		usage = append(usage, event.NewUsage(r))
+		s.recordUsage(sess, r)
 		req.UsageReport = append(req.UsageReport,
 			ie.NewUsageReportWithinSessionReportRequest(
 				r.IEsWithinSessReportReq(
@@ -119,6 +179,6 @@ func (s *PfcpServer) serveUSAReport(addr net.Addr, lSeid uint64, usars []report.
 			))
 	}
 
-	err = s.sendReqTo(req, addr)
+	err = s.sendSessReport(sess, req, addr, usage)
 	return errors.Wrap(err, "serveUSAReport")
 }
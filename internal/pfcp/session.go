@@ -7,6 +7,7 @@ import (
 	"github.com/wmnsk/go-pfcp/ie"
 	"github.com/wmnsk/go-pfcp/message"
 
+	"github.com/free5gc/go-upf/internal/event"
 	"github.com/free5gc/go-upf/internal/forwarder"
 	"github.com/free5gc/go-upf/internal/report"
 )
@@ -19,18 +20,18 @@ func (s *PfcpServer) handleSessionEstablishmentRequest(
 
 	if req.NodeID == nil {
 		s.log.Errorln("not found NodeID")
-		s.sendSessEstFailRsp(req, addr, ie.CauseMandatoryIEMissing)
+		s.sendSessEstFailRsp(req, addr, ie.CauseMandatoryIEMissing, ie.NewOffendingIE(ie.NodeID))
 		return
 	}
 	rnodeid, err := req.NodeID.NodeID()
 	if err != nil {
 		s.log.Errorln(err)
-		s.sendSessEstFailRsp(req, addr, ie.CauseMandatoryIEMissing)
+		s.sendSessEstFailRsp(req, addr, ie.CauseMandatoryIEIncorrect, ie.NewOffendingIE(ie.NodeID))
 		return
 	}
 	s.log.Debugf("remote nodeid: %v\n", rnodeid)
 
-	rnode, ok := s.rnodes[rnodeid]
+	rnode, ok := s.rnode(rnodeid)
 	if !ok {
 		s.log.Errorf("not found NodeID %v\n", rnodeid)
 		s.sendSessEstFailRsp(req, addr, ie.CauseNoEstablishedPFCPAssociation)
@@ -39,19 +40,50 @@ func (s *PfcpServer) handleSessionEstablishmentRequest(
 
 	if req.CPFSEID == nil {
 		s.log.Errorln("not found CP F-SEID")
-		s.sendSessEstFailRsp(req, addr, ie.CauseMandatoryIEMissing)
+		s.sendSessEstFailRsp(req, addr, ie.CauseMandatoryIEMissing, ie.NewOffendingIE(ie.FSEID))
 		return
 	}
 	fseid, err := req.CPFSEID.FSEID()
 	if err != nil {
 		s.log.Errorln(err)
-		s.sendSessEstFailRsp(req, addr, ie.CauseMandatoryIEMissing)
+		s.sendSessEstFailRsp(req, addr, ie.CauseMandatoryIEIncorrect, ie.NewOffendingIE(ie.FSEID))
 		return
 	}
 	s.log.Debugf("fseid.SEID: %#x\n", fseid.SEID)
 
-	// allocate a session
+	if !s.admitSess(rnode) {
+		rnode.rejectLimit()
+		s.sendSessEstFailRsp(req, addr, ie.CauseNoResourcesAvailable, s.loadIEs(rnode)...)
+		return
+	}
+
+	// allocate a session, established on its worker
 	sess := rnode.NewSess(fseid.SEID)
+	ok = s.workers.dispatch(sess.LocalID, func() {
+		s.establishSess(req, addr, sess)
+	})
+	if !ok {
+		s.log.Warnf("reject session of NodeID %v: worker congested", rnodeid)
+		rnode.DeleteSess(sess.LocalID)
+		s.sendSessEstFailRsp(req, addr, ie.CausePFCPEntityInCongestion)
+	}
+}
+
+// establishSess creates the rules of a session allocated for a Session
+// Establishment Request
+func (s *PfcpServer) establishSess(
+	req *message.SessionEstablishmentRequest,
+	addr net.Addr,
+	sess *Sess,
+) {
+	var err error
+	rnode := sess.rnode
+	if cur, err := s.lnode.Sess(sess.LocalID); err != nil || cur != sess {
+		// released by an Association Setup Request meanwhile
+		sess.log.Warnln("session released before establishment")
+		s.sendSessEstFailRsp(req, addr, ie.CauseNoEstablishedPFCPAssociation)
+		return
+	}
 
 	// ========================================================================
 	// PHASE 1: Validation - Build all plans and validate without execution
@@ -63,7 +95,7 @@ func (s *PfcpServer) handleSessionEstablishmentRequest(
 		if err1 != nil {
 			sess.log.Errorf("Est ValidateCreateFAR error: %v", err1)
 			cause := pfcpCauseFromError(err1)
-			s.sendSessEstFailRsp(req, addr, cause)
+			s.sendSessEstFailRsp(req, addr, cause, failureIEs(cause, err1)...)
 			rnode.DeleteSess(sess.LocalID)
 			return
 		}
@@ -75,7 +107,7 @@ func (s *PfcpServer) handleSessionEstablishmentRequest(
 		if err1 != nil {
 			sess.log.Errorf("Est ValidateCreateQER error: %v", err1)
 			cause := pfcpCauseFromError(err1)
-			s.sendSessEstFailRsp(req, addr, cause)
+			s.sendSessEstFailRsp(req, addr, cause, failureIEs(cause, err1)...)
 			rnode.DeleteSess(sess.LocalID)
 			return
 		}
@@ -87,7 +119,7 @@ func (s *PfcpServer) handleSessionEstablishmentRequest(
 		if err1 != nil {
 			sess.log.Errorf("Est ValidateCreateURR error: %v", err1)
 			cause := pfcpCauseFromError(err1)
-			s.sendSessEstFailRsp(req, addr, cause)
+			s.sendSessEstFailRsp(req, addr, cause, failureIEs(cause, err1)...)
 			rnode.DeleteSess(sess.LocalID)
 			return
 		}
@@ -99,7 +131,7 @@ func (s *PfcpServer) handleSessionEstablishmentRequest(
 		if err1 != nil {
 			sess.log.Errorf("Est ValidateCreateBAR error: %v", err1)
 			cause := pfcpCauseFromError(err1)
-			s.sendSessEstFailRsp(req, addr, cause)
+			s.sendSessEstFailRsp(req, addr, cause, failureIEs(cause, err1)...)
 			rnode.DeleteSess(sess.LocalID)
 			return
 		}
@@ -111,19 +143,42 @@ func (s *PfcpServer) handleSessionEstablishmentRequest(
 		if err1 != nil {
 			sess.log.Errorf("Est ValidateCreatePDR error: %v", err1)
 			cause := pfcpCauseFromError(err1)
-			s.sendSessEstFailRsp(req, addr, cause)
+			s.sendSessEstFailRsp(req, addr, cause, failureIEs(cause, err1)...)
 			rnode.DeleteSess(sess.LocalID)
 			return
 		}
 		plan.CreatePDRs = append(plan.CreatePDRs, p)
 	}
 
+	srrs := new(srrPlans)
+	for _, i := range req.CreateSRR {
+		p, err1 := sess.ValidateCreateSRR(i)
+		if err1 != nil {
+			sess.log.Errorf("Est ValidateCreateSRR error: %v", err1)
+			cause := pfcpCauseFromError(err1)
+			s.sendSessEstFailRsp(req, addr, cause, failureIEs(cause, err1)...)
+			rnode.DeleteSess(sess.LocalID)
+			return
+		}
+		srrs.create = append(srrs.create, p)
+	}
+
+	if err1 := sess.checkLimits(plan); err1 != nil {
+		sess.log.Errorf("Est limits error: %v", err1)
+		rnode.rejectLimit()
+		cause := pfcpCauseFromError(err1)
+		s.sendSessEstFailRsp(req, addr, cause, failureIEs(cause, err1)...)
+		rnode.DeleteSess(sess.LocalID)
+		return
+	}
+
 	// ========================================================================
 	// PHASE 2: Execution - Execute all Create operations (fail-fast)
 	// ========================================================================
 	if _, err1 := sess.rnode.driver.ExecuteEstablishmentPlan(plan); err1 != nil {
 		sess.log.Errorf("Est execution error: %v", err1)
-		s.sendSessEstFailRsp(req, addr, ie.CauseRuleCreationModificationFailure)
+		s.sendSessEstFailRsp(req, addr, ie.CauseRuleCreationModificationFailure,
+			failureIEs(ie.CauseRuleCreationModificationFailure, err1)...)
 		rnode.DeleteSess(sess.LocalID)
 		return
 	}
@@ -150,6 +205,7 @@ func (s *PfcpServer) handleSessionEstablishmentRequest(
 
 		ueIPAddress := getUEAddressFromPDR(p.OriginalIE)
 		pdrId := getPDRIDFromPDR(p.OriginalIE)
+		sess.setUEIP(ueIPAddress)
 
 		if ueIPAddress != nil {
 			ueIPv4 := ueIPAddress.IPv4Address.String()
@@ -160,6 +216,18 @@ func (s *PfcpServer) handleSessionEstablishmentRequest(
 		}
 	}
 
+	s.applyQuotas(sess, plan)
+	s.applyDropSample(sess, plan)
+	s.applySRRs(sess, srrs)
+	s.lnode.syncRules(sess)
+
+	if req.UserPlaneInactivityTimer != nil {
+		err = s.setInactivityTimer(sess, req.UserPlaneInactivityTimer)
+		if err != nil {
+			sess.log.Errorln(err)
+		}
+	}
+
 	var v4 net.IP
 	addrv4, err := net.ResolveIPAddr("ip4", s.nodeID)
 	if err == nil {
@@ -174,6 +242,7 @@ func (s *PfcpServer) handleSessionEstablishmentRequest(
 		newIeNodeID(s.nodeID),
 		ie.NewCause(ie.CauseRequestAccepted),
 		ie.NewFSEID(sess.LocalID, v4, v6))
+	ies = append(ies, s.loadIEs(rnode)...)
 
 	rsp := message.NewSessionEstablishmentResponse(
 		0,             // mp
@@ -189,6 +258,31 @@ func (s *PfcpServer) handleSessionEstablishmentRequest(
 		s.log.Errorln(err)
 		return
 	}
+	e := sessEvent(event.SESSION_ESTABLISHED, sess)
+	e.Diff = planDiff(plan, srrs)
+	s.events.Publish(e)
+}
+
+// takeOverSess changes the Node ID of the association of a session to the
+// one of the SMF taking over the control of the session. The jobs of the
+// sessions read the Node ID without a lock, so it runs exclusively of them.
+func (s *PfcpServer) takeOverSess(req *message.SessionModificationRequest) {
+	// TS 29.244 7.5.4:
+	// This IE shall be present if a new SMF in an SMF Set,
+	// with one PFCP association per SMF and UPF (see clause 5.22.3),
+	// takes over the control of the PFCP session.
+	// When present, it shall contain the unique identifier of the new SMF.
+	sess, err := s.lnode.Sess(req.SEID())
+	if err != nil {
+		// answered by handleSessionModificationRequest
+		return
+	}
+	rnodeid, err := req.NodeID.NodeID()
+	if err != nil || rnodeid == sess.rnode.ID {
+		return
+	}
+	s.log.Debugf("new remote nodeid: %v\n", rnodeid)
+	s.UpdateNodeID(sess.rnode, rnodeid)
 }
 
 func (s *PfcpServer) handleSessionModificationRequest(
@@ -218,18 +312,13 @@ func (s *PfcpServer) handleSessionModificationRequest(
 	}
 
 	if req.NodeID != nil {
-		// TS 29.244 7.5.4:
-		// This IE shall be present if a new SMF in an SMF Set,
-		// with one PFCP association per SMF and UPF (see clause 5.22.3),
-		// takes over the control of the PFCP session.
-		// When present, it shall contain the unique identifier of the new SMF.
-		rnodeid, err1 := req.NodeID.NodeID()
+		// the Node ID is changed by takeOverSess before the request is
+		// dispatched
+		_, err1 := req.NodeID.NodeID()
 		if err1 != nil {
 			s.log.Errorln(err1)
 			return
 		}
-		s.log.Debugf("new remote nodeid: %v\n", rnodeid)
-		s.UpdateNodeID(sess.rnode, rnodeid)
 	}
 
 	// ========================================================================
@@ -242,7 +331,7 @@ func (s *PfcpServer) handleSessionModificationRequest(
 		if err1 != nil {
 			sess.log.Errorf("Mod ValidateCreateFAR error: %v", err1)
 			cause := pfcpCauseFromError(err1)
-			s.sendSessModFailRsp(req, sess, addr, cause)
+			s.sendSessModFailRsp(req, sess, addr, cause, failureIEs(cause, err1)...)
 			return
 		}
 		plan.CreateFARs = append(plan.CreateFARs, p)
@@ -253,7 +342,7 @@ func (s *PfcpServer) handleSessionModificationRequest(
 		if err1 != nil {
 			sess.log.Errorf("Mod ValidateCreateQER error: %v", err1)
 			cause := pfcpCauseFromError(err1)
-			s.sendSessModFailRsp(req, sess, addr, cause)
+			s.sendSessModFailRsp(req, sess, addr, cause, failureIEs(cause, err1)...)
 			return
 		}
 		plan.CreateQERs = append(plan.CreateQERs, p)
@@ -264,7 +353,7 @@ func (s *PfcpServer) handleSessionModificationRequest(
 		if err1 != nil {
 			sess.log.Errorf("Mod ValidateCreateURR error: %v", err1)
 			cause := pfcpCauseFromError(err1)
-			s.sendSessModFailRsp(req, sess, addr, cause)
+			s.sendSessModFailRsp(req, sess, addr, cause, failureIEs(cause, err1)...)
 			return
 		}
 		plan.CreateURRs = append(plan.CreateURRs, p)
@@ -275,7 +364,7 @@ func (s *PfcpServer) handleSessionModificationRequest(
 		if err1 != nil {
 			sess.log.Errorf("Mod ValidateCreateBAR error: %v", err1)
 			cause := pfcpCauseFromError(err1)
-			s.sendSessModFailRsp(req, sess, addr, cause)
+			s.sendSessModFailRsp(req, sess, addr, cause, failureIEs(cause, err1)...)
 			return
 		}
 		plan.CreateBARs = append(plan.CreateBARs, p)
@@ -286,7 +375,7 @@ func (s *PfcpServer) handleSessionModificationRequest(
 		if err1 != nil {
 			sess.log.Errorf("Mod ValidateCreatePDR error: %v", err1)
 			cause := pfcpCauseFromError(err1)
-			s.sendSessModFailRsp(req, sess, addr, cause)
+			s.sendSessModFailRsp(req, sess, addr, cause, failureIEs(cause, err1)...)
 			return
 		}
 		plan.CreatePDRs = append(plan.CreatePDRs, p)
@@ -297,7 +386,7 @@ func (s *PfcpServer) handleSessionModificationRequest(
 		if err1 != nil {
 			sess.log.Errorf("Mod ValidateUpdateFAR error: %v", err1)
 			cause := pfcpCauseFromError(err1)
-			s.sendSessModFailRsp(req, sess, addr, cause)
+			s.sendSessModFailRsp(req, sess, addr, cause, failureIEs(cause, err1)...)
 			return
 		}
 		plan.UpdateFARs = append(plan.UpdateFARs, p)
@@ -308,7 +397,7 @@ func (s *PfcpServer) handleSessionModificationRequest(
 		if err1 != nil {
 			sess.log.Errorf("Mod ValidateUpdateQER error: %v", err1)
 			cause := pfcpCauseFromError(err1)
-			s.sendSessModFailRsp(req, sess, addr, cause)
+			s.sendSessModFailRsp(req, sess, addr, cause, failureIEs(cause, err1)...)
 			return
 		}
 		plan.UpdateQERs = append(plan.UpdateQERs, p)
@@ -319,7 +408,7 @@ func (s *PfcpServer) handleSessionModificationRequest(
 		if err1 != nil {
 			sess.log.Errorf("Mod ValidateUpdateURR error: %v", err1)
 			cause := pfcpCauseFromError(err1)
-			s.sendSessModFailRsp(req, sess, addr, cause)
+			s.sendSessModFailRsp(req, sess, addr, cause, failureIEs(cause, err1)...)
 			return
 		}
 		plan.UpdateURRs = append(plan.UpdateURRs, p)
@@ -330,7 +419,7 @@ func (s *PfcpServer) handleSessionModificationRequest(
 		if err1 != nil {
 			sess.log.Errorf("Mod ValidateUpdateBAR error: %v", err1)
 			cause := pfcpCauseFromError(err1)
-			s.sendSessModFailRsp(req, sess, addr, cause)
+			s.sendSessModFailRsp(req, sess, addr, cause, failureIEs(cause, err1)...)
 			return
 		}
 		plan.UpdateBARs = append(plan.UpdateBARs, p)
@@ -341,7 +430,7 @@ func (s *PfcpServer) handleSessionModificationRequest(
 		if err1 != nil {
 			sess.log.Errorf("Mod ValidateUpdatePDR error: %v", err1)
 			cause := pfcpCauseFromError(err1)
-			s.sendSessModFailRsp(req, sess, addr, cause)
+			s.sendSessModFailRsp(req, sess, addr, cause, failureIEs(cause, err1)...)
 			return
 		}
 		plan.UpdatePDRs = append(plan.UpdatePDRs, p)
@@ -352,7 +441,7 @@ func (s *PfcpServer) handleSessionModificationRequest(
 		if err1 != nil {
 			sess.log.Errorf("Mod ValidateQueryURR error: %v", err1)
 			cause := pfcpCauseFromError(err1)
-			s.sendSessModFailRsp(req, sess, addr, cause)
+			s.sendSessModFailRsp(req, sess, addr, cause, failureIEs(cause, err1)...)
 			return
 		}
 		plan.QueryURRs = append(plan.QueryURRs, p)
@@ -363,7 +452,7 @@ func (s *PfcpServer) handleSessionModificationRequest(
 		if err1 != nil {
 			sess.log.Errorf("Mod ValidateRemoveFAR error: %v", err1)
 			cause := pfcpCauseFromError(err1)
-			s.sendSessModFailRsp(req, sess, addr, cause)
+			s.sendSessModFailRsp(req, sess, addr, cause, failureIEs(cause, err1)...)
 			return
 		}
 		plan.RemoveFARs = append(plan.RemoveFARs, p)
@@ -374,7 +463,7 @@ func (s *PfcpServer) handleSessionModificationRequest(
 		if err1 != nil {
 			sess.log.Errorf("Mod ValidateRemoveQER error: %v", err1)
 			cause := pfcpCauseFromError(err1)
-			s.sendSessModFailRsp(req, sess, addr, cause)
+			s.sendSessModFailRsp(req, sess, addr, cause, failureIEs(cause, err1)...)
 			return
 		}
 		plan.RemoveQERs = append(plan.RemoveQERs, p)
@@ -385,7 +474,7 @@ func (s *PfcpServer) handleSessionModificationRequest(
 		if err1 != nil {
 			sess.log.Errorf("Mod ValidateRemoveURR error: %v", err1)
 			cause := pfcpCauseFromError(err1)
-			s.sendSessModFailRsp(req, sess, addr, cause)
+			s.sendSessModFailRsp(req, sess, addr, cause, failureIEs(cause, err1)...)
 			return
 		}
 		plan.RemoveURRs = append(plan.RemoveURRs, p)
@@ -396,7 +485,7 @@ func (s *PfcpServer) handleSessionModificationRequest(
 		if err1 != nil {
 			sess.log.Errorf("Mod ValidateRemoveBAR error: %v", err1)
 			cause := pfcpCauseFromError(err1)
-			s.sendSessModFailRsp(req, sess, addr, cause)
+			s.sendSessModFailRsp(req, sess, addr, cause, failureIEs(cause, err1)...)
 			return
 		}
 		plan.RemoveBARs = append(plan.RemoveBARs, p)
@@ -407,16 +496,55 @@ func (s *PfcpServer) handleSessionModificationRequest(
 		if err1 != nil {
 			sess.log.Errorf("Mod ValidateRemovePDR error: %v", err1)
 			cause := pfcpCauseFromError(err1)
-			s.sendSessModFailRsp(req, sess, addr, cause)
+			s.sendSessModFailRsp(req, sess, addr, cause, failureIEs(cause, err1)...)
 			return
 		}
 		plan.RemovePDRs = append(plan.RemovePDRs, p)
 	}
+
+	srrs := new(srrPlans)
+	for _, i := range req.CreateSRR {
+		p, err1 := sess.ValidateCreateSRR(i)
+		if err1 != nil {
+			sess.log.Errorf("Mod ValidateCreateSRR error: %v", err1)
+			cause := pfcpCauseFromError(err1)
+			s.sendSessModFailRsp(req, sess, addr, cause, failureIEs(cause, err1)...)
+			return
+		}
+		srrs.create = append(srrs.create, p)
+	}
+	for _, i := range req.UpdateSRR {
+		p, err1 := sess.ValidateUpdateSRR(i, srrs)
+		if err1 != nil {
+			sess.log.Errorf("Mod ValidateUpdateSRR error: %v", err1)
+			cause := pfcpCauseFromError(err1)
+			s.sendSessModFailRsp(req, sess, addr, cause, failureIEs(cause, err1)...)
+			return
+		}
+		srrs.update = append(srrs.update, p)
+	}
+	for _, i := range req.RemoveSRR {
+		id, err1 := sess.ValidateRemoveSRR(i, srrs)
+		if err1 != nil {
+			sess.log.Errorf("Mod ValidateRemoveSRR error: %v", err1)
+			cause := pfcpCauseFromError(err1)
+			s.sendSessModFailRsp(req, sess, addr, cause, failureIEs(cause, err1)...)
+			return
+		}
+		srrs.remove = append(srrs.remove, id)
+	}
 	// Validate mutual exclusion across operations
 	if err1 := validateMutualExclusion(plan); err1 != nil {
 		sess.log.Errorf("Mod mutual exclusion validation error: %v", err1)
 		cause := pfcpCauseFromError(err1)
-		s.sendSessModFailRsp(req, sess, addr, cause)
+		s.sendSessModFailRsp(req, sess, addr, cause, failureIEs(cause, err1)...)
+		return
+	}
+	if err1 := sess.checkLimits(plan); err1 != nil {
+		sess.log.Errorf("Mod limits error: %v", err1)
+		sess.rnode.rejectLimit()
+		cause := pfcpCauseFromError(err1)
+		s.sendSessModFailRsp(req, sess, addr, cause, failureIEs(cause, err1)...)
 		return
 	}
 
@@ -432,7 +560,8 @@ func (s *PfcpServer) handleSessionModificationRequest(
 		// must not be updated: reject the request instead of reporting success
 		// for rules that were not installed.
 		sess.log.Errorf("Mod execution error: %v", err1)
-		s.sendSessModFailRsp(req, sess, addr, ie.CauseRuleCreationModificationFailure)
+		s.sendSessModFailRsp(req, sess, addr, ie.CauseRuleCreationModificationFailure,
+			failureIEs(ie.CauseRuleCreationModificationFailure, err1)...)
 		return
 	}
 
@@ -456,15 +585,27 @@ func (s *PfcpServer) handleSessionModificationRequest(
 	}
 	for _, p := range plan.CreatePDRs {
 		sess.ApplyCreatePDR(p)
+		if p.OriginalIE != nil {
+			sess.setUEIP(getUEAddressFromPDR(p.OriginalIE))
+		}
 	}
 
 	// Apply Update operations (collect USAReports from PDR URR disassociation)
-	// UpdateFAR has no state change
-	// UpdateQER has no state change
+	for _, p := range plan.UpdateFARs {
+		// The buffering episode ends once the FAR neither buffers nor notifies
+		if p.ApplyAction != nil && !p.ApplyAction.BUFF() && !p.ApplyAction.NOCP() {
+			sess.buf.endEpisode()
+		}
+	}
+	for _, p := range plan.UpdateQERs {
+		sess.ApplyUpdateQER(p)
+	}
 	for _, p := range plan.UpdateURRs {
 		sess.ApplyUpdateURR(p)
 	}
-	// UpdateBAR has no state change
+	for _, p := range plan.UpdateBARs {
+		sess.ApplyUpdateBAR(p)
+	}
 	for _, p := range plan.UpdatePDRs {
 		rs := sess.ApplyUpdatePDR(p)
 		if len(rs) > 0 {
@@ -515,6 +656,18 @@ func (s *PfcpServer) handleSessionModificationRequest(
 		}
 		usars = append(usars, execResult.USAReports...)
 	}
+	usars = sess.linkUSAReports(usars)
+
+	s.applyQuotas(sess, plan)
+	s.applyDropSample(sess, plan)
+	s.applySRRs(sess, srrs)
+
+	if req.UserPlaneInactivityTimer != nil {
+		err = s.setInactivityTimer(sess, req.UserPlaneInactivityTimer)
+		if err != nil {
+			sess.log.Errorln(err)
+		}
+	}
 
 	rsp := message.NewSessionModificationResponse(
 		0,             // mp
@@ -530,7 +683,8 @@ func (s *PfcpServer) handleSessionModificationRequest(
 			sess.log.Warnf("Sess Mod: URRInfo[%#x] not found", r.URRID)
 			continue
 		}
-		r.URSEQN = sess.URRSeq(r.URRID)
+		sess.sealUSAReport(&r)
+		s.recordUsage(sess, r)
 		rsp.UsageReport = append(rsp.UsageReport,
 			ie.NewUsageReportWithinSessionModificationResponse(
 				r.IEsWithinSessModRsp(
@@ -540,11 +694,16 @@ func (s *PfcpServer) handleSessionModificationRequest(
 
 	// Cleanup removed URRs
 	sess.CleanupRemovedURRs()
+	s.lnode.syncRules(sess)
+	s.setLoadIEs(&rsp.LoadControlInformation, &rsp.OverloadControlInformation, sess.rnode)
 
 	if err := s.sendRspTo(rsp, addr); err != nil {
 		s.log.Errorln(err)
 		return
 	}
+	e := sessEvent(event.SESSION_MODIFIED, sess)
+	e.Diff = planDiff(plan, srrs)
+	s.events.Publish(e)
 }
 
 func (s *PfcpServer) handleSessionDeletionRequest(
@@ -586,15 +745,18 @@ func (s *PfcpServer) handleSessionDeletionRequest(
 		0, // pri
 		ie.NewCause(ie.CauseRequestAccepted),
 	)
+	e := sessEvent(event.SESSION_DELETED, sess)
 	for _, r := range usars {
 		urrInfo, ok := sess.URRIDs[r.URRID]
 		if !ok {
 			sess.log.Warnf("Sess Del: URRInfo[%#x] not found", r.URRID)
 			continue
 		}
-		r.URSEQN = sess.URRSeq(r.URRID)
+		sess.sealUSAReport(&r)
 		// indicates usage report being reported for a URR due to the termination of the PFCP session
 		r.USARTrigger.Flags |= report.USAR_TRIG_TERMR
+		e.Usage = append(e.Usage, event.NewUsage(r))
+		s.recordUsage(sess, r)
 		rsp.UsageReport = append(rsp.UsageReport,
 			ie.NewUsageReportWithinSessionDeletionResponse(
 				r.IEsWithinSessDelRsp(
@@ -605,12 +767,17 @@ func (s *PfcpServer) handleSessionDeletionRequest(
 			delete(sess.URRIDs, r.URRID)
 		}
 	}
+	// The Session Deletion Response of go-pfcp has no Session Report field;
+	// the IEs it does not know are encoded as they are
+	rsp.IEs = append(rsp.IEs, sessionReportIEs(sess.releaseQoSReports())...)
+	s.setLoadIEs(&rsp.LoadControlInformation, &rsp.OverloadControlInformation, sess.rnode)
 
 	err = s.sendRspTo(rsp, addr)
 	if err != nil {
 		s.log.Errorln(err)
 		return
 	}
+	s.events.Publish(e)
 }
 
 func (s *PfcpServer) handleSessionReportResponse(
@@ -642,7 +809,10 @@ func (s *PfcpServer) handleSessionReportResponse(
 			s.log.Errorln(err)
 			return
 		}
-		sess.rnode.DeleteSess(sess.LocalID)
+		e := s.releasedEvent(sess, sess.rnode.DeleteSess(sess.LocalID))
+		e.Cause = cause
+		e.Reason = "context not found in CP function"
+		s.events.Publish(e)
 		return
 	}
 
@@ -652,7 +822,36 @@ func (s *PfcpServer) handleSessionReportResponse(
 		return
 	}
 
+	e := sessEvent(event.REPORT_ACKNOWLEDGED, sess)
+	e.Sequence = rsp.Sequence()
+	if rsp.Cause != nil {
+		e.Cause, _ = rsp.Cause.Cause()
+	}
+	s.events.Publish(e)
+
 	s.log.Debugf("sess: %#+v\n", sess)
+
+	if rsp.UpdateBAR != nil {
+		s.updateBARByReportRsp(sess, rsp.UpdateBAR)
+	}
+}
+
+// updateBARByReportRsp applies the Update BAR of a Session Report Response,
+// which carries the DL Buffering Duration for the DL Data Report
+func (s *PfcpServer) updateBARByReportRsp(sess *Sess, i *ie.IE) {
+	plan := forwarder.NewModificationPlan(sess.LocalID)
+	p, err := sess.ValidateUpdateBAR(i, plan)
+	if err != nil {
+		sess.log.Errorf("Report Rsp ValidateUpdateBAR error: %v", err)
+		return
+	}
+	plan.UpdateBARs = append(plan.UpdateBARs, p)
+
+	_, err = sess.rnode.driver.ExecuteModificationPlan(plan)
+	if err != nil {
+		sess.log.Errorf("Report Rsp UpdateBAR execution error: %v", err)
+	}
+	sess.ApplyUpdateBAR(p)
 }
 
 func (s *PfcpServer) handleSessionReportRequestTimeout(
@@ -713,6 +912,7 @@ func (s *PfcpServer) sendSessEstFailRsp(
 	req *message.SessionEstablishmentRequest,
 	addr net.Addr,
 	cause uint8,
+	ies ...*ie.IE,
 ) {
 	rsp := message.NewSessionEstablishmentResponse(
 		0, // mp
@@ -720,7 +920,7 @@ func (s *PfcpServer) sendSessEstFailRsp(
 		0, // seid (session not created)
 		req.Header.SequenceNumber,
 		0, // pri
-		ie.NewCause(cause),
+		append([]*ie.IE{ie.NewCause(cause)}, ies...)...,
 	)
 	if err := s.sendRspTo(rsp, addr); err != nil {
 		s.log.Errorln(err)
@@ -732,6 +932,7 @@ func (s *PfcpServer) sendSessModFailRsp(
 	sess *Sess,
 	addr net.Addr,
 	cause uint8,
+	ies ...*ie.IE,
 ) {
 	rsp := message.NewSessionModificationResponse(
 		0,             // mp
@@ -739,7 +940,7 @@ func (s *PfcpServer) sendSessModFailRsp(
 		sess.RemoteID, // seid
 		req.Header.SequenceNumber,
 		0, // pri
-		ie.NewCause(cause),
+		append([]*ie.IE{ie.NewCause(cause)}, ies...)...,
 	)
 	err := s.sendRspTo(rsp, addr)
 	if err != nil {
@@ -757,7 +958,8 @@ func pfcpCauseFromError(err error) uint8 {
 
 	case errors.Is(err, ErrRuleNotFound) ||
 		errors.Is(err, ErrRuleCreationModificationFailed) ||
-		errors.Is(err, ErrMutualExclusionConflict):
+		errors.Is(err, ErrMutualExclusionConflict) ||
+		errors.Is(err, ErrLimitExceeded):
 		return ie.CauseRuleCreationModificationFailure
 
 	default:
@@ -776,11 +978,15 @@ func pfcpCauseFromError(err error) uint8 {
 // - Create + Remove same ID
 func validateMutualExclusion(plan *forwarder.ModificationPlan) error {
 	// Helper to check duplicates in a slice
-	checkDuplicates := func(ids []uint32, opName string) error {
+	checkDuplicates := func(ids []uint32, typ uint8, opName string) error {
 		seen := make(map[uint32]bool)
 		for _, id := range ids {
 			if seen[id] {
-				return errors.Wrapf(ErrMutualExclusionConflict, "duplicate %s for ID %d", opName, id)
+				return &forwarder.RuleError{
+					Type: typ,
+					ID:   id,
+					Err:  errors.Wrapf(ErrMutualExclusionConflict, "duplicate %s", opName),
+				}
 			}
 			seen[id] = true
 		}
@@ -788,14 +994,18 @@ func validateMutualExclusion(plan *forwarder.ModificationPlan) error {
 	}
 
 	// Helper to check overlap between two ID slices
-	checkOverlap := func(ids1, ids2 []uint32, op1Name, op2Name string) error {
+	checkOverlap := func(ids1, ids2 []uint32, typ uint8, op1Name, op2Name string) error {
 		set := make(map[uint32]bool)
 		for _, id := range ids1 {
 			set[id] = true
 		}
 		for _, id := range ids2 {
 			if set[id] {
-				return errors.Wrapf(ErrMutualExclusionConflict, "%s and %s conflict for ID %d", op1Name, op2Name, id)
+				return &forwarder.RuleError{
+					Type: typ,
+					ID:   id,
+					Err:  errors.Wrapf(ErrMutualExclusionConflict, "%s and %s conflict", op1Name, op2Name),
+				}
 			}
 		}
 		return nil
@@ -850,13 +1060,13 @@ func validateMutualExclusion(plan *forwarder.ModificationPlan) error {
 	removePDRIDs := collectPDRIDs(plan.RemovePDRs)
 	updatePDRIDs := collectPDRIDs(plan.UpdatePDRs)
 
-	if err := checkDuplicates(createPDRIDs, "CreatePDR"); err != nil {
+	if err := checkDuplicates(createPDRIDs, ie.RuleIDTypePDR, "CreatePDR"); err != nil {
 		return err
 	}
-	if err := checkDuplicates(removePDRIDs, "RemovePDR"); err != nil {
+	if err := checkDuplicates(removePDRIDs, ie.RuleIDTypePDR, "RemovePDR"); err != nil {
 		return err
 	}
-	if err := checkOverlap(removePDRIDs, updatePDRIDs, "RemovePDR", "UpdatePDR"); err != nil {
+	if err := checkOverlap(removePDRIDs, updatePDRIDs, ie.RuleIDTypePDR, "RemovePDR", "UpdatePDR"); err != nil {
 		return err
 	}
 
@@ -865,13 +1075,13 @@ func validateMutualExclusion(plan *forwarder.ModificationPlan) error {
 	removeFARIDs := collectFARIDs(plan.RemoveFARs)
 	updateFARIDs := collectFARIDs(plan.UpdateFARs)
 
-	if err := checkDuplicates(createFARIDs, "CreateFAR"); err != nil {
+	if err := checkDuplicates(createFARIDs, ie.RuleIDTypeFAR, "CreateFAR"); err != nil {
 		return err
 	}
-	if err := checkDuplicates(removeFARIDs, "RemoveFAR"); err != nil {
+	if err := checkDuplicates(removeFARIDs, ie.RuleIDTypeFAR, "RemoveFAR"); err != nil {
 		return err
 	}
-	if err := checkOverlap(removeFARIDs, updateFARIDs, "RemoveFAR", "UpdateFAR"); err != nil {
+	if err := checkOverlap(removeFARIDs, updateFARIDs, ie.RuleIDTypeFAR, "RemoveFAR", "UpdateFAR"); err != nil {
 		return err
 	}
 
@@ -880,13 +1090,13 @@ func validateMutualExclusion(plan *forwarder.ModificationPlan) error {
 	removeQERIDs := collectQERIDs(plan.RemoveQERs)
 	updateQERIDs := collectQERIDs(plan.UpdateQERs)
 
-	if err := checkDuplicates(createQERIDs, "CreateQER"); err != nil {
+	if err := checkDuplicates(createQERIDs, ie.RuleIDTypeQER, "CreateQER"); err != nil {
 		return err
 	}
-	if err := checkDuplicates(removeQERIDs, "RemoveQER"); err != nil {
+	if err := checkDuplicates(removeQERIDs, ie.RuleIDTypeQER, "RemoveQER"); err != nil {
 		return err
 	}
-	if err := checkOverlap(removeQERIDs, updateQERIDs, "RemoveQER", "UpdateQER"); err != nil {
+	if err := checkOverlap(removeQERIDs, updateQERIDs, ie.RuleIDTypeQER, "RemoveQER", "UpdateQER"); err != nil {
 		return err
 	}
 
@@ -896,16 +1106,16 @@ func validateMutualExclusion(plan *forwarder.ModificationPlan) error {
 	updateURRIDs := collectURRIDs(plan.UpdateURRs)
 	queryURRIDs := collectQueryURRIDs(plan.QueryURRs)
 
-	if err := checkDuplicates(createURRIDs, "CreateURR"); err != nil {
+	if err := checkDuplicates(createURRIDs, ie.RuleIDTypeURR, "CreateURR"); err != nil {
 		return err
 	}
-	if err := checkDuplicates(removeURRIDs, "RemoveURR"); err != nil {
+	if err := checkDuplicates(removeURRIDs, ie.RuleIDTypeURR, "RemoveURR"); err != nil {
 		return err
 	}
-	if err := checkOverlap(removeURRIDs, updateURRIDs, "RemoveURR", "UpdateURR"); err != nil {
+	if err := checkOverlap(removeURRIDs, updateURRIDs, ie.RuleIDTypeURR, "RemoveURR", "UpdateURR"); err != nil {
 		return err
 	}
-	if err := checkOverlap(removeURRIDs, queryURRIDs, "RemoveURR", "QueryURR"); err != nil {
+	if err := checkOverlap(removeURRIDs, queryURRIDs, ie.RuleIDTypeURR, "RemoveURR", "QueryURR"); err != nil {
 		return err
 	}
 
@@ -914,13 +1124,13 @@ func validateMutualExclusion(plan *forwarder.ModificationPlan) error {
 	removeBARIDs := collectBARIDs(plan.RemoveBARs)
 	updateBARIDs := collectBARIDs(plan.UpdateBARs)
 
-	if err := checkDuplicates(createBARIDs, "CreateBAR"); err != nil {
+	if err := checkDuplicates(createBARIDs, ie.RuleIDTypeBAR, "CreateBAR"); err != nil {
 		return err
 	}
-	if err := checkDuplicates(removeBARIDs, "RemoveBAR"); err != nil {
+	if err := checkDuplicates(removeBARIDs, ie.RuleIDTypeBAR, "RemoveBAR"); err != nil {
 		return err
 	}
-	if err := checkOverlap(removeBARIDs, updateBARIDs, "RemoveBAR", "UpdateBAR"); err != nil {
+	if err := checkOverlap(removeBARIDs, updateBARIDs, ie.RuleIDTypeBAR, "RemoveBAR", "UpdateBAR"); err != nil {
 		return err
 	}
 
@@ -4,7 +4,9 @@ import (
 	"net"
 	"testing"
 
+	"github.com/pkg/errors"
 	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
 	"github.com/wmnsk/go-pfcp/ie"
 	"github.com/wmnsk/go-pfcp/message"
 
@@ -66,3 +68,97 @@ func TestHandleSessionReportResponseSEIDZeroCause(t *testing.T) {
 		assert.Error(t, err)
 	})
 }
+
+type failDriver struct {
+	forwarder.Empty
+}
+
+func (failDriver) BuildCreateQERPlan(uint64, *ie.IE) (*forwarder.QERPlan, error) {
+	return nil, &forwarder.IEError{Type: ie.MBR, Err: errors.New("invalid MBR")}
+}
+
+func (failDriver) ExecuteEstablishmentPlan(plan *forwarder.ModificationPlan) (*forwarder.ExecutionResult, error) {
+	if len(plan.CreatePDRs) > 0 {
+		err := &forwarder.RuleError{Type: ie.RuleIDTypePDR, ID: 1, Err: errors.New("file exists")}
+		return nil, errors.Wrap(err, "EstablishmentPlan: CreatePDR failed")
+	}
+	return forwarder.NewExecutionResult(), nil
+}
+
+func TestSessionFailureIEs(t *testing.T) {
+	s, rnode, peer := newUDPTestServer(t, failDriver{})
+	s.nodeID = "127.0.0.8"
+	s.rxTrans = make(map[string]*RxTransaction)
+	s.rnodes = map[string]*RemoteNode{rnode.ID: rnode}
+	smf := peer.LocalAddr()
+	seq := uint32(0)
+
+	establish := func(ies ...*ie.IE) *message.SessionEstablishmentResponse {
+		seq++
+		req := message.NewSessionEstablishmentRequest(0, 0, 0, seq, 0,
+			append([]*ie.IE{
+				ie.NewNodeID(rnode.ID, "", ""),
+				ie.NewFSEID(uint64(seq), net.IPv4(127, 0, 0, 1), nil),
+			}, ies...)...,
+		)
+		rx := NewRxTransaction(s, smf, seq)
+		s.rxTrans[rx.id] = rx
+		s.handleSessionEstablishmentRequest(req, smf)
+		rsp, ok := readMsg(t, peer).(*message.SessionEstablishmentResponse)
+		require.True(t, ok)
+		return rsp
+	}
+	cause := func(i *ie.IE) uint8 {
+		v, err := i.Cause()
+		require.NoError(t, err)
+		return v
+	}
+	failedRule := func(i *ie.IE) (uint8, uint32) {
+		require.NotNil(t, i)
+		typ, err := i.RuleIDType()
+		require.NoError(t, err)
+		id, err := i.FailedRuleID()
+		require.NoError(t, err)
+		return typ, id
+	}
+
+	t.Run("Offending IE of a rule", func(t *testing.T) {
+		rsp := establish(ie.NewCreateQER(ie.NewQERID(2), ie.NewMBR(1000, 1000)))
+		assert.Equal(t, ie.CauseMandatoryIEMissing, cause(rsp.Cause))
+		require.NotNil(t, rsp.OffendingIE)
+		offending, err := rsp.OffendingIE.OffendingIE()
+		require.NoError(t, err)
+		assert.Equal(t, ie.MBR, offending)
+		assert.Nil(t, rsp.FailedRuleID)
+	})
+
+	t.Run("Failed Rule ID of the forwarder", func(t *testing.T) {
+		rsp := establish(ie.NewCreatePDR(ie.NewPDRID(1), ie.NewPrecedence(255)))
+		assert.Equal(t, ie.CauseRuleCreationModificationFailure, cause(rsp.Cause))
+		typ, id := failedRule(rsp.FailedRuleID)
+		assert.Equal(t, ie.RuleIDTypePDR, typ)
+		assert.Equal(t, uint32(1), id)
+		assert.Nil(t, rsp.OffendingIE)
+	})
+
+	t.Run("Failed Rule ID of a rule not found", func(t *testing.T) {
+		rsp := establish()
+		require.Equal(t, ie.CauseRequestAccepted, cause(rsp.Cause))
+		fseid, err := rsp.UPFSEID.FSEID()
+		require.NoError(t, err)
+
+		seq++
+		req := message.NewSessionModificationRequest(0, 0, fseid.SEID, seq, 0,
+			ie.NewUpdateFAR(ie.NewFARID(5), ie.NewApplyAction(0x02)),
+		)
+		rx := NewRxTransaction(s, smf, seq)
+		s.rxTrans[rx.id] = rx
+		s.handleSessionModificationRequest(req, smf)
+		mod, ok := readMsg(t, peer).(*message.SessionModificationResponse)
+		require.True(t, ok)
+		assert.Equal(t, ie.CauseRuleCreationModificationFailure, cause(mod.Cause))
+		typ, id := failedRule(mod.FailedRuleID)
+		assert.Equal(t, ie.RuleIDTypeFAR, typ)
+		assert.Equal(t, uint32(5), id)
+	})
+}
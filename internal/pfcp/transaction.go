@@ -69,7 +69,7 @@ func (tx *TxTransaction) send(req message.Message) error {
 	tx.msgBuf = b
 	tx.timer = tx.startTimer()
 
-	_, err = tx.server.conn.WriteTo(b, tx.raddr)
+	err = tx.server.writeTo(b, tx.raddr)
 	if err != nil {
 		return err
 	}
@@ -88,24 +88,23 @@ func (tx *TxTransaction) recv(rsp message.Message) message.Message {
 	return tx.req
 }
 
-func (tx *TxTransaction) handleTimeout() {
+// handleTimeout retransmits the request, and reports whether the maximum
+// retransmission was reached instead
+func (tx *TxTransaction) handleTimeout() bool {
 	if tx.retransCount < tx.maxRetrans {
 		// Start tx retransmission timer
 		tx.retransCount++
 		tx.log.Debugf("timeout, retransCount(%d)", tx.retransCount)
-		_, err := tx.server.conn.WriteTo(tx.msgBuf, tx.raddr)
+		err := tx.server.writeTo(tx.msgBuf, tx.raddr)
 		if err != nil {
 			tx.log.Errorf("retransmit[%d] error: %v", tx.retransCount, err)
 		}
 		tx.timer = tx.startTimer()
-	} else {
-		tx.log.Debugf("max retransmission reached - delete txtr")
-		delete(tx.server.txTrans, tx.id)
-		err := tx.server.txtoDispacher(tx.req, tx.raddr)
-		if err != nil {
-			tx.log.Errorf("txtoDispacher: %v", err)
-		}
+		return false
 	}
+	tx.log.Debugf("max retransmission reached - delete txtr")
+	delete(tx.server.txTrans, tx.id)
+	return true
 }
 
 func (tx *TxTransaction) startTimer() *time.Timer {
@@ -147,7 +146,7 @@ func (rx *RxTransaction) send(rsp message.Message) error {
 	}
 
 	rx.msgBuf = b
-	_, err = rx.server.conn.WriteTo(b, rx.raddr)
+	err = rx.server.writeTo(b, rx.raddr)
 	if err != nil {
 		return err
 	}
@@ -169,7 +168,7 @@ func (rx *RxTransaction) recv(req message.Message, rxTrFound bool) (bool, error)
 	}
 
 	rx.log.Debugf("recv req: retransmit rsp")
-	_, err := rx.server.conn.WriteTo(rx.msgBuf, rx.raddr)
+	err := rx.server.writeTo(rx.msgBuf, rx.raddr)
 	if err != nil {
 		return false, errors.Wrapf(err, "rxtr[%s] recv", rx.id)
 	}
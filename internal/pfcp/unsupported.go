@@ -0,0 +1,159 @@
+package pfcp
+
+import (
+	"encoding/binary"
+	"net"
+
+	"github.com/wmnsk/go-pfcp/ie"
+	"github.com/wmnsk/go-pfcp/message"
+)
+
+// PFCP_VERSION is the only version of the PFCP messages handled
+const PFCP_VERSION = 1
+
+// serveVersionNotSupported answers a request of another PFCP version with a
+// Version Not Supported Response, out of any transaction as TS 29.244 requires.
+// The responses of another version are discarded. It reports whether buf
+// was of another version.
+func (s *PfcpServer) serveVersionNotSupported(buf []byte, addr net.Addr) bool {
+	if len(buf) == 0 || buf[0]>>5 == PFCP_VERSION {
+		return false
+	}
+	h, err := message.ParseHeader(buf)
+	if err != nil || !isRequestType(h.Type) {
+		s.log.Debugf("ignored message of PFCP version %d from %s", buf[0]>>5, addr)
+		return true
+	}
+	s.log.Warnf("PFCP version %d not supported: message type %d from %s", h.Version(), h.Type, addr)
+
+	rsp := message.NewVersionNotSupportedResponse(h.SequenceNumber)
+	b, err := rsp.Marshal()
+	if err != nil {
+		s.log.Errorln(err)
+		return true
+	}
+	err = s.writeTo(b, addr)
+	if err != nil {
+		s.log.Errorln(err)
+	}
+	return true
+}
+
+// serveMalformed rejects a request which could not be decoded, with the
+// Offending IE if the undecodable IE is found
+func (s *PfcpServer) serveMalformed(buf []byte, addr net.Addr) {
+	h, err := message.ParseHeader(buf)
+	if err != nil || !isRequestType(h.Type) {
+		return
+	}
+	if !s.recvReq(addr, h.SequenceNumber) {
+		return
+	}
+
+	cause, offending := malformedIE(h.Payload)
+	var seid uint64
+	if h.HasSEID() {
+		if sess, err1 := s.lnode.Sess(h.SEID); err1 == nil {
+			seid = sess.RemoteID
+		}
+	}
+	s.log.Warnf("reject malformed message type %d from %s: cause %d", h.Type, addr, cause)
+	s.sendRejectRsp(h.Type, h.SequenceNumber, seid, addr, cause, offending)
+}
+
+// malformedIE returns the cause of rejecting the IEs of a request which
+// could not be decoded, and the Offending IE if found
+func malformedIE(b []byte) (uint8, *ie.IE) {
+	for len(b) > 0 {
+		if len(b) < 4 {
+			return ie.CauseInvalidLength, nil
+		}
+		typ := binary.BigEndian.Uint16(b)
+		end := 4 + int(binary.BigEndian.Uint16(b[2:]))
+		if end > len(b) {
+			return ie.CauseInvalidLength, ie.NewOffendingIE(typ)
+		}
+		if _, err := ie.Parse(b[:end]); err != nil {
+			return ie.CauseMandatoryIEIncorrect, ie.NewOffendingIE(typ)
+		}
+		b = b[end:]
+	}
+	return ie.CauseMandatoryIEIncorrect, nil
+}
+
+// handleUnsupportedRequest answers a request the UP function does not
+// handle with the cause "Service not supported"
+func (s *PfcpServer) handleUnsupportedRequest(msg message.Message, addr net.Addr) {
+	s.log.Warnf("%s not supported from %s", msg.MessageTypeName(), addr)
+	s.sendRejectRsp(msg.MessageType(), msg.Sequence(), 0, addr, ie.CauseServiceNotSupported, nil)
+}
+
+// associationCause returns the cause of rejecting an association level
+// request not supported, and the Offending IE if the Node ID is wrong
+func (s *PfcpServer) associationCause(nodeID *ie.IE) (uint8, *ie.IE) {
+	if nodeID == nil {
+		return ie.CauseMandatoryIEMissing, ie.NewOffendingIE(ie.NodeID)
+	}
+	rnodeid, err := nodeID.NodeID()
+	if err != nil || rnodeid == "" {
+		return ie.CauseMandatoryIEIncorrect, ie.NewOffendingIE(ie.NodeID)
+	}
+	if _, ok := s.rnode(rnodeid); !ok {
+		return ie.CauseNoEstablishedPFCPAssociation, nil
+	}
+	return ie.CauseServiceNotSupported, nil
+}
+
+// sendRejectRsp sends the response of a request type with a rejection
+// cause; the Offending IE is left out of the responses without one
+func (s *PfcpServer) sendRejectRsp(
+	reqType uint8,
+	seq uint32,
+	seid uint64,
+	addr net.Addr,
+	cause uint8,
+	offending *ie.IE,
+) {
+	causeIE := ie.NewCause(cause)
+	ies := []*ie.IE{causeIE}
+	if offending != nil {
+		ies = append(ies, offending)
+	}
+
+	var rsp message.Message
+	switch reqType {
+	case message.MsgTypePFDManagementRequest:
+		rsp = message.NewPFDManagementResponse(seq, causeIE, offending)
+	case message.MsgTypeAssociationSetupRequest:
+		rsp = message.NewAssociationSetupResponse(seq,
+			newIeNodeID(s.nodeID),
+			causeIE,
+			ie.NewRecoveryTimeStamp(s.recoveryTime),
+		)
+	case message.MsgTypeAssociationUpdateRequest:
+		rsp = message.NewAssociationUpdateResponse(seq, newIeNodeID(s.nodeID), causeIE)
+	case message.MsgTypeAssociationReleaseRequest:
+		rsp = message.NewAssociationReleaseResponse(seq, newIeNodeID(s.nodeID), causeIE)
+	case message.MsgTypeNodeReportRequest:
+		rsp = message.NewNodeReportResponse(seq, newIeNodeID(s.nodeID), causeIE, offending)
+	case message.MsgTypeSessionSetDeletionRequest:
+		rsp = message.NewSessionSetDeletionResponse(seq, newIeNodeID(s.nodeID), causeIE, offending)
+	case message.MsgTypeSessionEstablishmentRequest:
+		rsp = message.NewSessionEstablishmentResponse(0, 0, seid, seq, 0,
+			append([]*ie.IE{newIeNodeID(s.nodeID)}, ies...)...)
+	case message.MsgTypeSessionModificationRequest:
+		rsp = message.NewSessionModificationResponse(0, 0, seid, seq, 0, ies...)
+	case message.MsgTypeSessionDeletionRequest:
+		rsp = message.NewSessionDeletionResponse(0, 0, seid, seq, 0, ies...)
+	case message.MsgTypeSessionReportRequest:
+		rsp = message.NewSessionReportResponse(0, 0, seid, seq, 0, ies...)
+	default:
+		// no Cause in the response, e.g. a Heartbeat Response
+		return
+	}
+
+	err := s.sendRspTo(rsp, addr)
+	if err != nil {
+		s.log.Errorln(err)
+	}
+}
@@ -0,0 +1,113 @@
+package pfcp
+
+import (
+	"encoding/binary"
+	"net"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"github.com/wmnsk/go-pfcp/ie"
+	"github.com/wmnsk/go-pfcp/message"
+
+	"github.com/free5gc/go-upf/internal/forwarder"
+)
+
+// readMsg reads the message the peer receives from the server
+func readMsg(t *testing.T, peer *net.UDPConn) message.Message {
+	err := peer.SetReadDeadline(time.Now().Add(100 * time.Millisecond))
+	require.NoError(t, err)
+	b := make([]byte, MAX_PFCP_MSG_LEN)
+	n, _, err := peer.ReadFrom(b)
+	require.NoError(t, err)
+	msg, err := message.Parse(b[:n])
+	require.NoError(t, err)
+	return msg
+}
+
+func TestUnsupportedMessages(t *testing.T) {
+	s, _, peer := newUDPTestServer(t, forwarder.Empty{})
+	s.nodeID = "127.0.0.8"
+	s.rxTrans = make(map[string]*RxTransaction)
+	smf := peer.LocalAddr()
+
+	t.Run("version not supported", func(t *testing.T) {
+		b, err := message.NewHeartbeatRequest(11, ie.NewRecoveryTimeStamp(time.Now()), nil).Marshal()
+		require.NoError(t, err)
+		b[0] = 2<<5 | b[0]&0x1f
+		assert.False(t, s.serveHeartbeat(b, smf))
+		s.serveMsg(ReceivePacket{RemoteAddr: smf, Buf: b})
+
+		rsp := readMsg(t, peer)
+		assert.Equal(t, message.MsgTypeVersionNotSupportedResponse, rsp.MessageType())
+		assert.Equal(t, uint32(11), rsp.Sequence())
+		assert.Empty(t, s.rxTrans)
+	})
+
+	t.Run("PFD Management", func(t *testing.T) {
+		b, err := message.NewPFDManagementRequest(12).Marshal()
+		require.NoError(t, err)
+		s.serveMsg(ReceivePacket{RemoteAddr: smf, Buf: b})
+
+		rsp, ok := readMsg(t, peer).(*message.PFDManagementResponse)
+		require.True(t, ok)
+		assert.Equal(t, uint32(12), rsp.Sequence())
+		cause, err := rsp.Cause.Cause()
+		require.NoError(t, err)
+		assert.Equal(t, ie.CauseServiceNotSupported, cause)
+	})
+
+	t.Run("Association Update without association", func(t *testing.T) {
+		b, err := message.NewAssociationUpdateRequest(13, ie.NewNodeID("10.100.200.3", "", "")).Marshal()
+		require.NoError(t, err)
+		s.serveMsg(ReceivePacket{RemoteAddr: smf, Buf: b})
+
+		rsp, ok := readMsg(t, peer).(*message.AssociationUpdateResponse)
+		require.True(t, ok)
+		cause, err := rsp.Cause.Cause()
+		require.NoError(t, err)
+		assert.Equal(t, ie.CauseNoEstablishedPFCPAssociation, cause)
+	})
+
+	t.Run("malformed IE", func(t *testing.T) {
+		b, err := message.NewSessionEstablishmentRequest(0, 0, 0, 14, 0,
+			ie.NewNodeID("10.100.200.3", "", ""),
+			ie.NewCreatePDR(ie.NewPDRID(1), ie.NewPrecedence(255)),
+		).Marshal()
+		require.NoError(t, err)
+		// a Precedence too short in the Create PDR
+		off := len(b) - 4
+		require.Equal(t, ie.Precedence, binary.BigEndian.Uint16(b[off-4:]))
+		binary.BigEndian.PutUint16(b[off-2:], 5)
+		s.serveMsg(ReceivePacket{RemoteAddr: smf, Buf: b})
+
+		rsp, ok := readMsg(t, peer).(*message.SessionEstablishmentResponse)
+		require.True(t, ok)
+		assert.Equal(t, uint32(14), rsp.Sequence())
+		cause, err := rsp.Cause.Cause()
+		require.NoError(t, err)
+		assert.Equal(t, ie.CauseMandatoryIEIncorrect, cause)
+		require.NotNil(t, rsp.OffendingIE)
+		offending, err := rsp.OffendingIE.OffendingIE()
+		require.NoError(t, err)
+		assert.Equal(t, ie.CreatePDR, offending)
+
+		// the retransmitted request is answered again
+		s.serveMsg(ReceivePacket{RemoteAddr: smf, Buf: b})
+		_, ok = readMsg(t, peer).(*message.SessionEstablishmentResponse)
+		assert.True(t, ok)
+	})
+
+	t.Run("unknown message type", func(t *testing.T) {
+		b, err := message.NewHeartbeatRequest(15, ie.NewRecoveryTimeStamp(time.Now()), nil).Marshal()
+		require.NoError(t, err)
+		b[1] = 200
+		s.serveMsg(ReceivePacket{RemoteAddr: smf, Buf: b})
+
+		err = peer.SetReadDeadline(time.Now().Add(50 * time.Millisecond))
+		require.NoError(t, err)
+		_, _, err = peer.ReadFrom(make([]byte, MAX_PFCP_MSG_LEN))
+		assert.Error(t, err)
+	})
+}
@@ -0,0 +1,182 @@
+package pfcp
+
+import (
+	"runtime/debug"
+	"sync"
+
+	"github.com/sirupsen/logrus"
+)
+
+// REPORT_QUEUE_LEN is the number of the jobs queued on a session worker
+// beyond its requests above which posting a report or a response waits for
+// the worker, so that a burst of reports slows the forwarder down rather
+// than piling up
+const REPORT_QUEUE_LEN = 1024
+
+// sessWorkers runs the session level requests and reports on worker
+// goroutines sharded by local SEID: the jobs of a session run in order on
+// the same worker, while a slow session does not stall the others.
+//
+// Dispatching a request never blocks the main goroutine: the requests
+// above the queue length of the worker are rejected. The association level
+// messages run on the main goroutine; the ones touching the sessions of a
+// node run exclusively of the jobs.
+type sessWorkers struct {
+	queues []*jobQueue
+	// requests queued on a worker above which they are rejected
+	queueLen int
+	// held for reading by the running jobs
+	mu  sync.RWMutex
+	wg  sync.WaitGroup
+	log *logrus.Entry
+}
+
+// jobQueue is the jobs of a worker
+type jobQueue struct {
+	mu     sync.Mutex
+	jobs   []func()
+	closed bool
+	ready  chan struct{}
+	// signaled as the jobs are taken or the queue is closed
+	room *sync.Cond
+}
+
+func newSessWorkers(n, queueLen int, log *logrus.Entry) *sessWorkers {
+	w := &sessWorkers{
+		queues:   make([]*jobQueue, n),
+		queueLen: queueLen,
+		log:      log,
+	}
+	for i := range w.queues {
+		q := &jobQueue{ready: make(chan struct{}, 1)}
+		q.room = sync.NewCond(&q.mu)
+		w.queues[i] = q
+		w.wg.Add(1)
+		go w.run(w.queues[i])
+	}
+	return w
+}
+
+func (w *sessWorkers) run(q *jobQueue) {
+	defer func() {
+		if p := recover(); p != nil {
+			// Print stack for panic to log. Fatalf() will let program exit.
+			w.log.Fatalf("panic: %v\n%s", p, string(debug.Stack()))
+		}
+		w.wg.Done()
+	}()
+
+	for range q.ready {
+		for {
+			q.mu.Lock()
+			if len(q.jobs) == 0 {
+				closed := q.closed
+				q.mu.Unlock()
+				if closed {
+					return
+				}
+				break
+			}
+			job := q.jobs[0]
+			q.jobs[0] = nil
+			q.jobs = q.jobs[1:]
+			q.room.Broadcast()
+			q.mu.Unlock()
+
+			w.mu.RLock()
+			job()
+			w.mu.RUnlock()
+		}
+	}
+}
+
+// push queues a job, unless the queue holds limit jobs already, or waits
+// for the room to queue it
+func (q *jobQueue) push(job func(), limit int, wait bool) bool {
+	q.mu.Lock()
+	for !q.closed && len(q.jobs) >= limit {
+		if !wait {
+			q.mu.Unlock()
+			return false
+		}
+		q.room.Wait()
+	}
+	if q.closed {
+		q.mu.Unlock()
+		return false
+	}
+	q.jobs = append(q.jobs, job)
+	select {
+	case q.ready <- struct{}{}:
+	default:
+	}
+	q.mu.Unlock()
+	return true
+}
+
+func (w *sessWorkers) queue(lSeid uint64) *jobQueue {
+	return w.queues[lSeid%uint64(len(w.queues))]
+}
+
+// dispatch queues a request of the session on its worker, and reports
+// false if the worker is congested; without workers, the request runs on
+// the caller
+func (w *sessWorkers) dispatch(lSeid uint64, job func()) bool {
+	if w == nil {
+		job()
+		return true
+	}
+	return w.queue(lSeid).push(job, w.queueLen, false)
+}
+
+// post queues a report or a response of the session on its worker, which
+// must not be lost to the congestion, waiting for the worker if it is
+// REPORT_QUEUE_LEN jobs behind; without workers, the job runs on the caller
+func (w *sessWorkers) post(lSeid uint64, job func()) {
+	if w == nil {
+		job()
+		return
+	}
+	w.queue(lSeid).push(job, w.queueLen+REPORT_QUEUE_LEN, true)
+}
+
+// load returns the jobs queued on the most loaded worker in percent of the
+// queue length of the requests, the reports and responses included
+func (w *sessWorkers) load() int {
+	if w == nil || w.queueLen <= 0 {
+		return 0
+	}
+	var n int
+	for _, q := range w.queues {
+		q.mu.Lock()
+		n = max(n, len(q.jobs))
+		q.mu.Unlock()
+	}
+	return min(n*100/w.queueLen, 100)
+}
+
+// exclusive runs f while no job is running
+func (w *sessWorkers) exclusive(f func()) {
+	if w == nil {
+		f()
+		return
+	}
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	f()
+}
+
+// stop waits for the queued jobs to finish
+func (w *sessWorkers) stop() {
+	if w == nil {
+		return
+	}
+	for _, q := range w.queues {
+		q.mu.Lock()
+		q.closed = true
+		close(q.ready)
+		q.room.Broadcast()
+		q.mu.Unlock()
+	}
+	w.wg.Wait()
+}
@@ -0,0 +1,245 @@
+package pfcp
+
+import (
+	"fmt"
+	"slices"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/sirupsen/logrus"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"github.com/wmnsk/go-pfcp/ie"
+	"github.com/wmnsk/go-pfcp/message"
+
+	"github.com/free5gc/go-upf/internal/forwarder"
+	"github.com/free5gc/go-upf/internal/logger"
+	"github.com/free5gc/go-upf/pkg/factory"
+)
+
+// slowDriver stands for a forwarder taking a netlink round trip per plan
+type slowDriver struct {
+	forwarder.Empty
+	delay time.Duration
+}
+
+func (d slowDriver) ExecuteModificationPlan(plan *forwarder.ModificationPlan) (*forwarder.ExecutionResult, error) {
+	time.Sleep(d.delay)
+	return d.Empty.ExecuteModificationPlan(plan)
+}
+
+func TestSessWorkers(t *testing.T) {
+	t.Run("in order per session", func(t *testing.T) {
+		w := newSessWorkers(4, factory.UpfWorkerQueueLen, logger.PfcpLog)
+		var mu sync.Mutex
+		got := make(map[uint64][]int)
+		for i := 0; i < 100; i++ {
+			lSeid := uint64(i%8 + 1)
+			w.dispatch(lSeid, func() {
+				mu.Lock()
+				defer mu.Unlock()
+				got[lSeid] = append(got[lSeid], i)
+			})
+		}
+		w.stop()
+
+		require.Len(t, got, 8)
+		for lSeid, jobs := range got {
+			assert.True(t, slices.IsSorted(jobs), "sess[%d]: %v", lSeid, jobs)
+		}
+	})
+
+	t.Run("exclusive of the jobs", func(t *testing.T) {
+		w := newSessWorkers(2, factory.UpfWorkerQueueLen, logger.PfcpLog)
+		defer w.stop()
+		started := make(chan struct{})
+		release := make(chan struct{})
+		w.dispatch(1, func() {
+			close(started)
+			<-release
+		})
+		<-started
+
+		done := make(chan struct{})
+		go w.exclusive(func() {
+			close(done)
+		})
+		select {
+		case <-done:
+			t.Fatal("exclusive ran along a job")
+		case <-time.After(50 * time.Millisecond):
+		}
+		close(release)
+		select {
+		case <-done:
+		case <-time.After(time.Second):
+			t.Fatal("exclusive not run")
+		}
+	})
+
+	t.Run("congested", func(t *testing.T) {
+		w := newSessWorkers(1, 4, logger.PfcpLog)
+		started := make(chan struct{})
+		release := make(chan struct{})
+		require.True(t, w.dispatch(1, func() {
+			close(started)
+			<-release
+		}))
+		<-started
+
+		var ran int
+		for i := 0; i < 4; i++ {
+			require.True(t, w.dispatch(1, func() { ran++ }))
+			assert.Equal(t, (i+1)*25, w.load())
+		}
+		assert.False(t, w.dispatch(1, func() { ran++ }))
+		w.post(1, func() { ran++ })
+		close(release)
+		w.stop()
+		assert.Equal(t, 5, ran)
+	})
+
+	t.Run("reports behind", func(t *testing.T) {
+		w := newSessWorkers(1, 4, logger.PfcpLog)
+		started := make(chan struct{})
+		release := make(chan struct{})
+		w.post(1, func() {
+			close(started)
+			<-release
+		})
+		<-started
+
+		var ran int
+		for i := 0; i < 4+REPORT_QUEUE_LEN; i++ {
+			w.post(1, func() { ran++ })
+		}
+		done := make(chan struct{})
+		go func() {
+			w.post(1, func() { ran++ })
+			close(done)
+		}()
+		select {
+		case <-done:
+			t.Fatal("report queued beyond REPORT_QUEUE_LEN")
+		case <-time.After(50 * time.Millisecond):
+		}
+		close(release)
+		select {
+		case <-done:
+		case <-time.After(time.Second):
+			t.Fatal("report not queued")
+		}
+		w.stop()
+		assert.Equal(t, 5+REPORT_QUEUE_LEN, ran)
+	})
+
+	t.Run("without workers", func(t *testing.T) {
+		var w *sessWorkers
+		assert.Zero(t, w.load())
+		ran := false
+		w.dispatch(1, func() {
+			ran = true
+		})
+		assert.True(t, ran)
+	})
+}
+
+func TestTakeOverSess(t *testing.T) {
+	s, rnode, peer := newUDPTestServer(t, forwarder.Empty{})
+	s.rxTrans = make(map[string]*RxTransaction)
+	s.rnodes = map[string]*RemoteNode{rnode.ID: rnode}
+	s.workers = newSessWorkers(2, factory.UpfWorkerQueueLen, s.log)
+	defer s.workers.stop()
+	sess := rnode.NewSess(0x10)
+	smf := peer.LocalAddr()
+
+	req := message.NewSessionModificationRequest(0, 0, sess.LocalID, 1, 0,
+		ie.NewNodeID("127.0.0.2", "", ""),
+	)
+	rx := NewRxTransaction(s, smf, 1)
+	s.rxTrans[rx.id] = rx
+	require.NoError(t, s.reqDispacher(req, smf))
+	_, ok := readMsg(t, peer).(*message.SessionModificationResponse)
+	require.True(t, ok)
+
+	s.workers.exclusive(func() {
+		assert.Equal(t, "127.0.0.2", sess.rnode.ID)
+		assert.Same(t, rnode, s.rnodes["127.0.0.2"])
+		assert.Nil(t, s.rnodes["127.0.0.1"])
+	})
+}
+
+// BenchmarkSessionModification serves Session Modification Requests of 64
+// sessions with a forwarder taking 200µs per plan. BENCH_IN_FLIGHT requests
+// are outstanding at most, below the queue of a worker, and each one waits
+// for its response, so the throughput shows the workers running in parallel.
+func BenchmarkSessionModification(b *testing.B) {
+	const BENCH_IN_FLIGHT = 64
+	level := logger.PfcpLog.Logger.GetLevel()
+	logger.PfcpLog.Logger.SetLevel(logrus.WarnLevel)
+	defer logger.PfcpLog.Logger.SetLevel(level)
+
+	for _, n := range []int{1, 2, 4, 8, 16} {
+		b.Run(fmt.Sprintf("workers=%d", n), func(b *testing.B) {
+			s, rnode, peer := newUDPTestServer(b, slowDriver{delay: 200 * time.Microsecond})
+			s.rxTrans = make(map[string]*RxTransaction)
+
+			var lSeids []uint64
+			for i := 0; i < 64; i++ {
+				lSeids = append(lSeids, rnode.NewSess(uint64(i)).LocalID)
+			}
+			reqs := make([][]byte, b.N)
+			for i := range reqs {
+				seq := uint32(i+1) & 0xffffff
+				req := message.NewSessionModificationRequest(0, 0, lSeids[i%len(lSeids)], seq, 0)
+				var err error
+				reqs[i], err = req.Marshal()
+				require.NoError(b, err)
+			}
+
+			// the responses free the slots of the requests in flight
+			slots := make(chan struct{}, BENCH_IN_FLIGHT)
+			rejected := 0
+			done := make(chan struct{})
+			go func() {
+				defer close(done)
+				buf := make([]byte, MAX_PFCP_MSG_LEN)
+				for range reqs {
+					err := peer.SetReadDeadline(time.Now().Add(5 * time.Second))
+					if err != nil {
+						return
+					}
+					k, _, err := peer.ReadFrom(buf)
+					if err != nil {
+						return
+					}
+					rsp, err := message.ParseSessionModificationResponse(buf[:k])
+					if err != nil {
+						return
+					}
+					if cause, err := rsp.Cause.Cause(); err != nil || cause != ie.CauseRequestAccepted {
+						rejected++
+					}
+					<-slots
+				}
+			}()
+
+			b.ResetTimer()
+			start := time.Now()
+			s.workers = newSessWorkers(n, factory.UpfWorkerQueueLen, s.log)
+			for _, buf := range reqs {
+				slots <- struct{}{}
+				s.serveMsg(ReceivePacket{RemoteAddr: peer.LocalAddr(), Buf: buf})
+			}
+			<-done
+			elapsed := time.Since(start)
+			s.workers.stop()
+			b.StopTimer()
+
+			require.Zero(b, rejected)
+			require.Empty(b, slots, "responses missing")
+			b.ReportMetric(float64(b.N)/elapsed.Seconds(), "req/s")
+		})
+	}
+}
@@ -3,4 +3,5 @@ package report
 type Handler interface {
 	NotifySessReport(SessReport)
 	PopBufPkt(uint64, uint16) ([]byte, bool)
+	DropBufPkt(uint64, uint16) bool
 }
@@ -2,6 +2,7 @@ package report
 
 import (
 	"encoding/binary"
+	"net"
 	"time"
 
 	"github.com/pkg/errors"
@@ -21,8 +22,13 @@ const (
 	UISR
 )
 
+// INTERNAL is the type of the reports the UPF notifies itself, e.g. on the
+// expiry of a timer of a session, to handle them on the worker of the
+// session; it is no Report Type of TS 29.244
+const INTERNAL ReportType = 0
+
 func (t ReportType) String() string {
-	str := []string{"", "DLDR", "USAR", "ERIR", "UPIR", "TMIR", "SESR", "UISR"}
+	str := []string{"INTERNAL", "DLDR", "USAR", "ERIR", "UPIR", "TMIR", "SESR", "UISR"}
 	return str[t]
 }
 
@@ -40,6 +46,50 @@ func (r DLDReport) Type() ReportType {
 	return DLDR
 }
 
+// UPIRReport indicates the User Plane Inactivity Timer of the session expired
+type UPIRReport struct{}
+
+func (r UPIRReport) Type() ReportType {
+	return UPIR
+}
+
+// MACReport carries the source MAC addresses seen in the uplink frames of an
+// Ethernet PDR
+type MACReport struct {
+	PDRID uint16
+	MACs  []net.HardwareAddr
+}
+
+func (r MACReport) Type() ReportType {
+	return USAR
+}
+
+// DropReport indicates a packet of a PDR dropped by the forwarder for
+// exceeding the MBR of its QERs
+type DropReport struct {
+	PDRID uint16
+	Len   int
+	DL    bool
+}
+
+func (r DropReport) Type() ReportType {
+	return USAR
+}
+
+// QoSMonitoringReport carries the packet delays of a QoS flow measured by a
+// QoS monitoring packet answered by the NG-RAN
+type QoSMonitoringReport struct {
+	QFI  uint8
+	DL   time.Duration
+	UL   time.Duration
+	RP   time.Duration // round trip
+	Time time.Time     // the time the answer was received
+}
+
+func (r QoSMonitoringReport) Type() ReportType {
+	return SESR
+}
+
 type MeasureMethod struct {
 	DURAT bool
 	VOLUM bool
@@ -66,6 +116,10 @@ type USAReport struct {
 	QueryUrrRef  uint32
 	StartTime    time.Time
 	EndTime      time.Time
+	// MAC addresses of the Ethernet Traffic Information, for a report with
+	// the MAC Addresses Reporting trigger
+	MACDetected []net.HardwareAddr
+	MACRemoved  []net.HardwareAddr
 }
 
 func (r USAReport) Type() ReportType {
@@ -86,6 +140,13 @@ func (r USAReport) IEsWithinSessReportReq(
 		// Addresses Reporting'.
 		ies = append(ies, ie.NewStartTime(r.StartTime), ie.NewEndTime(r.EndTime))
 	}
+	if r.USARTrigger.MACAR() {
+		ies = append(ies, r.ethernetTrafficInformation())
+		if r.USARTrigger.Flags == USAR_TRIG_MACAR {
+			// no measurement is reported with the MAC addresses alone
+			return ies
+		}
+	}
 	if method.VOLUM {
 		r.VolumMeasure.SetFlags(info.MNOP)
 		ies = append(ies, r.VolumMeasure.IE())
@@ -96,6 +157,19 @@ func (r USAReport) IEsWithinSessReportReq(
 	return ies
 }
 
+func (r USAReport) ethernetTrafficInformation() *ie.IE {
+	var ies []*ie.IE
+	// the MAC addresses are learnt untagged
+	noTag := &ie.IE{}
+	if len(r.MACDetected) > 0 {
+		ies = append(ies, ie.NewMACAddressesDetected(noTag, noTag, r.MACDetected...))
+	}
+	if len(r.MACRemoved) > 0 {
+		ies = append(ies, ie.NewMACAddressesRemoved(noTag, noTag, r.MACRemoved...))
+	}
+	return ie.NewEthernetTrafficInformation(ies...)
+}
+
 func (r USAReport) IEsWithinSessModRsp(
 	method MeasureMethod, info MeasureInformation,
 ) []*ie.IE {
@@ -422,6 +496,24 @@ func (t *UsageReportTrigger) UPINT() bool {
 	return t.Flags&USAR_TRIG_UPINT != 0
 }
 
+// usarTrigNames is the names of the Usage Report Trigger bits, in bit order
+var usarTrigNames = [...]string{
+	"PERIO", "VOLTH", "TIMTH", "QUHTI", "START", "STOPT", "DROTH", "IMMER",
+	"VOLQU", "TIMQU", "LIUSA", "TERMR", "MONIT", "ENVCL", "MACAR", "EVETH",
+	"EVEQU", "TEBUR", "IPMJL", "QUVTI", "EMRRE", "UPINT",
+}
+
+// Names returns the names of the triggers set, e.g. ["PERIO", "TERMR"]
+func (t *UsageReportTrigger) Names() []string {
+	var names []string
+	for i, name := range usarTrigNames {
+		if t.Flags&(1<<i) != 0 {
+			names = append(names, name)
+		}
+	}
+	return names
+}
+
 // Volume Measurement IE Flag bits definition
 const (
 	TOVOL uint8 = 1 << iota
@@ -449,6 +541,16 @@ func (m *VolumeMeasure) SetFlags(mnop bool) {
 	}
 }
 
+// Add adds the volume and packets of o
+func (m *VolumeMeasure) Add(o VolumeMeasure) {
+	m.TotalVolume += o.TotalVolume
+	m.UplinkVolume += o.UplinkVolume
+	m.DownlinkVolume += o.DownlinkVolume
+	m.TotalPktNum += o.TotalPktNum
+	m.UplinkPktNum += o.UplinkPktNum
+	m.DownlinkPktNum += o.DownlinkPktNum
+}
+
 func (m *VolumeMeasure) IE() *ie.IE {
 	return ie.NewVolumeMeasurement(
 		m.Flags,
@@ -461,6 +563,59 @@ func (m *VolumeMeasure) IE() *ie.IE {
 	)
 }
 
+// Dropped DL Traffic Threshold IE Flag bits definition
+const (
+	DLPA uint8 = 1 << iota
+	DLBY
+)
+
+type DroppedDLThreshold struct {
+	Flags   uint8
+	Packets uint64
+	Bytes   uint64
+}
+
+func (t *DroppedDLThreshold) Unmarshal(b []byte) error {
+	if len(b) < 1 {
+		return errors.Errorf("DroppedDLThreshold Unmarshal: less than 1 bytes")
+	}
+	t.Flags = b[0]
+	pos := 1
+	if t.DLPA() {
+		if len(b) < pos+8 {
+			return errors.Errorf("DroppedDLThreshold Unmarshal: DLPA without packets")
+		}
+		t.Packets = binary.BigEndian.Uint64(b[pos : pos+8])
+		pos += 8
+	}
+	if t.DLBY() {
+		if len(b) < pos+8 {
+			return errors.Errorf("DroppedDLThreshold Unmarshal: DLBY without bytes")
+		}
+		t.Bytes = binary.BigEndian.Uint64(b[pos : pos+8])
+	}
+	return nil
+}
+
+func (t *DroppedDLThreshold) DLPA() bool {
+	return t.Flags&DLPA != 0
+}
+
+func (t *DroppedDLThreshold) DLBY() bool {
+	return t.Flags&DLBY != 0
+}
+
+// Reached reports whether the dropped packets or bytes have reached the threshold
+func (t *DroppedDLThreshold) Reached(pkts, bytes uint64) bool {
+	if t.DLPA() && t.Packets > 0 && pkts >= t.Packets {
+		return true
+	}
+	if t.DLBY() && t.Bytes > 0 && bytes >= t.Bytes {
+		return true
+	}
+	return false
+}
+
 type DurationMeasure struct {
 	DurationValue uint64
 }
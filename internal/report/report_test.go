@@ -1,9 +1,12 @@
 package report_test
 
 import (
+	"net"
 	"testing"
 
 	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"github.com/wmnsk/go-pfcp/ie"
 
 	"github.com/free5gc/go-upf/internal/report"
 )
@@ -53,3 +56,58 @@ func TestApplyAction2(t *testing.T) {
 	assert.False(t, act.FSSM())
 	assert.False(t, act.MBSU())
 }
+
+func TestDroppedDLThreshold(t *testing.T) {
+	var th report.DroppedDLThreshold
+	assert.Error(t, th.Unmarshal([]byte{}))
+	assert.Error(t, th.Unmarshal([]byte{0x01, 0x00}))
+
+	e := th.Unmarshal([]byte{
+		0x03,
+		0x00, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00, 0x05,
+		0x00, 0x00, 0x00, 0x00, 0x00, 0x00, 0x10, 0x00,
+	})
+	assert.NoError(t, e)
+	assert.True(t, th.DLPA())
+	assert.True(t, th.DLBY())
+	assert.Equal(t, uint64(5), th.Packets)
+	assert.Equal(t, uint64(0x1000), th.Bytes)
+	assert.False(t, th.Reached(4, 0xfff))
+	assert.True(t, th.Reached(5, 0))
+	assert.True(t, th.Reached(0, 0x1000))
+}
+
+func TestUSAReportMACAR(t *testing.T) {
+	mac := net.HardwareAddr{0x02, 0x00, 0x00, 0x00, 0x00, 0x01}
+	r := report.USAReport{
+		URRID:       1,
+		MACDetected: []net.HardwareAddr{mac},
+	}
+	r.USARTrigger.Flags = report.USAR_TRIG_MACAR
+
+	ies := r.IEsWithinSessReportReq(report.MeasureMethod{VOLUM: true}, report.MeasureInformation{})
+	var eti *ie.IE
+	for _, x := range ies {
+		assert.NotEqual(t, ie.StartTime, x.Type)
+		assert.NotEqual(t, ie.VolumeMeasurement, x.Type)
+		if x.Type == ie.EthernetTrafficInformation {
+			eti = x
+		}
+	}
+	require.NotNil(t, eti)
+	xs, err := eti.EthernetTrafficInformation()
+	require.NoError(t, err)
+	require.Len(t, xs, 1)
+	assert.Equal(t, ie.MACAddressesDetected, xs[0].Type)
+	// number of MAC addresses, MAC addresses, no C-TAG nor S-TAG
+	want := append(append([]byte{1}, mac...), 0, 0)
+	assert.Equal(t, want, xs[0].Payload)
+}
+
+func TestUsageReportTriggerNames(t *testing.T) {
+	trig := report.UsageReportTrigger{
+		Flags: report.USAR_TRIG_PERIO | report.USAR_TRIG_TERMR | report.USAR_TRIG_UPINT,
+	}
+	assert.Equal(t, []string{"PERIO", "TERMR", "UPINT"}, trig.Names())
+	assert.Empty(t, (&report.UsageReportTrigger{}).Names())
+}
@@ -10,8 +10,12 @@ import (
 
 	"github.com/sirupsen/logrus"
 
+	"github.com/free5gc/go-upf/internal/event"
 	"github.com/free5gc/go-upf/internal/forwarder"
+	"github.com/free5gc/go-upf/internal/journal"
 	"github.com/free5gc/go-upf/internal/logger"
+	"github.com/free5gc/go-upf/internal/mgmt"
+	"github.com/free5gc/go-upf/internal/nat"
 	"github.com/free5gc/go-upf/internal/pfcp"
 	"github.com/free5gc/go-upf/pkg/factory"
 )
@@ -22,6 +26,10 @@ type UpfApp struct {
 	cfg        *factory.Config
 	driver     forwarder.Driver
 	pfcpServer *pfcp.PfcpServer
+	nat        *nat.Manager
+	events     *event.Stream
+	journal    *journal.Journal
+	mgmt       *mgmt.Server
 }
 
 func NewApp(cfg *factory.Config) (*UpfApp, error) {
@@ -77,7 +85,48 @@ func (u *UpfApp) Run() error {
 		return err
 	}
 
+	rules, err := nat.Rules(u.cfg.DnnList)
+	if err != nil {
+		return err
+	}
+	if len(rules) > 0 {
+		u.nat, err = nat.Open(&u.wg, rules)
+		if err != nil {
+			return err
+		}
+	}
+
+	u.events, err = event.Open(&u.wg, u.cfg.Events)
+	if err != nil {
+		return err
+	}
+
+	u.journal, err = journal.Open(u.cfg.UsageJournal)
+	if err != nil {
+		return err
+	}
+
 	u.pfcpServer = pfcp.NewPfcpServer(u.cfg, u.driver)
+	u.pfcpServer.SetEvents(u.events)
+	u.pfcpServer.SetJournal(u.journal)
+
+	if u.cfg.Management != nil {
+		u.mgmt = mgmt.NewServer(u.cfg.Management.Addr)
+		if u.nat != nil {
+			u.mgmt.HandleJSON("/nat", func() any { return u.nat.Status() })
+		}
+		u.mgmt.HandleJSON("/pfcp/drops", func() any { return u.pfcpServer.Drops() })
+		u.mgmt.HandleJSON("/pfcp/usage", func() any { return u.pfcpServer.Usage() })
+		u.mgmt.HandleControl("/pfcp/capture",
+			func() any { return u.pfcpServer.CaptureStatus() },
+			u.pfcpServer.ControlCapture)
+		err = u.mgmt.Start(&u.wg)
+		if err != nil {
+			u.mgmt = nil
+			return err
+		}
+	}
+
 	u.driver.HandleReport(u.pfcpServer)
 	u.pfcpServer.Start(&u.wg)
 
@@ -108,9 +157,16 @@ func (u *UpfApp) listenShutdownEvent() {
 	}()
 
 	<-u.ctx.Done()
+	if u.mgmt != nil {
+		u.mgmt.Stop()
+	}
 	if u.pfcpServer != nil {
 		u.pfcpServer.Stop()
 	}
+	u.events.Close()
+	if u.nat != nil {
+		u.nat.Close()
+	}
 	if u.driver != nil {
 		u.driver.Close()
 	}
@@ -129,5 +185,9 @@ func (u *UpfApp) Start() {
 
 func (u *UpfApp) Terminate() {
 	logger.MainLog.Infof("Terminating UPF...")
+	// closed once the sessions stopped reporting
+	if err := u.journal.Close(); err != nil {
+		logger.MainLog.Warnln(err)
+	}
 	logger.MainLog.Infof("UPF terminated")
 }
@@ -1,6 +1,9 @@
 package factory
 
 import (
+	"net"
+	"runtime"
+	"strconv"
 	"time"
 
 	"github.com/davecgh/go-spew/spew"
@@ -13,27 +16,168 @@ const (
 	UpfDefaultIPv4       = "127.0.0.8"
 	UpfPfcpDefaultPort   = 8805
 	UpfGtpDefaultPort    = 2152
+	UpfMaxDscp           = 63
+	UpfMaxQfi            = 63
+	UpfWorkerQueueLen    = 128
 )
 
 type Config struct {
-	Version     string    `yaml:"version"     valid:"required,in(1.0.3)"`
-	Description string    `yaml:"description" valid:"optional"`
-	Pfcp        *Pfcp     `yaml:"pfcp"        valid:"required"`
-	Gtpu        *Gtpu     `yaml:"gtpu"        valid:"required"`
-	DnnList     []DnnList `yaml:"dnnList"     valid:"required"`
-	Logger      *Logger   `yaml:"logger"      valid:"required"`
+	Version      string        `yaml:"version"      valid:"required,in(1.0.3)"`
+	Description  string        `yaml:"description"  valid:"optional"`
+	Pfcp         *Pfcp         `yaml:"pfcp"         valid:"required"`
+	Gtpu         *Gtpu         `yaml:"gtpu"         valid:"required"`
+	DnnList      []DnnList     `yaml:"dnnList"      valid:"required"`
+	Buffer       *Buffer       `yaml:"buffer"       valid:"optional"`
+	LoadControl  *LoadControl  `yaml:"loadControl"  valid:"optional"`
+	Limits       *Limits       `yaml:"limits"       valid:"optional"`
+	Events       *Events       `yaml:"events"       valid:"optional"`
+	UsageJournal *UsageJournal `yaml:"usageJournal" valid:"optional"`
+	Management   *Management   `yaml:"management"   valid:"optional"`
+	Logger       *Logger       `yaml:"logger"       valid:"required"`
 }
 
 type Pfcp struct {
-	Addr           string        `yaml:"addr"           valid:"required,host"`
+	// Address of the PFCP endpoint, on the default port, unless Listen is set
+	Addr           string        `yaml:"addr"           valid:"optional,host"`
 	NodeID         string        `yaml:"nodeID"         valid:"required,host"`
 	RetransTimeout time.Duration `yaml:"retransTimeout" valid:"required"`
 	MaxRetrans     uint8         `yaml:"maxRetrans"     valid:"optional"`
+	// PFCP endpoints, e.g. on the management and the signalling networks
+	Listen []PfcpEndpoint `yaml:"listen" valid:"optional"`
+	// Goroutines handling the session requests and reports, the number of
+	// CPUs if not set
+	Workers int `yaml:"workers" valid:"optional"`
+	// Session requests queued on a worker above which the requests of its
+	// sessions are rejected with the cause "PFCP entity in congestion"
+	// (TS 29.244 8.2.1) rather than stalling the other workers, 128 if not
+	// set
+	WorkerQueueLen int `yaml:"workerQueueLen" valid:"optional"`
+	// Node IDs of the CP functions allowed to set up an association, from
+	// the address of the Node ID, any if not set
+	AllowedNodeIDs []string `yaml:"allowedNodeIDs" valid:"optional"`
+	// Source CIDRs of the PFCP messages accepted, any if not set
+	AllowedCIDRs []string `yaml:"allowedCIDRs" valid:"optional"`
+	// Rate of the PFCP messages accepted from a source address, unlimited if
+	// not set
+	RateLimit *PfcpRateLimit `yaml:"rateLimit" valid:"optional"`
+	// Capture of the PFCP messages, also started and stopped at runtime
+	// through the management API
+	Capture *PfcpCapture `yaml:"capture" valid:"optional"`
+	// PFCP ports of the CP functions by Node ID, the requests of the UP
+	// function are sent to the default port if not set
+	PeerPorts map[string]uint16 `yaml:"peerPorts" valid:"optional"`
+}
+
+// NumWorkers returns the number of the PFCP session workers
+func (p *Pfcp) NumWorkers() int {
+	if p != nil && p.Workers > 0 {
+		return p.Workers
+	}
+	return runtime.NumCPU()
+}
+
+// QueueLen returns the number of the session requests queued on a PFCP
+// session worker above which they are rejected
+func (p *Pfcp) QueueLen() int {
+	if p != nil && p.WorkerQueueLen > 0 {
+		return p.WorkerQueueLen
+	}
+	return UpfWorkerQueueLen
+}
+
+// PeerPort returns the PFCP port of a CP function
+func (p *Pfcp) PeerPort(nodeID string) uint16 {
+	if port, ok := p.PeerPorts[nodeID]; ok {
+		return port
+	}
+	return UpfPfcpDefaultPort
+}
+
+// PfcpEndpoint is an address and a port the PFCP server listens on
+type PfcpEndpoint struct {
+	Addr string `yaml:"addr" valid:"required,host"`
+	// The default port if not set
+	Port uint16 `yaml:"port" valid:"optional"`
+}
+
+func (e PfcpEndpoint) String() string {
+	port := e.Port
+	if port == 0 {
+		port = UpfPfcpDefaultPort
+	}
+	return net.JoinHostPort(e.Addr, strconv.Itoa(int(port)))
+}
+
+// Endpoints returns the PFCP endpoints listened on
+func (p *Pfcp) Endpoints() []PfcpEndpoint {
+	if len(p.Listen) > 0 {
+		return p.Listen
+	}
+	return []PfcpEndpoint{{Addr: p.Addr}}
+}
+
+// PfcpRateLimit is the token bucket of the PFCP messages of a source address
+type PfcpRateLimit struct {
+	// Messages per second
+	Rate float64 `yaml:"rate"  valid:"required"`
+	// Messages accepted at once, the rate if not set
+	Burst int `yaml:"burst" valid:"optional"`
+}
+
+// PfcpCapture captures the PFCP messages sent and received to a pcap file
+type PfcpCapture struct {
+	// Capture from the start of the UPF
+	Enable bool   `yaml:"enable"   valid:"optional"`
+	File   string `yaml:"file"     valid:"required"`
+	// Bytes of the file before it is rotated, 16 MiB if not set
+	MaxSize int64 `yaml:"maxSize"  valid:"optional"`
+	// Rotated files kept
+	MaxFiles int `yaml:"maxFiles" valid:"optional"`
+	// Only the messages of the CP functions or the sessions, any if not set
+	NodeIDs []string `yaml:"nodeIDs"  valid:"optional"`
+	SEIDs   []uint64 `yaml:"seids"    valid:"optional"`
 }
 
 type Gtpu struct {
 	Forwarder string   `yaml:"forwarder" valid:"required,in(gtp5g)"`
 	IfList    []IfInfo `yaml:"ifList"    valid:"optional"`
+	// DSCP of the outer IP header of the GTP-U packets of a 5QI, unless the
+	// SMF sends a Transport Level Marking
+	Dscp map[uint8]uint8 `yaml:"dscp"      valid:"optional"`
+	// 5QI of the QoS flows by QFI. The UPF is not told the 5QI of a QoS
+	// flow, so a QFI not set is taken as its 5QI, as assigned by an SMF
+	// using the standardized 5QIs as the QFIs.
+	FiveQIs map[uint8]uint8 `yaml:"fiveQIs"   valid:"optional"`
+	// GTP-U port of the peers by IP address, the default port if not set
+	PeerPorts map[string]uint16 `yaml:"peerPorts" valid:"optional"`
+}
+
+// PeerPort returns the GTP-U port of a peer
+func (g *Gtpu) PeerPort(ip net.IP) uint16 {
+	if port, ok := g.PeerPorts[ip.String()]; ok {
+		return port
+	}
+	return UpfGtpDefaultPort
+}
+
+// FiveQI returns the 5QI of the QoS flows of a QFI
+func (g *Gtpu) FiveQI(qfi uint8) uint8 {
+	if fqi, ok := g.FiveQIs[qfi]; ok {
+		return fqi
+	}
+	return qfi
+}
+
+// DscpByQFI returns the DSCP of the QoS flows by QFI, from the DSCP of
+// their 5QI
+func (g *Gtpu) DscpByQFI() map[uint8]uint8 {
+	dscp := make(map[uint8]uint8)
+	for qfi := uint8(0); qfi <= UpfMaxQfi; qfi++ {
+		if v, ok := g.Dscp[g.FiveQI(qfi)]; ok {
+			dscp[qfi] = v
+		}
+	}
+	return dscp
 }
 
 type IfInfo struct {
@@ -42,12 +186,170 @@ type IfInfo struct {
 	Name   string `yaml:"name"   valid:"optional"`
 	IfName string `yaml:"ifname" valid:"optional"`
 	MTU    uint32 `yaml:"mtu"    valid:"optional"`
+	// GTP-U port, the default port if not set
+	Port uint16 `yaml:"port"   valid:"optional"`
+}
+
+// GtpuAddr returns the address and the port of the GTP-U endpoint
+func (i *IfInfo) GtpuAddr() string {
+	port := i.Port
+	if port == 0 {
+		port = UpfGtpDefaultPort
+	}
+	return net.JoinHostPort(i.Addr, strconv.Itoa(int(port)))
 }
 
 type DnnList struct {
 	Dnn       string `yaml:"dnn"       valid:"required"`
 	Cidr      string `yaml:"cidr"      valid:"required,cidr"`
 	NatIfName string `yaml:"natifname" valid:"optional"`
+	// Network Instance of the DNN in PFCP, the DNN if not set
+	NetworkInstance string `yaml:"networkInstance" valid:"optional"`
+	// Routing table of the DNN, the main table if not set
+	Table uint32 `yaml:"table"    valid:"optional"`
+	// Egress interface and next hop of the DNN in its routing table
+	IfName  string `yaml:"ifname"   valid:"optional"`
+	Gateway string `yaml:"gateway"  valid:"optional,ipv4"`
+	// GTP-U address of a gtp5g link of its own for the DNN; DNNs on
+	// different links may have overlapping CIDRs
+	GtpuAddr string `yaml:"gtpuAddr" valid:"optional,host"`
+}
+
+// NetInstance returns the Network Instance of the DNN
+func (d *DnnList) NetInstance() string {
+	if d.NetworkInstance != "" {
+		return d.NetworkInstance
+	}
+	return d.Dnn
+}
+
+// Buffer configures the DL data buffering in the UPF
+type Buffer struct {
+	// Max buffered packets per session if the BAR doesn't suggest one
+	MaxPackets int `yaml:"maxPackets" valid:"optional"`
+	// Max buffered bytes of all sessions
+	MaxBytes int `yaml:"maxBytes"   valid:"optional"`
+}
+
+// Limits bounds the resources the CP functions may use for their sessions
+type Limits struct {
+	// Limits of all associations, and of each session and PDR
+	Global *ResourceLimits `yaml:"global"      valid:"optional"`
+	// Limits of each association, and of each session and PDR of it
+	Association *ResourceLimits `yaml:"association" valid:"optional"`
+	// Limits of the association of a CP function by Node ID, over Association
+	Nodes map[string]*ResourceLimits `yaml:"nodes"       valid:"optional"`
+}
+
+// ResourceLimits are the limits of the resources, unlimited if not set
+type ResourceLimits struct {
+	Sessions int `yaml:"sessions"        valid:"optional"`
+	// Rules of each type per session
+	PDRs int `yaml:"pdrs"            valid:"optional"`
+	FARs int `yaml:"fars"            valid:"optional"`
+	QERs int `yaml:"qers"            valid:"optional"`
+	URRs int `yaml:"urrs"            valid:"optional"`
+	// SDF Filters per PDR
+	SDFFilters      int `yaml:"sdfFilters"      valid:"optional"`
+	BufferedPackets int `yaml:"bufferedPackets" valid:"optional"`
+	BufferedBytes   int `yaml:"bufferedBytes"   valid:"optional"`
+}
+
+// GlobalLimits returns the limits of all associations
+func (l *Limits) GlobalLimits() ResourceLimits {
+	if l == nil || l.Global == nil {
+		return ResourceLimits{}
+	}
+	return *l.Global
+}
+
+// NodeLimits returns the limits of the association of a CP function. The
+// limits of each session and PDR are the lower of the association and the
+// global ones.
+func (l *Limits) NodeLimits(nodeID string) ResourceLimits {
+	if l == nil {
+		return ResourceLimits{}
+	}
+	var r ResourceLimits
+	if n, ok := l.Nodes[nodeID]; ok && n != nil {
+		r = *n
+	} else if l.Association != nil {
+		r = *l.Association
+	}
+	g := l.GlobalLimits()
+	r.PDRs = minLimit(r.PDRs, g.PDRs)
+	r.FARs = minLimit(r.FARs, g.FARs)
+	r.QERs = minLimit(r.QERs, g.QERs)
+	r.URRs = minLimit(r.URRs, g.URRs)
+	r.SDFFilters = minLimit(r.SDFFilters, g.SDFFilters)
+	return r
+}
+
+// minLimit returns the lower of two limits, where 0 is unlimited
+func minLimit(a, b int) int {
+	if a == 0 || (b != 0 && b < a) {
+		return b
+	}
+	return a
+}
+
+// Events configures the sinks of the session lifecycle events, published
+// as JSON objects
+type Events struct {
+	// JSON lines file the events are appended to
+	File string `yaml:"file"   valid:"optional"`
+	// Syslog server the events are sent to
+	Syslog *EventSyslog `yaml:"syslog" valid:"optional"`
+	// Unix socket path the subscribers connect to for the JSON lines of
+	// the events
+	Socket string `yaml:"socket" valid:"optional"`
+}
+
+type EventSyslog struct {
+	// Network and address of the syslog server, the local one if not set
+	Network string `yaml:"network" valid:"optional,in(udp|tcp|unix|unixgram)"`
+	Addr    string `yaml:"addr"    valid:"optional"`
+	// Tag of the messages, "upf" if not set
+	Tag string `yaml:"tag"     valid:"optional"`
+}
+
+// UsageJournal records the usage reports sent to the SMFs to local files,
+// to reconcile the reports an SMF lost
+type UsageJournal struct {
+	File string `yaml:"file"     valid:"required"`
+	// Format of the records, "csv" if not set
+	Format string `yaml:"format"   valid:"optional,in(csv|json)"`
+	// Bytes of the file before it is rotated, 64 MiB if not set
+	MaxSize int64 `yaml:"maxSize"  valid:"optional"`
+	// Rotated files kept
+	MaxFiles int `yaml:"maxFiles" valid:"optional"`
+}
+
+// LoadControl configures the load of the UPF reported to the CP functions
+// supporting the Load Control and the Overload Control features. The load is
+// the percentage of the most loaded of the sessions, the rules, the longest
+// queue of the PFCP session workers relative to workerQueueLen and the CPU.
+type LoadControl struct {
+	// Sessions at full load, not accounted if not set
+	MaxSessions int `yaml:"maxSessions"       valid:"optional"`
+	// Rules of all sessions at full load, not accounted if not set
+	MaxRules int `yaml:"maxRules"          valid:"optional"`
+	// Account the CPU usage of the node
+	CPU bool `yaml:"cpu"               valid:"optional"`
+	// Load entering the overload, no overload if not set
+	OverloadHighWater uint8 `yaml:"overloadHighWater" valid:"optional"`
+	// Load leaving the overload, the high-water mark if not set
+	OverloadLowWater uint8 `yaml:"overloadLowWater"  valid:"optional"`
+	// Period of Validity of the Overload Control Information, 10 minutes if
+	// not set
+	OverloadValidity time.Duration `yaml:"overloadValidity"  valid:"optional"`
+	// Load above which new sessions are rejected, up to 99, none if not set
+	RejectAbove uint8 `yaml:"rejectAbove"       valid:"optional"`
+}
+
+// Management configures the HTTP server of the UPF state for debugging
+type Management struct {
+	Addr string `yaml:"addr" valid:"required"`
 }
 
 type Logger struct {
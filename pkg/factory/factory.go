@@ -51,6 +51,260 @@ func ReadConfig(cfgPath string) (*Config, error) {
 		return nil, errors.Errorf("cfg.Pfcp.NodeID[%s] can't be resolved", cfg.Pfcp.NodeID)
 	}
 
+	err = validatePfcp(cfg.Pfcp)
+	if err != nil {
+		return nil, err
+	}
+
+	err = validateDnnList(cfg.DnnList)
+	if err != nil {
+		return nil, err
+	}
+
+	err = validateDscp(cfg.Gtpu.Dscp, cfg.Gtpu.FiveQIs)
+	if err != nil {
+		return nil, err
+	}
+
+	err = validatePeerPorts(cfg.Gtpu.PeerPorts)
+	if err != nil {
+		return nil, err
+	}
+
+	err = validateBuffer(cfg.Buffer)
+	if err != nil {
+		return nil, err
+	}
+
+	err = validateLoadControl(cfg.LoadControl)
+	if err != nil {
+		return nil, err
+	}
+
+	err = validateLimits(cfg.Limits)
+	if err != nil {
+		return nil, err
+	}
+
+	err = validateEvents(cfg.Events)
+	if err != nil {
+		return nil, err
+	}
+
+	err = validateUsageJournal(cfg.UsageJournal)
+	if err != nil {
+		return nil, err
+	}
+
 	cfg.Print()
 	return cfg, nil
 }
+
+// validateDnnList checks the network instances of the DNNs: the CIDRs of the
+// DNNs forwarded by the same gtp5g link must not overlap
+func validateDnnList(dnns []DnnList) error {
+	nis := make(map[string]*DnnList)
+	for i := range dnns {
+		d := &dnns[i]
+		if o, ok := nis[d.NetInstance()]; ok && o.Dnn != d.Dnn {
+			return errors.Errorf("DNN[%s]: network instance %q used by DNN[%s]", d.Dnn, d.NetInstance(), o.Dnn)
+		}
+		nis[d.NetInstance()] = d
+		if d.Gateway != "" && d.IfName == "" {
+			return errors.Errorf("DNN[%s]: gateway without ifname", d.Dnn)
+		}
+
+		_, n1, err := net.ParseCIDR(d.Cidr)
+		if err != nil {
+			return errors.Wrapf(err, "DNN[%s]", d.Dnn)
+		}
+		for j := range dnns[:i] {
+			o := &dnns[j]
+			_, n2, err := net.ParseCIDR(o.Cidr)
+			if err != nil {
+				continue
+			}
+			if !n1.Contains(n2.IP) && !n2.Contains(n1.IP) {
+				continue
+			}
+			if d.GtpuAddr == o.GtpuAddr {
+				return errors.Errorf("DNN[%s]: CIDR %s overlaps DNN[%s] on the same GTP-U address",
+					d.Dnn, d.Cidr, o.Dnn)
+			}
+			if d.Table == o.Table {
+				return errors.Errorf("DNN[%s]: CIDR %s overlaps DNN[%s] in the same routing table",
+					d.Dnn, d.Cidr, o.Dnn)
+			}
+		}
+	}
+	return nil
+}
+
+// validatePfcp checks the endpoints, the allow-list and the rate limit of the PFCP peers
+func validatePfcp(p *Pfcp) error {
+	if p.Addr == "" && len(p.Listen) == 0 {
+		return errors.New("pfcp: addr or listen required")
+	}
+	if p.Workers < 0 || p.WorkerQueueLen < 0 {
+		return errors.Errorf("pfcp: negative workers %d or workerQueueLen %d", p.Workers, p.WorkerQueueLen)
+	}
+	for _, c := range p.AllowedCIDRs {
+		_, _, err := net.ParseCIDR(c)
+		if err != nil {
+			return errors.Wrap(err, "pfcp allowedCIDRs")
+		}
+	}
+	if r := p.RateLimit; r != nil {
+		if r.Rate <= 0 {
+			return errors.Errorf("pfcp rateLimit: rate %v not positive", r.Rate)
+		}
+		if r.Burst < 0 {
+			return errors.Errorf("pfcp rateLimit: burst %d negative", r.Burst)
+		}
+	}
+	if c := p.Capture; c != nil {
+		if c.File == "" {
+			return errors.New("pfcp capture: file required")
+		}
+		if c.MaxSize < 0 || c.MaxFiles < 0 {
+			return errors.Errorf("pfcp capture: negative maxSize %d or maxFiles %d", c.MaxSize, c.MaxFiles)
+		}
+	}
+	for nodeID, port := range p.PeerPorts {
+		if port == 0 {
+			return errors.Errorf("pfcp peer %s: port 0", nodeID)
+		}
+	}
+	return nil
+}
+
+// validateDscp checks the DSCP of the 5QIs and the QFIs of the 5QIs fit in
+// the 6 bits of their fields
+func validateDscp(dscp, fiveQIs map[uint8]uint8) error {
+	for fqi, v := range dscp {
+		if v > UpfMaxDscp {
+			return errors.Errorf("5QI[%d]: DSCP %d out of range", fqi, v)
+		}
+	}
+	for qfi := range fiveQIs {
+		if qfi > UpfMaxQfi {
+			return errors.Errorf("fiveQIs: QFI %d out of range", qfi)
+		}
+	}
+	return nil
+}
+
+// validatePeerPorts checks the GTP-U ports of the peers by IP address
+func validatePeerPorts(ports map[string]uint16) error {
+	for addr, port := range ports {
+		if net.ParseIP(addr) == nil {
+			return errors.Errorf("GTP-U peer %q: not an IP address", addr)
+		}
+		if port == 0 {
+			return errors.Errorf("GTP-U peer %s: port 0", addr)
+		}
+	}
+	return nil
+}
+
+// validateBuffer checks the limits of the DL data buffering
+func validateBuffer(b *Buffer) error {
+	if b == nil {
+		return nil
+	}
+	if b.MaxPackets < 0 || b.MaxBytes < 0 {
+		return errors.Errorf("buffer: negative maxPackets %d or maxBytes %d", b.MaxPackets, b.MaxBytes)
+	}
+	return nil
+}
+
+// validateLoadControl checks the limits and the marks of the load
+func validateLoadControl(l *LoadControl) error {
+	if l == nil {
+		return nil
+	}
+	if l.MaxSessions < 0 || l.MaxRules < 0 {
+		return errors.New("loadControl: negative maxSessions or maxRules")
+	}
+	for name, v := range map[string]uint8{
+		"overloadHighWater": l.OverloadHighWater,
+		"overloadLowWater":  l.OverloadLowWater,
+	} {
+		if v > 100 {
+			return errors.Errorf("loadControl %s: %d%% out of range", name, v)
+		}
+	}
+	// the load never exceeds 100%
+	if l.RejectAbove > 99 {
+		return errors.Errorf("loadControl rejectAbove: %d%% out of range", l.RejectAbove)
+	}
+	if l.OverloadLowWater > l.OverloadHighWater {
+		return errors.Errorf("loadControl: overloadLowWater %d%% above overloadHighWater %d%%",
+			l.OverloadLowWater, l.OverloadHighWater)
+	}
+	if l.OverloadValidity < 0 {
+		return errors.Errorf("loadControl: overloadValidity %s negative", l.OverloadValidity)
+	}
+	return nil
+}
+
+// validateLimits checks that no resource limit is negative
+func validateLimits(l *Limits) error {
+	if l == nil {
+		return nil
+	}
+	check := func(name string, r *ResourceLimits) error {
+		if r == nil {
+			return nil
+		}
+		for _, v := range []int{
+			r.Sessions, r.PDRs, r.FARs, r.QERs, r.URRs,
+			r.SDFFilters, r.BufferedPackets, r.BufferedBytes,
+		} {
+			if v < 0 {
+				return errors.Errorf("limits %s: negative limit %d", name, v)
+			}
+		}
+		return nil
+	}
+	if err := check("global", l.Global); err != nil {
+		return err
+	}
+	if err := check("association", l.Association); err != nil {
+		return err
+	}
+	for id, r := range l.Nodes {
+		if err := check("node "+id, r); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// validateEvents checks that the events have a sink
+func validateEvents(e *Events) error {
+	if e == nil {
+		return nil
+	}
+	if e.File == "" && e.Syslog == nil && e.Socket == "" {
+		return errors.New("events: no file, syslog or socket")
+	}
+	if s := e.Syslog; s != nil && (s.Network == "") != (s.Addr == "") {
+		return errors.New("events syslog: network and addr required together")
+	}
+	return nil
+}
+
+// validateUsageJournal checks the file and the rotation of the usage journal
+func validateUsageJournal(j *UsageJournal) error {
+	if j == nil {
+		return nil
+	}
+	if j.File == "" {
+		return errors.New("usageJournal: file required")
+	}
+	if j.MaxSize < 0 || j.MaxFiles < 0 {
+		return errors.Errorf("usageJournal: negative maxSize %d or maxFiles %d", j.MaxSize, j.MaxFiles)
+	}
+	return nil
+}
@@ -0,0 +1,193 @@
+package factory
+
+import (
+	"net"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestValidateDnnList(t *testing.T) {
+	cases := []struct {
+		name string
+		dnns []DnnList
+		ok   bool
+	}{
+		{
+			name: "disjoint CIDRs",
+			dnns: []DnnList{
+				{Dnn: "internet", Cidr: "10.60.0.0/16"},
+				{Dnn: "corp", Cidr: "10.61.0.0/16", Table: 100},
+			},
+			ok: true,
+		},
+		{
+			name: "overlapping CIDRs on the same link",
+			dnns: []DnnList{
+				{Dnn: "internet", Cidr: "10.60.0.0/16"},
+				{Dnn: "corp", Cidr: "10.60.1.0/24", Table: 100},
+			},
+		},
+		{
+			name: "overlapping CIDRs on different links",
+			dnns: []DnnList{
+				{Dnn: "internet", Cidr: "10.60.0.0/16"},
+				{Dnn: "corp", Cidr: "10.60.0.0/16", Table: 100, GtpuAddr: "10.200.200.102"},
+			},
+			ok: true,
+		},
+		{
+			name: "overlapping CIDRs in the same table",
+			dnns: []DnnList{
+				{Dnn: "internet", Cidr: "10.60.0.0/16"},
+				{Dnn: "corp", Cidr: "10.60.0.0/16", GtpuAddr: "10.200.200.102"},
+			},
+		},
+		{
+			name: "network instance of another DNN",
+			dnns: []DnnList{
+				{Dnn: "internet", Cidr: "10.60.0.0/16"},
+				{Dnn: "corp", Cidr: "10.61.0.0/16", NetworkInstance: "internet"},
+			},
+		},
+	}
+	for _, tc := range cases {
+		t.Run(tc.name, func(t *testing.T) {
+			err := validateDnnList(tc.dnns)
+			if tc.ok {
+				assert.NoError(t, err)
+			} else {
+				assert.Error(t, err)
+			}
+		})
+	}
+}
+
+func TestValidateDscp(t *testing.T) {
+	assert.NoError(t, validateDscp(map[uint8]uint8{1: 46, 9: 0, 5: UpfMaxDscp, 82: 46}, nil))
+	assert.Error(t, validateDscp(map[uint8]uint8{1: 64}, nil))
+	assert.NoError(t, validateDscp(nil, map[uint8]uint8{1: 82}))
+	assert.Error(t, validateDscp(nil, map[uint8]uint8{64: 1}))
+}
+
+func TestDscpByQFI(t *testing.T) {
+	g := &Gtpu{
+		Dscp:    map[uint8]uint8{1: 46, 9: 0, 82: 34},
+		FiveQIs: map[uint8]uint8{2: 82, 9: 8},
+	}
+	assert.Equal(t, uint8(82), g.FiveQI(2))
+	assert.Equal(t, uint8(5), g.FiveQI(5))
+	// QFI 9 carries the 5QI 8, without a DSCP
+	assert.Equal(t, map[uint8]uint8{1: 46, 2: 34}, g.DscpByQFI())
+}
+
+func TestValidatePfcp(t *testing.T) {
+	assert.Error(t, validatePfcp(&Pfcp{}))
+	assert.NoError(t, validatePfcp(&Pfcp{Listen: []PfcpEndpoint{{Addr: "127.0.0.8", Port: 8806}}}))
+	assert.NoError(t, validatePfcp(&Pfcp{
+		Addr:         "127.0.0.8",
+		AllowedCIDRs: []string{"10.100.200.0/24", "fd00::/8"},
+		RateLimit:    &PfcpRateLimit{Rate: 100},
+	}))
+	assert.Error(t, validatePfcp(&Pfcp{Addr: "127.0.0.8", AllowedCIDRs: []string{"10.100.200.3"}}))
+	assert.Error(t, validatePfcp(&Pfcp{Addr: "127.0.0.8", RateLimit: &PfcpRateLimit{}}))
+	assert.Error(t, validatePfcp(&Pfcp{Addr: "127.0.0.8", RateLimit: &PfcpRateLimit{Rate: 1, Burst: -1}}))
+	assert.NoError(t, validatePfcp(&Pfcp{Addr: "127.0.0.8", Capture: &PfcpCapture{File: "/tmp/n4.pcap"}}))
+	assert.Error(t, validatePfcp(&Pfcp{Addr: "127.0.0.8", Capture: &PfcpCapture{}}))
+	assert.NoError(t, validatePfcp(&Pfcp{Addr: "127.0.0.8", PeerPorts: map[string]uint16{"smf.free5gc.org": 8806}}))
+	assert.Error(t, validatePfcp(&Pfcp{Addr: "127.0.0.8", PeerPorts: map[string]uint16{"127.0.0.1": 0}}))
+	assert.NoError(t, validatePfcp(&Pfcp{Addr: "127.0.0.8", Workers: 4, WorkerQueueLen: 512}))
+	assert.Error(t, validatePfcp(&Pfcp{Addr: "127.0.0.8", WorkerQueueLen: -1}))
+}
+
+func TestValidateBuffer(t *testing.T) {
+	assert.NoError(t, validateBuffer(nil))
+	assert.NoError(t, validateBuffer(&Buffer{MaxPackets: 64, MaxBytes: 1 << 20}))
+	assert.Error(t, validateBuffer(&Buffer{MaxPackets: -1}))
+	assert.Error(t, validateBuffer(&Buffer{MaxBytes: -1}))
+}
+
+func TestEndpoints(t *testing.T) {
+	p := &Pfcp{Addr: "127.0.0.8"}
+	assert.Equal(t, []string{"127.0.0.8:8805"}, endpointStrings(p.Endpoints()))
+	p.Listen = []PfcpEndpoint{{Addr: "10.0.0.8"}, {Addr: "192.168.0.8", Port: 8806}}
+	assert.Equal(t, []string{"10.0.0.8:8805", "192.168.0.8:8806"}, endpointStrings(p.Endpoints()))
+	p.PeerPorts = map[string]uint16{"127.0.0.1": 8806}
+	assert.Equal(t, uint16(8806), p.PeerPort("127.0.0.1"))
+	assert.Equal(t, uint16(UpfPfcpDefaultPort), p.PeerPort("127.0.0.2"))
+	assert.Equal(t, UpfWorkerQueueLen, p.QueueLen())
+	p.WorkerQueueLen = 512
+	assert.Equal(t, 512, p.QueueLen())
+
+	i := &IfInfo{Addr: "127.0.0.8"}
+	assert.Equal(t, "127.0.0.8:2152", i.GtpuAddr())
+	i.Port = 2153
+	assert.Equal(t, "127.0.0.8:2153", i.GtpuAddr())
+
+	g := &Gtpu{PeerPorts: map[string]uint16{"10.200.200.102": 2153}}
+	assert.Equal(t, uint16(2153), g.PeerPort(net.IPv4(10, 200, 200, 102)))
+	assert.Equal(t, uint16(UpfGtpDefaultPort), g.PeerPort(net.IPv4(10, 200, 200, 101)))
+	assert.NoError(t, validatePeerPorts(g.PeerPorts))
+	assert.Error(t, validatePeerPorts(map[string]uint16{"gnb": 2152}))
+	assert.Error(t, validatePeerPorts(map[string]uint16{"10.200.200.102": 0}))
+}
+
+func endpointStrings(es []PfcpEndpoint) []string {
+	var ss []string
+	for _, e := range es {
+		ss = append(ss, e.String())
+	}
+	return ss
+}
+
+func TestValidateLoadControl(t *testing.T) {
+	assert.NoError(t, validateLoadControl(nil))
+	assert.NoError(t, validateLoadControl(&LoadControl{
+		MaxSessions:       10000,
+		OverloadHighWater: 80,
+		OverloadLowWater:  70,
+		RejectAbove:       95,
+	}))
+	assert.Error(t, validateLoadControl(&LoadControl{MaxSessions: -1}))
+	assert.Error(t, validateLoadControl(&LoadControl{RejectAbove: 101}))
+	assert.Error(t, validateLoadControl(&LoadControl{RejectAbove: 100}))
+	assert.NoError(t, validateLoadControl(&LoadControl{RejectAbove: 99}))
+	assert.Error(t, validateLoadControl(&LoadControl{OverloadHighWater: 70, OverloadLowWater: 80}))
+}
+
+func TestLimits(t *testing.T) {
+	var nilLimits *Limits
+	assert.Equal(t, ResourceLimits{}, nilLimits.NodeLimits("10.100.200.3"))
+
+	l := &Limits{
+		Global:      &ResourceLimits{Sessions: 1000, PDRs: 16, SDFFilters: 4},
+		Association: &ResourceLimits{Sessions: 100, PDRs: 32, FARs: 8},
+		Nodes: map[string]*ResourceLimits{
+			"10.100.200.3": {Sessions: 10, PDRs: 8, BufferedBytes: 1 << 20},
+		},
+	}
+	assert.NoError(t, validateLimits(l))
+	assert.Equal(t, ResourceLimits{Sessions: 1000, PDRs: 16, SDFFilters: 4}, l.GlobalLimits())
+	assert.Equal(t, ResourceLimits{Sessions: 100, PDRs: 16, FARs: 8, SDFFilters: 4},
+		l.NodeLimits("10.100.200.4"))
+	assert.Equal(t, ResourceLimits{Sessions: 10, PDRs: 8, SDFFilters: 4, BufferedBytes: 1 << 20},
+		l.NodeLimits("10.100.200.3"))
+
+	l.Nodes["10.100.200.5"] = &ResourceLimits{QERs: -1}
+	assert.Error(t, validateLimits(l))
+}
+
+func TestValidateEvents(t *testing.T) {
+	assert.NoError(t, validateEvents(nil))
+	assert.Error(t, validateEvents(&Events{}))
+	assert.NoError(t, validateEvents(&Events{Socket: "/run/upf/events.sock"}))
+	assert.NoError(t, validateEvents(&Events{Syslog: &EventSyslog{}}))
+	assert.Error(t, validateEvents(&Events{Syslog: &EventSyslog{Network: "udp"}}))
+}
+
+func TestValidateUsageJournal(t *testing.T) {
+	assert.NoError(t, validateUsageJournal(nil))
+	assert.Error(t, validateUsageJournal(&UsageJournal{}))
+	assert.NoError(t, validateUsageJournal(&UsageJournal{File: "/var/log/upf/usage.csv"}))
+	assert.Error(t, validateUsageJournal(&UsageJournal{File: "/var/log/upf/usage.csv", MaxFiles: -1}))
+}